@@ -8,7 +8,9 @@ import (
 	"github.com/spf13/cobra"
 
 	"git.blauwelle.com/go/crate/cmd/sso/cmd/init_mysql"
+	"git.blauwelle.com/go/crate/cmd/sso/cmd/keys"
 	"git.blauwelle.com/go/crate/cmd/sso/cmd/sso_server"
+	"git.blauwelle.com/go/crate/cmd/sso/cmd/token"
 )
 
 var rootCmd = &cobra.Command{
@@ -20,7 +22,7 @@ var rootCmd = &cobra.Command{
 	Args: func(cmd *cobra.Command, args []string) error {
 		return nil
 	},
-	Example: "go run main.go init-mysql\n   go run main.go sso-server",
+	Example: "go run main.go init-mysql\n   go run main.go sso-server\n   go run main.go keys generate --alg RS256 --out private.rsa\n   go run main.go token inspect <jwt>",
 	Run: func(cmd *cobra.Command, args []string) {
 		sso()
 	},
@@ -28,6 +30,7 @@ var rootCmd = &cobra.Command{
 
 func sso() {
 	fmt.Printf("欢迎使用sso\n")
+	fmt.Printf("如果还没有签名私钥，请先执行 go run main.go keys generate 生成\n")
 	fmt.Printf("如果您是第一次启动，请先执行 go run main.go init-mysql 初始化数据库\n")
 	fmt.Printf("初始完数据库之后，执行 go run main.go sso-server 启动sso服务\n")
 	fmt.Printf("不是第一次启动执行 go run main.go sso-server 即可启动sso服务\n")
@@ -36,6 +39,8 @@ func sso() {
 func init() {
 	rootCmd.AddCommand(init_mysql.StartCmd)
 	rootCmd.AddCommand(sso_server.StartCmd)
+	rootCmd.AddCommand(keys.StartCmd)
+	rootCmd.AddCommand(token.StartCmd)
 }
 
 func Execute() {
@@ -5,9 +5,11 @@ import (
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"gorm.io/gorm/logger"
 
 	"git.blauwelle.com/go/crate/cmd/sso/config"
+	"git.blauwelle.com/go/crate/cmd/sso/constants"
 	"git.blauwelle.com/go/crate/cmd/sso/model"
 )
 
@@ -40,14 +42,56 @@ func run() error {
 	}
 
 	err = db.Migrator().AutoMigrate(
+		&model.Organization{},
 		&model.Application{},
 		&model.Role{},
 		&model.User{},
 		&model.UserRole{},
+		&model.Ticket{},
+		&model.RefreshToken{},
+		&model.RevokedToken{},
+		&model.UserTokenRevocation{},
+		&model.SessionApplication{},
+		&model.LogoutDelivery{},
+		&model.UserTOTP{},
+		&model.RecoveryCode{},
+		&model.WebAuthnCredential{},
+		&model.WebAuthnChallenge{},
+		&model.PasswordHistory{},
+		&model.PasswordResetToken{},
+		&model.EmailVerification{},
+		&model.Invitation{},
+		&model.InvitationRole{},
+		&model.Permission{},
+		&model.RolePermission{},
+		&model.AppAccessRole{},
+		&model.AppRole{},
+		&model.UserAppRole{},
+		&model.Group{},
+		&model.GroupMember{},
+		&model.GroupSubgroup{},
+		&model.GroupRole{},
+		&model.GroupAppRole{},
+		&model.AppAccessGroup{},
 	)
 	if err != nil {
 		return err
 	}
+	// 角色名和组名改为在组织内唯一，删除旧版本的唯一索引
+	for _, table := range []interface{}{&model.Role{}, &model.Group{}} {
+		if db.Migrator().HasIndex(table, "name") {
+			if err := db.Migrator().DropIndex(table, "name"); err != nil {
+				return err
+			}
+		}
+	}
+
+	// 已有的用户、应用和角色都属于默认组织
+	db.Clauses(clause.OnConflict{DoNothing: true}).Create(&model.Organization{
+		Model: model.Model{ID: constants.DefaultOrganizationID},
+		Name:  "default",
+		Slug:  "default",
+	})
 
 	db.Create(&model.Role{
 		Model: model.Model{ID: 1},
@@ -63,5 +107,65 @@ func run() error {
 
 	db.Create(&model.UserRole{UserID: 1, RoleID: 1})
 
+	return seedPermissions(db)
+}
+
+// 内置角色及其权限，重复执行时跳过已存在的记录
+var builtinRoles = []struct {
+	name        string
+	description string
+	permissions []string
+}{
+	{constants.Admin, "全部权限", []string{constants.PermissionAll}},
+	{constants.Auditor, "只读访问用户、应用、角色和审计记录", []string{
+		constants.PermissionUserRead,
+		constants.PermissionAppRead,
+		constants.PermissionRoleRead,
+		constants.PermissionAuditRead,
+	}},
+	{constants.AppManager, "管理应用", []string{constants.PermissionAppRead, constants.PermissionAppWrite}},
+}
+
+var builtinPermissions = map[string]string{
+	constants.PermissionAll:       "全部权限",
+	constants.PermissionUserRead:  "查看用户",
+	constants.PermissionUserWrite: "管理用户",
+	constants.PermissionAppRead:   "查看应用",
+	constants.PermissionAppWrite:  "管理应用",
+	constants.PermissionRoleRead:  "查看角色",
+	constants.PermissionRoleWrite: "管理角色",
+	constants.PermissionAuditRead: "查看审计记录",
+	constants.PermissionOrgRead:   "查看组织",
+	constants.PermissionOrgWrite:  "管理组织，并可以操作任意组织",
+}
+
+func seedPermissions(db *gorm.DB) error {
+	for name, description := range builtinPermissions {
+		if err := db.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&model.Permission{Name: name, Description: description}).Error; err != nil {
+			return err
+		}
+	}
+	for _, builtin := range builtinRoles {
+		if err := db.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&model.Role{Name: builtin.name, Description: builtin.description}).Error; err != nil {
+			return err
+		}
+		var role model.Role
+		if err := db.Where("organization_id = ? AND name = ?", constants.DefaultOrganizationID, builtin.name).First(&role).Error; err != nil {
+			return err
+		}
+		var permissions []model.Permission
+		if err := db.Where("name IN ?", builtin.permissions).Find(&permissions).Error; err != nil {
+			return err
+		}
+		for _, permission := range permissions {
+			if err := db.Clauses(clause.OnConflict{DoNothing: true}).
+				Create(&model.RolePermission{RoleID: role.ID, PermissionID: permission.ID}).Error; err != nil {
+				return err
+			}
+		}
+	}
+
 	return nil
 }
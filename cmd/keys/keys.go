@@ -0,0 +1,225 @@
+package keys
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"git.blauwelle.com/go/crate/cmd/sso/config"
+	"git.blauwelle.com/go/crate/cmd/sso/util"
+)
+
+var (
+	StartCmd = &cobra.Command{
+		Use:          "keys",
+		Short:        "keys",
+		Example:      "keys generate --alg ES256 --out private.pem\n  keys public --format jwk\n  keys rotate",
+		SilenceUsage: true,
+	}
+
+	generateCmd = &cobra.Command{
+		Use:          "generate",
+		Short:        "generate a signing key",
+		Example:      "keys generate --alg EdDSA --out private.pem",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return generate()
+		},
+	}
+
+	publicCmd = &cobra.Command{
+		Use:          "public",
+		Short:        "export public keys as PEM or JWK",
+		Example:      "keys public --in private.rsa --format pem",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return public()
+		},
+	}
+
+	rotateCmd = &cobra.Command{
+		Use:          "rotate",
+		Short:        "rotate signing keys",
+		Example:      "keys rotate --if-older-than 720h",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return rotate()
+		},
+	}
+
+	ifOlderThan time.Duration
+
+	generateAlg   string
+	generateOut   string
+	generateForce bool
+
+	publicIn     string
+	publicFormat string
+)
+
+func init() {
+	rotateCmd.Flags().DurationVar(&ifOlderThan, "if-older-than", 0, "只在active密钥启用超过该时长时轮换，便于由定时任务调用")
+
+	generateCmd.Flags().StringVar(&generateAlg, "alg", util.AlgRS256, "签名算法：RS256、ES256、EdDSA")
+	generateCmd.Flags().StringVar(&generateOut, "out", "private.rsa", "私钥输出文件")
+	generateCmd.Flags().BoolVar(&generateForce, "force", false, "覆盖已存在的文件")
+
+	publicCmd.Flags().StringVar(&publicIn, "in", "", "私钥文件，为空时导出配置中的全部可用公钥")
+	publicCmd.Flags().StringVar(&publicFormat, "format", "pem", "输出格式：pem、jwk")
+
+	StartCmd.AddCommand(generateCmd)
+	StartCmd.AddCommand(publicCmd)
+	StartCmd.AddCommand(rotateCmd)
+}
+
+func generate() error {
+	privateKey, err := util.GenerateKey(generateAlg)
+	if err != nil {
+		return err
+	}
+	keyBytes, err := util.MarshalPrivateKey(privateKey)
+	if err != nil {
+		return err
+	}
+	flag := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if generateForce {
+		flag = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(generateOut, flag, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(keyBytes); err != nil {
+		return err
+	}
+	kid, err := util.KeyID(privateKey.Public())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("generated %s key %s -> %s\n", generateAlg, kid, generateOut)
+	return nil
+}
+
+func public() error {
+	var keys []util.Key
+	if publicIn != "" {
+		keyBytes, err := os.ReadFile(publicIn)
+		if err != nil {
+			return err
+		}
+		privateKey, err := util.ParsePrivateKey(keyBytes)
+		if err != nil {
+			return err
+		}
+		kid, err := util.KeyID(privateKey.Public())
+		if err != nil {
+			return err
+		}
+		keys = append(keys, util.Key{ID: kid, Status: util.KeyStatusActive, PublicKey: privateKey.Public()})
+	} else {
+		cfg, err := config.GetConfig("config/config.yaml")
+		if err != nil {
+			return err
+		}
+		jwt, err := util.LoadJWT(cfg.Keys.Dir, cfg.Keys.PrivateKey)
+		if err != nil {
+			return err
+		}
+		keys = jwt.PublicKeys()
+	}
+
+	switch publicFormat {
+	case "pem":
+		for _, key := range keys {
+			b, err := util.MarshalPublicKey(key.PublicKey)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("# kid: %s alg: %s status: %s\n%s", key.ID, key.Alg(), key.Status, b)
+		}
+	case "jwk":
+		jwks := util.JWKS{Keys: make([]util.JWK, 0, len(keys))}
+		for _, key := range keys {
+			jwk, err := util.PublicJWK(key)
+			if err != nil {
+				return err
+			}
+			jwks.Keys = append(jwks.Keys, jwk)
+		}
+		b, err := json.MarshalIndent(jwks, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+	default:
+		return fmt.Errorf("unknown format %q", publicFormat)
+	}
+	return nil
+}
+
+func rotate() error {
+	cfg, err := config.GetConfig("config/config.yaml")
+	if err != nil {
+		return err
+	}
+	if cfg.Keys.Dir == "" {
+		return errors.New("keys.dir is not configured")
+	}
+
+	kr, err := util.LoadKeyRing(cfg.Keys.Dir)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+
+	// 第一次使用密钥环时导入原有的私钥，已签发的token仍然有效
+	if len(kr.Keys) == 0 {
+		if keyBytes, err := os.ReadFile(cfg.Keys.PrivateKey); err == nil {
+			privateKey, err := util.ParsePrivateKey(keyBytes)
+			if err != nil {
+				return err
+			}
+			entry, err := kr.Import(privateKey, util.KeyStatusActive, now)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("imported %s as active key %s\n", cfg.Keys.PrivateKey, entry.ID)
+		} else {
+			entry, err := kr.Generate(cfg.Keys.Alg, util.KeyStatusActive, now)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("generated active key %s\n", entry.ID)
+		}
+		// 先只发布next密钥，下一次轮换时才启用
+		entry, err := kr.Generate(cfg.Keys.Alg, util.KeyStatusNext, now)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("generated next key %s\n", entry.ID)
+		return kr.Save()
+	}
+
+	if active, ok := kr.Active(); ok && ifOlderThan > 0 && active.ActivatedAt != nil &&
+		now.Sub(*active.ActivatedAt) < ifOlderThan {
+		fmt.Printf("active key %s is younger than %s, skip\n", active.ID, ifOlderThan)
+		return nil
+	}
+
+	retireAfter := time.Duration(cfg.Keys.RetireAfter) * time.Hour
+	if err := kr.Rotate(cfg.Keys.Alg, now, retireAfter); err != nil {
+		return err
+	}
+	if err := kr.Save(); err != nil {
+		return err
+	}
+	for _, entry := range kr.Keys {
+		fmt.Printf("%s\t%s\t%s\n", entry.ID, entry.Alg, entry.Status)
+	}
+	return nil
+}
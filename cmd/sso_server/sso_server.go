@@ -2,9 +2,11 @@ package sso_server
 
 import (
 	"context"
+	"fmt"
 	"net/http"
-	"os"
+	"net/url"
 	"strconv"
+	"time"
 
 	"git.blauwelle.com/go/crate/exegroup"
 	"git.blauwelle.com/go/crate/exegroup/eghttp"
@@ -39,28 +41,68 @@ func run() error {
 		return err
 	}
 
+	// OIDC、SAML和WebAuthn都使用对外访问地址，不能根据请求的Host推断
+	if issuer, err := url.Parse(cfg.OIDC.Issuer); err != nil || issuer.Host == "" ||
+		(issuer.Scheme != "https" && issuer.Scheme != "http") {
+		return fmt.Errorf("oidc.issuer: must be an absolute http(s) URL, got %q", cfg.OIDC.Issuer)
+	}
+
 	log.Logger().AddProcessor(logsdk.AllLevels, logjson.New(logjson.WithPrettyPrint(true), logjson.WithDisableHTMLEscape(true)))
 
 	// JWT
-	keyBytes, err := os.ReadFile("private.rsa")
+	jwt, err := util.LoadJWT(cfg.Keys.Dir, cfg.Keys.PrivateKey)
 	if err != nil {
 		return err
 	}
+	if cfg.Keys.Dir != "" && cfg.Keys.ReloadInterval > 0 {
+		go reloadKeyRing(ctx, jwt, cfg.Keys.Dir, time.Duration(cfg.Keys.ReloadInterval)*time.Second)
+	}
 
-	jwt, err := util.NewJWTFromKeyBytes(keyBytes)
+	db, err := database.NewMysql(cfg)
 	if err != nil {
+		log.Error(context.TODO(), "Failed to connect to MySQL database")
 		return err
 	}
 
-	db, err := database.NewMysql(cfg)
+	store, err := database.NewStore(cfg, db)
 	if err != nil {
-		log.Error(context.TODO(), "Failed to connect to MySQL database")
 		return err
 	}
 
-	redisDB, err := database.NewRedis(cfg)
+	// 强制MFA时必须配置加密TOTP密钥的密钥，否则管理员将无法登录
+	if cfg.MFA.RequireForAdmin {
+		if _, err := util.NewSecretBox(cfg.MFA.EncryptionKey); err != nil {
+			return fmt.Errorf("mfa.encryptionKey: %w", err)
+		}
+	}
 
-	routers := router.NewRouter(db, redisDB, jwt)
+	// 登录认证器链
+	authenticator, err := database.NewAuthenticator(cfg, db)
+	if err != nil {
+		return err
+	}
+
+	// 登录失败限制
+	limiter, err := database.NewLoginLimiter(cfg)
+	if err != nil {
+		return err
+	}
+
+	// 重置密码等邮件
+	mailer, err := database.NewMailer(cfg)
+	if err != nil {
+		return err
+	}
+
+	// 后端通道登出通知
+	notifier, err := util.NewLogoutNotifier(db, jwt, cfg.OIDC.Issuer, cfg.Logout.MaxAttempts,
+		time.Duration(cfg.Logout.RetryInterval)*time.Second, time.Duration(cfg.Logout.Timeout)*time.Second)
+	if err != nil {
+		return err
+	}
+	go notifier.Run(ctx, 5*time.Second)
+
+	routers := router.NewRouter(cfg, db, store, jwt, notifier, authenticator, limiter, mailer)
 	group := exegroup.Default()
 	group.New().WithGoStop(eghttp.HTTPListenAndServe(eghttp.WithServerOption(func(server *http.Server) {
 		server.Addr = ":" + strconv.Itoa(cfg.Listen.Port)
@@ -76,3 +118,19 @@ func run() error {
 
 	return nil
 }
+
+// 定时重新读取密钥环，使 keys rotate 的结果无需重启即可生效
+func reloadKeyRing(ctx context.Context, jwt *util.JWT, dir string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := jwt.ReloadKeyRing(dir); err != nil {
+				log.Error(ctx, "reload key ring: "+err.Error())
+			}
+		}
+	}
+}
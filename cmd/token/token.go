@@ -0,0 +1,70 @@
+package token
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/spf13/cobra"
+
+	"git.blauwelle.com/go/crate/cmd/sso/config"
+	"git.blauwelle.com/go/crate/cmd/sso/util"
+)
+
+var (
+	StartCmd = &cobra.Command{
+		Use:          "token",
+		Short:        "token",
+		Example:      "token inspect <jwt>",
+		SilenceUsage: true,
+	}
+
+	inspectCmd = &cobra.Command{
+		Use:          "inspect <jwt>",
+		Short:        "decode a token and verify it against the configured keys",
+		Example:      "token inspect eyJhbGciOi...",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return inspect(args[0])
+		},
+	}
+)
+
+func init() {
+	StartCmd.AddCommand(inspectCmd)
+}
+
+func inspect(tokenString string) error {
+	// 先不校验签名解析，便于查看无效token的内容
+	claims := jwt.MapClaims{}
+	token, _, err := jwt.NewParser().ParseUnverified(tokenString, claims)
+	if err != nil {
+		return err
+	}
+	header, err := json.MarshalIndent(token.Header, "", "  ")
+	if err != nil {
+		return err
+	}
+	payload, err := json.MarshalIndent(claims, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("header:\n%s\nclaims:\n%s\n", header, payload)
+
+	cfg, err := config.GetConfig("config/config.yaml")
+	if err != nil {
+		return err
+	}
+	j, err := util.LoadJWT(cfg.Keys.Dir, cfg.Keys.PrivateKey)
+	if err != nil {
+		return err
+	}
+	if err := j.VerifyClaims(context.Background(), tokenString, jwt.MapClaims{}); err != nil {
+		fmt.Println("verify: invalid")
+		return err
+	}
+	fmt.Println("verify: ok")
+	return nil
+}
@@ -7,7 +7,8 @@ import (
 )
 
 type ListenConfig struct {
-	Port int `yaml:"port"`
+	Port       int  `yaml:"port"`
+	TrustProxy bool `yaml:"trustProxy"` // 部署在反向代理之后时开启，使用X-Forwarded-For中最后一个地址作为客户端IP
 }
 
 type MysqlConfig struct {
@@ -27,10 +28,137 @@ type RedisConfig struct {
 	TTL             int    `yaml:"ttl"`
 }
 
+type StoreConfig struct {
+	Type string `yaml:"type"` // redis、memory、sql，默认redis
+	TTL  int    `yaml:"ttl"`  // 单位为秒，未配置时使用redis.ttl
+}
+
+type OIDCConfig struct {
+	Issuer         string `yaml:"issuer"`         // 对外访问地址，如 https://sso.example.com，必须配置
+	LoginURL       string `yaml:"loginURL"`       // 未登录时跳转的登录页面，会附带redirect参数
+	AccessTokenTTL int    `yaml:"accessTokenTTL"` // 单位为秒
+	IDTokenTTL     int    `yaml:"idTokenTTL"`     // 单位为秒
+}
+
+type KeysConfig struct {
+	PrivateKey     string `yaml:"privateKey"`     // 未使用密钥环时的私钥文件，默认private.rsa
+	Dir            string `yaml:"dir"`            // 密钥环目录，为空时只使用privateKey
+	Alg            string `yaml:"alg"`            // 密钥环生成新密钥的算法：RS256、ES256、EdDSA，默认RS256
+	RetireAfter    int    `yaml:"retireAfter"`    // 轮换后旧密钥仍可用于校验的时长，单位为小时
+	ReloadInterval int    `yaml:"reloadInterval"` // 服务端重新读取密钥环的间隔，单位为秒
+}
+
+type SessionConfig struct {
+	AccessTokenTTL  int `yaml:"accessTokenTTL"`  // 会话cookie中access token的有效期，单位为秒
+	RefreshTokenTTL int `yaml:"refreshTokenTTL"` // refresh token的有效期，单位为秒
+}
+
+type LogoutConfig struct {
+	MaxAttempts   int `yaml:"maxAttempts"`   // 登出通知最多尝试次数
+	RetryInterval int `yaml:"retryInterval"` // 首次重试间隔，之后每次翻倍，单位为秒
+	Timeout       int `yaml:"timeout"`       // 单次请求超时，单位为秒
+}
+
+const (
+	AuthenticatorLocal = "local"
+	AuthenticatorLDAP  = "ldap"
+)
+
+type AuthConfig struct {
+	Authenticators []string `yaml:"authenticators"` // 依次尝试的认证方式：local、ldap，默认只使用local
+}
+
+type LDAPConfig struct {
+	URL                string            `yaml:"url"` // 如 ldap://127.0.0.1:389、ldaps://ad.example.com:636
+	StartTLS           bool              `yaml:"startTLS"`
+	InsecureSkipVerify bool              `yaml:"insecureSkipVerify"`
+	BindDN             string            `yaml:"bindDN"` // 用于搜索用户的服务账号
+	BindPassword       string            `yaml:"bindPassword"`
+	BaseDN             string            `yaml:"baseDN"`
+	UserFilter         string            `yaml:"userFilter"`        // %s为用户名，默认 (uid=%s)，AD可使用 (sAMAccountName=%s)
+	UsernameAttribute  string            `yaml:"usernameAttribute"` // 默认uid
+	GroupBaseDN        string            `yaml:"groupBaseDN"`       // 为空时使用baseDN
+	GroupFilter        string            `yaml:"groupFilter"`       // %s为用户DN，如 (member=%s)；为空时读取用户的memberOf
+	GroupAttribute     string            `yaml:"groupAttribute"`    // 默认cn
+	Timeout            int               `yaml:"timeout"`           // 单位为秒
+	CreateUsers        bool              `yaml:"createUsers"`       // 首次登录时自动创建本地用户
+	GroupRoles         map[string]string `yaml:"groupRoles"`        // 组名(使用memberOf时为组DN)到角色名的映射
+}
+
+type MFAConfig struct {
+	Issuer          string `yaml:"issuer"`          // 验证器App中显示的服务名称
+	EncryptionKey   string `yaml:"encryptionKey"`   // 加密TOTP密钥的AES-256密钥，base64编码的32字节
+	RequireForAdmin bool   `yaml:"requireForAdmin"` // admin角色成员必须通过MFA才能登录
+}
+
+type WebAuthnConfig struct {
+	RPID          string   `yaml:"rpID"`          // 默认使用oidc.issuer的域名，登录页面须在该域名或其子域名下
+	RPDisplayName string   `yaml:"rpDisplayName"` // 默认使用mfa.issuer
+	RPOrigins     []string `yaml:"rpOrigins"`     // 允许发起认证的页面来源，默认为oidc.loginURL和oidc.issuer的来源
+}
+
+type LoginLimitConfig struct {
+	FreeAttempts      int `yaml:"freeAttempts"`      // 同一用户名连续失败超过该次数后，每次失败的等待时间翻倍，默认3
+	BaseDelay         int `yaml:"baseDelay"`         // 首次等待时间，单位为秒，默认1
+	MaxDelay          int `yaml:"maxDelay"`          // 最长等待时间，单位为秒，默认60
+	LockoutAttempts   int `yaml:"lockoutAttempts"`   // 同一用户名连续失败达到该次数后锁定，默认10
+	LockoutDuration   int `yaml:"lockoutDuration"`   // 锁定时长，单位为秒，默认900
+	IPFreeAttempts    int `yaml:"ipFreeAttempts"`    // 同一IP的对应次数，默认20
+	IPLockoutAttempts int `yaml:"ipLockoutAttempts"` // 默认100
+	Window            int `yaml:"window"`            // 最后一次失败之后计数保留的时长，单位为秒，默认3600
+}
+
+type PasswordConfig struct {
+	MinLength        int    `yaml:"minLength"` // 默认8
+	MaxLength        int    `yaml:"maxLength"` // 按字节计算，bcrypt只使用前72字节，默认72
+	RequireUpper     bool   `yaml:"requireUpper"`
+	RequireLower     bool   `yaml:"requireLower"`
+	RequireDigit     bool   `yaml:"requireDigit"`
+	RequireSymbol    bool   `yaml:"requireSymbol"`
+	DisallowUsername bool   `yaml:"disallowUsername"` // 密码中不能包含用户名
+	History          int    `yaml:"history"`          // 保留最近N个旧密码，新密码不能与当前密码和这些旧密码相同
+	MaxAge           int    `yaml:"maxAge"`           // 密码有效期，单位为天，0为不过期
+	BreachedDir      string `yaml:"breachedDir"`      // 泄露密码库目录，格式见 util.BreachedPasswords
+	ResetURL         string `yaml:"resetURL"`         // 重置密码页面，邮件中的链接会附带token参数，默认为oidc.loginURL
+	ResetTTL         int    `yaml:"resetTTL"`         // 重置链接的有效期，单位为秒，默认1800
+}
+
+type MailConfig struct {
+	Type      string `yaml:"type"`     // smtp、file、log，默认log
+	From      string `yaml:"from"`     // 发件人，如 SSO <sso@example.com>
+	Host      string `yaml:"host"`     // SMTP服务器
+	Port      int    `yaml:"port"`     // 默认587
+	Username  string `yaml:"username"` // 为空时不认证
+	Password  string `yaml:"password"`
+	Security  string `yaml:"security"`  // none、starttls、tls，默认starttls
+	Timeout   int    `yaml:"timeout"`   // 单位为秒，默认10
+	Dir       string `yaml:"dir"`       // type为file时保存邮件的目录
+	VerifyURL string `yaml:"verifyURL"` // 验证邮箱页面，邮件中的链接会附带token参数，默认为oidc.loginURL
+	VerifyTTL int    `yaml:"verifyTTL"` // 验证链接的有效期，单位为秒，默认86400
+}
+
+type InvitationConfig struct {
+	URL string `yaml:"url"` // 注册页面，邀请链接会附带code参数，默认为oidc.loginURL
+	TTL int    `yaml:"ttl"` // 未指定有效期时的默认值，单位为秒，默认604800
+}
+
 type Config struct {
-	Listen ListenConfig `yaml:"listen"`
-	Mysql  MysqlConfig  `yaml:"mysql"`
-	Redis  RedisConfig  `yaml:"redis"`
+	Listen     ListenConfig     `yaml:"listen"`
+	Mysql      MysqlConfig      `yaml:"mysql"`
+	Redis      RedisConfig      `yaml:"redis"`
+	Store      StoreConfig      `yaml:"store"`
+	OIDC       OIDCConfig       `yaml:"oidc"`
+	Keys       KeysConfig       `yaml:"keys"`
+	Session    SessionConfig    `yaml:"session"`
+	Logout     LogoutConfig     `yaml:"logout"`
+	Auth       AuthConfig       `yaml:"auth"`
+	LDAP       LDAPConfig       `yaml:"ldap"`
+	MFA        MFAConfig        `yaml:"mfa"`
+	WebAuthn   WebAuthnConfig   `yaml:"webauthn"`
+	LoginLimit LoginLimitConfig `yaml:"loginLimit"`
+	Password   PasswordConfig   `yaml:"password"`
+	Mail       MailConfig       `yaml:"mail"`
+	Invitation InvitationConfig `yaml:"invitation"`
 }
 
 func GetConfig(path string) (Config, error) {
@@ -43,5 +171,41 @@ func GetConfig(path string) (Config, error) {
 	if err := yaml.Unmarshal(b, &cfg); err != nil {
 		return Config{}, err
 	}
+	if cfg.Keys.PrivateKey == "" {
+		cfg.Keys.PrivateKey = "private.rsa"
+	}
+	if cfg.MFA.Issuer == "" {
+		cfg.MFA.Issuer = "SSO"
+	}
+	if len(cfg.Auth.Authenticators) == 0 {
+		cfg.Auth.Authenticators = []string{AuthenticatorLocal}
+	}
+	setDefault(&cfg.LoginLimit.FreeAttempts, 3)
+	setDefault(&cfg.LoginLimit.BaseDelay, 1)
+	setDefault(&cfg.LoginLimit.MaxDelay, 60)
+	setDefault(&cfg.LoginLimit.LockoutAttempts, 10)
+	setDefault(&cfg.LoginLimit.LockoutDuration, 900)
+	setDefault(&cfg.LoginLimit.IPFreeAttempts, 20)
+	setDefault(&cfg.LoginLimit.IPLockoutAttempts, 100)
+	setDefault(&cfg.LoginLimit.Window, 3600)
+	setDefault(&cfg.Password.MinLength, 8)
+	setDefault(&cfg.Password.MaxLength, 72)
+	setDefault(&cfg.Password.ResetTTL, 1800)
+	setDefault(&cfg.Mail.Port, 587)
+	setDefault(&cfg.Mail.Timeout, 10)
+	setDefault(&cfg.Mail.VerifyTTL, 86400)
+	setDefault(&cfg.Invitation.TTL, 604800)
+	if cfg.Mail.Type == "" {
+		cfg.Mail.Type = "log"
+	}
+	if cfg.Mail.Security == "" {
+		cfg.Mail.Security = "starttls"
+	}
 	return cfg, nil
 }
+
+func setDefault(v *int, d int) {
+	if *v == 0 {
+		*v = d
+	}
+}
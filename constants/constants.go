@@ -2,7 +2,32 @@ package constants
 
 const (
 	SessionCookieName = "_session_"
+	RefreshCookieName = "_refresh_"
+	RefreshCookiePath = "/api/v1/token"
 	HTTPHeaderAppKey  = "X-App-Key"
 	Admin             = "admin"
 	AdminID           = 1
+	// 拥有 PermissionOrgWrite 的用户通过该请求头指定管理接口操作的组织
+	HTTPHeaderOrganization = "X-Organization-ID"
+	DefaultOrganizationID  = 1
+)
+
+// 内置角色，默认组织的admin拥有全部权限，其他组织的admin只能管理本组织
+const (
+	Auditor    = "auditor"
+	AppManager = "app-manager"
+)
+
+// 权限名称为 资源:操作，PermissionAll 表示全部权限
+const (
+	PermissionAll       = "*"
+	PermissionUserRead  = "user:read"
+	PermissionUserWrite = "user:write"
+	PermissionAppRead   = "app:read"
+	PermissionAppWrite  = "app:write"
+	PermissionRoleRead  = "role:read"
+	PermissionRoleWrite = "role:write"
+	PermissionAuditRead = "audit:read"
+	PermissionOrgRead   = "org:read"
+	PermissionOrgWrite  = "org:write"
 )
@@ -0,0 +1,78 @@
+package database
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"git.blauwelle.com/go/crate/log"
+	"gorm.io/gorm"
+
+	"git.blauwelle.com/go/crate/cmd/sso/config"
+	"git.blauwelle.com/go/crate/cmd/sso/util"
+)
+
+// NewAuthenticator 根据配置创建登录使用的认证器链
+func NewAuthenticator(cfg config.Config, db *gorm.DB) (util.AuthenticatorChain, error) {
+	log.Info(context.TODO(), "New authenticators: "+strings.Join(cfg.Auth.Authenticators, ","))
+
+	chain := make(util.AuthenticatorChain, 0, len(cfg.Auth.Authenticators))
+	for _, name := range cfg.Auth.Authenticators {
+		switch name {
+		case config.AuthenticatorLocal:
+			chain = append(chain, util.NewLocalAuthenticator(db))
+		case config.AuthenticatorLDAP:
+			authenticator, err := NewLDAPAuthenticator(cfg.LDAP)
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, authenticator)
+		default:
+			return nil, fmt.Errorf("unknown authenticator %q", name)
+		}
+	}
+	return chain, nil
+}
+
+func NewLDAPAuthenticator(cfg config.LDAPConfig) (*util.LDAPAuthenticator, error) {
+	if cfg.URL == "" || cfg.BaseDN == "" {
+		return nil, fmt.Errorf("ldap: url and baseDN are required")
+	}
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	authenticator := &util.LDAPAuthenticator{
+		URL:               cfg.URL,
+		StartTLS:          cfg.StartTLS,
+		TLSConfig:         &tls.Config{ServerName: u.Hostname(), InsecureSkipVerify: cfg.InsecureSkipVerify},
+		BindDN:            cfg.BindDN,
+		BindPassword:      cfg.BindPassword,
+		BaseDN:            cfg.BaseDN,
+		UserFilter:        cfg.UserFilter,
+		UsernameAttribute: cfg.UsernameAttribute,
+		GroupBaseDN:       cfg.GroupBaseDN,
+		GroupFilter:       cfg.GroupFilter,
+		GroupAttribute:    cfg.GroupAttribute,
+		Timeout:           time.Duration(cfg.Timeout) * time.Second,
+	}
+	if authenticator.UserFilter == "" {
+		authenticator.UserFilter = "(uid=%s)"
+	}
+	if authenticator.UsernameAttribute == "" {
+		authenticator.UsernameAttribute = "uid"
+	}
+	if authenticator.GroupBaseDN == "" {
+		authenticator.GroupBaseDN = authenticator.BaseDN
+	}
+	if authenticator.GroupAttribute == "" {
+		authenticator.GroupAttribute = "cn"
+	}
+	if authenticator.Timeout <= 0 {
+		authenticator.Timeout = 5 * time.Second
+	}
+	return authenticator, nil
+}
@@ -0,0 +1,40 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"git.blauwelle.com/go/crate/log"
+
+	"git.blauwelle.com/go/crate/cmd/sso/config"
+	"git.blauwelle.com/go/crate/cmd/sso/util"
+)
+
+// NewLoginLimiter 根据配置创建登录失败限制，ticket存储使用redis时计数也保存在redis，多个节点共享
+func NewLoginLimiter(cfg config.Config) (*util.LoginLimiter, error) {
+	var store util.LoginFailureStore
+	if cfg.Store.Type == "" || cfg.Store.Type == util.StoreTypeRedis {
+		redisDB, err := NewRedis(cfg)
+		if err != nil {
+			return nil, err
+		}
+		store = util.NewRedisLoginFailureStore(redisDB)
+	} else {
+		log.Info(context.TODO(), "Login failures are counted in memory")
+		store = util.NewMemoryLoginFailureStore()
+	}
+
+	limit := cfg.LoginLimit
+	second := func(n int) time.Duration { return time.Duration(n) * time.Second }
+	user := util.LoginLimitPolicy{
+		FreeAttempts:    limit.FreeAttempts,
+		BaseDelay:       second(limit.BaseDelay),
+		MaxDelay:        second(limit.MaxDelay),
+		LockoutAttempts: limit.LockoutAttempts,
+		LockoutDuration: second(limit.LockoutDuration),
+	}
+	ip := user
+	ip.FreeAttempts = limit.IPFreeAttempts
+	ip.LockoutAttempts = limit.IPLockoutAttempts
+	return util.NewLoginLimiter(store, user, ip, second(limit.Window)), nil
+}
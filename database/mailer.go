@@ -0,0 +1,43 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"git.blauwelle.com/go/crate/log"
+
+	"git.blauwelle.com/go/crate/cmd/sso/config"
+	"git.blauwelle.com/go/crate/cmd/sso/util"
+)
+
+// NewMailer 根据配置创建邮件发送
+func NewMailer(cfg config.Config) (util.Mailer, error) {
+	log.Info(context.TODO(), "New mailer: "+cfg.Mail.Type)
+	switch cfg.Mail.Type {
+	case util.MailerTypeSMTP:
+		switch cfg.Mail.Security {
+		case util.SMTPSecurityNone, util.SMTPSecurityStartTLS, util.SMTPSecurityTLS:
+		default:
+			return nil, fmt.Errorf("unknown smtp security %q", cfg.Mail.Security)
+		}
+		return &util.SMTPMailer{
+			Host:     cfg.Mail.Host,
+			Port:     cfg.Mail.Port,
+			Username: cfg.Mail.Username,
+			Password: cfg.Mail.Password,
+			From:     cfg.Mail.From,
+			Security: cfg.Mail.Security,
+			Timeout:  time.Duration(cfg.Mail.Timeout) * time.Second,
+		}, nil
+	case util.MailerTypeFile:
+		if cfg.Mail.Dir == "" {
+			return nil, fmt.Errorf("mail.dir is required for file mailer")
+		}
+		return &util.FileMailer{Dir: cfg.Mail.Dir, From: cfg.Mail.From}, nil
+	case util.MailerTypeLog:
+		return util.LogMailer{}, nil
+	default:
+		return nil, fmt.Errorf("unknown mailer type %q", cfg.Mail.Type)
+	}
+}
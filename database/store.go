@@ -0,0 +1,43 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"git.blauwelle.com/go/crate/log"
+	"gorm.io/gorm"
+
+	"git.blauwelle.com/go/crate/cmd/sso/config"
+	"git.blauwelle.com/go/crate/cmd/sso/util"
+)
+
+// NewStore 根据配置创建ticket存储
+func NewStore(cfg config.Config, db *gorm.DB) (util.Store, error) {
+	ttl := cfg.Store.TTL
+	if ttl == 0 {
+		ttl = cfg.Redis.TTL
+	}
+	ttlDuration := time.Duration(ttl) * time.Second
+
+	storeType := cfg.Store.Type
+	if storeType == "" {
+		storeType = util.StoreTypeRedis
+	}
+	log.Info(context.TODO(), "New ticket store: "+storeType)
+
+	switch storeType {
+	case util.StoreTypeRedis:
+		redisDB, err := NewRedis(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return util.NewRedisStore(redisDB, ttlDuration), nil
+	case util.StoreTypeMemory:
+		return util.NewMemoryStore(ttlDuration), nil
+	case util.StoreTypeSQL:
+		return util.NewSQLStore(db, ttlDuration), nil
+	default:
+		return nil, fmt.Errorf("unknown store type %q", storeType)
+	}
+}
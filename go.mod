@@ -1,34 +1,47 @@
 module git.blauwelle.com/go/crate/cmd/sso
 
-go 1.20
+go 1.21
 
 require (
 	git.blauwelle.com/go/crate/exegroup v0.6.0
 	git.blauwelle.com/go/crate/log v1.13.0
-	github.com/golang-jwt/jwt/v5 v5.0.0
+	github.com/beevik/etree v1.1.0
+	github.com/fxamacker/cbor/v2 v2.5.0
+	github.com/go-ldap/ldap/v3 v3.4.1
+	github.com/go-sql-driver/mysql v1.7.0
+	github.com/go-webauthn/webauthn v0.9.4
+	github.com/golang-jwt/jwt/v5 v5.2.0
 	github.com/redis/go-redis/v9 v9.0.5
+	github.com/russellhaering/goxmldsig v1.4.0
 	github.com/spf13/cobra v1.7.0
 	github.com/uptrace/bunrouter v1.0.20
 	github.com/uptrace/bunrouter/extra/reqlog v1.0.20
-	golang.org/x/crypto v0.9.0
+	golang.org/x/crypto v0.16.0
 	gopkg.in/yaml.v3 v3.0.1
 	gorm.io/driver/mysql v1.5.1
 	gorm.io/gorm v1.25.1
 )
 
 require (
+	github.com/Azure/go-ntlmssp v0.0.0-20200615164410-66371956d46c // indirect
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
 	github.com/fatih/color v1.14.1 // indirect
 	github.com/felixge/httpsnoop v1.0.3 // indirect
-	github.com/go-sql-driver/mysql v1.7.0 // indirect
+	github.com/go-asn1-ber/asn1-ber v1.5.1 // indirect
+	github.com/go-webauthn/x v0.1.5 // indirect
+	github.com/google/go-tpm v0.9.0 // indirect
+	github.com/google/uuid v1.4.0 // indirect
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/jinzhu/inflection v1.0.0 // indirect
 	github.com/jinzhu/now v1.1.5 // indirect
+	github.com/jonboulle/clockwork v0.2.2 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.17 // indirect
+	github.com/mitchellh/mapstructure v1.5.0 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
 	go.opentelemetry.io/otel v1.13.0 // indirect
 	go.opentelemetry.io/otel/trace v1.13.0 // indirect
-	golang.org/x/sys v0.8.0 // indirect
+	golang.org/x/sys v0.15.0 // indirect
 )
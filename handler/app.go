@@ -4,27 +4,56 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
+	"net/url"
 	"strconv"
 
 	"git.blauwelle.com/go/crate/log"
 	"github.com/uptrace/bunrouter"
+	"golang.org/x/crypto/bcrypt"
 
 	"git.blauwelle.com/go/crate/cmd/sso/model"
 	"git.blauwelle.com/go/crate/cmd/sso/response"
 )
 
+// CreateAppRequest 只包含基本信息，SAML配置通过 UpdateAppSAML 校验后设置
+type CreateAppRequest struct {
+	Name         string `json:"name"`
+	Site         string `json:"site"`
+	Redirect     string `json:"redirect"`
+	RedirectURIs string `json:"redirect_uris"`
+	LogoutURL    string `json:"logout_url"`
+}
+
 func (h *Handler) CreateApp() bunrouter.HandlerFunc {
 	return func(rw http.ResponseWriter, r bunrouter.Request) error {
-		var application model.Application
-		if err := json.NewDecoder(r.Body).Decode(&application); err != nil {
+		var request CreateAppRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
 			return response.Error(rw, response.MessageBindError, bunrouter.H{})
 		}
-		//生成app_key
+		application := model.Application{
+			Name:         request.Name,
+			Site:         request.Site,
+			Redirect:     request.Redirect,
+			RedirectURIs: request.RedirectURIs,
+			LogoutURL:    request.LogoutURL,
+		}
+		//生成app_key和client_secret，client_secret只在创建时返回一次
 		application.AppKey = h.r.RandString(20)
+		clientSecret := h.r.RandString(40)
+		secretHash, err := bcrypt.GenerateFromPassword([]byte(clientSecret), 12)
+		if err != nil {
+			return err
+		}
+		application.ClientSecretHash = string(secretHash)
+		// 应用属于当前组织
+		application.OrganizationID = currentOrganizationID(r.Context())
 		if dbCreate := h.db.Create(&application); dbCreate.Error != nil {
 			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
 		}
-		return response.WriteOK(rw, response.MessageOK, bunrouter.H{"app_key": application.AppKey})
+		return response.WriteOK(rw, response.MessageOK, bunrouter.H{
+			"app_key":       application.AppKey,
+			"client_secret": clientSecret,
+		})
 	}
 }
 
@@ -40,7 +69,7 @@ func (h *Handler) SearchApp() bunrouter.HandlerFunc {
 		var count int64
 
 		// 构建查询条件
-		query := h.db.Model(&model.Application{})
+		query := h.tenant(r.Context()).Model(&model.Application{})
 
 		// 添加模糊查询条件
 		if name != "" {
@@ -87,7 +116,7 @@ func (h *Handler) DeleteApp() bunrouter.HandlerFunc {
 			log.Error(ctx, err.Error())
 			return response.Error(rw, response.MessageBindError, bunrouter.H{})
 		}
-		if db := h.db.Delete(&model.Application{}, "id=?", request.ID); db.Error != nil {
+		if db := h.tenant(ctx).Delete(&model.Application{}, "id=?", request.ID); db.Error != nil {
 
 			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
 		}
@@ -97,10 +126,12 @@ func (h *Handler) DeleteApp() bunrouter.HandlerFunc {
 }
 
 type UpdateAppRequest struct {
-	ID       uint   `json:"id"`
-	Name     string `json:"name"`
-	Site     string `json:"site"`
-	Redirect string `json:"redirect"`
+	ID           uint   `json:"id"`
+	Name         string `json:"name"`
+	Site         string `json:"site"`
+	Redirect     string `json:"redirect"`
+	RedirectURIs string `json:"redirect_uris"`
+	LogoutURL    string `json:"logout_url"`
 }
 
 func (h *Handler) UpdateApp() bunrouter.HandlerFunc {
@@ -113,17 +144,125 @@ func (h *Handler) UpdateApp() bunrouter.HandlerFunc {
 			return response.Error(rw, response.MessageBindError, bunrouter.H{})
 		}
 		updates := map[string]interface{}{
-			"name":     request.Name,
-			"site":     request.Site,
-			"redirect": request.Redirect,
+			"name":          request.Name,
+			"site":          request.Site,
+			"redirect":      request.Redirect,
+			"redirect_uris": request.RedirectURIs,
+			"logout_url":    request.LogoutURL,
 		}
-		if h.db.Model(&model.Application{}).Where("id=?", request.ID).Updates(updates).Error != nil {
+		if h.tenant(ctx).Model(&model.Application{}).Where("id=?", request.ID).Updates(updates).Error != nil {
 			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
 		}
 		return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
 	}
 }
 
+type ResetAppSecretRequest struct {
+	ID uint `json:"id"`
+}
+
+// 重新生成client_secret，旧的立即失效
+func (h *Handler) ResetAppSecret() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, req bunrouter.Request) error {
+		ctx := req.Context()
+		var request ResetAppSecretRequest
+
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		clientSecret := h.r.RandString(40)
+		secretHash, err := bcrypt.GenerateFromPassword([]byte(clientSecret), 12)
+		if err != nil {
+			return err
+		}
+		db := h.tenant(ctx).Model(&model.Application{}).Where("id=?", request.ID).Update("client_secret_hash", string(secretHash))
+		if db.Error != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if db.RowsAffected != 1 {
+			return response.Error(rw, response.MessageAppNotExist, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, bunrouter.H{"client_secret": clientSecret})
+	}
+}
+
+type UpdateAppSAMLRequest struct {
+	ID           uint              `json:"id"`
+	EntityID     string            `json:"entity_id"`
+	ACSURL       string            `json:"acs_url"`
+	NameIDFormat string            `json:"name_id_format"`
+	Attributes   map[string]string `json:"attributes"` // SAML属性名到用户字段(id、username)的映射
+}
+
+// 配置应用作为SAML SP的参数，entity_id为空时关闭SAML
+func (h *Handler) UpdateAppSAML() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, req bunrouter.Request) error {
+		ctx := req.Context()
+		var request UpdateAppSAMLRequest
+
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		if !validSAMLConfig(request) {
+			return response.Error(rw, response.MessageSAMLConfigInvalid, bunrouter.H{})
+		}
+		if request.EntityID != "" {
+			var count int64
+			if err := h.db.Model(&model.Application{}).Where("saml_entity_id=? AND id<>?", request.EntityID, request.ID).Count(&count).Error; err != nil {
+				return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+			}
+			if count > 0 {
+				return response.Error(rw, response.MessageSAMLEntityExist, bunrouter.H{})
+			}
+		}
+		attributes := ""
+		if len(request.Attributes) > 0 {
+			b, err := json.Marshal(request.Attributes)
+			if err != nil {
+				return err
+			}
+			attributes = string(b)
+		}
+		updates := map[string]interface{}{
+			"saml_entity_id":      request.EntityID,
+			"saml_acs_url":        request.ACSURL,
+			"saml_name_id_format": request.NameIDFormat,
+			"saml_attributes":     attributes,
+		}
+		db := h.tenant(ctx).Model(&model.Application{}).Where("id=?", request.ID).Updates(updates)
+		if db.Error != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if db.RowsAffected != 1 {
+			return response.Error(rw, response.MessageAppNotExist, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
+	}
+}
+
+func validSAMLConfig(request UpdateAppSAMLRequest) bool {
+	if request.EntityID == "" {
+		return true
+	}
+	acs, err := url.Parse(request.ACSURL)
+	if err != nil || (acs.Scheme != "https" && acs.Scheme != "http") || acs.Host == "" {
+		return false
+	}
+	switch request.NameIDFormat {
+	case "", SAMLNameIDFormatUnspecified, SAMLNameIDFormatPersistent, SAMLNameIDFormatTransient:
+	default:
+		return false
+	}
+	for _, field := range request.Attributes {
+		if _, ok := samlUserAttribute(model.User{}, field); !ok {
+			return false
+		}
+	}
+	return true
+}
+
 // 计算偏移量
 func calculateOffset(page string, pageSize int, totalRecords int64) (int, error) {
 	pageNumber, err := strconv.Atoi(page)
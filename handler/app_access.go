@@ -0,0 +1,255 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"git.blauwelle.com/go/crate/log"
+	"github.com/uptrace/bunrouter"
+	"gorm.io/gorm"
+
+	"git.blauwelle.com/go/crate/cmd/sso/middleware"
+	"git.blauwelle.com/go/crate/cmd/sso/model"
+	"git.blauwelle.com/go/crate/cmd/sso/response"
+)
+
+type UpdateAppAccessRequest struct {
+	ID             uint   `json:"id"`
+	RestrictAccess bool   `json:"restrict_access"`
+	RoleIDs        []uint `json:"role_ids"`
+	GroupIDs       []uint `json:"group_ids"`
+}
+
+type AppAccessResponse struct {
+	RestrictAccess bool          `json:"restrict_access"`
+	Roles          []model.Role  `json:"roles"`
+	Groups         []model.Group `json:"groups"`
+}
+
+// GetAppAccess 应用的访问限制和允许访问的角色、组
+func (h *Handler) GetAppAccess() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil {
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		app, ok, err := isExistAppByID(uint(id), h.tenant(ctx))
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if !ok {
+			return response.Error(rw, response.MessageAppNotExist, bunrouter.H{})
+		}
+		roles := []model.Role{}
+		if err := h.db.WithContext(ctx).
+			Joins("JOIN app_access_roles ON app_access_roles.role_id = roles.id").
+			Where("app_access_roles.app_id = ?", app.ID).Order("roles.name").Find(&roles).Error; err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		groups := []model.Group{}
+		if err := h.db.WithContext(ctx).
+			Joins("JOIN app_access_groups ON app_access_groups.group_id = groups.id").
+			Where("app_access_groups.app_id = ?", app.ID).Order("groups.name").Find(&groups).Error; err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, AppAccessResponse{RestrictAccess: app.RestrictAccess, Roles: roles, Groups: groups})
+	}
+}
+
+// UpdateAppAccess 设置应用是否限制访问，并替换允许访问的角色和组
+func (h *Handler) UpdateAppAccess() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request UpdateAppAccessRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		_, ok, err := isExistAppByID(request.ID, h.tenant(ctx))
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if !ok {
+			return response.Error(rw, response.MessageAppNotExist, bunrouter.H{})
+		}
+		roleIDs := uniqueIDs(request.RoleIDs)
+		if len(roleIDs) > 0 {
+			var count int64
+			if err := h.tenant(ctx).Model(&model.Role{}).Where("id IN ?", roleIDs).Count(&count).Error; err != nil {
+				return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+			}
+			if int(count) != len(roleIDs) {
+				return response.Error(rw, response.MessageRoleNotExist, bunrouter.H{})
+			}
+		}
+		groupIDs := uniqueIDs(request.GroupIDs)
+		if len(groupIDs) > 0 {
+			var count int64
+			if err := h.tenant(ctx).Model(&model.Group{}).Where("id IN ?", groupIDs).Count(&count).Error; err != nil {
+				return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+			}
+			if int(count) != len(groupIDs) {
+				return response.Error(rw, response.MessageGroupNotExist, bunrouter.H{})
+			}
+		}
+		if err := h.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(&model.Application{}).Where("id = ?", request.ID).
+				Update("restrict_access", request.RestrictAccess).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("app_id = ?", request.ID).Delete(&model.AppAccessRole{}).Error; err != nil {
+				return err
+			}
+			for _, roleID := range roleIDs {
+				if err := tx.Create(&model.AppAccessRole{AppID: request.ID, RoleID: roleID}).Error; err != nil {
+					return err
+				}
+			}
+			if err := tx.Where("app_id = ?", request.ID).Delete(&model.AppAccessGroup{}).Error; err != nil {
+				return err
+			}
+			for _, groupID := range groupIDs {
+				if err := tx.Create(&model.AppAccessGroup{AppID: request.ID, GroupID: groupID}).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
+	}
+}
+
+// SearchAppMember 可以访问应用的用户，分页；不限制访问的应用返回全部用户
+func (h *Handler) SearchAppMember() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil {
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		app, ok, err := isExistAppByID(uint(id), h.tenant(r.Context()))
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if !ok {
+			return response.Error(rw, response.MessageAppNotExist, bunrouter.H{})
+		}
+		pageSize := r.URL.Query().Get("pageSize")
+		page := r.URL.Query().Get("page")
+		// 设置默认每页记录数
+		defaultPageSize := 20
+
+		users := []model.User{}
+		var count int64
+
+		query := h.tenant(r.Context()).Model(&model.User{})
+		if app.RestrictAccess {
+			roleIDs, groupIDs, err := appAccessGrants(r.Context(), h.db, app.ID)
+			if err != nil {
+				log.Error(r.Context(), err.Error())
+				return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+			}
+			// 直接拥有允许的角色，或属于允许的组、拥有允许角色的组及它们的子组
+			query = query.Where("users.id IN (?) OR users.id IN (?)",
+				h.db.Model(&model.UserRole{}).Select("user_id").Where("role_id IN ?", roleIDs),
+				h.db.Model(&model.GroupMember{}).Select("user_id").Where("group_id IN ?", groupIDs))
+		}
+		if dbCount := query.Count(&count); dbCount.Error != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+
+		pageSizeInt, err := strconv.Atoi(pageSize)
+		pageInt, _ := strconv.Atoi(page)
+		if err != nil || pageSizeInt <= 0 {
+			pageSizeInt = defaultPageSize
+		}
+		if count == 0 {
+			return response.WriteOK(rw, response.MessageOK, response.NewPaginationData(pageInt, pageSizeInt, users))
+		}
+		offset, err := calculateOffset(page, pageSizeInt, count)
+		if err != nil {
+			return response.Error(rw, response.MessageCalculateOffset, bunrouter.H{})
+		}
+		if dbFind := query.Order("users.id").Offset(offset).Limit(pageSizeInt).
+			Select("users.id, users.created_at, users.updated_at, users.username, users.email, users.email_verified_at").
+			Find(&users); dbFind.Error != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, response.NewPaginationData(pageInt, pageSizeInt, users))
+	}
+}
+
+// 用户是否可以登录应用，SSOLogin、OIDC、CAS、SAML签发凭证前和应用兑换凭证时都要检查
+// 其他组织的用户不能访问应用
+func canAccessApp(ctx context.Context, db *gorm.DB, app model.Application, userID uint) (bool, error) {
+	var count int64
+	if err := db.WithContext(ctx).Model(&model.User{}).
+		Where("id = ? AND organization_id = ?", userID, app.OrganizationID).Count(&count).Error; err != nil {
+		return false, err
+	}
+	if count == 0 {
+		return false, nil
+	}
+	if !app.RestrictAccess {
+		return true, nil
+	}
+	groupIDs, err := middleware.UserGroupIDs(ctx, db, userID)
+	if err != nil {
+		return false, err
+	}
+	roleIDs, err := middleware.UserRoleIDs(ctx, db, userID, groupIDs)
+	if err != nil {
+		return false, err
+	}
+	count = 0
+	if len(roleIDs) > 0 {
+		if err := db.WithContext(ctx).Model(&model.AppAccessRole{}).
+			Where("app_id = ? AND role_id IN ?", app.ID, roleIDs).Count(&count).Error; err != nil {
+			return false, err
+		}
+	}
+	if count == 0 && len(groupIDs) > 0 {
+		if err := db.WithContext(ctx).Model(&model.AppAccessGroup{}).
+			Where("app_id = ? AND group_id IN ?", app.ID, groupIDs).Count(&count).Error; err != nil {
+			return false, err
+		}
+	}
+	return count > 0, nil
+}
+
+// 允许访问应用的角色，以及成员可以访问应用的全部组
+func appAccessGrants(ctx context.Context, db *gorm.DB, appID uint) ([]uint, []uint, error) {
+	var roleIDs, groupIDs []uint
+	if err := db.WithContext(ctx).Model(&model.AppAccessRole{}).
+		Where("app_id = ?", appID).Pluck("role_id", &roleIDs).Error; err != nil {
+		return nil, nil, err
+	}
+	if err := db.WithContext(ctx).Model(&model.AppAccessGroup{}).
+		Where("app_id = ?", appID).Pluck("group_id", &groupIDs).Error; err != nil {
+		return nil, nil, err
+	}
+	if len(roleIDs) > 0 {
+		var roleGroupIDs []uint
+		if err := db.WithContext(ctx).Model(&model.GroupRole{}).
+			Where("role_id IN ?", roleIDs).Pluck("group_id", &roleGroupIDs).Error; err != nil {
+			return nil, nil, err
+		}
+		groupIDs = append(groupIDs, roleGroupIDs...)
+	}
+	groupIDs, err := middleware.GroupDescendantIDs(ctx, db, groupIDs)
+	return roleIDs, groupIDs, err
+}
+
+func isExistAppByID(id uint, db *gorm.DB) (model.Application, bool, error) {
+	var app model.Application
+	DB := db.Where("id = ?", id).Find(&app)
+	if DB.Error != nil || DB.RowsAffected != 1 {
+		return model.Application{}, false, DB.Error
+	}
+	return app, true, nil
+}
@@ -0,0 +1,312 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"git.blauwelle.com/go/crate/log"
+	"github.com/uptrace/bunrouter"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"git.blauwelle.com/go/crate/cmd/sso/middleware"
+	"git.blauwelle.com/go/crate/cmd/sso/model"
+	"git.blauwelle.com/go/crate/cmd/sso/response"
+)
+
+type CreateAppRoleRequest struct {
+	AppID       uint   `json:"app_id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+type UpdateAppRoleRequest struct {
+	ID          uint   `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+type DeleteAppRoleRequest struct {
+	ID uint `json:"id"`
+}
+
+type AppRoleMemberRequest struct {
+	RoleID uint `json:"role_id"`
+	UserID uint `json:"user_id"`
+}
+
+func (h *Handler) CreateAppRole() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request CreateAppRoleRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		request.Name = strings.TrimSpace(request.Name)
+		if request.Name == "" || len(request.Name) > 64 {
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		_, ok, err := isExistAppByID(request.AppID, h.tenant(ctx))
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if !ok {
+			return response.Error(rw, response.MessageAppNotExist, bunrouter.H{})
+		}
+		_, ok, err = isExistAppRoleByName(request.AppID, request.Name, h.db)
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if ok {
+			return response.Error(rw, response.MessageAppRoleExist, bunrouter.H{})
+		}
+		role := model.AppRole{AppID: request.AppID, Name: request.Name, Description: request.Description}
+		if err := h.db.WithContext(ctx).Create(&role).Error; err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, bunrouter.H{"id": role.ID})
+	}
+}
+
+// SearchAppRole 应用的全部角色，不分页
+func (h *Handler) SearchAppRole() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		appID, err := strconv.Atoi(r.URL.Query().Get("app_id"))
+		if err != nil {
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		roles := []model.AppRole{}
+		if err := h.db.WithContext(r.Context()).Where("app_id = ? AND app_id IN (?)", appID, h.tenantAppIDs(r.Context())).
+			Order("name").Find(&roles).Error; err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, roles)
+	}
+}
+
+func (h *Handler) UpdateAppRole() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request UpdateAppRoleRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		request.Name = strings.TrimSpace(request.Name)
+		if request.Name == "" || len(request.Name) > 64 {
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		role, ok, err := isExistAppRoleByID(request.ID, h.tenantAppRoles(ctx))
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if !ok {
+			return response.Error(rw, response.MessageAppRoleNotExist, bunrouter.H{})
+		}
+		if request.Name != role.Name {
+			_, exist, err := isExistAppRoleByName(role.AppID, request.Name, h.db)
+			if err != nil {
+				return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+			}
+			if exist {
+				return response.Error(rw, response.MessageAppRoleExist, bunrouter.H{})
+			}
+		}
+		if err := h.db.WithContext(ctx).Model(&model.AppRole{}).Where("id = ?", role.ID).Updates(map[string]interface{}{
+			"name":        request.Name,
+			"description": request.Description,
+		}).Error; err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
+	}
+}
+
+// DeleteAppRole 同时移除角色的成员和组
+func (h *Handler) DeleteAppRole() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request DeleteAppRoleRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		_, ok, err := isExistAppRoleByID(request.ID, h.tenantAppRoles(ctx))
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if !ok {
+			return response.Error(rw, response.MessageAppRoleNotExist, bunrouter.H{})
+		}
+		if err := h.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			for _, table := range []interface{}{&model.UserAppRole{}, &model.GroupAppRole{}} {
+				if err := tx.Where("app_role_id = ?", request.ID).Delete(table).Error; err != nil {
+					return err
+				}
+			}
+			// 直接删除记录，角色名可以重新使用
+			return tx.Unscoped().Delete(&model.AppRole{}, "id = ?", request.ID).Error
+		}); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
+	}
+}
+
+func (h *Handler) AddAppRoleMember() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request AppRoleMemberRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		_, ok, err := isExistUserByID(request.UserID, h.tenant(ctx))
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if !ok {
+			return response.Error(rw, response.MessageUserNotExist, bunrouter.H{})
+		}
+		_, ok, err = isExistAppRoleByID(request.RoleID, h.tenantAppRoles(ctx))
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if !ok {
+			return response.Error(rw, response.MessageAppRoleNotExist, bunrouter.H{})
+		}
+		if err := h.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&model.UserAppRole{UserID: request.UserID, AppRoleID: request.RoleID}).Error; err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
+	}
+}
+
+// RemoveAppRoleMember 已签发给应用的token在过期前仍包含该角色
+func (h *Handler) RemoveAppRoleMember() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request AppRoleMemberRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		if err := h.db.WithContext(ctx).Where("app_role_id IN (?)", h.tenantAppRoles(ctx).Model(&model.AppRole{}).Select("id")).
+			Delete(&model.UserAppRole{}, "user_id = ? AND app_role_id = ?", request.UserID, request.RoleID).Error; err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
+	}
+}
+
+// SearchAppRoleMember 应用角色的成员，分页
+func (h *Handler) SearchAppRoleMember() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		roleID, err := strconv.Atoi(r.URL.Query().Get("role_id"))
+		if err != nil {
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		pageSize := r.URL.Query().Get("pageSize")
+		page := r.URL.Query().Get("page")
+		// 设置默认每页记录数
+		defaultPageSize := 20
+
+		users := []model.User{}
+		var count int64
+
+		query := h.tenant(r.Context()).Model(&model.User{}).
+			Joins("JOIN user_app_roles ON user_app_roles.user_id = users.id").
+			Where("user_app_roles.app_role_id = ?", roleID)
+		if dbCount := query.Count(&count); dbCount.Error != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+
+		pageSizeInt, err := strconv.Atoi(pageSize)
+		pageInt, _ := strconv.Atoi(page)
+		if err != nil || pageSizeInt <= 0 {
+			pageSizeInt = defaultPageSize
+		}
+		if count == 0 {
+			return response.WriteOK(rw, response.MessageOK, response.NewPaginationData(pageInt, pageSizeInt, users))
+		}
+		offset, err := calculateOffset(page, pageSizeInt, count)
+		if err != nil {
+			return response.Error(rw, response.MessageCalculateOffset, bunrouter.H{})
+		}
+		if dbFind := query.Order("users.id").Offset(offset).Limit(pageSizeInt).
+			Select("users.id, users.created_at, users.updated_at, users.username, users.email, users.email_verified_at").
+			Find(&users); dbFind.Error != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, response.NewPaginationData(pageInt, pageSizeInt, users))
+	}
+}
+
+// SearchUserAppRole 用户在各应用中的角色
+func (h *Handler) SearchUserAppRole() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		userID, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil {
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		roles := []model.AppRole{}
+		if err := h.db.WithContext(r.Context()).
+			Joins("JOIN user_app_roles ON user_app_roles.app_role_id = app_roles.id").
+			Where("user_app_roles.user_id = ? AND app_roles.app_id IN (?)", userID, h.tenantAppIDs(r.Context())).
+			Order("app_roles.app_id, app_roles.name").Find(&roles).Error; err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, roles)
+	}
+}
+
+// 用户在应用中的角色名称，包括通过组获得的，作为签发给该应用的token中的roles
+func appRoleNames(ctx context.Context, db *gorm.DB, appID, userID uint) ([]string, error) {
+	groupIDs, err := middleware.UserGroupIDs(ctx, db, userID)
+	if err != nil {
+		return nil, err
+	}
+	assigned := db.Where("app_roles.id IN (?)",
+		db.Model(&model.UserAppRole{}).Select("app_role_id").Where("user_id = ?", userID))
+	if len(groupIDs) > 0 {
+		assigned = assigned.Or("app_roles.id IN (?)",
+			db.Model(&model.GroupAppRole{}).Select("app_role_id").Where("group_id IN ?", groupIDs))
+	}
+	var names []string
+	err = db.WithContext(ctx).Model(&model.AppRole{}).
+		Where("app_roles.app_id = ?", appID).Where(assigned).
+		Order("app_roles.name").Pluck("app_roles.name", &names).Error
+	return names, err
+}
+
+// 当前组织的应用的角色
+func (h *Handler) tenantAppRoles(ctx context.Context) *gorm.DB {
+	return h.db.WithContext(ctx).Where("app_roles.app_id IN (?)", h.tenantAppIDs(ctx))
+}
+
+func isExistAppRoleByID(id uint, db *gorm.DB) (model.AppRole, bool, error) {
+	var role model.AppRole
+	DB := db.Where("id = ?", id).Find(&role)
+	if DB.Error != nil || DB.RowsAffected != 1 {
+		return model.AppRole{}, false, DB.Error
+	}
+	return role, true, nil
+}
+
+func isExistAppRoleByName(appID uint, name string, db *gorm.DB) (model.AppRole, bool, error) {
+	var role model.AppRole
+	DB := db.Where("app_id = ? AND name = ?", appID, name).Find(&role)
+	if DB.Error != nil || DB.RowsAffected != 1 {
+		return model.AppRole{}, false, DB.Error
+	}
+	return role, true, nil
+}
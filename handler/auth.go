@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+
+	"git.blauwelle.com/go/crate/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"git.blauwelle.com/go/crate/cmd/sso/model"
+	"git.blauwelle.com/go/crate/cmd/sso/util"
+)
+
+// 通过认证器链校验用户名和密码，返回对应的本地用户
+// 外部目录的用户首次登录时按配置在登录的组织中创建本地用户，并按组同步角色
+// 用户不属于登录的组织时与用户不存在相同
+func (h *Handler) authenticate(ctx context.Context, username, password string, organizationID uint) (model.User, error) {
+	identity, err := h.authenticator.Authenticate(ctx, username, password)
+	if err != nil {
+		return model.User{}, err
+	}
+	user, ok, err := isExistUserByName(identity.Username, h.db)
+	if err != nil {
+		return model.User{}, err
+	}
+	if !ok {
+		if identity.Source == model.UserSourceLocal || !h.cfg.LDAP.CreateUsers {
+			return model.User{}, util.ErrUnknownUser
+		}
+		user = model.User{OrganizationID: organizationID, Username: identity.Username, Source: identity.Source}
+		if err := h.db.WithContext(ctx).Create(&user).Error; err != nil {
+			return model.User{}, err
+		}
+		log.Info(ctx, fmt.Sprintf("created %s user %s", user.Source, user.Username))
+	}
+	// 同名的本地用户不能通过外部目录登录，反之亦然
+	if user.Source != identity.Source {
+		log.Error(ctx, fmt.Sprintf("user %s source mismatch: local=%s authenticated=%s", user.Username, user.Source, identity.Source))
+		return model.User{}, util.ErrUnknownUser
+	}
+	if user.OrganizationID != organizationID {
+		return model.User{}, util.ErrUnknownUser
+	}
+	if identity.Source == model.UserSourceLDAP {
+		if err := syncGroupRoles(ctx, h.db, user, identity.Groups, h.cfg.LDAP.GroupRoles); err != nil {
+			return model.User{}, err
+		}
+	}
+	return user, nil
+}
+
+// 按组到角色的映射同步用户角色，只修改映射中出现的角色，手动分配的其他角色保持不变
+// 角色按名称在用户所属的组织中查找
+func syncGroupRoles(ctx context.Context, db *gorm.DB, user model.User, groups []string, groupRoles map[string]string) error {
+	if len(groupRoles) == 0 {
+		return nil
+	}
+	managed := make([]string, 0, len(groupRoles))
+	for _, role := range groupRoles {
+		managed = append(managed, role)
+	}
+	var roles []model.Role
+	if err := db.WithContext(ctx).Where("organization_id = ? AND name IN ?", user.OrganizationID, managed).Find(&roles).Error; err != nil {
+		return err
+	}
+	grant, revoke := groupRoleChanges(roles, groups, groupRoles)
+	return db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, roleID := range grant {
+			if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&model.UserRole{UserID: user.ID, RoleID: roleID}).Error; err != nil {
+				return err
+			}
+		}
+		for _, roleID := range revoke {
+			if err := tx.Where("user_id=? AND role_id=?", user.ID, roleID).Delete(&model.UserRole{}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// 用户所在的任一组映射到某角色时授予该角色，否则收回
+// 多个组映射到同一角色时只要在其中一个组中即可
+func groupRoleChanges(roles []model.Role, groups []string, groupRoles map[string]string) (grant, revoke []uint) {
+	granted := make(map[string]bool)
+	for _, group := range groups {
+		if role, ok := groupRoles[group]; ok {
+			granted[role] = true
+		}
+	}
+	for _, role := range roles {
+		if granted[role.Name] {
+			grant = append(grant, role.ID)
+		} else {
+			revoke = append(revoke, role.ID)
+		}
+	}
+	return grant, revoke
+}
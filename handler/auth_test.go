@@ -0,0 +1,48 @@
+package handler
+
+import (
+	"reflect"
+	"testing"
+
+	"git.blauwelle.com/go/crate/cmd/sso/model"
+)
+
+func TestGroupRoleChanges(t *testing.T) {
+	roles := []model.Role{
+		{Model: model.Model{ID: 1}, Name: "admin"},
+		{Model: model.Model{ID: 2}, Name: "developer"},
+	}
+	groupRoles := map[string]string{
+		"cn=admins,ou=groups,dc=example,dc=com": "admin",
+		"cn=devs,ou=groups,dc=example,dc=com":   "developer",
+		"cn=ops,ou=groups,dc=example,dc=com":    "developer",
+	}
+	tests := []struct {
+		name       string
+		groups     []string
+		wantGrant  []uint
+		wantRevoke []uint
+	}{
+		{"no groups", nil, nil, []uint{1, 2}},
+		{"one group", []string{"cn=admins,ou=groups,dc=example,dc=com"}, []uint{1}, []uint{2}},
+		{"shared role", []string{"cn=ops,ou=groups,dc=example,dc=com"}, []uint{2}, []uint{1}},
+		{
+			"all groups",
+			[]string{"cn=admins,ou=groups,dc=example,dc=com", "cn=devs,ou=groups,dc=example,dc=com", "cn=ops,ou=groups,dc=example,dc=com"},
+			[]uint{1, 2}, nil,
+		},
+		// 组名区分大小写，未映射的组不影响任何角色
+		{"unmapped group", []string{"CN=admins,ou=groups,dc=example,dc=com", "cn=other"}, nil, []uint{1, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			grant, revoke := groupRoleChanges(roles, tt.groups, groupRoles)
+			if !reflect.DeepEqual(grant, tt.wantGrant) {
+				t.Errorf("grant = %v, want %v", grant, tt.wantGrant)
+			}
+			if !reflect.DeepEqual(revoke, tt.wantRevoke) {
+				t.Errorf("revoke = %v, want %v", revoke, tt.wantRevoke)
+			}
+		})
+	}
+}
@@ -0,0 +1,334 @@
+package handler
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"git.blauwelle.com/go/crate/log"
+	"github.com/uptrace/bunrouter"
+	"gorm.io/gorm"
+
+	"git.blauwelle.com/go/crate/cmd/sso/model"
+	"git.blauwelle.com/go/crate/cmd/sso/util"
+)
+
+// CAS协议兼容接口，ticket与 SSOLogin 共用同一个存储，应用按service的site匹配
+
+const (
+	casTicketPrefix = "ST-"
+
+	casCodeInvalidRequest = "INVALID_REQUEST"
+	casCodeInvalidTicket  = "INVALID_TICKET"
+	casCodeInvalidService = "INVALID_SERVICE"
+	casCodeInternalError  = "INTERNAL_ERROR"
+	casCodeUnauthorized   = "UNAUTHORIZED_SERVICE"
+)
+
+// CASLogin /cas/login?service=...，已登录时签发service ticket并跳转回service
+func (h *Handler) CASLogin() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		query := r.URL.Query()
+		service := query.Get("service")
+		if service == "" {
+			return writeJSON(rw, http.StatusBadRequest, bunrouter.H{"error": casCodeInvalidRequest})
+		}
+		app, ok, err := findAppByService(service, h.db)
+		if err != nil {
+			log.Error(ctx, err.Error())
+			return writeJSON(rw, http.StatusInternalServerError, bunrouter.H{"error": casCodeInternalError})
+		}
+		if !ok {
+			return writeJSON(rw, http.StatusBadRequest, bunrouter.H{"error": casCodeInvalidService})
+		}
+
+		// 登录后回到不带renew的地址，否则renew会让已登录的用户不断跳转到登录页面
+		login := func() error {
+			if h.cfg.OIDC.LoginURL == "" {
+				log.Error(ctx, "cas login: oidc.loginURL is not configured")
+				return writeJSON(rw, http.StatusInternalServerError, bunrouter.H{"error": casCodeInternalError})
+			}
+			returnQuery := r.URL.Query()
+			returnQuery.Del("renew")
+			return h.redirectToLoginReturning(rw, r.Request, h.issuer()+r.URL.Path+"?"+returnQuery.Encode())
+		}
+
+		claims, ok := h.sessionClaims(r.Request)
+		if ok && query.Get("renew") == "true" {
+			ok = false
+		}
+		if !ok {
+			// gateway模式下不要求登录，直接回到service
+			if query.Get("gateway") == "true" {
+				http.Redirect(rw, r.Request, service, http.StatusFound)
+				return nil
+			}
+			return login()
+		}
+
+		id, err := strconv.Atoi(claims.Subject)
+		if err != nil {
+			return login()
+		}
+		user, ok, err := isExistUserByID(uint(id), h.db)
+		if err != nil {
+			return writeJSON(rw, http.StatusInternalServerError, bunrouter.H{"error": casCodeInternalError})
+		}
+		if !ok {
+			return login()
+		}
+		if ok, err := canAccessApp(ctx, h.db, app, user.ID); err != nil {
+			log.Error(ctx, err.Error())
+			return writeJSON(rw, http.StatusInternalServerError, bunrouter.H{"error": casCodeInternalError})
+		} else if !ok {
+			return writeJSON(rw, http.StatusForbidden, bunrouter.H{"error": casCodeUnauthorized})
+		}
+
+		ticket := casTicketPrefix + h.r.RandString(32)
+		if err := h.store.SetTicket(ctx, ticket, util.TicketInfo{
+			UserInfo: util.UserInfo{
+				ID:       user.ID,
+				Username: user.Username,
+			},
+			AppID:     app.ID,
+			Service:   service,
+			SessionID: claims.SessionID,
+		}); err != nil {
+			log.Error(ctx, err.Error())
+			return writeJSON(rw, http.StatusInternalServerError, bunrouter.H{"error": casCodeInternalError})
+		}
+
+		u, err := url.Parse(service)
+		if err != nil {
+			return writeJSON(rw, http.StatusBadRequest, bunrouter.H{"error": casCodeInvalidService})
+		}
+		params := u.Query()
+		params.Set("ticket", ticket)
+		u.RawQuery = params.Encode()
+		http.Redirect(rw, r.Request, u.String(), http.StatusFound)
+		return nil
+	}
+}
+
+// CASLogout /cas/logout?service=...，结束会话后跳转到已注册的service
+func (h *Handler) CASLogout() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		if claims, ok := h.sessionClaims(r.Request); ok {
+			if err := h.endSession(ctx, rw, claims); err != nil {
+				log.Error(ctx, err.Error())
+				return writeJSON(rw, http.StatusInternalServerError, bunrouter.H{"error": casCodeInternalError})
+			}
+		} else {
+			clearSessionCookies(rw)
+		}
+
+		service := r.URL.Query().Get("service")
+		if service != "" {
+			// 只允许跳转到已注册的应用，避免开放重定向
+			if _, ok, err := findAppByService(service, h.db); err == nil && ok {
+				http.Redirect(rw, r.Request, service, http.StatusFound)
+				return nil
+			}
+		}
+		return writeJSON(rw, http.StatusOK, bunrouter.H{"logout": true})
+	}
+}
+
+// CASServiceValidate CAS 2.0 /cas/serviceValidate，不返回属性
+func (h *Handler) CASServiceValidate() bunrouter.HandlerFunc {
+	return h.casValidate(false)
+}
+
+// CASP3ServiceValidate CAS 3.0 /cas/p3/serviceValidate，返回用户属性
+func (h *Handler) CASP3ServiceValidate() bunrouter.HandlerFunc {
+	return h.casValidate(true)
+}
+
+func (h *Handler) casValidate(releaseAttributes bool) bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		query := r.URL.Query()
+		format := query.Get("format")
+		service := query.Get("service")
+		ticket := query.Get("ticket")
+		if service == "" || ticket == "" {
+			return writeCASFailure(rw, format, casCodeInvalidRequest, "service and ticket are required")
+		}
+
+		app, ok, err := findAppByService(service, h.db)
+		if err != nil {
+			log.Error(ctx, err.Error())
+			return writeCASFailure(rw, format, casCodeInternalError, "")
+		}
+		if !ok {
+			return writeCASFailure(rw, format, casCodeInvalidService, "service is not registered")
+		}
+
+		// ticket无论校验是否通过都会被消耗
+		info, err := h.store.ConsumeTicket(ctx, ticket)
+		if err != nil {
+			if errors.Is(err, util.ErrTicketUsed) {
+				h.ticketStats.Replayed.Add(1)
+				log.Error(ctx, "cas ticket replay: app="+strconv.Itoa(int(app.ID)))
+			}
+			if errors.Is(err, util.ErrTicketUsed) || errors.Is(err, util.ErrTicketNotExists) {
+				return writeCASFailure(rw, format, casCodeInvalidTicket, "ticket "+ticket+" not recognized")
+			}
+			log.Error(ctx, err.Error())
+			return writeCASFailure(rw, format, casCodeInternalError, "")
+		}
+		if info.OIDC != nil || info.AppID != app.ID {
+			h.ticketStats.AppMismatch.Add(1)
+			return writeCASFailure(rw, format, casCodeInvalidTicket, "ticket was not issued for this service")
+		}
+		if info.Service != service {
+			h.ticketStats.ServiceMismatch.Add(1)
+			return writeCASFailure(rw, format, casCodeInvalidService, "service does not match ticket")
+		}
+		if ok, err := canAccessApp(ctx, h.db, app, info.ID); err != nil {
+			log.Error(ctx, err.Error())
+			return writeCASFailure(rw, format, casCodeInternalError, "")
+		} else if !ok {
+			return writeCASFailure(rw, format, casCodeUnauthorized, "user is not allowed to access this service")
+		}
+		if err := h.notifier.RecordSessionApp(ctx, info.SessionID, info.Username, info.ID, app.ID); err != nil {
+			log.Error(ctx, err.Error())
+		}
+
+		success := casAuthenticationSuccess{User: info.Username}
+		if releaseAttributes {
+			if success.Attributes, err = h.casAttributes(ctx, info); err != nil {
+				log.Error(ctx, err.Error())
+				return writeCASFailure(rw, format, casCodeInternalError, "")
+			}
+		}
+		return writeCASSuccess(rw, format, success)
+	}
+}
+
+// 释放给应用的用户属性
+func (h *Handler) casAttributes(ctx context.Context, info util.TicketInfo) (map[string][]string, error) {
+	attributes := map[string][]string{
+		"user_id":            {strconv.Itoa(int(info.ID))},
+		"username":           {info.Username},
+		"authenticationDate": {time.Now().UTC().Format(time.RFC3339)},
+	}
+	roles, err := appRoleNames(ctx, h.db, info.AppID, info.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(roles) > 0 {
+		attributes["roles"] = roles
+	}
+	return attributes, nil
+}
+
+type casAuthenticationSuccess struct {
+	User       string              `json:"user"`
+	Attributes map[string][]string `json:"attributes,omitempty"`
+}
+
+type casAuthenticationFailure struct {
+	Code        string `json:"code"`
+	Description string `json:"description"`
+}
+
+// XML格式的响应
+type casXMLServiceResponse struct {
+	XMLName xml.Name       `xml:"cas:serviceResponse"`
+	XMLNS   string         `xml:"xmlns:cas,attr"`
+	Success *casXMLSuccess `xml:"cas:authenticationSuccess,omitempty"`
+	Failure *casXMLFailure `xml:"cas:authenticationFailure,omitempty"`
+}
+
+type casXMLSuccess struct {
+	User       string            `xml:"cas:user"`
+	Attributes *casXMLAttributes `xml:"cas:attributes,omitempty"`
+}
+
+type casXMLAttributes struct {
+	Items []casXMLAttribute
+}
+
+type casXMLAttribute struct {
+	XMLName xml.Name
+	Value   string `xml:",chardata"`
+}
+
+type casXMLFailure struct {
+	Code        string `xml:"code,attr"`
+	Description string `xml:",chardata"`
+}
+
+func writeCASSuccess(rw http.ResponseWriter, format string, success casAuthenticationSuccess) error {
+	if format == "JSON" {
+		return writeJSON(rw, http.StatusOK, bunrouter.H{
+			"serviceResponse": bunrouter.H{"authenticationSuccess": success},
+		})
+	}
+	resp := casXMLServiceResponse{Success: &casXMLSuccess{User: success.User}}
+	if len(success.Attributes) > 0 {
+		attributes := &casXMLAttributes{}
+		for _, name := range sortedKeys(success.Attributes) {
+			for _, value := range success.Attributes[name] {
+				attributes.Items = append(attributes.Items, casXMLAttribute{
+					XMLName: xml.Name{Local: "cas:" + name},
+					Value:   value,
+				})
+			}
+		}
+		resp.Success.Attributes = attributes
+	}
+	return writeCASXML(rw, resp)
+}
+
+func writeCASFailure(rw http.ResponseWriter, format, code, description string) error {
+	if format == "JSON" {
+		return writeJSON(rw, http.StatusOK, bunrouter.H{
+			"serviceResponse": bunrouter.H{"authenticationFailure": casAuthenticationFailure{
+				Code:        code,
+				Description: description,
+			}},
+		})
+	}
+	return writeCASXML(rw, casXMLServiceResponse{Failure: &casXMLFailure{Code: code, Description: description}})
+}
+
+func writeCASXML(rw http.ResponseWriter, resp casXMLServiceResponse) error {
+	resp.XMLNS = "http://www.yale.edu/tp/cas"
+	rw.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	rw.WriteHeader(http.StatusOK)
+	enc := xml.NewEncoder(rw)
+	enc.Indent("", "  ")
+	return enc.Encode(resp)
+}
+
+// 根据service地址的site查找应用，与 SSOLogin 的匹配方式一致
+func findAppByService(service string, db *gorm.DB) (model.Application, bool, error) {
+	u, err := url.Parse(service)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return model.Application{}, false, nil
+	}
+	var app model.Application
+	DB := db.Find(&app, "site=?", u.Scheme+"://"+u.Host)
+	if DB.Error != nil || DB.RowsAffected != 1 {
+		return model.Application{}, false, DB.Error
+	}
+	return app, true, nil
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
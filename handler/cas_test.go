@@ -0,0 +1,142 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/uptrace/bunrouter"
+
+	"git.blauwelle.com/go/crate/cmd/sso/constants"
+)
+
+const testCASService = "https://web.example.com/cas"
+
+// casLogin 访问 /cas/login，withSession为true时带上会话cookie
+func (pt *protocolTest) casLogin(params url.Values, withSession bool) *httptest.ResponseRecorder {
+	pt.t.Helper()
+	req := httptest.NewRequest("GET", "/cas/login?"+params.Encode(), nil)
+	if withSession {
+		req.AddCookie(&http.Cookie{Name: constants.SessionCookieName, Value: pt.session})
+	}
+	rw := httptest.NewRecorder()
+	if err := pt.h.CASLogin()(rw, bunrouter.NewRequest(req)); err != nil {
+		pt.t.Fatal(err)
+	}
+	return rw
+}
+
+// casValidate 调用 /cas/p3/serviceValidate，返回JSON格式的结果
+func (pt *protocolTest) casValidate(service, ticket string) (casAuthenticationSuccess, casAuthenticationFailure) {
+	pt.t.Helper()
+	params := url.Values{"service": {service}, "ticket": {ticket}, "format": {"JSON"}}
+	req := httptest.NewRequest("GET", "/cas/p3/serviceValidate?"+params.Encode(), nil)
+	rw := httptest.NewRecorder()
+	if err := pt.h.CASP3ServiceValidate()(rw, bunrouter.NewRequest(req)); err != nil {
+		pt.t.Fatal(err)
+	}
+	var resp struct {
+		ServiceResponse struct {
+			Success casAuthenticationSuccess `json:"authenticationSuccess"`
+			Failure casAuthenticationFailure `json:"authenticationFailure"`
+		} `json:"serviceResponse"`
+	}
+	if err := json.Unmarshal(rw.Body.Bytes(), &resp); err != nil {
+		pt.t.Fatal(err)
+	}
+	return resp.ServiceResponse.Success, resp.ServiceResponse.Failure
+}
+
+func redirectLocation(t *testing.T, rw *httptest.ResponseRecorder) *url.URL {
+	t.Helper()
+	if rw.Code != http.StatusFound {
+		t.Fatalf("status = %d, body = %s", rw.Code, rw.Body)
+	}
+	location, err := url.Parse(rw.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return location
+}
+
+func TestCASLoginAndValidate(t *testing.T) {
+	pt := newProtocolTest(t)
+	location := redirectLocation(t, pt.casLogin(url.Values{"service": {testCASService}}, true))
+	ticket := location.Query().Get("ticket")
+	if location.Host != "web.example.com" || ticket == "" {
+		t.Fatalf("redirect = %s", location)
+	}
+
+	success, failure := pt.casValidate(testCASService, ticket)
+	if success.User != "alice" || failure.Code != "" {
+		t.Fatalf("validate = %+v %+v", success, failure)
+	}
+	if got := success.Attributes["user_id"]; len(got) != 1 || got[0] != "7" {
+		t.Errorf("attributes = %v", success.Attributes)
+	}
+	// ticket只能使用一次
+	if _, failure := pt.casValidate(testCASService, ticket); failure.Code != casCodeInvalidTicket {
+		t.Errorf("replay = %+v", failure)
+	}
+}
+
+func TestCASValidateRejected(t *testing.T) {
+	tests := []struct {
+		name     string
+		service  string
+		wantCode string
+	}{
+		{"other path of same site", "https://web.example.com/other", casCodeInvalidService},
+		{"other app", "https://spa.example.com/cas", casCodeInvalidTicket},
+		{"unknown service", "https://unknown.example.com/cas", casCodeInvalidService},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pt := newProtocolTest(t)
+			location := redirectLocation(t, pt.casLogin(url.Values{"service": {testCASService}}, true))
+			success, failure := pt.casValidate(tt.service, location.Query().Get("ticket"))
+			if success.User != "" || failure.Code != tt.wantCode {
+				t.Errorf("validate = %+v %+v, want %s", success, failure, tt.wantCode)
+			}
+		})
+	}
+}
+
+// renew=true时跳转到登录页面，登录后回到不带renew的地址并签发ticket，不会循环跳转
+func TestCASLoginRenew(t *testing.T) {
+	pt := newProtocolTest(t)
+	pt.h.cfg.OIDC.LoginURL = "https://login.example.com/"
+	location := redirectLocation(t, pt.casLogin(url.Values{"service": {testCASService}, "renew": {"true"}}, true))
+	if location.Host != "login.example.com" {
+		t.Fatalf("redirect = %s", location)
+	}
+	returnTo, err := url.Parse(location.Query().Get("redirect"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if returnTo.Scheme+"://"+returnTo.Host != testIssuer || returnTo.Path != "/cas/login" ||
+		returnTo.Query().Get("renew") != "" || returnTo.Query().Get("service") != testCASService {
+		t.Fatalf("return to = %s", returnTo)
+	}
+
+	location = redirectLocation(t, pt.casLogin(returnTo.Query(), true))
+	if location.Host != "web.example.com" || location.Query().Get("ticket") == "" {
+		t.Errorf("redirect after login = %s", location)
+	}
+}
+
+// 未配置登录页面时返回错误，不能不带ticket跳转回service；gateway模式除外
+func TestCASLoginWithoutLoginURL(t *testing.T) {
+	pt := newProtocolTest(t)
+	rw := pt.casLogin(url.Values{"service": {testCASService}}, false)
+	if rw.Code != http.StatusInternalServerError || rw.Header().Get("Location") != "" {
+		t.Errorf("login = %d %s", rw.Code, rw.Header().Get("Location"))
+	}
+
+	location := redirectLocation(t, pt.casLogin(url.Values{"service": {testCASService}, "gateway": {"true"}}, false))
+	if location.String() != testCASService {
+		t.Errorf("gateway redirect = %s", location)
+	}
+}
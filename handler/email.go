@@ -0,0 +1,292 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"git.blauwelle.com/go/crate/log"
+	"github.com/uptrace/bunrouter"
+	"gorm.io/gorm"
+
+	"git.blauwelle.com/go/crate/cmd/sso/model"
+	"git.blauwelle.com/go/crate/cmd/sso/response"
+	"git.blauwelle.com/go/crate/cmd/sso/util"
+)
+
+// 同一用户两次发送验证邮件的最小间隔
+const emailVerificationInterval = time.Minute
+
+var (
+	errEmailTokenInvalid            = errors.New("email token invalid")
+	errEmailVerificationTooFrequent = errors.New("email verification sent too frequently")
+)
+
+type UpdateEmailRequest struct {
+	Email string `json:"email"` // 为空时删除邮箱
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+// UpdateEmail 修改当前用户的邮箱，修改后需重新验证，验证邮件随即发送
+func (h *Handler) UpdateEmail() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request UpdateEmailRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		userID, err := currentUserID(ctx)
+		if err != nil {
+			return err
+		}
+		var email *string
+		if request.Email != "" {
+			normalized, ok := normalizeEmail(request.Email)
+			if !ok {
+				return response.Error(rw, response.MessageEmailInvalid, bunrouter.H{})
+			}
+			existing, ok, err := isExistUserByEmail(normalized, h.db)
+			if err != nil {
+				return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+			}
+			if ok && existing.ID != userID {
+				return response.Error(rw, response.MessageEmailExist, bunrouter.H{})
+			}
+			// 邮箱没有变化时保留验证状态
+			if ok {
+				return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
+			}
+			email = &normalized
+			// 在修改之前检查发送频率，否则反复修改邮箱可以向任意地址发送邮件
+			if err := h.checkEmailVerificationInterval(ctx, userID); err != nil {
+				return h.writeMailError(ctx, rw, err)
+			}
+		}
+		if result := h.db.WithContext(ctx).Model(&model.User{}).Where("id = ?", userID).
+			Updates(map[string]interface{}{"email": email, "email_verified_at": nil}); result.Error != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		// 旧邮箱的验证链接失效，记录保留用于计算发送频率
+		if err := h.db.WithContext(ctx).Model(&model.EmailVerification{}).
+			Where("user_id = ? AND used_at IS NULL", userID).Update("expires_at", time.Now()).Error; err != nil {
+			log.Error(ctx, err.Error())
+		}
+		if email == nil {
+			return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
+		}
+		user, _, err := isExistUserByID(userID, h.db)
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if err := h.sendEmailVerification(ctx, user); err != nil {
+			return h.writeMailError(ctx, rw, err)
+		}
+		return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
+	}
+}
+
+// SendEmailVerification 重新发送验证邮件
+func (h *Handler) SendEmailVerification() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		userID, err := currentUserID(ctx)
+		if err != nil {
+			return err
+		}
+		user, ok, err := isExistUserByID(userID, h.db)
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if !ok {
+			return response.Error(rw, response.MessageUserNotExist, bunrouter.H{})
+		}
+		if user.Email == nil {
+			return response.Error(rw, response.MessageEmailNotSet, bunrouter.H{})
+		}
+		if user.EmailVerifiedAt != nil {
+			return response.Error(rw, response.MessageEmailAlreadyVerified, bunrouter.H{})
+		}
+		if err := h.sendEmailVerification(ctx, user); err != nil {
+			return h.writeMailError(ctx, rw, err)
+		}
+		return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
+	}
+}
+
+// VerifyEmail 使用邮件中的token完成验证，不需要登录
+func (h *Handler) VerifyEmail() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request VerifyEmailRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		now := time.Now()
+		var verification model.EmailVerification
+		DB := h.db.WithContext(ctx).Where("token_hash = ? AND used_at IS NULL AND expires_at > ?",
+			hashMailToken(request.Token), now).Find(&verification)
+		if DB.Error != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if DB.RowsAffected != 1 {
+			return response.Error(rw, response.MessageEmailTokenInvalid, bunrouter.H{})
+		}
+		err := h.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			DB := tx.Model(&model.EmailVerification{}).
+				Where("id = ? AND used_at IS NULL", verification.ID).Update("used_at", now)
+			if DB.Error != nil {
+				return DB.Error
+			}
+			if DB.RowsAffected != 1 {
+				return errEmailTokenInvalid
+			}
+			// 发送之后邮箱已被修改时不能验证
+			DB = tx.Model(&model.User{}).Where("id = ? AND email = ?", verification.UserID, verification.Email).
+				Update("email_verified_at", now)
+			if DB.Error != nil {
+				return DB.Error
+			}
+			if DB.RowsAffected != 1 {
+				return errEmailTokenInvalid
+			}
+			return nil
+		})
+		if errors.Is(err, errEmailTokenInvalid) {
+			return response.Error(rw, response.MessageEmailTokenInvalid, bunrouter.H{})
+		}
+		if err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
+	}
+}
+
+func (h *Handler) sendEmailVerification(ctx context.Context, user model.User) error {
+	if err := h.checkEmailVerificationInterval(ctx, user.ID); err != nil {
+		return err
+	}
+	now := time.Now()
+	if err := h.db.WithContext(ctx).Where("user_id = ? AND used_at IS NULL", user.ID).
+		Delete(&model.EmailVerification{}).Error; err != nil {
+		return err
+	}
+	token := h.r.RandString(32)
+	ttl := time.Duration(h.cfg.Mail.VerifyTTL) * time.Second
+	if err := h.db.WithContext(ctx).Create(&model.EmailVerification{
+		TokenHash: hashMailToken(token),
+		UserID:    user.ID,
+		Email:     *user.Email,
+		ExpiresAt: now.Add(ttl),
+	}).Error; err != nil {
+		return err
+	}
+
+	link, err := mailLink(h.cfg.Mail.VerifyURL, h.cfg.OIDC.LoginURL, "token", token)
+	if err != nil {
+		return err
+	}
+	return h.mailer.Send(ctx, util.Mail{
+		To:      []string{*user.Email},
+		Subject: "验证邮箱",
+		Body: "你好 " + user.Username + "，\n\n" +
+			"请在" + ttl.String() + "内打开以下链接验证邮箱：\n\n" +
+			link + "\n\n" +
+			"如果不是你本人的操作，请忽略这封邮件。\n",
+	})
+}
+
+// 距离上次发送验证邮件不足emailVerificationInterval时返回 errEmailVerificationTooFrequent
+func (h *Handler) checkEmailVerificationInterval(ctx context.Context, userID uint) error {
+	var recent int64
+	if err := h.db.WithContext(ctx).Model(&model.EmailVerification{}).
+		Where("user_id = ? AND created_at > ?", userID, time.Now().Add(-emailVerificationInterval)).
+		Count(&recent).Error; err != nil {
+		return err
+	}
+	if recent > 0 {
+		return errEmailVerificationTooFrequent
+	}
+	return nil
+}
+
+func (h *Handler) writeMailError(ctx context.Context, rw http.ResponseWriter, err error) error {
+	if errors.Is(err, errEmailVerificationTooFrequent) {
+		return response.Error(rw, response.MessageMailTooFrequent, bunrouter.H{"retry_after": int(emailVerificationInterval.Seconds())})
+	}
+	log.Error(ctx, "send mail: "+err.Error())
+	return response.Error(rw, response.MessageMailError, bunrouter.H{})
+}
+
+// 登录名可以是用户名或登录的组织中已验证的邮箱，邮箱对应的用户不存在时原样返回
+func (h *Handler) resolveLoginName(ctx context.Context, name string, organizationID uint) (string, error) {
+	if !strings.Contains(name, "@") {
+		return name, nil
+	}
+	// 已验证的邮箱优先，之前创建的包含@的用户名不能冒充其他用户的邮箱
+	email, ok := normalizeEmail(name)
+	if !ok {
+		return name, nil
+	}
+	var user model.User
+	DB := h.db.WithContext(ctx).
+		Where("email = ? AND email_verified_at IS NOT NULL AND organization_id = ?", email, organizationID).Find(&user)
+	if DB.Error != nil {
+		return "", DB.Error
+	}
+	if DB.RowsAffected != 1 {
+		return name, nil
+	}
+	return user.Username, nil
+}
+
+// 邮件中的链接，page为空时使用登录页面
+func mailLink(page, fallback, param, value string) (string, error) {
+	if page == "" {
+		page = fallback
+	}
+	u, err := url.Parse(page)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Set(param, value)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// 邮箱统一保存为小写，不允许带显示名称
+func normalizeEmail(email string) (string, bool) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || len(email) > 255 {
+		return "", false
+	}
+	return email, true
+}
+
+func isExistUserByEmail(email string, db *gorm.DB) (model.User, bool, error) {
+	var user model.User
+	DB := db.Where("email = ?", email).Find(&user)
+	if DB.Error != nil || DB.RowsAffected != 1 {
+		return model.User{}, false, DB.Error
+	}
+	return user, true, nil
+}
+
+func hashMailToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,42 @@
+package handler
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"testing"
+
+	"git.blauwelle.com/go/crate/cmd/sso/config"
+	"git.blauwelle.com/go/crate/cmd/sso/util"
+)
+
+func TestResolveLoginName(t *testing.T) {
+	// 组织2的用户bob验证了邮箱bob@example.com，查询中有组织条件时才按组织过滤
+	gdb := openFakeDB(t, func(q string, args []driver.Value) ([]string, [][]driver.Value, int64) {
+		if strings.HasPrefix(q, "SELECT * FROM `users` WHERE (email = ? AND email_verified_at IS NOT NULL") && args[0] == "bob@example.com" &&
+			(!strings.Contains(q, "organization_id = ?") || args[1] == int64(2)) {
+			return []string{"id", "organization_id", "username"}, [][]driver.Value{{int64(8), int64(2), "bob"}}, 0
+		}
+		return []string{"id"}, nil, 0
+	})
+	h := NewHandler(config.Config{}, gdb, util.NewMemoryStore(0), nil, util.NewRevocationList(gdb), nil, nil, nil, nil)
+	tests := []struct {
+		name           string
+		login          string
+		organizationID uint
+		want           string
+	}{
+		{"username", "bob", 2, "bob"},
+		{"verified email", "Bob@Example.com", 2, "bob"},
+		{"email in other organization", "bob@example.com", 1, "bob@example.com"},
+		{"unknown email", "carol@example.com", 2, "carol@example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := h.resolveLoginName(context.Background(), tt.login, tt.organizationID)
+			if err != nil || got != tt.want {
+				t.Errorf("got %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
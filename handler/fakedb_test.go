@@ -0,0 +1,125 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"regexp"
+	"strings"
+	"testing"
+
+	gormmysql "gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// fakeQuery 处理一条SQL语句，返回查询结果的列和行，或者修改的行数
+type fakeQuery func(q string, args []driver.Value) (columns []string, rows [][]driver.Value, affected int64)
+
+// fakeFailure 返回非nil时语句执行失败，用于模拟数据库返回的错误
+type fakeFailure func(q string, args []driver.Value) error
+
+// openFakeDB 使用只把语句交给query处理的database/sql驱动，测试只需模拟涉及的表
+// 语句为gorm按MySQL生成的SQL
+func openFakeDB(t *testing.T, query fakeQuery) *gorm.DB {
+	t.Helper()
+	return openFailingFakeDB(t, query, func(string, []driver.Value) error { return nil })
+}
+
+// openFailingFakeDB 与 openFakeDB 相同，fail返回错误的语句不再交给query处理
+func openFailingFakeDB(t *testing.T, query fakeQuery, fail fakeFailure) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(gormmysql.New(gormmysql.Config{
+		Conn:                      sql.OpenDB(fakeConnector{query: query, fail: fail}),
+		SkipInitializeWithVersion: true,
+	}), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// gorm生成的INSERT和UPDATE语句中列的顺序与参数的顺序一致
+var (
+	insertColumnsPattern = regexp.MustCompile("INSERT INTO `\\w+` \\(([^)]*)\\)")
+	setColumnsPattern    = regexp.MustCompile("SET (.*) WHERE")
+)
+
+// insertedColumns 按列名取出只插入一行的INSERT语句的参数
+func insertedColumns(q string, args []driver.Value) map[string]driver.Value {
+	values := make(map[string]driver.Value)
+	for i, column := range strings.Split(insertColumnsPattern.FindStringSubmatch(q)[1], ",") {
+		values[strings.Trim(column, "`")] = args[i]
+	}
+	return values
+}
+
+type fakeConnector struct {
+	query fakeQuery
+	fail  fakeFailure
+}
+
+func (c fakeConnector) Connect(context.Context) (driver.Conn, error) { return fakeConn(c), nil }
+func (c fakeConnector) Driver() driver.Driver                        { return nil }
+
+type fakeConn struct {
+	query fakeQuery
+	fail  fakeFailure
+}
+
+func (c fakeConn) Prepare(string) (driver.Stmt, error) { return nil, driver.ErrSkip }
+func (c fakeConn) Close() error                        { return nil }
+func (c fakeConn) Begin() (driver.Tx, error)           { return fakeTx{}, nil }
+
+func (c fakeConn) ExecContext(_ context.Context, q string, args []driver.NamedValue) (driver.Result, error) {
+	if err := c.fail(q, values(args)); err != nil {
+		return nil, err
+	}
+	_, _, n := c.query(q, values(args))
+	return fakeResult(n), nil
+}
+
+func (c fakeConn) QueryContext(_ context.Context, q string, args []driver.NamedValue) (driver.Rows, error) {
+	if err := c.fail(q, values(args)); err != nil {
+		return nil, err
+	}
+	columns, rows, _ := c.query(q, values(args))
+	return &fakeRows{columns: columns, rows: rows}, nil
+}
+
+func values(args []driver.NamedValue) []driver.Value {
+	v := make([]driver.Value, len(args))
+	for i, arg := range args {
+		v[i] = arg.Value
+	}
+	return v
+}
+
+// 插入的记录ID由测试分配，gorm只在LastInsertId返回非0时回填
+type fakeResult int64
+
+func (r fakeResult) LastInsertId() (int64, error) { return 0, nil }
+func (r fakeResult) RowsAffected() (int64, error) { return int64(r), nil }
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
@@ -0,0 +1,659 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"git.blauwelle.com/go/crate/log"
+	"github.com/uptrace/bunrouter"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"git.blauwelle.com/go/crate/cmd/sso/middleware"
+	"git.blauwelle.com/go/crate/cmd/sso/model"
+	"git.blauwelle.com/go/crate/cmd/sso/response"
+)
+
+var (
+	errGroupNotExist = errors.New("group not exist")
+	errGroupCycle    = errors.New("group cycle")
+)
+
+type CreateGroupRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+type UpdateGroupRequest struct {
+	ID          uint   `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+type DeleteGroupRequest struct {
+	ID uint `json:"id"`
+}
+
+type GroupMemberRequest struct {
+	GroupID uint `json:"group_id"`
+	UserID  uint `json:"user_id"`
+}
+
+type GroupSubgroupRequest struct {
+	GroupID uint `json:"group_id"`
+	ChildID uint `json:"child_id"`
+}
+
+type GroupRoleRequest struct {
+	GroupID uint `json:"group_id"`
+	RoleID  uint `json:"role_id"`
+}
+
+func (h *Handler) CreateGroup() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request CreateGroupRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		request.Name = strings.TrimSpace(request.Name)
+		if request.Name == "" || len(request.Name) > 64 {
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		_, ok, err := isExistGroupByName(request.Name, h.tenant(ctx))
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if ok {
+			return response.Error(rw, response.MessageGroupExist, bunrouter.H{})
+		}
+		group := model.Group{OrganizationID: currentOrganizationID(ctx), Name: request.Name, Description: request.Description}
+		if err := h.db.WithContext(ctx).Create(&group).Error; err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, bunrouter.H{"id": group.ID})
+	}
+}
+
+func (h *Handler) SearchGroup() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		pageSize := r.URL.Query().Get("pageSize")
+		name := r.URL.Query().Get("name")
+		page := r.URL.Query().Get("page")
+		// 设置默认每页记录数
+		defaultPageSize := 20
+
+		groups := []model.Group{}
+		var count int64
+
+		query := h.tenant(r.Context()).Model(&model.Group{})
+		if name != "" {
+			query = query.Where("name LIKE ?", "%"+name+"%")
+		}
+		if dbCount := query.Count(&count); dbCount.Error != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+
+		pageSizeInt, err := strconv.Atoi(pageSize)
+		pageInt, _ := strconv.Atoi(page)
+		if err != nil || pageSizeInt <= 0 {
+			pageSizeInt = defaultPageSize
+		}
+		if count == 0 {
+			return response.WriteOK(rw, response.MessageOK, response.NewPaginationData(pageInt, pageSizeInt, groups))
+		}
+		offset, err := calculateOffset(page, pageSizeInt, count)
+		if err != nil {
+			return response.Error(rw, response.MessageCalculateOffset, bunrouter.H{})
+		}
+		if dbFind := query.Order("name").Offset(offset).Limit(pageSizeInt).Find(&groups); dbFind.Error != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, response.NewPaginationData(pageInt, pageSizeInt, groups))
+	}
+}
+
+func (h *Handler) UpdateGroup() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request UpdateGroupRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		request.Name = strings.TrimSpace(request.Name)
+		if request.Name == "" || len(request.Name) > 64 {
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		group, ok, err := isExistGroupByID(request.ID, h.tenant(ctx))
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if !ok {
+			return response.Error(rw, response.MessageGroupNotExist, bunrouter.H{})
+		}
+		if request.Name != group.Name {
+			_, exist, err := isExistGroupByName(request.Name, h.tenant(ctx))
+			if err != nil {
+				return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+			}
+			if exist {
+				return response.Error(rw, response.MessageGroupExist, bunrouter.H{})
+			}
+		}
+		if err := h.db.WithContext(ctx).Model(&model.Group{}).Where("id = ?", group.ID).Updates(map[string]interface{}{
+			"name":        request.Name,
+			"description": request.Description,
+		}).Error; err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
+	}
+}
+
+// DeleteGroup 同时移除组的成员、嵌套关系、角色和应用访问设置，子组本身保留
+// 组及其子组的成员失去组的角色，会话全部失效
+func (h *Handler) DeleteGroup() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request DeleteGroupRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		if err := h.checkGroupGrant(ctx, request.ID); err != nil {
+			return h.writeRoleError(ctx, rw, err)
+		}
+		var members []uint
+		if err := h.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			// 删除前取出受影响的成员
+			var err error
+			if members, err = groupMemberIDs(ctx, tx, request.ID); err != nil {
+				return err
+			}
+			for _, table := range []interface{}{&model.GroupMember{}, &model.GroupRole{}, &model.GroupAppRole{}, &model.AppAccessGroup{}} {
+				if err := tx.Where("group_id = ?", request.ID).Delete(table).Error; err != nil {
+					return err
+				}
+			}
+			if err := tx.Where("parent_id = ? OR child_id = ?", request.ID, request.ID).Delete(&model.GroupSubgroup{}).Error; err != nil {
+				return err
+			}
+			// 直接删除记录，组名可以重新使用
+			return tx.Unscoped().Delete(&model.Group{}, "id = ?", request.ID).Error
+		}); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if err := h.revokeUsersTokens(ctx, members); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
+	}
+}
+
+// AddGroupMember 成员获得组及其上级组的角色，只能加入权限不超过当前用户的组
+func (h *Handler) AddGroupMember() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request GroupMemberRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		if err := h.checkGroupMember(ctx, request); err != nil {
+			return h.writeRoleError(ctx, rw, err)
+		}
+		if err := h.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&model.GroupMember{GroupID: request.GroupID, UserID: request.UserID}).Error; err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
+	}
+}
+
+// RemoveGroupMember 移出组后用户的会话全部失效
+func (h *Handler) RemoveGroupMember() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request GroupMemberRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		if err := h.checkGroupMember(ctx, request); err != nil {
+			return h.writeRoleError(ctx, rw, err)
+		}
+		DB := h.db.WithContext(ctx).Delete(&model.GroupMember{}, "group_id = ? AND user_id = ?", request.GroupID, request.UserID)
+		if DB.Error != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if DB.RowsAffected == 0 {
+			return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
+		}
+		if err := h.revokeUserTokens(ctx, request.UserID); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
+	}
+}
+
+// SearchGroupMember 直接属于组的用户，分页
+func (h *Handler) SearchGroupMember() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		groupID, err := strconv.Atoi(r.URL.Query().Get("group_id"))
+		if err != nil {
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		pageSize := r.URL.Query().Get("pageSize")
+		page := r.URL.Query().Get("page")
+		// 设置默认每页记录数
+		defaultPageSize := 20
+
+		users := []model.User{}
+		var count int64
+
+		query := h.tenant(r.Context()).Model(&model.User{}).
+			Joins("JOIN group_members ON group_members.user_id = users.id").
+			Where("group_members.group_id = ?", groupID)
+		if dbCount := query.Count(&count); dbCount.Error != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+
+		pageSizeInt, err := strconv.Atoi(pageSize)
+		pageInt, _ := strconv.Atoi(page)
+		if err != nil || pageSizeInt <= 0 {
+			pageSizeInt = defaultPageSize
+		}
+		if count == 0 {
+			return response.WriteOK(rw, response.MessageOK, response.NewPaginationData(pageInt, pageSizeInt, users))
+		}
+		offset, err := calculateOffset(page, pageSizeInt, count)
+		if err != nil {
+			return response.Error(rw, response.MessageCalculateOffset, bunrouter.H{})
+		}
+		if dbFind := query.Order("users.id").Offset(offset).Limit(pageSizeInt).
+			Select("users.id, users.created_at, users.updated_at, users.username, users.email, users.email_verified_at").
+			Find(&users); dbFind.Error != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, response.NewPaginationData(pageInt, pageSizeInt, users))
+	}
+}
+
+// AddSubgroup 子组的成员获得上级组的角色，不允许形成环
+func (h *Handler) AddSubgroup() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request GroupSubgroupRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		if err := h.checkSubgroup(ctx, request); err != nil {
+			return h.writeRoleError(ctx, rw, err)
+		}
+		if err := h.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			// 锁定读到的嵌套关系，避免并发添加相反的关系时都通过检查而形成环
+			locked := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Session(&gorm.Session{})
+			ancestors, err := middleware.GroupAncestorIDs(ctx, locked, []uint{request.GroupID})
+			if err != nil {
+				return err
+			}
+			for _, id := range ancestors {
+				if id == request.ChildID {
+					return errGroupCycle
+				}
+			}
+			return tx.Clauses(clause.OnConflict{DoNothing: true}).
+				Create(&model.GroupSubgroup{ParentID: request.GroupID, ChildID: request.ChildID}).Error
+		}); err != nil {
+			return h.writeRoleError(ctx, rw, err)
+		}
+		return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
+	}
+}
+
+// RemoveSubgroup 子组及其下级组的成员失去上级组的角色，会话全部失效
+func (h *Handler) RemoveSubgroup() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request GroupSubgroupRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		if err := h.checkSubgroup(ctx, request); err != nil {
+			return h.writeRoleError(ctx, rw, err)
+		}
+		DB := h.db.WithContext(ctx).Delete(&model.GroupSubgroup{},
+			"parent_id = ? AND child_id = ?", request.GroupID, request.ChildID)
+		if DB.Error != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if DB.RowsAffected == 0 {
+			return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
+		}
+		if err := h.revokeGroupMembers(ctx, request.ChildID); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
+	}
+}
+
+// SearchSubgroup 组的直接子组
+func (h *Handler) SearchSubgroup() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		groupID, err := strconv.Atoi(r.URL.Query().Get("group_id"))
+		if err != nil {
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		groups := []model.Group{}
+		if err := h.tenant(r.Context()).
+			Joins("JOIN group_subgroups ON group_subgroups.child_id = groups.id").
+			Where("group_subgroups.parent_id = ?", groupID).Order("groups.name").Find(&groups).Error; err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, groups)
+	}
+}
+
+// AddGroupRole 为组分配角色，只能分配当前用户拥有的权限
+func (h *Handler) AddGroupRole() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request GroupRoleRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		if err := h.checkGroupRole(ctx, request); err != nil {
+			return h.writeRoleError(ctx, rw, err)
+		}
+		if err := h.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&model.GroupRole{GroupID: request.GroupID, RoleID: request.RoleID}).Error; err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
+	}
+}
+
+// RemoveGroupRole 组及其子组的成员失去该角色，会话全部失效
+func (h *Handler) RemoveGroupRole() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request GroupRoleRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		if err := h.checkGroupRole(ctx, request); err != nil {
+			return h.writeRoleError(ctx, rw, err)
+		}
+		DB := h.db.WithContext(ctx).Delete(&model.GroupRole{},
+			"group_id = ? AND role_id = ?", request.GroupID, request.RoleID)
+		if DB.Error != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if DB.RowsAffected == 0 {
+			return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
+		}
+		if err := h.revokeGroupMembers(ctx, request.GroupID); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
+	}
+}
+
+// SearchGroupRole 直接分配给组的角色
+func (h *Handler) SearchGroupRole() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		groupID, err := strconv.Atoi(r.URL.Query().Get("group_id"))
+		if err != nil {
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		roles := []model.Role{}
+		if err := h.tenant(r.Context()).
+			Joins("JOIN group_roles ON group_roles.role_id = roles.id").
+			Where("group_roles.group_id = ?", groupID).Order("roles.name").Find(&roles).Error; err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, roles)
+	}
+}
+
+// AddGroupAppRole 为组分配应用角色
+func (h *Handler) AddGroupAppRole() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request GroupRoleRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		_, ok, err := isExistGroupByID(request.GroupID, h.tenant(ctx))
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if !ok {
+			return response.Error(rw, response.MessageGroupNotExist, bunrouter.H{})
+		}
+		_, ok, err = isExistAppRoleByID(request.RoleID, h.tenantAppRoles(ctx))
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if !ok {
+			return response.Error(rw, response.MessageAppRoleNotExist, bunrouter.H{})
+		}
+		if err := h.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&model.GroupAppRole{GroupID: request.GroupID, AppRoleID: request.RoleID}).Error; err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
+	}
+}
+
+func (h *Handler) RemoveGroupAppRole() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request GroupRoleRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		_, ok, err := isExistGroupByID(request.GroupID, h.tenant(ctx))
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if !ok {
+			return response.Error(rw, response.MessageGroupNotExist, bunrouter.H{})
+		}
+		if err := h.db.WithContext(ctx).Delete(&model.GroupAppRole{},
+			"group_id = ? AND app_role_id = ?", request.GroupID, request.RoleID).Error; err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
+	}
+}
+
+// SearchGroupAppRole 直接分配给组的应用角色
+func (h *Handler) SearchGroupAppRole() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		groupID, err := strconv.Atoi(r.URL.Query().Get("group_id"))
+		if err != nil {
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		roles := []model.AppRole{}
+		if err := h.db.WithContext(r.Context()).
+			Joins("JOIN group_app_roles ON group_app_roles.app_role_id = app_roles.id").
+			Where("group_app_roles.group_id = ? AND app_roles.app_id IN (?)", groupID, h.tenantAppIDs(r.Context())).
+			Order("app_roles.app_id, app_roles.name").Find(&roles).Error; err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, roles)
+	}
+}
+
+// SearchUserGroup 用户所在的组，包括通过子组间接所在的上级组
+func (h *Handler) SearchUserGroup() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		userID, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil {
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		groupIDs, err := middleware.UserGroupIDs(ctx, h.db, uint(userID))
+		if err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		groups := []model.Group{}
+		if len(groupIDs) > 0 {
+			if err := h.tenant(ctx).Where("id IN ?", groupIDs).Order("name").Find(&groups).Error; err != nil {
+				return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+			}
+		}
+		return response.WriteOK(rw, response.MessageOK, groups)
+	}
+}
+
+func (h *Handler) checkGroupMember(ctx context.Context, request GroupMemberRequest) error {
+	_, ok, err := isExistUserByID(request.UserID, h.tenant(ctx))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errUserNotExist
+	}
+	return h.checkGroupGrant(ctx, request.GroupID)
+}
+
+// 子组的成员获得上级组的权限，按上级组检查
+func (h *Handler) checkSubgroup(ctx context.Context, request GroupSubgroupRequest) error {
+	if request.GroupID == request.ChildID {
+		return errGroupCycle
+	}
+	_, ok, err := isExistGroupByID(request.ChildID, h.tenant(ctx))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errGroupNotExist
+	}
+	return h.checkGroupGrant(ctx, request.GroupID)
+}
+
+func (h *Handler) checkGroupRole(ctx context.Context, request GroupRoleRequest) error {
+	_, ok, err := isExistGroupByID(request.GroupID, h.tenant(ctx))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errGroupNotExist
+	}
+	_, ok, err = isExistRoleByID(request.RoleID, h.tenant(ctx))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errRoleNotExist
+	}
+	permissions, err := rolePermissions(ctx, h.db, []uint{request.RoleID})
+	if err != nil {
+		return err
+	}
+	return h.checkGrant(ctx, permissions[request.RoleID])
+}
+
+// 组及其上级组的角色提供的权限都必须是当前用户拥有的
+func (h *Handler) checkGroupGrant(ctx context.Context, groupID uint) error {
+	_, ok, err := isExistGroupByID(groupID, h.tenant(ctx))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errGroupNotExist
+	}
+	groupIDs, err := middleware.GroupAncestorIDs(ctx, h.db, []uint{groupID})
+	if err != nil {
+		return err
+	}
+	var roleIDs []uint
+	if err := h.db.WithContext(ctx).Model(&model.GroupRole{}).
+		Where("group_id IN ?", groupIDs).Distinct().Pluck("role_id", &roleIDs).Error; err != nil {
+		return err
+	}
+	permissions, err := rolePermissions(ctx, h.db, roleIDs)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, list := range permissions {
+		names = append(names, list...)
+	}
+	return h.checkGrant(ctx, names)
+}
+
+// 撤销组及其全部子组成员的会话，组的角色或嵌套关系变化后成员的权限随之变化
+func (h *Handler) revokeGroupMembers(ctx context.Context, groupID uint) error {
+	members, err := groupMemberIDs(ctx, h.db, groupID)
+	if err != nil {
+		return err
+	}
+	return h.revokeUsersTokens(ctx, members)
+}
+
+func (h *Handler) revokeUsersTokens(ctx context.Context, userIDs []uint) error {
+	for _, userID := range userIDs {
+		if err := h.revokeUserTokens(ctx, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 直接属于组及其全部子组的用户
+func groupMemberIDs(ctx context.Context, db *gorm.DB, groupID uint) ([]uint, error) {
+	groupIDs, err := middleware.GroupDescendantIDs(ctx, db, []uint{groupID})
+	if err != nil {
+		return nil, err
+	}
+	var userIDs []uint
+	if err := db.WithContext(ctx).Model(&model.GroupMember{}).
+		Where("group_id IN ?", groupIDs).Distinct().Pluck("user_id", &userIDs).Error; err != nil {
+		return nil, err
+	}
+	return userIDs, nil
+}
+
+func isExistGroupByID(id uint, db *gorm.DB) (model.Group, bool, error) {
+	var group model.Group
+	DB := db.Where("id = ?", id).Find(&group)
+	if DB.Error != nil || DB.RowsAffected != 1 {
+		return model.Group{}, false, DB.Error
+	}
+	return group, true, nil
+}
+
+func isExistGroupByName(name string, db *gorm.DB) (model.Group, bool, error) {
+	var group model.Group
+	DB := db.Where("name = ?", name).Find(&group)
+	if DB.Error != nil || DB.RowsAffected != 1 {
+		return model.Group{}, false, DB.Error
+	}
+	return group, true, nil
+}
@@ -0,0 +1,130 @@
+package handler
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/uptrace/bunrouter"
+
+	"git.blauwelle.com/go/crate/cmd/sso/model"
+	"git.blauwelle.com/go/crate/cmd/sso/response"
+)
+
+// newGroupTest 组2是组1的子组，组1有auditor角色；用户9在组1，用户11在组2
+func newGroupTest(t *testing.T) *rbacTest {
+	rt := newRBACTest(t)
+	rt.db.groups = []model.Group{
+		{Model: model.Model{ID: 1}, OrganizationID: 1, Name: "eng"},
+		{Model: model.Model{ID: 2}, OrganizationID: 1, Name: "backend"},
+		{Model: model.Model{ID: 3}, OrganizationID: 1, Name: "ops"},
+		{Model: model.Model{ID: 4}, OrganizationID: 2, Name: "eng"},
+	}
+	rt.db.relations["group_subgroups"].rows = [][2]int64{{1, 2}}
+	rt.db.relations["group_members"].rows = [][2]int64{{1, 9}, {2, 11}}
+	rt.db.relations["group_roles"].rows = [][2]int64{{1, 3}}
+	return rt
+}
+
+func (rt *rbacTest) revokedUsers() []int64 {
+	users := []int64{}
+	for userID := range rt.db.revoked {
+		users = append(users, userID)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i] < users[j] })
+	return users
+}
+
+// 成员通过组或上级组获得的角色被移除后，会话全部失效
+func TestGroupChangeRevokesMembers(t *testing.T) {
+	tests := []struct {
+		name        string
+		handler     func(h *Handler) bunrouter.HandlerFunc
+		body        any
+		wantRevoked []int64
+	}{
+		{"remove member", (*Handler).RemoveGroupMember, GroupMemberRequest{GroupID: 1, UserID: 9}, []int64{9}},
+		{"remove role", (*Handler).RemoveGroupRole, GroupRoleRequest{GroupID: 1, RoleID: 3}, []int64{9, 11}},
+		{"remove missing role", (*Handler).RemoveGroupRole, GroupRoleRequest{GroupID: 1, RoleID: 2}, []int64{}},
+		{"remove subgroup", (*Handler).RemoveSubgroup, GroupSubgroupRequest{GroupID: 1, ChildID: 2}, []int64{11}},
+		{"delete group", (*Handler).DeleteGroup, DeleteGroupRequest{ID: 1}, []int64{9, 11}},
+		{"delete subgroup", (*Handler).DeleteGroup, DeleteGroupRequest{ID: 2}, []int64{11}},
+		{"delete empty group", (*Handler).DeleteGroup, DeleteGroupRequest{ID: 3}, []int64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := newGroupTest(t)
+			if got := rt.call(tt.handler(rt.h), 7, tt.body); got != response.MessageOK {
+				t.Fatalf("got %s", got)
+			}
+			if got := rt.revokedUsers(); !reflect.DeepEqual(got, tt.wantRevoked) {
+				t.Errorf("revoked = %v, want %v", got, tt.wantRevoked)
+			}
+		})
+	}
+}
+
+func TestGroupDeleteRemovesRelations(t *testing.T) {
+	rt := newGroupTest(t)
+	if got := rt.call(rt.h.DeleteGroup(), 7, DeleteGroupRequest{ID: 1}); got != response.MessageOK {
+		t.Fatalf("got %s", got)
+	}
+	relations := rt.db.relations
+	if !reflect.DeepEqual(relations["group_members"].rows, [][2]int64{{2, 11}}) ||
+		len(relations["group_roles"].rows) != 0 || len(relations["group_subgroups"].rows) != 0 {
+		t.Errorf("relations = %v %v %v", relations["group_members"].rows, relations["group_roles"].rows, relations["group_subgroups"].rows)
+	}
+	if len(rt.db.groups) != 3 {
+		t.Errorf("groups = %v", rt.db.groups)
+	}
+}
+
+func TestAddSubgroup(t *testing.T) {
+	rt := newGroupTest(t)
+	if got := rt.call(rt.h.AddSubgroup(), 7, GroupSubgroupRequest{GroupID: 2, ChildID: 3}); got != response.MessageOK {
+		t.Fatalf("got %s", got)
+	}
+	if !rt.db.has("group_subgroups", [2]int64{2, 3}) {
+		t.Errorf("group_subgroups = %v", rt.db.relations["group_subgroups"].rows)
+	}
+	// 环的检查读取的上级关系需要加锁
+	if len(rt.db.locked) == 0 || rt.db.locked[0] != "group_subgroups" {
+		t.Errorf("locked = %v", rt.db.locked)
+	}
+}
+
+func TestGroupRejected(t *testing.T) {
+	tests := []struct {
+		name     string
+		userID   uint
+		handler  func(h *Handler) bunrouter.HandlerFunc
+		body     any
+		wantCode string
+	}{
+		{"subgroup of itself", 7, (*Handler).AddSubgroup, GroupSubgroupRequest{GroupID: 1, ChildID: 1}, response.MessageGroupCycle},
+		{"ancestor as subgroup", 7, (*Handler).AddSubgroup, GroupSubgroupRequest{GroupID: 2, ChildID: 1}, response.MessageGroupCycle},
+		{"group of other organization", 7, (*Handler).AddSubgroup, GroupSubgroupRequest{GroupID: 3, ChildID: 4}, response.MessageGroupNotExist},
+		{"user of other organization", 7, (*Handler).AddGroupMember, GroupMemberRequest{GroupID: 1, UserID: 10}, response.MessageUserNotExist},
+		// 组1的auditor角色有用户8没有的权限，组2继承该角色
+		{"add member with missing permission", 8, (*Handler).AddGroupMember, GroupMemberRequest{GroupID: 2, UserID: 9}, response.MessageUnauthorized},
+		{"nest under group with missing permission", 8, (*Handler).AddSubgroup, GroupSubgroupRequest{GroupID: 1, ChildID: 3}, response.MessageUnauthorized},
+		{"assign role with missing permission", 8, (*Handler).AddGroupRole, GroupRoleRequest{GroupID: 3, RoleID: 1}, response.MessageUnauthorized},
+		{"remove role with missing permission", 8, (*Handler).RemoveGroupRole, GroupRoleRequest{GroupID: 1, RoleID: 3}, response.MessageUnauthorized},
+		{"delete group with missing permission", 8, (*Handler).DeleteGroup, DeleteGroupRequest{ID: 2}, response.MessageUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := newGroupTest(t)
+			if got := rt.call(tt.handler(rt.h), tt.userID, tt.body); got != tt.wantCode {
+				t.Errorf("got %s, want %s", got, tt.wantCode)
+			}
+			if !reflect.DeepEqual(rt.db.relations["group_subgroups"].rows, [][2]int64{{1, 2}}) ||
+				len(rt.db.relations["group_members"].rows) != 2 || len(rt.db.relations["group_roles"].rows) != 1 || len(rt.db.groups) != 4 {
+				t.Errorf("relations changed: %v %v %v", rt.db.relations["group_subgroups"].rows, rt.db.relations["group_members"].rows, rt.db.relations["group_roles"].rows)
+			}
+			if len(rt.db.revoked) != 0 {
+				t.Errorf("revoked = %v", rt.db.revoked)
+			}
+		})
+	}
+}
@@ -0,0 +1,355 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"git.blauwelle.com/go/crate/log"
+	"github.com/uptrace/bunrouter"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+
+	"git.blauwelle.com/go/crate/cmd/sso/model"
+	"git.blauwelle.com/go/crate/cmd/sso/response"
+	"git.blauwelle.com/go/crate/cmd/sso/util"
+)
+
+var errInvitationInvalid = errors.New("invitation invalid")
+
+type CreateInvitationRequest struct {
+	MaxUses   int    `json:"max_uses"`   // 默认1
+	ExpiresIn int    `json:"expires_in"` // 单位为秒，默认为invitation.ttl
+	RoleIDs   []uint `json:"role_ids"`
+	Email     string `json:"email"` // 不为空时只能使用该邮箱注册，并发送邀请邮件
+	Note      string `json:"note"`
+}
+
+type CreateInvitationResponse struct {
+	ID        uint      `json:"id"`
+	Code      string    `json:"code"` // 只在创建时返回
+	Link      string    `json:"link"`
+	ExpiresAt time.Time `json:"expires_at"`
+	MailSent  bool      `json:"mail_sent"`
+}
+
+type InvitationResponse struct {
+	model.Invitation
+	RoleIDs []uint `json:"role_ids"`
+}
+
+type RevokeInvitationRequest struct {
+	ID uint `json:"id"`
+}
+
+type RegisterRequest struct {
+	Code     string `json:"code"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Email    string `json:"email"` // 可选，邀请指定了邮箱时可省略
+}
+
+// CreateInvitation 创建注册邀请，返回邀请码和链接
+func (h *Handler) CreateInvitation() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request CreateInvitationRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		if request.MaxUses == 0 {
+			request.MaxUses = 1
+		}
+		if request.ExpiresIn == 0 {
+			request.ExpiresIn = h.cfg.Invitation.TTL
+		}
+		if request.MaxUses < 0 || request.ExpiresIn < 0 {
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		var email string
+		if request.Email != "" {
+			var ok bool
+			if email, ok = normalizeEmail(request.Email); !ok {
+				return response.Error(rw, response.MessageEmailInvalid, bunrouter.H{})
+			}
+		}
+		roleIDs := uniqueIDs(request.RoleIDs)
+		if len(roleIDs) > 0 {
+			var count int64
+			if err := h.tenant(ctx).Model(&model.Role{}).Where("id IN ?", roleIDs).Count(&count).Error; err != nil {
+				return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+			}
+			if int(count) != len(roleIDs) {
+				return response.Error(rw, response.MessageRoleNotExist, bunrouter.H{})
+			}
+			// 通过邀请注册的用户获得的权限不能超过邀请人
+			permissions, err := rolePermissions(ctx, h.db, roleIDs)
+			if err != nil {
+				log.Error(ctx, err.Error())
+				return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+			}
+			var names []string
+			for _, list := range permissions {
+				names = append(names, list...)
+			}
+			if err := h.checkGrant(ctx, names); err != nil {
+				return h.writeRoleError(ctx, rw, err)
+			}
+		}
+		userID, err := currentUserID(ctx)
+		if err != nil {
+			return err
+		}
+
+		code := h.r.RandString(32)
+		invitation := model.Invitation{
+			OrganizationID: currentOrganizationID(ctx),
+			CodeHash:       hashMailToken(code),
+			Note:           request.Note,
+			Email:          email,
+			MaxUses:        request.MaxUses,
+			ExpiresAt:      time.Now().Add(time.Duration(request.ExpiresIn) * time.Second),
+			CreatedBy:      userID,
+		}
+		if err := h.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&invitation).Error; err != nil {
+				return err
+			}
+			for _, roleID := range roleIDs {
+				if err := tx.Create(&model.InvitationRole{InvitationID: invitation.ID, RoleID: roleID}).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+
+		link, err := mailLink(h.cfg.Invitation.URL, h.cfg.OIDC.LoginURL, "code", code)
+		if err != nil {
+			return err
+		}
+		result := CreateInvitationResponse{ID: invitation.ID, Code: code, Link: link, ExpiresAt: invitation.ExpiresAt}
+		// 邮件发送失败时邀请仍然有效，管理员可以自行转发链接
+		if email != "" {
+			if err := h.sendInvitation(ctx, email, link, invitation.ExpiresAt); err != nil {
+				log.Error(ctx, "send invitation: "+err.Error())
+			} else {
+				result.MailSent = true
+			}
+		}
+		return response.WriteOK(rw, response.MessageOK, result)
+	}
+}
+
+// SearchInvitation 分页查询邀请，参数为page、pageSize
+func (h *Handler) SearchInvitation() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		page := r.URL.Query().Get("page")
+		pageSizeInt, err := strconv.Atoi(r.URL.Query().Get("pageSize"))
+		if err != nil || pageSizeInt <= 0 {
+			pageSizeInt = 20
+		}
+		pageInt, _ := strconv.Atoi(page)
+
+		query := h.tenant(ctx).Model(&model.Invitation{})
+		var count int64
+		if err := query.Count(&count).Error; err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		offset, err := calculateOffset(page, pageSizeInt, count)
+		if err != nil {
+			return response.Error(rw, response.MessageCalculateOffset, bunrouter.H{})
+		}
+		var invitations []model.Invitation
+		if err := query.Order("id DESC").Offset(offset).Limit(pageSizeInt).Find(&invitations).Error; err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+
+		ids := make([]uint, 0, len(invitations))
+		for _, invitation := range invitations {
+			ids = append(ids, invitation.ID)
+		}
+		var roles []model.InvitationRole
+		if err := h.db.WithContext(ctx).Where("invitation_id IN ?", ids).Find(&roles).Error; err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		roleIDs := make(map[uint][]uint)
+		for _, role := range roles {
+			roleIDs[role.InvitationID] = append(roleIDs[role.InvitationID], role.RoleID)
+		}
+		list := make([]InvitationResponse, 0, len(invitations))
+		for _, invitation := range invitations {
+			list = append(list, InvitationResponse{Invitation: invitation, RoleIDs: roleIDs[invitation.ID]})
+		}
+		return response.WriteOK(rw, response.MessageOK, response.NewPaginationData(pageInt, pageSizeInt, list))
+	}
+}
+
+// RevokeInvitation 撤销邀请，已注册的用户不受影响
+func (h *Handler) RevokeInvitation() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request RevokeInvitationRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		DB := h.tenant(ctx).Model(&model.Invitation{}).
+			Where("id = ? AND revoked_at IS NULL", request.ID).Update("revoked_at", time.Now())
+		if DB.Error != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if DB.RowsAffected != 1 {
+			return response.Error(rw, response.MessageInvitationNotExist, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
+	}
+}
+
+// Register 使用邀请码注册，用户获得邀请中预设的角色
+func (h *Handler) Register() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request RegisterRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		if request.Username == "" || request.Code == "" {
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		if !validUsername(request.Username) {
+			return response.Error(rw, response.MessageUsernameInvalid, bunrouter.H{})
+		}
+		now := time.Now()
+		var invitation model.Invitation
+		DB := h.db.WithContext(ctx).Where("code_hash = ? AND revoked_at IS NULL AND expires_at > ? AND uses < max_uses",
+			hashMailToken(request.Code), now).Find(&invitation)
+		if DB.Error != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if DB.RowsAffected != 1 {
+			return response.Error(rw, response.MessageInvitationInvalid, bunrouter.H{})
+		}
+
+		// 邀请指定了邮箱时，邀请链接本身证明了对邮箱的控制
+		var email *string
+		var emailVerifiedAt *time.Time
+		if request.Email != "" {
+			normalized, ok := normalizeEmail(request.Email)
+			if !ok {
+				return response.Error(rw, response.MessageEmailInvalid, bunrouter.H{})
+			}
+			email = &normalized
+		}
+		if invitation.Email != "" {
+			if email != nil && *email != invitation.Email {
+				return response.Error(rw, response.MessageEmailInvalid, bunrouter.H{})
+			}
+			email = &invitation.Email
+			emailVerifiedAt = &now
+		}
+
+		_, ok, err := isExistUserByName(request.Username, h.db)
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if ok {
+			return response.Error(rw, response.MessageUsernameUnavailable, bunrouter.H{})
+		}
+		if email != nil {
+			_, ok, err := isExistUserByEmail(*email, h.db)
+			if err != nil {
+				return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+			}
+			if ok {
+				return response.Error(rw, response.MessageEmailExist, bunrouter.H{})
+			}
+		}
+		if err := h.passwords.Check(request.Username, request.Password); err != nil {
+			return h.writePasswordError(ctx, rw, err)
+		}
+		passwordHash, err := bcrypt.GenerateFromPassword([]byte(request.Password), 12)
+		if err != nil {
+			return err
+		}
+
+		user := model.User{
+			OrganizationID:    invitation.OrganizationID,
+			Username:          request.Username,
+			PasswordHash:      string(passwordHash),
+			Email:             email,
+			EmailVerifiedAt:   emailVerifiedAt,
+			PasswordChangedAt: &now,
+		}
+		err = h.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			// 并发注册时不超过可使用次数
+			DB := tx.Model(&model.Invitation{}).
+				Where("id = ? AND revoked_at IS NULL AND expires_at > ? AND uses < max_uses", invitation.ID, now).
+				Update("uses", gorm.Expr("uses + 1"))
+			if DB.Error != nil {
+				return DB.Error
+			}
+			if DB.RowsAffected != 1 {
+				return errInvitationInvalid
+			}
+			if err := tx.Create(&user).Error; err != nil {
+				return err
+			}
+			var roles []model.InvitationRole
+			if err := tx.Where("invitation_id = ?", invitation.ID).Find(&roles).Error; err != nil {
+				return err
+			}
+			for _, role := range roles {
+				if err := tx.Create(&model.UserRole{UserID: user.ID, RoleID: role.RoleID}).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if errors.Is(err, errInvitationInvalid) {
+			return response.Error(rw, response.MessageInvitationInvalid, bunrouter.H{})
+		}
+		if err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		log.Info(ctx, "registered user "+user.Username+" with invitation "+strconv.Itoa(int(invitation.ID)))
+
+		if email != nil && emailVerifiedAt == nil {
+			if err := h.sendEmailVerification(ctx, user); err != nil {
+				log.Error(ctx, "send mail: "+err.Error())
+			}
+		}
+		return response.WriteOK(rw, response.MessageOK, bunrouter.H{"id": user.ID})
+	}
+}
+
+func (h *Handler) sendInvitation(ctx context.Context, email, link string, expiresAt time.Time) error {
+	return h.mailer.Send(ctx, util.Mail{
+		To:      []string{email},
+		Subject: "注册邀请",
+		Body: "你好，\n\n" +
+			"你被邀请注册账号，请在" + expiresAt.Format("2006-01-02 15:04") + "之前打开以下链接完成注册：\n\n" +
+			link + "\n",
+	})
+}
+
+func uniqueIDs(ids []uint) []uint {
+	seen := make(map[uint]bool, len(ids))
+	result := make([]uint, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			result = append(result, id)
+		}
+	}
+	return result
+}
@@ -0,0 +1,146 @@
+package handler
+
+import (
+	"encoding/json"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.blauwelle.com/go/crate/log"
+	"github.com/uptrace/bunrouter"
+
+	"git.blauwelle.com/go/crate/cmd/sso/response"
+	"git.blauwelle.com/go/crate/cmd/sso/util"
+)
+
+type LoginThrottledResponse struct {
+	RetryAfter int `json:"retry_after"` // 单位为秒
+}
+
+type LoginLockStatus struct {
+	Failures   int        `json:"failures"`
+	LastFailed *time.Time `json:"last_failed"`
+	RetryAfter int        `json:"retry_after"` // 为0表示未被限制，单位为秒
+}
+
+type LoginLockResponse struct {
+	Username *LoginLockStatus `json:"username,omitempty"`
+	IP       *LoginLockStatus `json:"ip,omitempty"`
+}
+
+type UnlockLoginRequest struct {
+	Username string `json:"username"`
+	IP       string `json:"ip"`
+}
+
+// GetLoginLock 查询用户名或IP的登录失败次数和锁定状态，参数为username、ip
+func (h *Handler) GetLoginLock() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		username := r.URL.Query().Get("username")
+		ip := r.URL.Query().Get("ip")
+		if username == "" && ip == "" {
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		var result LoginLockResponse
+		if username != "" {
+			// 只能查询当前组织的用户，IP不属于组织
+			_, ok, err := isExistUserByName(username, h.tenant(ctx))
+			if err != nil {
+				return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+			}
+			if !ok {
+				return response.Error(rw, response.MessageUserNotExist, bunrouter.H{})
+			}
+			failures, wait, err := h.limiter.UserStatus(ctx, username)
+			if err != nil {
+				log.Error(ctx, err.Error())
+				return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+			}
+			result.Username = newLoginLockStatus(failures, wait)
+		}
+		if ip != "" {
+			failures, wait, err := h.limiter.IPStatus(ctx, ip)
+			if err != nil {
+				log.Error(ctx, err.Error())
+				return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+			}
+			result.IP = newLoginLockStatus(failures, wait)
+		}
+		return response.WriteOK(rw, response.MessageOK, result)
+	}
+}
+
+// UnlockLogin 清除用户名或IP的登录失败计数，解除锁定
+func (h *Handler) UnlockLogin() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request UnlockLoginRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		if request.Username == "" && request.IP == "" {
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		if request.Username != "" {
+			_, ok, err := isExistUserByName(request.Username, h.tenant(ctx))
+			if err != nil {
+				return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+			}
+			if !ok {
+				return response.Error(rw, response.MessageUserNotExist, bunrouter.H{})
+			}
+			if err := h.limiter.UnlockUser(ctx, request.Username); err != nil {
+				log.Error(ctx, err.Error())
+				return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+			}
+		}
+		if request.IP != "" {
+			if err := h.limiter.UnlockIP(ctx, request.IP); err != nil {
+				log.Error(ctx, err.Error())
+				return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+			}
+		}
+		log.Info(ctx, "login unlocked: username="+request.Username+" ip="+request.IP)
+		return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
+	}
+}
+
+func newLoginLockStatus(failures util.LoginFailures, wait time.Duration) *LoginLockStatus {
+	status := &LoginLockStatus{Failures: failures.Count, RetryAfter: retryAfterSeconds(wait)}
+	if !failures.Last.IsZero() {
+		status.LastFailed = &failures.Last
+	}
+	return status
+}
+
+func writeLoginThrottled(rw http.ResponseWriter, wait time.Duration) error {
+	seconds := retryAfterSeconds(wait)
+	rw.Header().Set("Retry-After", strconv.Itoa(seconds))
+	return response.Error(rw, response.MessageLoginThrottled, LoginThrottledResponse{RetryAfter: seconds})
+}
+
+func retryAfterSeconds(wait time.Duration) int {
+	return int(math.Ceil(wait.Seconds()))
+}
+
+// 客户端IP，配置了trustProxy时使用反向代理追加到X-Forwarded-For的最后一个地址
+func (h *Handler) clientIP(r *http.Request) string {
+	if h.cfg.Listen.TrustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			addrs := strings.Split(forwarded, ",")
+			if ip := strings.TrimSpace(addrs[len(addrs)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/uptrace/bunrouter"
+
+	"git.blauwelle.com/go/crate/cmd/sso/model"
+	"git.blauwelle.com/go/crate/cmd/sso/response"
+)
+
+// SearchLogoutDeliveries 查看后端通道登出通知的发送状态
+func (h *Handler) SearchLogoutDeliveries() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		pageSize := r.URL.Query().Get("pageSize")
+		status := r.URL.Query().Get("status")
+		appID := r.URL.Query().Get("app_id")
+		page := r.URL.Query().Get("page")
+		// 设置默认每页记录数
+		defaultPageSize := 20
+
+		var deliveries []model.LogoutDelivery
+		var count int64
+
+		// 构建查询条件
+		query := h.db.Model(&model.LogoutDelivery{}).Where("app_id IN (?)", h.tenantAppIDs(r.Context()))
+		if status != "" {
+			query = query.Where("status = ?", status)
+		}
+		if appID != "" {
+			query = query.Where("app_id = ?", appID)
+		}
+
+		// 查询总记录数
+		if dbCount := query.Count(&count); dbCount.Error != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+
+		pageSizeInt, err := strconv.Atoi(pageSize)
+		pageInt, _ := strconv.Atoi(page)
+		if err != nil || pageSizeInt <= 0 {
+			pageSizeInt = defaultPageSize
+		}
+
+		// 计算偏移量
+		offset, err := calculateOffset(page, pageSizeInt, count)
+		if err != nil {
+			return response.Error(rw, response.MessageCalculateOffset, bunrouter.H{})
+		}
+
+		if dbFind := query.Order("id DESC").Offset(offset).Limit(pageSizeInt).Find(&deliveries); dbFind.Error != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, response.NewPaginationData(pageInt, pageSizeInt, deliveries))
+	}
+}
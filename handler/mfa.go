@@ -0,0 +1,656 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.blauwelle.com/go/crate/log"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/uptrace/bunrouter"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"git.blauwelle.com/go/crate/cmd/sso/constants"
+	"git.blauwelle.com/go/crate/cmd/sso/middleware"
+	"git.blauwelle.com/go/crate/cmd/sso/model"
+	"git.blauwelle.com/go/crate/cmd/sso/response"
+	"git.blauwelle.com/go/crate/cmd/sso/util"
+)
+
+// 密码校验通过但还需要第二因素时签发mfa_token，它带有aud，不能作为会话使用
+const (
+	mfaMethodTOTP     = "totp"
+	mfaMethodWebAuthn = "webauthn"
+
+	mfaTokenAudience       = "mfa"
+	mfaEnrollTokenAudience = "mfa-enroll" // 策略要求MFA但用户没有任何第二因素，只能用于登录时绑定TOTP
+	mfaTokenTTL            = 5 * time.Minute
+	recoveryCodeCount      = 10
+)
+
+var (
+	errMFAAlreadyEnabled = errors.New("mfa already enabled")
+	errMFANotEnabled     = errors.New("mfa not enabled")
+	errMFAInvalidCode    = errors.New("mfa invalid code")
+)
+
+type LoginMFARequiredResponse struct {
+	MFAToken           string   `json:"mfa_token"`
+	Methods            []string `json:"methods"`             // 可用的第二因素：totp、webauthn
+	EnrollmentRequired bool     `json:"enrollment_required"` // 策略要求MFA但用户尚未绑定，需先调用 /api/v1/login/mfa/totp
+}
+
+type LoginMFARequest struct {
+	MFAToken     string `json:"mfa_token"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type LoginMFAResponse struct {
+	SessionResponse
+	RecoveryCodes []string `json:"recovery_codes,omitempty"` // 登录时完成绑定才会返回
+}
+
+type TOTPEnrollResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"` // otpauth:// 地址，可生成二维码供验证器App扫描
+}
+
+type TOTPStatusResponse struct {
+	Enabled                bool       `json:"enabled"`
+	Required               bool       `json:"required"`
+	ConfirmedAt            *time.Time `json:"confirmed_at"`
+	RecoveryCodesRemaining int64      `json:"recovery_codes_remaining"`
+}
+
+type TOTPCodeRequest struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// LoginMFA 使用mfa_token和TOTP验证码或恢复码完成登录
+func (h *Handler) LoginMFA() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request LoginMFARequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		token, ok := h.parseLoginToken(ctx, request.MFAToken, mfaTokenAudience, mfaEnrollTokenAudience)
+		if !ok {
+			return response.Error(rw, response.MessageMFATokenInvalid, bunrouter.H{})
+		}
+		userID := token.userID
+		// 验证码只有6位，按用户限制失败次数，重新登录获得新的mfa_token不会清除计数
+		wait, err := h.limiter.CheckSecondFactor(ctx, userID)
+		if err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if wait > 0 {
+			return writeLoginThrottled(rw, wait)
+		}
+		totp, ok, err := findUserTOTP(ctx, h.db, userID)
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if !ok {
+			return response.Error(rw, response.MessageMFANotEnabled, bunrouter.H{})
+		}
+
+		var result LoginMFAResponse
+		if totp.ConfirmedAt == nil {
+			// 策略强制绑定时，首次验证同时完成绑定；已有其他第二因素的用户必须使用它
+			if !token.enroll() {
+				return response.Error(rw, response.MessageMFANotEnabled, bunrouter.H{})
+			}
+			factors, err := h.secondFactors(ctx, userID)
+			if err != nil {
+				return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+			}
+			if len(factors.methods()) > 0 {
+				return response.Error(rw, response.MessageMFANotEnabled, bunrouter.H{})
+			}
+			if err := h.confirmTOTP(ctx, totp, request.Code); err != nil {
+				h.failSecondFactor(ctx, userID, err)
+				return h.writeMFAError(rw, err)
+			}
+			codes, err := h.newRecoveryCodes(ctx, userID)
+			if err != nil {
+				return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+			}
+			result.RecoveryCodes = codes
+		} else if err := h.verifySecondFactor(ctx, totp, request.Code, request.RecoveryCode); err != nil {
+			h.failSecondFactor(ctx, userID, err)
+			return h.writeMFAError(rw, err)
+		}
+		if err := h.succeedSecondFactor(ctx, token); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+
+		session, err := h.issueSession(ctx, rw, userID, "")
+		if err != nil {
+			return response.Error(rw, response.MessageTokenExpired, bunrouter.H{})
+		}
+		result.SessionResponse = session
+		return response.WriteOK(rw, response.MessageOK, result)
+	}
+}
+
+// LoginMFAEnroll 策略要求MFA但没有任何第二因素的用户，使用 enrollment_required 时返回的mfa_token开始绑定TOTP
+func (h *Handler) LoginMFAEnroll() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request LoginMFARequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		token, ok := h.parseLoginToken(ctx, request.MFAToken, mfaEnrollTokenAudience)
+		if !ok {
+			return response.Error(rw, response.MessageMFATokenInvalid, bunrouter.H{})
+		}
+		// 签发mfa_token之后可能已在其他会话中绑定
+		factors, err := h.secondFactors(ctx, token.userID)
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if len(factors.methods()) > 0 {
+			return response.Error(rw, response.MessageMFAAlreadyEnabled, bunrouter.H{})
+		}
+		user, ok, err := isExistUserByID(token.userID, h.db)
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if !ok {
+			return response.Error(rw, response.MessageUserNotExist, bunrouter.H{})
+		}
+		enroll, err := h.startTOTPEnrollment(ctx, user)
+		if err != nil {
+			return h.writeMFAError(rw, err)
+		}
+		return response.WriteOK(rw, response.MessageOK, enroll)
+	}
+}
+
+// GetTOTP 当前用户的TOTP状态
+func (h *Handler) GetTOTP() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		userID, err := currentUserID(ctx)
+		if err != nil {
+			return err
+		}
+		var status TOTPStatusResponse
+		totp, ok, err := findUserTOTP(ctx, h.db, userID)
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if ok && totp.ConfirmedAt != nil {
+			status.Enabled = true
+			status.ConfirmedAt = totp.ConfirmedAt
+			if err := h.db.WithContext(ctx).Model(&model.RecoveryCode{}).
+				Where("user_id = ? AND used_at IS NULL", userID).
+				Count(&status.RecoveryCodesRemaining).Error; err != nil {
+				return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+			}
+		}
+		if status.Required, err = h.mfaRequiredByPolicy(ctx, userID); err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, status)
+	}
+}
+
+// EnrollTOTP 生成新的TOTP密钥，调用 ConfirmTOTP 验证后生效
+func (h *Handler) EnrollTOTP() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		userID, err := currentUserID(ctx)
+		if err != nil {
+			return err
+		}
+		user, ok, err := isExistUserByID(userID, h.db)
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if !ok {
+			return response.Error(rw, response.MessageUserNotExist, bunrouter.H{})
+		}
+		enroll, err := h.startTOTPEnrollment(ctx, user)
+		if err != nil {
+			return h.writeMFAError(rw, err)
+		}
+		return response.WriteOK(rw, response.MessageOK, enroll)
+	}
+}
+
+// ConfirmTOTP 使用验证码确认绑定，返回一次性恢复码
+func (h *Handler) ConfirmTOTP() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request TOTPCodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		userID, err := currentUserID(ctx)
+		if err != nil {
+			return err
+		}
+		totp, ok, err := findUserTOTP(ctx, h.db, userID)
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if !ok {
+			return response.Error(rw, response.MessageMFANotEnabled, bunrouter.H{})
+		}
+		if totp.ConfirmedAt != nil {
+			return response.Error(rw, response.MessageMFAAlreadyEnabled, bunrouter.H{})
+		}
+		if err := h.confirmTOTP(ctx, totp, request.Code); err != nil {
+			return h.writeMFAError(rw, err)
+		}
+		codes, err := h.newRecoveryCodes(ctx, userID)
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, RecoveryCodesResponse{RecoveryCodes: codes})
+	}
+}
+
+// DisableTOTP 关闭TOTP，需要提供当前验证码或恢复码；策略要求MFA的用户没有其他第二因素时不能关闭
+func (h *Handler) DisableTOTP() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request TOTPCodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		userID, err := currentUserID(ctx)
+		if err != nil {
+			return err
+		}
+		required, err := h.mfaRequiredByPolicy(ctx, userID)
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		factors, err := h.secondFactors(ctx, userID)
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if required && factors.webAuthn == 0 {
+			return response.Error(rw, response.MessageMFARequired, bunrouter.H{})
+		}
+		totp, ok, err := findUserTOTP(ctx, h.db, userID)
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if !ok || totp.ConfirmedAt == nil {
+			return response.Error(rw, response.MessageMFANotEnabled, bunrouter.H{})
+		}
+		if err := h.verifySecondFactor(ctx, totp, request.Code, request.RecoveryCode); err != nil {
+			return h.writeMFAError(rw, err)
+		}
+		if err := h.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			if err := tx.Where("user_id = ?", userID).Delete(&model.UserTOTP{}).Error; err != nil {
+				return err
+			}
+			return tx.Where("user_id = ?", userID).Delete(&model.RecoveryCode{}).Error
+		}); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
+	}
+}
+
+// RegenerateRecoveryCodes 重新生成恢复码，旧的全部失效
+func (h *Handler) RegenerateRecoveryCodes() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request TOTPCodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		userID, err := currentUserID(ctx)
+		if err != nil {
+			return err
+		}
+		totp, ok, err := findUserTOTP(ctx, h.db, userID)
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if !ok || totp.ConfirmedAt == nil {
+			return response.Error(rw, response.MessageMFANotEnabled, bunrouter.H{})
+		}
+		if err := h.verifySecondFactor(ctx, totp, request.Code, ""); err != nil {
+			return h.writeMFAError(rw, err)
+		}
+		codes, err := h.newRecoveryCodes(ctx, userID)
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, RecoveryCodesResponse{RecoveryCodes: codes})
+	}
+}
+
+// 用户已绑定的第二因素数量
+type secondFactors struct {
+	totp     int64
+	webAuthn int64
+}
+
+func (f secondFactors) methods() []string {
+	var methods []string
+	if f.totp > 0 {
+		methods = append(methods, mfaMethodTOTP)
+	}
+	if f.webAuthn > 0 {
+		methods = append(methods, mfaMethodWebAuthn)
+	}
+	return methods
+}
+
+func (h *Handler) secondFactors(ctx context.Context, userID uint) (secondFactors, error) {
+	var factors secondFactors
+	if err := h.db.WithContext(ctx).Model(&model.UserTOTP{}).
+		Where("user_id = ? AND confirmed_at IS NOT NULL", userID).
+		Count(&factors.totp).Error; err != nil {
+		return factors, err
+	}
+	if err := h.db.WithContext(ctx).Model(&model.WebAuthnCredential{}).
+		Where("user_id = ?", userID).
+		Count(&factors.webAuthn).Error; err != nil {
+		return factors, err
+	}
+	return factors, nil
+}
+
+// 判断登录是否需要第二因素，已绑定TOTP或注册了WebAuthn凭证的用户都需要
+// methods为空表示策略要求但用户尚未绑定
+func (h *Handler) mfaRequired(ctx context.Context, userID uint) (required bool, methods []string, err error) {
+	factors, err := h.secondFactors(ctx, userID)
+	if err != nil {
+		return false, nil, err
+	}
+	if methods = factors.methods(); len(methods) > 0 {
+		return true, methods, nil
+	}
+	required, err = h.mfaRequiredByPolicy(ctx, userID)
+	return required, nil, err
+}
+
+func (h *Handler) mfaRequiredByPolicy(ctx context.Context, userID uint) (bool, error) {
+	if !h.cfg.MFA.RequireForAdmin {
+		return false, nil
+	}
+	// 直接或通过组拥有任意组织的admin角色
+	groupIDs, err := middleware.UserGroupIDs(ctx, h.db, userID)
+	if err != nil {
+		return false, err
+	}
+	roleIDs, err := middleware.UserRoleIDs(ctx, h.db, userID, groupIDs)
+	if err != nil || len(roleIDs) == 0 {
+		return false, err
+	}
+	var count int64
+	if err := h.db.WithContext(ctx).Model(&model.Role{}).
+		Where("id IN ? AND name = ?", roleIDs, constants.Admin).
+		Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// enroll为true时签发只能用于绑定TOTP的mfa_token
+func (h *Handler) signMFAToken(ctx context.Context, userID uint, enroll bool) (string, error) {
+	if enroll {
+		return h.signLoginToken(ctx, userID, mfaEnrollTokenAudience, mfaTokenTTL)
+	}
+	return h.signLoginToken(ctx, userID, mfaTokenAudience, mfaTokenTTL)
+}
+
+// 已绑定第二因素的用户使用的mfa_token
+func (h *Handler) verifyMFAToken(ctx context.Context, token string) (loginToken, bool) {
+	return h.parseLoginToken(ctx, token, mfaTokenAudience)
+}
+
+// 第二因素验证失败，只有验证码或恢复码错误才计数
+func (h *Handler) failSecondFactor(ctx context.Context, userID uint, err error) {
+	if !errors.Is(err, errMFAInvalidCode) {
+		return
+	}
+	if err := h.limiter.FailSecondFactor(ctx, userID); err != nil {
+		log.Error(ctx, err.Error())
+	}
+}
+
+// 第二因素验证通过：mfa_token作废，清除失败计数
+func (h *Handler) succeedSecondFactor(ctx context.Context, token loginToken) error {
+	if err := h.revocations.RevokeToken(ctx, util.SessionClaims{RegisteredClaims: token.claims}); err != nil {
+		return err
+	}
+	if err := h.limiter.SucceedSecondFactor(ctx, token.userID); err != nil {
+		log.Error(ctx, err.Error())
+	}
+	return nil
+}
+
+// 登录过程中间步骤使用的短期token，通过aud区分用途，不能作为会话使用
+func (h *Handler) signLoginToken(ctx context.Context, userID uint, audience string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	return h.j.SignClaims(ctx, jwt.RegisteredClaims{
+		ID:        h.r.RandString(24),
+		Subject:   strconv.Itoa(int(userID)),
+		Audience:  jwt.ClaimStrings{audience},
+		ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		IssuedAt:  jwt.NewNumericDate(now),
+	})
+}
+
+type loginToken struct {
+	claims jwt.RegisteredClaims
+	userID uint
+}
+
+func (t loginToken) enroll() bool {
+	return t.claims.Audience[0] == mfaEnrollTokenAudience
+}
+
+// 校验签名、用途，并且没有被撤销(已使用或用户的token被全部撤销)
+func (h *Handler) parseLoginToken(ctx context.Context, token string, audiences ...string) (loginToken, bool) {
+	if token == "" {
+		return loginToken{}, false
+	}
+	var claims jwt.RegisteredClaims
+	if err := h.j.VerifyClaims(ctx, token, &claims); err != nil {
+		return loginToken{}, false
+	}
+	if len(claims.Audience) != 1 || !slices.Contains(audiences, claims.Audience[0]) {
+		return loginToken{}, false
+	}
+	id, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return loginToken{}, false
+	}
+	revoked, err := h.revocations.IsRevoked(ctx, util.SessionClaims{RegisteredClaims: claims})
+	if err != nil {
+		log.Error(ctx, err.Error())
+		return loginToken{}, false
+	}
+	if revoked {
+		return loginToken{}, false
+	}
+	return loginToken{claims: claims, userID: uint(id)}, true
+}
+
+func (h *Handler) secretBox() (*util.SecretBox, error) {
+	return util.NewSecretBox(h.cfg.MFA.EncryptionKey)
+}
+
+// 生成新的密钥并保存为未确认状态，已确认的TOTP需先关闭
+func (h *Handler) startTOTPEnrollment(ctx context.Context, user model.User) (TOTPEnrollResponse, error) {
+	existing, ok, err := findUserTOTP(ctx, h.db, user.ID)
+	if err != nil {
+		return TOTPEnrollResponse{}, err
+	}
+	if ok && existing.ConfirmedAt != nil {
+		return TOTPEnrollResponse{}, errMFAAlreadyEnabled
+	}
+	box, err := h.secretBox()
+	if err != nil {
+		return TOTPEnrollResponse{}, err
+	}
+	secret, err := util.GenerateTOTPSecret()
+	if err != nil {
+		return TOTPEnrollResponse{}, err
+	}
+	sealed, err := box.Seal(secret)
+	if err != nil {
+		return TOTPEnrollResponse{}, err
+	}
+	if err := h.db.WithContext(ctx).Clauses(clause.OnConflict{UpdateAll: true}).Create(&model.UserTOTP{
+		UserID: user.ID,
+		Secret: sealed,
+	}).Error; err != nil {
+		return TOTPEnrollResponse{}, err
+	}
+	return TOTPEnrollResponse{
+		Secret: secret,
+		URI:    util.TOTPProvisioningURI(h.cfg.MFA.Issuer, user.Username, secret),
+	}, nil
+}
+
+func (h *Handler) confirmTOTP(ctx context.Context, totp model.UserTOTP, code string) error {
+	if err := h.useTOTPCode(ctx, totp, code); err != nil {
+		return err
+	}
+	return h.db.WithContext(ctx).Model(&model.UserTOTP{}).
+		Where("user_id = ?", totp.UserID).
+		Update("confirmed_at", time.Now()).Error
+}
+
+// 校验TOTP验证码或恢复码
+func (h *Handler) verifySecondFactor(ctx context.Context, totp model.UserTOTP, code, recoveryCode string) error {
+	if recoveryCode != "" {
+		return h.useRecoveryCode(ctx, totp.UserID, recoveryCode)
+	}
+	return h.useTOTPCode(ctx, totp, code)
+}
+
+// 校验验证码并记录其时间窗口，同一窗口内的验证码只能使用一次
+func (h *Handler) useTOTPCode(ctx context.Context, totp model.UserTOTP, code string) error {
+	box, err := h.secretBox()
+	if err != nil {
+		return err
+	}
+	secret, err := box.Open(totp.Secret)
+	if err != nil {
+		return err
+	}
+	step, ok := util.ValidateTOTP(secret, strings.TrimSpace(code), time.Now())
+	if !ok {
+		return errMFAInvalidCode
+	}
+	db := h.db.WithContext(ctx).Model(&model.UserTOTP{}).
+		Where("user_id = ? AND last_used_step < ?", totp.UserID, step).
+		Update("last_used_step", step)
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected != 1 {
+		return errMFAInvalidCode
+	}
+	return nil
+}
+
+func (h *Handler) useRecoveryCode(ctx context.Context, userID uint, code string) error {
+	db := h.db.WithContext(ctx).Model(&model.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hashRecoveryCode(code)).
+		Update("used_at", time.Now())
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected != 1 {
+		return errMFAInvalidCode
+	}
+	return nil
+}
+
+// 生成新的恢复码并替换旧的，明文只在此时返回
+func (h *Handler) newRecoveryCodes(ctx context.Context, userID uint) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	rows := make([]model.RecoveryCode, recoveryCodeCount)
+	for i := range codes {
+		code := strings.ToLower(h.r.RandString(10))
+		codes[i] = code[:5] + "-" + code[5:]
+		rows[i] = model.RecoveryCode{UserID: userID, CodeHash: hashRecoveryCode(codes[i])}
+	}
+	err := h.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&model.RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&rows).Error
+	})
+	if err != nil {
+		log.Error(ctx, err.Error())
+		return nil, err
+	}
+	return codes, nil
+}
+
+func (h *Handler) writeMFAError(rw http.ResponseWriter, err error) error {
+	switch {
+	case errors.Is(err, errMFAInvalidCode):
+		return response.Error(rw, response.MessageMFAInvalidCode, bunrouter.H{})
+	case errors.Is(err, errMFAAlreadyEnabled):
+		return response.Error(rw, response.MessageMFAAlreadyEnabled, bunrouter.H{})
+	case errors.Is(err, errMFANotEnabled):
+		return response.Error(rw, response.MessageMFANotEnabled, bunrouter.H{})
+	case errors.Is(err, util.ErrSecretBoxKey):
+		return response.Error(rw, response.MessageMFANotConfigured, bunrouter.H{})
+	default:
+		return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+	}
+}
+
+func findUserTOTP(ctx context.Context, db *gorm.DB, userID uint) (model.UserTOTP, bool, error) {
+	var totp model.UserTOTP
+	DB := db.WithContext(ctx).Where("user_id = ?", userID).Find(&totp)
+	if DB.Error != nil || DB.RowsAffected != 1 {
+		return model.UserTOTP{}, false, DB.Error
+	}
+	return totp, true, nil
+}
+
+func currentUserID(ctx context.Context) (uint, error) {
+	id, err := strconv.Atoi(middleware.ContextJWTClaims{}.Value(ctx).Subject)
+	if err != nil {
+		return 0, err
+	}
+	return uint(id), nil
+}
+
+// 恢复码忽略大小写、空格和连字符
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
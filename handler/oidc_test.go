@@ -0,0 +1,352 @@
+package handler
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/uptrace/bunrouter"
+	"golang.org/x/crypto/bcrypt"
+
+	"git.blauwelle.com/go/crate/cmd/sso/config"
+	"git.blauwelle.com/go/crate/cmd/sso/constants"
+	"git.blauwelle.com/go/crate/cmd/sso/model"
+	"git.blauwelle.com/go/crate/cmd/sso/util"
+)
+
+const testIssuer = "https://sso.example.com"
+
+// appDB 只实现applications表和ID为7、属于组织1的用户，其他查询返回空结果，用于各协议的测试
+type appDB struct {
+	apps []model.Application
+}
+
+func (d *appDB) query(q string, args []driver.Value) ([]string, [][]driver.Value, int64) {
+	switch {
+	case strings.HasPrefix(q, "SELECT * FROM `applications`"):
+		for _, app := range d.apps {
+			if (strings.Contains(q, "app_key=?") && args[0] == app.AppKey) ||
+				(strings.Contains(q, "site=?") && args[0] == app.Site) ||
+				(strings.Contains(q, "saml_entity_id=?") && args[0] == app.SAMLEntityID) {
+				return appColumns, [][]driver.Value{appRow(app)}, 0
+			}
+		}
+		return appColumns, nil, 0
+	case strings.HasPrefix(q, "SELECT * FROM `users`"):
+		if strings.Contains(q, "id = ?") && args[0] == int64(7) {
+			return []string{"id", "organization_id", "username", "source"}, [][]driver.Value{{int64(7), int64(1), "alice", model.UserSourceLocal}}, 0
+		}
+		return []string{"id"}, nil, 0
+	case strings.HasPrefix(q, "SELECT count(*) FROM `users`"):
+		if strings.Contains(q, "organization_id = ?") && args[0] == int64(7) && args[1] == int64(1) {
+			return []string{"count(*)"}, [][]driver.Value{{int64(1)}}, 0
+		}
+		return []string{"count(*)"}, [][]driver.Value{{int64(0)}}, 0
+	}
+	return nil, nil, 0
+}
+
+var appColumns = []string{
+	"id", "organization_id", "app_key", "name", "site", "redirect", "client_secret_hash", "redirect_uris",
+	"saml_entity_id", "saml_acs_url", "saml_name_id_format",
+}
+
+func appRow(app model.Application) []driver.Value {
+	return []driver.Value{
+		int64(app.ID), int64(app.OrganizationID), app.AppKey, app.Name, app.Site, app.Redirect, app.ClientSecretHash, app.RedirectURIs,
+		app.SAMLEntityID, app.SAMLACSURL, app.SAMLNameIDFormat,
+	}
+}
+
+type protocolTest struct {
+	t       *testing.T
+	h       *Handler
+	session string
+}
+
+func newProtocolTest(t *testing.T) *protocolTest {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := util.NewJWT(key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretHash, err := bcrypt.GenerateFromPassword([]byte("web-secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &appDB{apps: []model.Application{
+		{Model: model.Model{ID: 1}, OrganizationID: 1, AppKey: "web", Site: "https://web.example.com", Redirect: "https://web.example.com/cb", ClientSecretHash: string(secretHash)},
+		{Model: model.Model{ID: 2}, OrganizationID: 1, AppKey: "spa", Site: "https://spa.example.com", Redirect: "https://spa.example.com/cb"},
+		{
+			Model: model.Model{ID: 3}, OrganizationID: 1, AppKey: "sp", Site: "https://sp.example.com",
+			SAMLEntityID: "https://sp.example.com/metadata", SAMLACSURL: "https://sp.example.com/acs", SAMLNameIDFormat: SAMLNameIDFormatPersistent,
+		},
+		// 其他组织的应用，用户7不能访问
+		{
+			Model: model.Model{ID: 4}, OrganizationID: 2, AppKey: "other", Site: "https://other.example.com",
+			SAMLEntityID: "https://other.example.com/metadata", SAMLACSURL: "https://other.example.com/acs",
+		},
+	}}
+	gdb := openFakeDB(t, db.query)
+	var cfg config.Config
+	cfg.OIDC.Issuer = testIssuer
+	cfg.Keys.Dir = t.TempDir() // SAML证书保存在密钥目录
+	notifier, err := util.NewLogoutNotifier(gdb, j, testIssuer, 1, time.Second, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(cfg, gdb, util.NewMemoryStore(0), j, util.NewRevocationList(gdb), notifier, nil, nil, nil)
+	now := time.Now()
+	session, err := j.SignClaims(context.Background(), util.SessionClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        "session-jti",
+			Subject:   "7",
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+		SessionID: "s1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &protocolTest{t: t, h: h, session: session}
+}
+
+// authorize 以已登录用户访问 /authorize，返回跳转地址中的参数
+func (pt *protocolTest) authorize(params url.Values) url.Values {
+	pt.t.Helper()
+	req := httptest.NewRequest("GET", "/authorize?"+params.Encode(), nil)
+	req.AddCookie(&http.Cookie{Name: constants.SessionCookieName, Value: pt.session})
+	rw := httptest.NewRecorder()
+	if err := pt.h.OIDCAuthorize()(rw, bunrouter.NewRequest(req)); err != nil {
+		pt.t.Fatal(err)
+	}
+	if rw.Code != http.StatusFound {
+		pt.t.Fatalf("authorize status = %d, body = %s", rw.Code, rw.Body)
+	}
+	location, err := url.Parse(rw.Header().Get("Location"))
+	if err != nil {
+		pt.t.Fatal(err)
+	}
+	return location.Query()
+}
+
+// token 调用 /token，username不为空时使用 client_secret_basic
+func (pt *protocolTest) token(form url.Values, username, password string) (int, map[string]string) {
+	pt.t.Helper()
+	req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if username != "" {
+		req.SetBasicAuth(username, password)
+	}
+	rw := httptest.NewRecorder()
+	if err := pt.h.OIDCToken()(rw, bunrouter.NewRequest(req)); err != nil {
+		pt.t.Fatal(err)
+	}
+	var body map[string]any
+	if err := json.Unmarshal(rw.Body.Bytes(), &body); err != nil {
+		pt.t.Fatal(err)
+	}
+	values := make(map[string]string)
+	for k, v := range body {
+		if s, ok := v.(string); ok {
+			values[k] = s
+		}
+	}
+	return rw.Code, values
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func authorizeParams(clientID, redirectURI, verifier string) url.Values {
+	params := url.Values{
+		"client_id":     {clientID},
+		"redirect_uri":  {redirectURI},
+		"response_type": {"code"},
+		"scope":         {"openid profile"},
+		"state":         {"xyz"},
+		"nonce":         {"n-1"},
+	}
+	if verifier != "" {
+		params.Set("code_challenge", pkceChallenge(verifier))
+		params.Set("code_challenge_method", pkceMethodS256)
+	}
+	return params
+}
+
+const testVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+
+func TestOIDCAuthorizationCodeFlow(t *testing.T) {
+	tests := []struct {
+		name         string
+		clientID     string
+		redirectURI  string
+		verifier     string
+		basicUser    string
+		basicPass    string
+		clientSecret string
+	}{
+		{"confidential basic", "web", "https://web.example.com/cb", "", "web", "web-secret", ""},
+		{"confidential post with pkce", "web", "https://web.example.com/cb", testVerifier, "", "", "web-secret"},
+		{"public", "spa", "https://spa.example.com/cb", testVerifier, "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pt := newProtocolTest(t)
+			params := pt.authorize(authorizeParams(tt.clientID, tt.redirectURI, tt.verifier))
+			if params.Get("error") != "" || params.Get("code") == "" || params.Get("state") != "xyz" {
+				t.Fatalf("authorize redirect = %v", params)
+			}
+			form := url.Values{
+				"grant_type":   {"authorization_code"},
+				"code":         {params.Get("code")},
+				"redirect_uri": {tt.redirectURI},
+			}
+			if tt.basicUser == "" {
+				form.Set("client_id", tt.clientID)
+			}
+			if tt.clientSecret != "" {
+				form.Set("client_secret", tt.clientSecret)
+			}
+			if tt.verifier != "" {
+				form.Set("code_verifier", tt.verifier)
+			}
+			status, body := pt.token(form, tt.basicUser, tt.basicPass)
+			if status != http.StatusOK {
+				t.Fatalf("token status = %d, body = %v", status, body)
+			}
+			var claims IDTokenClaims
+			if err := pt.h.j.VerifyClaims(context.Background(), body["id_token"], &claims); err != nil {
+				t.Fatal(err)
+			}
+			if claims.Issuer != testIssuer || claims.Subject != "7" || claims.Nonce != "n-1" ||
+				len(claims.Audience) != 1 || claims.Audience[0] != tt.clientID || claims.PreferredUsername != "alice" {
+				t.Errorf("id_token claims = %+v", claims)
+			}
+			// 授权码只能使用一次
+			if status, body := pt.token(form, tt.basicUser, tt.basicPass); status != http.StatusBadRequest || body["error"] != "invalid_grant" {
+				t.Errorf("replay = %d %v", status, body)
+			}
+		})
+	}
+}
+
+func TestOIDCTokenRejected(t *testing.T) {
+	tests := []struct {
+		name      string
+		clientID  string
+		verifier  string
+		form      url.Values
+		basicUser string
+		basicPass string
+		wantError string
+	}{
+		{"public without verifier", "spa", testVerifier, url.Values{"client_id": {"spa"}}, "", "", "invalid_grant"},
+		{"public wrong verifier", "spa", testVerifier, url.Values{"client_id": {"spa"}, "code_verifier": {strings.Repeat("x", 43)}}, "", "", "invalid_grant"},
+		{"public with secret", "spa", testVerifier, url.Values{"client_id": {"spa"}, "client_secret": {"guess"}, "code_verifier": {testVerifier}}, "", "", "invalid_client"},
+		{"confidential without secret", "web", "", url.Values{"client_id": {"web"}}, "", "", "invalid_client"},
+		{"confidential wrong secret", "web", "", nil, "web", "guess", "invalid_client"},
+		{"code of other client", "spa", testVerifier, url.Values{"code_verifier": {testVerifier}}, "web", "web-secret", "invalid_grant"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pt := newProtocolTest(t)
+			redirectURI := "https://" + tt.clientID + ".example.com/cb"
+			params := pt.authorize(authorizeParams(tt.clientID, redirectURI, tt.verifier))
+			form := url.Values{
+				"grant_type":   {"authorization_code"},
+				"code":         {params.Get("code")},
+				"redirect_uri": {redirectURI},
+			}
+			for k, v := range tt.form {
+				form[k] = v
+			}
+			status, body := pt.token(form, tt.basicUser, tt.basicPass)
+			if body["error"] != tt.wantError || status == http.StatusOK {
+				t.Errorf("token = %d %v, want %s", status, body, tt.wantError)
+			}
+		})
+	}
+}
+
+// 没有client_secret的应用在 /authorize 就必须提供S256的code_challenge
+func TestOIDCAuthorizePublicClientRequiresPKCE(t *testing.T) {
+	pt := newProtocolTest(t)
+	params := pt.authorize(authorizeParams("spa", "https://spa.example.com/cb", ""))
+	if params.Get("error") != "invalid_request" || params.Get("code") != "" {
+		t.Errorf("authorize redirect = %v", params)
+	}
+}
+
+// 只接受S256，缺少code_challenge_method时不再按plain处理
+func TestOIDCAuthorizeChallengeMethod(t *testing.T) {
+	tests := []struct {
+		name      string
+		method    string
+		wantError string
+	}{
+		{"S256", pkceMethodS256, ""},
+		{"plain", "plain", "invalid_request"},
+		{"missing", "", "invalid_request"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pt := newProtocolTest(t)
+			params := authorizeParams("web", "https://web.example.com/cb", testVerifier)
+			params.Set("code_challenge_method", tt.method)
+			if params := pt.authorize(params); params.Get("error") != tt.wantError {
+				t.Errorf("authorize redirect = %v, want error %q", params, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestOIDCDiscoveryChallengeMethods(t *testing.T) {
+	pt := newProtocolTest(t)
+	rw := httptest.NewRecorder()
+	if err := pt.h.OIDCDiscovery()(rw, bunrouter.NewRequest(httptest.NewRequest("GET", "/.well-known/openid-configuration", nil))); err != nil {
+		t.Fatal(err)
+	}
+	var discovery OIDCDiscoveryResponse
+	if err := json.Unmarshal(rw.Body.Bytes(), &discovery); err != nil {
+		t.Fatal(err)
+	}
+	if methods := discovery.CodeChallengeMethodsSupported; len(methods) != 1 || methods[0] != pkceMethodS256 {
+		t.Errorf("code_challenge_methods_supported = %q", methods)
+	}
+}
+
+// issuer只来自配置，请求的Host不影响
+func TestOIDCDiscoveryIgnoresHost(t *testing.T) {
+	pt := newProtocolTest(t)
+	req := httptest.NewRequest("GET", "http://evil.example.com/.well-known/openid-configuration", nil)
+	rw := httptest.NewRecorder()
+	if err := pt.h.OIDCDiscovery()(rw, bunrouter.NewRequest(req)); err != nil {
+		t.Fatal(err)
+	}
+	var discovery OIDCDiscoveryResponse
+	if err := json.Unmarshal(rw.Body.Bytes(), &discovery); err != nil {
+		t.Fatal(err)
+	}
+	if discovery.Issuer != testIssuer || discovery.TokenEndpoint != testIssuer+"/token" {
+		t.Errorf("discovery = %+v", discovery)
+	}
+}
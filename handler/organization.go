@@ -0,0 +1,252 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"git.blauwelle.com/go/crate/log"
+	"github.com/uptrace/bunrouter"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"git.blauwelle.com/go/crate/cmd/sso/constants"
+	"git.blauwelle.com/go/crate/cmd/sso/middleware"
+	"git.blauwelle.com/go/crate/cmd/sso/model"
+	"git.blauwelle.com/go/crate/cmd/sso/response"
+)
+
+// 新组织的admin角色拥有的权限，只能管理本组织
+var organizationAdminPermissions = []string{
+	constants.PermissionUserRead,
+	constants.PermissionUserWrite,
+	constants.PermissionAppRead,
+	constants.PermissionAppWrite,
+	constants.PermissionRoleRead,
+	constants.PermissionRoleWrite,
+	constants.PermissionAuditRead,
+}
+
+var organizationSlugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,63}$`)
+
+type OrganizationRequest struct {
+	ID          uint   `json:"id"` // 修改时使用
+	Name        string `json:"name"`
+	Slug        string `json:"slug"`
+	Domain      string `json:"domain"`
+	Description string `json:"description"`
+}
+
+type DeleteOrganizationRequest struct {
+	ID uint `json:"id"`
+}
+
+// CreateOrganization 创建组织及其admin角色
+func (h *Handler) CreateOrganization() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request OrganizationRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		organization, ok := normalizeOrganization(request)
+		if !ok {
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		exist, err := isExistOrganization(ctx, h.db, organization)
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if exist {
+			return response.Error(rw, response.MessageOrganizationExist, bunrouter.H{})
+		}
+		permissions, err := h.findPermissions(ctx, organizationAdminPermissions)
+		if err != nil {
+			return h.writeRoleError(ctx, rw, err)
+		}
+		if err := h.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&organization).Error; err != nil {
+				return err
+			}
+			role := model.Role{OrganizationID: organization.ID, Name: constants.Admin, Description: "管理本组织"}
+			if err := tx.Create(&role).Error; err != nil {
+				return err
+			}
+			return setRolePermissions(tx, role.ID, permissions)
+		}); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, bunrouter.H{"id": organization.ID})
+	}
+}
+
+// SearchOrganization 组织数量不多，不分页
+func (h *Handler) SearchOrganization() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		organizations := []model.Organization{}
+		if err := h.db.WithContext(r.Context()).Order("id").Find(&organizations).Error; err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, organizations)
+	}
+}
+
+func (h *Handler) UpdateOrganization() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request OrganizationRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		organization, ok := normalizeOrganization(request)
+		if !ok {
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		exist, err := isExistOrganization(ctx, h.db, organization)
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if exist {
+			return response.Error(rw, response.MessageOrganizationExist, bunrouter.H{})
+		}
+		DB := h.db.WithContext(ctx).Model(&model.Organization{}).Where("id = ?", request.ID).Updates(map[string]interface{}{
+			"name":        organization.Name,
+			"slug":        organization.Slug,
+			"domain":      organization.Domain,
+			"description": organization.Description,
+		})
+		if DB.Error != nil {
+			log.Error(ctx, DB.Error.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if DB.RowsAffected != 1 {
+			return response.Error(rw, response.MessageOrganizationNotExist, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
+	}
+}
+
+// DeleteOrganization 只能删除没有用户、应用和组的组织，默认组织不能删除
+func (h *Handler) DeleteOrganization() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request DeleteOrganizationRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		if request.ID == constants.DefaultOrganizationID {
+			return response.Error(rw, response.MessageOrganizationNotEmpty, bunrouter.H{})
+		}
+		for _, table := range []interface{}{&model.User{}, &model.Application{}, &model.Group{}} {
+			var count int64
+			if err := h.db.WithContext(ctx).Model(table).Where("organization_id = ?", request.ID).Count(&count).Error; err != nil {
+				return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+			}
+			if count > 0 {
+				return response.Error(rw, response.MessageOrganizationNotEmpty, bunrouter.H{})
+			}
+		}
+		if err := h.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			roleIDs := tx.Model(&model.Role{}).Select("id").Where("organization_id = ?", request.ID)
+			invitationIDs := tx.Model(&model.Invitation{}).Select("id").Where("organization_id = ?", request.ID)
+			if err := tx.Where("role_id IN (?)", roleIDs).Delete(&model.RolePermission{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("invitation_id IN (?)", invitationIDs).Delete(&model.InvitationRole{}).Error; err != nil {
+				return err
+			}
+			for _, table := range []interface{}{&model.Role{}, &model.Invitation{}} {
+				if err := tx.Unscoped().Where("organization_id = ?", request.ID).Delete(table).Error; err != nil {
+					return err
+				}
+			}
+			// 直接删除记录，名称和路径可以重新使用
+			return tx.Unscoped().Delete(&model.Organization{}, "id = ?", request.ID).Error
+		}); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
+	}
+}
+
+// 管理接口的查询限制在当前操作的组织内，见 middleware.Tenant
+func (h *Handler) tenant(ctx context.Context) *gorm.DB {
+	return h.db.WithContext(ctx).Where(clause.Eq{
+		Column: clause.Column{Table: clause.CurrentTable, Name: "organization_id"},
+		Value:  currentOrganizationID(ctx),
+	}).Session(&gorm.Session{})
+}
+
+// 当前组织的应用ID，用于限制应用角色等没有组织字段的数据
+func (h *Handler) tenantAppIDs(ctx context.Context) *gorm.DB {
+	return h.tenant(ctx).Model(&model.Application{}).Select("id")
+}
+
+func currentOrganizationID(ctx context.Context) uint {
+	return middleware.ContextOrganization{}.Value(ctx)
+}
+
+// 登录时选择的组织：路径中的组织标识优先，其次按请求的域名匹配，都没有时为默认组织
+func (h *Handler) loginOrganization(r bunrouter.Request) (uint, bool, error) {
+	var organization model.Organization
+	if slug := r.Param("org"); slug != "" {
+		DB := h.db.WithContext(r.Context()).Where("slug = ?", slug).Find(&organization)
+		if DB.Error != nil || DB.RowsAffected != 1 {
+			return 0, false, DB.Error
+		}
+		return organization.ID, true, nil
+	}
+	host := r.Host
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	host = strings.ToLower(host)
+	DB := h.db.WithContext(r.Context()).Where("domain = ? AND domain <> ''", host).Find(&organization)
+	if DB.Error != nil {
+		return 0, false, DB.Error
+	}
+	if DB.RowsAffected == 1 {
+		return organization.ID, true, nil
+	}
+	return constants.DefaultOrganizationID, true, nil
+}
+
+func normalizeOrganization(request OrganizationRequest) (model.Organization, bool) {
+	organization := model.Organization{
+		Model:       model.Model{ID: request.ID},
+		Name:        strings.TrimSpace(request.Name),
+		Slug:        strings.ToLower(strings.TrimSpace(request.Slug)),
+		Domain:      strings.ToLower(strings.TrimSpace(request.Domain)),
+		Description: request.Description,
+	}
+	if organization.Name == "" || len(organization.Name) > 64 || !organizationSlugPattern.MatchString(organization.Slug) {
+		return model.Organization{}, false
+	}
+	if len(organization.Domain) > 255 || strings.ContainsAny(organization.Domain, "/: ") {
+		return model.Organization{}, false
+	}
+	return organization, true
+}
+
+// 名称、路径或域名与其他组织重复
+func isExistOrganization(ctx context.Context, db *gorm.DB, organization model.Organization) (bool, error) {
+	query := db.WithContext(ctx).Model(&model.Organization{}).Where("id <> ?", organization.ID)
+	if organization.Domain != "" {
+		query = query.Where("name = ? OR slug = ? OR domain = ?", organization.Name, organization.Slug, organization.Domain)
+	} else {
+		query = query.Where("name = ? OR slug = ?", organization.Name, organization.Slug)
+	}
+	var count int64
+	if err := query.Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/uptrace/bunrouter"
+
+	"git.blauwelle.com/go/crate/cmd/sso/constants"
+	"git.blauwelle.com/go/crate/cmd/sso/middleware"
+	"git.blauwelle.com/go/crate/cmd/sso/response"
+)
+
+// callTenant 经过 middleware.Tenant 调用接口，header不为空时指定操作的组织
+func (rt *rbacTest) callTenant(handler bunrouter.HandlerFunc, userID uint, header string, body any) response.GenResponse[json.RawMessage] {
+	rt.t.Helper()
+	b, err := json.Marshal(body)
+	if err != nil {
+		rt.t.Fatal(err)
+	}
+	req := asUser(httptest.NewRequest("POST", "/", strings.NewReader(string(b))), userID, 0)
+	if header != "" {
+		req.Header.Set(constants.HTTPHeaderOrganization, header)
+	}
+	rw := httptest.NewRecorder()
+	if err := middleware.Tenant(rt.h.db)(handler)(rw, bunrouter.NewRequest(req)); err != nil {
+		rt.t.Fatal(err)
+	}
+	var resp response.GenResponse[json.RawMessage]
+	if err := json.Unmarshal(rw.Body.Bytes(), &resp); err != nil {
+		rt.t.Fatal(err)
+	}
+	return resp
+}
+
+func TestTenant(t *testing.T) {
+	tests := []struct {
+		name     string
+		userID   uint
+		header   string
+		wantCode string
+		wantOrg  string
+	}{
+		{"own organization", 8, "", response.MessageOK, "1"},
+		{"other user's own organization", 10, "", response.MessageOK, "2"},
+		{"own organization in header", 8, "1", response.MessageOK, "1"},
+		{"other organization without org:write", 8, "2", response.MessageUnauthorized, ""},
+		{"other organization with org:write", 7, "2", response.MessageOK, "2"},
+		{"unknown organization", 7, "99", response.MessageOrganizationNotExist, ""},
+		{"invalid header", 7, "x", response.MessageBindError, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := newRBACTest(t)
+			next := func(rw http.ResponseWriter, r bunrouter.Request) error {
+				return response.WriteOK(rw, response.MessageOK, strconv.Itoa(int(currentOrganizationID(r.Context()))))
+			}
+			resp := rt.callTenant(next, tt.userID, tt.header, struct{}{})
+			if resp.Message != tt.wantCode {
+				t.Fatalf("got %s, want %s", resp.Message, tt.wantCode)
+			}
+			var org string
+			_ = json.Unmarshal(resp.Data, &org)
+			if org != tt.wantOrg {
+				t.Errorf("organization = %q, want %q", org, tt.wantOrg)
+			}
+		})
+	}
+}
+
+// 管理接口只能看到当前操作的组织中的用户和角色
+func TestTenantScopesHandlers(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   string
+		request  RoleMemberRequest
+		wantCode string
+	}{
+		{"own organization", "", RoleMemberRequest{RoleID: 3, UserID: 9}, response.MessageOK},
+		{"role of other organization", "", RoleMemberRequest{RoleID: 4, UserID: 9}, response.MessageRoleNotExist},
+		{"user of other organization", "", RoleMemberRequest{RoleID: 3, UserID: 10}, response.MessageUserNotExist},
+		{"selected organization", "2", RoleMemberRequest{RoleID: 4, UserID: 10}, response.MessageOK},
+		{"role outside selected organization", "2", RoleMemberRequest{RoleID: 3, UserID: 10}, response.MessageRoleNotExist},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := newRBACTest(t)
+			if got := rt.callTenant(rt.h.AddRoleMember(), 7, tt.header, tt.request).Message; got != tt.wantCode {
+				t.Errorf("got %s, want %s", got, tt.wantCode)
+			}
+			row := [2]int64{int64(tt.request.UserID), int64(tt.request.RoleID)}
+			if rt.db.has("user_roles", row) != (tt.wantCode == response.MessageOK) {
+				t.Errorf("user_roles = %v", rt.db.relations["user_roles"].rows)
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"git.blauwelle.com/go/crate/log"
+	"github.com/uptrace/bunrouter"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+
+	"git.blauwelle.com/go/crate/cmd/sso/config"
+	"git.blauwelle.com/go/crate/cmd/sso/model"
+	"git.blauwelle.com/go/crate/cmd/sso/response"
+	"git.blauwelle.com/go/crate/cmd/sso/util"
+)
+
+// 密码过期时签发password_token，只能用于修改密码
+const (
+	passwordTokenAudience = "password"
+	passwordTokenTTL      = 10 * time.Minute
+)
+
+type PasswordExpiredResponse struct {
+	PasswordToken string `json:"password_token"`
+}
+
+type ChangeExpiredPasswordRequest struct {
+	PasswordToken string `json:"password_token"`
+	NewPassword   string `json:"newPassword"`
+}
+
+type PasswordPolicyResponse struct {
+	Violations []util.PasswordViolation `json:"violations"`
+}
+
+func newPasswordPolicy(cfg config.PasswordConfig) util.PasswordPolicy {
+	policy := util.PasswordPolicy{
+		MinLength:        cfg.MinLength,
+		MaxLength:        cfg.MaxLength,
+		RequireUpper:     cfg.RequireUpper,
+		RequireLower:     cfg.RequireLower,
+		RequireDigit:     cfg.RequireDigit,
+		RequireSymbol:    cfg.RequireSymbol,
+		DisallowUsername: cfg.DisallowUsername,
+		History:          cfg.History,
+		MaxAge:           time.Duration(cfg.MaxAge) * 24 * time.Hour,
+	}
+	if cfg.BreachedDir != "" {
+		policy.Breached = util.NewBreachedPasswords(cfg.BreachedDir)
+	}
+	return policy
+}
+
+// ChangeExpiredPassword 使用登录时返回的password_token修改过期的密码，之后继续登录流程
+func (h *Handler) ChangeExpiredPassword() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request ChangeExpiredPasswordRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		token, ok := h.parseLoginToken(ctx, request.PasswordToken, passwordTokenAudience)
+		if !ok {
+			return response.Error(rw, response.MessagePasswordTokenInvalid, bunrouter.H{})
+		}
+		user, ok, err := isExistUserByID(token.userID, h.db)
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if !ok {
+			return response.Error(rw, response.MessageUserNotExist, bunrouter.H{})
+		}
+		// 同一个token只能修改一次，修改后密码不再过期
+		if !h.passwordExpired(user) {
+			return response.Error(rw, response.MessagePasswordTokenInvalid, bunrouter.H{})
+		}
+		if err := h.setPassword(ctx, user, request.NewPassword); err != nil {
+			return h.writePasswordError(ctx, rw, err)
+		}
+		// 撤销用户的token精确到秒，同一秒内签发的password_token需要单独撤销
+		if err := h.revocations.RevokeToken(ctx, util.SessionClaims{RegisteredClaims: token.claims}); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if err := h.revokeUserTokens(ctx, user.ID); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return h.finishLogin(ctx, rw, user.ID)
+	}
+}
+
+// 本地用户的密码是否超过有效期，外部目录的用户由目录管理
+func (h *Handler) passwordExpired(user model.User) bool {
+	if user.Source != model.UserSourceLocal {
+		return false
+	}
+	changedAt := user.CreatedAt
+	if user.PasswordChangedAt != nil {
+		changedAt = *user.PasswordChangedAt
+	}
+	return h.passwords.Expired(changedAt, time.Now())
+}
+
+// 按密码策略校验并修改密码，旧密码保存到历史记录
+func (h *Handler) setPassword(ctx context.Context, user model.User, password string) error {
+	if err := h.checkNewPassword(ctx, user, password); err != nil {
+		return err
+	}
+	return h.savePassword(ctx, user, password)
+}
+
+func (h *Handler) checkNewPassword(ctx context.Context, user model.User, password string) error {
+	if err := h.passwords.Check(user.Username, password); err != nil {
+		return err
+	}
+	return h.checkPasswordHistory(ctx, user, password)
+}
+
+// 保存已通过校验的新密码
+func (h *Handler) savePassword(ctx context.Context, user model.User, password string) error {
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+	if err != nil {
+		return err
+	}
+	history := h.passwords.History
+	return h.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if history > 0 && user.PasswordHash != "" {
+			if err := tx.Create(&model.PasswordHistory{UserID: user.ID, PasswordHash: user.PasswordHash}).Error; err != nil {
+				return err
+			}
+			// 只保留最近history条
+			var ids []uint
+			if err := tx.Model(&model.PasswordHistory{}).Where("user_id = ?", user.ID).
+				Order("id DESC").Pluck("id", &ids).Error; err != nil {
+				return err
+			}
+			if len(ids) > history {
+				if err := tx.Delete(&model.PasswordHistory{}, ids[history:]).Error; err != nil {
+					return err
+				}
+			}
+		}
+		return tx.Model(&model.User{}).Where("id = ?", user.ID).Updates(map[string]interface{}{
+			"password_hash":       string(passwordHash),
+			"password_changed_at": time.Now(),
+		}).Error
+	})
+}
+
+// 新密码不能与当前密码和最近的旧密码相同
+func (h *Handler) checkPasswordHistory(ctx context.Context, user model.User, password string) error {
+	history := h.passwords.History
+	if history <= 0 {
+		return nil
+	}
+	hashes := []string{user.PasswordHash}
+	var previous []string
+	if err := h.db.WithContext(ctx).Model(&model.PasswordHistory{}).Where("user_id = ?", user.ID).
+		Order("id DESC").Limit(history).Pluck("password_hash", &previous).Error; err != nil {
+		return err
+	}
+	hashes = append(hashes, previous...)
+	for _, hash := range hashes {
+		if hash != "" && bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil {
+			return &util.PasswordPolicyError{Violations: []util.PasswordViolation{
+				{Rule: util.PasswordRuleHistory, Limit: history},
+			}}
+		}
+	}
+	return nil
+}
+
+func (h *Handler) writePasswordError(ctx context.Context, rw http.ResponseWriter, err error) error {
+	var policyErr *util.PasswordPolicyError
+	if errors.As(err, &policyErr) {
+		return response.Error(rw, response.MessagePasswordPolicy, PasswordPolicyResponse{Violations: policyErr.Violations})
+	}
+	log.Error(ctx, err.Error())
+	return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+}
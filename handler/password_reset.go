@@ -0,0 +1,156 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"git.blauwelle.com/go/crate/log"
+	"github.com/uptrace/bunrouter"
+
+	"git.blauwelle.com/go/crate/cmd/sso/model"
+	"git.blauwelle.com/go/crate/cmd/sso/response"
+	"git.blauwelle.com/go/crate/cmd/sso/util"
+)
+
+// 同一用户两次发送重置邮件的最小间隔
+const passwordResetInterval = time.Minute
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type ResetPasswordRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"newPassword"`
+}
+
+// ForgotPassword 向邮箱发送重置密码的链接
+// 无论邮箱是否存在都返回成功，邮件在后台发送，避免通过响应内容或时间判断邮箱是否注册
+func (h *Handler) ForgotPassword() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request ForgotPasswordRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		email, ok := normalizeEmail(request.Email)
+		if !ok {
+			return response.Error(rw, response.MessageEmailInvalid, bunrouter.H{})
+		}
+		go func(ctx context.Context) {
+			if err := h.sendPasswordReset(ctx, email); err != nil {
+				log.Error(ctx, "send password reset: "+err.Error())
+			}
+		}(context.WithoutCancel(ctx))
+		return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
+	}
+}
+
+// ResetPassword 使用邮件中的token设置新密码，token只能使用一次
+func (h *Handler) ResetPassword() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request ResetPasswordRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		now := time.Now()
+		var token model.PasswordResetToken
+		DB := h.db.WithContext(ctx).Where("token_hash = ? AND used_at IS NULL AND expires_at > ?",
+			hashMailToken(request.Token), now).Find(&token)
+		if DB.Error != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if DB.RowsAffected != 1 {
+			return response.Error(rw, response.MessageResetTokenInvalid, bunrouter.H{})
+		}
+		user, ok, err := isExistUserByID(token.UserID, h.db)
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if !ok || user.Source != model.UserSourceLocal {
+			return response.Error(rw, response.MessageResetTokenInvalid, bunrouter.H{})
+		}
+		// 新密码不符合策略时token仍然可用
+		if err := h.checkNewPassword(ctx, user, request.NewPassword); err != nil {
+			return h.writePasswordError(ctx, rw, err)
+		}
+		// 并发请求中只有一个能成功使用token
+		DB = h.db.WithContext(ctx).Model(&model.PasswordResetToken{}).
+			Where("id = ? AND used_at IS NULL", token.ID).Update("used_at", now)
+		if DB.Error != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if DB.RowsAffected != 1 {
+			return response.Error(rw, response.MessageResetTokenInvalid, bunrouter.H{})
+		}
+		if err := h.savePassword(ctx, user, request.NewPassword); err != nil {
+			return h.writePasswordError(ctx, rw, err)
+		}
+		if err := h.db.WithContext(ctx).Where("user_id = ? AND used_at IS NULL", user.ID).
+			Delete(&model.PasswordResetToken{}).Error; err != nil {
+			log.Error(ctx, err.Error())
+		}
+		// 重置后已有会话全部失效，并解除登录锁定
+		if err := h.revokeUserTokens(ctx, user.ID); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if err := h.limiter.UnlockUser(ctx, user.Username); err != nil {
+			log.Error(ctx, err.Error())
+		}
+		return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
+	}
+}
+
+func (h *Handler) sendPasswordReset(ctx context.Context, email string) error {
+	user, ok, err := isExistUserByEmail(email, h.db)
+	if err != nil {
+		return err
+	}
+	// 外部目录的用户密码由目录管理；未验证的邮箱可能不属于该用户
+	if !ok || user.Source != model.UserSourceLocal || user.EmailVerifiedAt == nil {
+		return nil
+	}
+	now := time.Now()
+	var recent int64
+	if err := h.db.WithContext(ctx).Model(&model.PasswordResetToken{}).
+		Where("user_id = ? AND created_at > ?", user.ID, now.Add(-passwordResetInterval)).
+		Count(&recent).Error; err != nil {
+		return err
+	}
+	if recent > 0 {
+		return nil
+	}
+
+	// 之前发送的链接全部失效
+	if err := h.db.WithContext(ctx).Where("user_id = ? AND used_at IS NULL", user.ID).
+		Delete(&model.PasswordResetToken{}).Error; err != nil {
+		return err
+	}
+	token := h.r.RandString(32)
+	if err := h.db.WithContext(ctx).Create(&model.PasswordResetToken{
+		TokenHash: hashMailToken(token),
+		UserID:    user.ID,
+		ExpiresAt: now.Add(time.Duration(h.cfg.Password.ResetTTL) * time.Second),
+	}).Error; err != nil {
+		return err
+	}
+
+	link, err := mailLink(h.cfg.Password.ResetURL, h.cfg.OIDC.LoginURL, "token", token)
+	if err != nil {
+		return err
+	}
+	return h.mailer.Send(ctx, util.Mail{
+		To:      []string{email},
+		Subject: "重置密码",
+		Body: "你好 " + user.Username + "，\n\n" +
+			"请在" + (time.Duration(h.cfg.Password.ResetTTL) * time.Second).String() + "内打开以下链接设置新密码：\n\n" +
+			link + "\n\n" +
+			"如果不是你本人的操作，请忽略这封邮件。\n",
+	})
+}
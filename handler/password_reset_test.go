@@ -0,0 +1,416 @@
+package handler
+
+import (
+	"bufio"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/quotedprintable"
+	"net"
+	"net/http/httptest"
+	"net/mail"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uptrace/bunrouter"
+	"golang.org/x/crypto/bcrypt"
+
+	"git.blauwelle.com/go/crate/cmd/sso/config"
+	"git.blauwelle.com/go/crate/cmd/sso/model"
+	"git.blauwelle.com/go/crate/cmd/sso/response"
+	"git.blauwelle.com/go/crate/cmd/sso/util"
+)
+
+// fakeSMTP 只接收邮件的SMTP服务，每封邮件的DATA部分写入messages
+type fakeSMTP struct {
+	ln       net.Listener
+	messages chan fakeSMTPMessage
+}
+
+type fakeSMTPMessage struct {
+	from string
+	to   []string
+	data string
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTP{ln: ln, messages: make(chan fakeSMTPMessage, 8)}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { fmt.Fprintf(conn, "%s\r\n", line) }
+	reply("220 fake ESMTP")
+	var msg fakeSMTPMessage
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch {
+		case verb == "EHLO" || verb == "HELO":
+			reply("250 fake")
+		case strings.HasPrefix(strings.ToUpper(line), "MAIL FROM:"):
+			msg = fakeSMTPMessage{from: strings.Trim(line[len("MAIL FROM:"):], "<>")}
+			reply("250 OK")
+		case strings.HasPrefix(strings.ToUpper(line), "RCPT TO:"):
+			msg.to = append(msg.to, strings.Trim(line[len("RCPT TO:"):], "<>"))
+			reply("250 OK")
+		case verb == "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(l, "."))
+			}
+			msg.data = data.String()
+			s.messages <- msg
+			reply("250 queued")
+		case verb == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func (s *fakeSMTP) mailer() *util.SMTPMailer {
+	addr := s.ln.Addr().(*net.TCPAddr)
+	return &util.SMTPMailer{
+		Host:     "127.0.0.1",
+		Port:     addr.Port,
+		From:     "SSO <sso@example.com>",
+		Security: util.SMTPSecurityNone,
+		Timeout:  5 * time.Second,
+	}
+}
+
+func (s *fakeSMTP) next(t *testing.T) fakeSMTPMessage {
+	t.Helper()
+	select {
+	case msg := <-s.messages:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no mail received")
+		return fakeSMTPMessage{}
+	}
+}
+
+func (s *fakeSMTP) none(t *testing.T) {
+	t.Helper()
+	select {
+	case msg := <-s.messages:
+		t.Fatalf("unexpected mail to %v", msg.to)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// resetDB 只实现重置密码流程用到的users和password_reset_tokens两张表，其他语句视为成功且没有数据
+type resetDB struct {
+	mu     sync.Mutex
+	user   model.User
+	tokens []model.PasswordResetToken
+}
+
+func (d *resetDB) query(q string, args []driver.Value) ([]string, [][]driver.Value, int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch {
+	case strings.HasPrefix(q, "SELECT * FROM `users`"):
+		if (strings.Contains(q, "email = ?") && d.user.Email != nil && args[0] == *d.user.Email) ||
+			(strings.Contains(q, "id = ?") && args[0] == int64(d.user.ID)) {
+			return userColumns, [][]driver.Value{userRow(d.user)}, 0
+		}
+		return userColumns, nil, 0
+	case strings.HasPrefix(q, "UPDATE `users`"):
+		columns := strings.Split(setColumnsPattern.FindStringSubmatch(q)[1], ",")
+		for i, column := range columns {
+			if strings.HasPrefix(column, "`password_hash`") {
+				d.user.PasswordHash = args[i].(string)
+			}
+		}
+		return nil, nil, 1
+	case strings.HasPrefix(q, "SELECT count(*) FROM `password_reset_tokens`"):
+		var n int64
+		for _, token := range d.tokens {
+			if args[0] == int64(token.UserID) && token.CreatedAt.After(args[1].(time.Time)) {
+				n++
+			}
+		}
+		return []string{"count(*)"}, [][]driver.Value{{n}}, 0
+	case strings.HasPrefix(q, "DELETE FROM `password_reset_tokens`"):
+		var n int64
+		kept := d.tokens[:0]
+		for _, token := range d.tokens {
+			if args[0] == int64(token.UserID) && token.UsedAt == nil {
+				n++
+				continue
+			}
+			kept = append(kept, token)
+		}
+		d.tokens = kept
+		return nil, nil, n
+	case strings.HasPrefix(q, "INSERT INTO `password_reset_tokens`"):
+		token := model.PasswordResetToken{ID: uint(len(d.tokens) + 1)}
+		for i, column := range strings.Split(insertColumnsPattern.FindStringSubmatch(q)[1], ",") {
+			switch column {
+			case "`token_hash`":
+				token.TokenHash = args[i].(string)
+			case "`user_id`":
+				token.UserID = uint(args[i].(int64))
+			case "`expires_at`":
+				token.ExpiresAt = args[i].(time.Time)
+			case "`created_at`":
+				token.CreatedAt = args[i].(time.Time)
+			}
+		}
+		d.tokens = append(d.tokens, token)
+		return nil, nil, 1
+	case strings.HasPrefix(q, "SELECT * FROM `password_reset_tokens`"):
+		// 条件按语句中实际出现的部分判断，语句去掉条件时测试能发现
+		for _, token := range d.tokens {
+			if args[0] != token.TokenHash {
+				continue
+			}
+			if strings.Contains(q, "used_at IS NULL") && token.UsedAt != nil {
+				continue
+			}
+			if strings.Contains(q, "expires_at > ?") && !token.ExpiresAt.After(args[1].(time.Time)) {
+				continue
+			}
+			return resetTokenColumns, [][]driver.Value{resetTokenRow(token)}, 0
+		}
+		return resetTokenColumns, nil, 0
+	case strings.HasPrefix(q, "UPDATE `password_reset_tokens` SET `used_at`=?"):
+		for i, token := range d.tokens {
+			if args[1] == int64(token.ID) && (token.UsedAt == nil || !strings.Contains(q, "used_at IS NULL")) {
+				usedAt := args[0].(time.Time)
+				d.tokens[i].UsedAt = &usedAt
+				return nil, nil, 1
+			}
+		}
+		return nil, nil, 0
+	}
+	return nil, nil, 0
+}
+
+var (
+	userColumns       = []string{"id", "created_at", "updated_at", "organization_id", "username", "password_hash", "source", "email", "email_verified_at"}
+	resetTokenColumns = []string{"id", "token_hash", "user_id", "expires_at", "used_at", "created_at"}
+)
+
+func userRow(user model.User) []driver.Value {
+	return []driver.Value{
+		int64(user.ID), user.CreatedAt, user.UpdatedAt, int64(user.OrganizationID),
+		user.Username, user.PasswordHash, user.Source, *user.Email, *user.EmailVerifiedAt,
+	}
+}
+
+func resetTokenRow(token model.PasswordResetToken) []driver.Value {
+	var usedAt driver.Value
+	if token.UsedAt != nil {
+		usedAt = *token.UsedAt
+	}
+	return []driver.Value{int64(token.ID), token.TokenHash, int64(token.UserID), token.ExpiresAt, usedAt, token.CreatedAt}
+}
+
+type resetTest struct {
+	t    *testing.T
+	h    *Handler
+	db   *resetDB
+	smtp *fakeSMTP
+}
+
+func newResetTest(t *testing.T, resetTTL int) *resetTest {
+	email := "alice@example.com"
+	verifiedAt := time.Now().Add(-time.Hour)
+	hash, err := bcrypt.GenerateFromPassword([]byte("Old-password-1"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &resetDB{user: model.User{
+		Model:           model.Model{ID: 7, CreatedAt: verifiedAt, UpdatedAt: verifiedAt},
+		OrganizationID:  1,
+		Username:        "alice",
+		PasswordHash:    string(hash),
+		Source:          model.UserSourceLocal,
+		Email:           &email,
+		EmailVerifiedAt: &verifiedAt,
+	}}
+	gdb := openFakeDB(t, db.query)
+	var cfg config.Config
+	cfg.Password.MinLength = 8
+	cfg.Password.MaxLength = 72
+	cfg.Password.ResetTTL = resetTTL
+	cfg.Password.ResetURL = "https://sso.example.com/reset"
+	smtp := newFakeSMTP(t)
+	limiter := util.NewLoginLimiter(util.NewMemoryLoginFailureStore(), util.LoginLimitPolicy{}, util.LoginLimitPolicy{}, time.Minute)
+	notifier, err := util.NewLogoutNotifier(gdb, nil, "https://sso.example.com", 1, time.Second, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(cfg, gdb, util.NewMemoryStore(0), nil, util.NewRevocationList(gdb), notifier, nil, limiter, smtp.mailer())
+	return &resetTest{t: t, h: h, db: db, smtp: smtp}
+}
+
+func (rt *resetTest) call(handler bunrouter.HandlerFunc, body interface{}) string {
+	rt.t.Helper()
+	b, err := json.Marshal(body)
+	if err != nil {
+		rt.t.Fatal(err)
+	}
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/", strings.NewReader(string(b)))
+	if err := handler(rw, bunrouter.NewRequest(req)); err != nil {
+		rt.t.Fatal(err)
+	}
+	var resp response.GenResponse[json.RawMessage]
+	if err := json.Unmarshal(rw.Body.Bytes(), &resp); err != nil {
+		rt.t.Fatal(err)
+	}
+	return resp.Message
+}
+
+var resetLinkPattern = regexp.MustCompile(`https://sso\.example\.com/reset\?token=([0-9A-Za-z]+)`)
+
+// 发送重置邮件并从中取出token
+func (rt *resetTest) forgot() string {
+	rt.t.Helper()
+	if msg := rt.call(rt.h.ForgotPassword(), ForgotPasswordRequest{Email: " Alice@Example.com "}); msg != response.MessageOK {
+		rt.t.Fatalf("forgot = %s", msg)
+	}
+	msg := rt.smtp.next(rt.t)
+	if msg.from != "sso@example.com" || len(msg.to) != 1 || msg.to[0] != "alice@example.com" {
+		rt.t.Fatalf("envelope from=%q to=%q", msg.from, msg.to)
+	}
+	parsed, err := mail.ReadMessage(strings.NewReader(msg.data))
+	if err != nil {
+		rt.t.Fatal(err)
+	}
+	if got := parsed.Header.Get("To"); got != "alice@example.com" {
+		rt.t.Errorf("To = %q", got)
+	}
+	if got := parsed.Header.Get("Content-Transfer-Encoding"); got != "quoted-printable" {
+		rt.t.Errorf("Content-Transfer-Encoding = %q", got)
+	}
+	body, err := io.ReadAll(quotedprintable.NewReader(parsed.Body))
+	if err != nil {
+		rt.t.Fatal(err)
+	}
+	if !strings.Contains(string(body), "你好 alice") {
+		rt.t.Errorf("body = %q", body)
+	}
+	match := resetLinkPattern.FindSubmatch(body)
+	if match == nil {
+		rt.t.Fatalf("no reset link in %q", body)
+	}
+	token := string(match[1])
+	// 数据库中只保存token的哈希
+	rt.db.mu.Lock()
+	defer rt.db.mu.Unlock()
+	for _, stored := range rt.db.tokens {
+		if stored.TokenHash == token {
+			rt.t.Error("token stored in plain text")
+		}
+	}
+	return token
+}
+
+func (rt *resetTest) reset(token, password string) string {
+	rt.t.Helper()
+	return rt.call(rt.h.ResetPassword(), ResetPasswordRequest{Token: token, NewPassword: password})
+}
+
+func (rt *resetTest) passwordIs(password string) bool {
+	rt.db.mu.Lock()
+	defer rt.db.mu.Unlock()
+	return bcrypt.CompareHashAndPassword([]byte(rt.db.user.PasswordHash), []byte(password)) == nil
+}
+
+func TestPasswordResetSingleUse(t *testing.T) {
+	rt := newResetTest(t, 1800)
+	token := rt.forgot()
+
+	// 不符合策略时token仍然可用
+	if msg := rt.reset(token, "short"); msg != response.MessagePasswordPolicy {
+		t.Fatalf("weak password = %s", msg)
+	}
+	if msg := rt.reset(token, "New-password-1"); msg != response.MessageOK {
+		t.Fatalf("reset = %s", msg)
+	}
+	if !rt.passwordIs("New-password-1") {
+		t.Error("password not changed")
+	}
+	if msg := rt.reset(token, "Another-password-2"); msg != response.MessageResetTokenInvalid {
+		t.Fatalf("reuse = %s", msg)
+	}
+	if !rt.passwordIs("New-password-1") {
+		t.Error("password changed by reused token")
+	}
+	if msg := rt.reset("not-a-token", "Another-password-2"); msg != response.MessageResetTokenInvalid {
+		t.Fatalf("unknown token = %s", msg)
+	}
+}
+
+func TestPasswordResetExpired(t *testing.T) {
+	rt := newResetTest(t, 1)
+	token := rt.forgot()
+	time.Sleep(1100 * time.Millisecond)
+	if msg := rt.reset(token, "New-password-1"); msg != response.MessageResetTokenInvalid {
+		t.Fatalf("expired = %s", msg)
+	}
+	if !rt.passwordIs("Old-password-1") {
+		t.Error("password changed by expired token")
+	}
+}
+
+// 一分钟内重复请求不再发送邮件，之前的链接仍然有效
+func TestPasswordResetRateLimited(t *testing.T) {
+	rt := newResetTest(t, 1800)
+	token := rt.forgot()
+	if msg := rt.call(rt.h.ForgotPassword(), ForgotPasswordRequest{Email: "alice@example.com"}); msg != response.MessageOK {
+		t.Fatalf("forgot = %s", msg)
+	}
+	rt.smtp.none(t)
+	if msg := rt.reset(token, "New-password-1"); msg != response.MessageOK {
+		t.Fatalf("reset = %s", msg)
+	}
+}
+
+// 未注册的邮箱同样返回成功，但不发送邮件
+func TestPasswordResetUnknownEmail(t *testing.T) {
+	rt := newResetTest(t, 1800)
+	if msg := rt.call(rt.h.ForgotPassword(), ForgotPasswordRequest{Email: "mallory@example.com"}); msg != response.MessageOK {
+		t.Fatalf("forgot = %s", msg)
+	}
+	rt.smtp.none(t)
+}
@@ -0,0 +1,161 @@
+package handler
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uptrace/bunrouter"
+	"golang.org/x/crypto/bcrypt"
+
+	"git.blauwelle.com/go/crate/cmd/sso/config"
+	"git.blauwelle.com/go/crate/cmd/sso/model"
+	"git.blauwelle.com/go/crate/cmd/sso/response"
+	"git.blauwelle.com/go/crate/cmd/sso/util"
+)
+
+// expiredDB 用户7的密码已过期；只记录按jti撤销的token，不实现按用户撤销，
+// 这样同一秒内签发的password_token只有单独撤销后才会失效
+type expiredDB struct {
+	mu      sync.Mutex
+	user    model.User
+	revoked map[string]bool
+}
+
+func (d *expiredDB) query(q string, args []driver.Value) ([]string, [][]driver.Value, int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch {
+	case strings.HasPrefix(q, "SELECT * FROM `users` WHERE id = ?") && args[0] == int64(d.user.ID):
+		return []string{"id", "created_at", "organization_id", "username", "password_hash", "source", "password_changed_at"},
+			[][]driver.Value{{int64(d.user.ID), d.user.CreatedAt, int64(d.user.OrganizationID), d.user.Username, d.user.PasswordHash, d.user.Source, *d.user.PasswordChangedAt}}, 0
+	case strings.HasPrefix(q, "UPDATE `users`"):
+		for i, column := range strings.Split(setColumnsPattern.FindStringSubmatch(q)[1], ",") {
+			switch {
+			case strings.HasPrefix(column, "`password_hash`"):
+				d.user.PasswordHash = args[i].(string)
+			case strings.HasPrefix(column, "`password_changed_at`"):
+				changedAt := args[i].(time.Time)
+				d.user.PasswordChangedAt = &changedAt
+			}
+		}
+		return nil, nil, 1
+	case strings.HasPrefix(q, "INSERT INTO `revoked_tokens`"):
+		d.revoked[insertedColumns(q, args)["jti"].(string)] = true
+		return nil, nil, 1
+	case strings.HasPrefix(q, "SELECT count(*) FROM `revoked_tokens` WHERE jti = ?"):
+		if d.revoked[args[0].(string)] {
+			return []string{"count(*)"}, [][]driver.Value{{int64(1)}}, 0
+		}
+		return []string{"count(*)"}, [][]driver.Value{{int64(0)}}, 0
+	}
+	return []string{"id"}, nil, 0
+}
+
+func newExpiredPasswordTest(t *testing.T) (*Handler, *expiredDB) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := util.NewJWT(key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte("Old-password-1"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changedAt := time.Now().AddDate(0, 0, -100)
+	db := &expiredDB{
+		user: model.User{
+			Model:             model.Model{ID: 7, CreatedAt: changedAt},
+			OrganizationID:    1,
+			Username:          "alice",
+			PasswordHash:      string(hash),
+			Source:            model.UserSourceLocal,
+			PasswordChangedAt: &changedAt,
+		},
+		revoked: make(map[string]bool),
+	}
+	gdb := openFakeDB(t, db.query)
+	var cfg config.Config
+	cfg.Password.MinLength = 8
+	cfg.Password.MaxLength = 72
+	cfg.Password.MaxAge = 90
+	limiter := util.NewLoginLimiter(util.NewMemoryLoginFailureStore(), util.LoginLimitPolicy{}, util.LoginLimitPolicy{}, time.Minute)
+	notifier, err := util.NewLogoutNotifier(gdb, j, testIssuer, 1, time.Second, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(cfg, gdb, util.NewMemoryStore(0), j, util.NewRevocationList(gdb), notifier, nil, limiter, nil)
+	return h, db
+}
+
+func changeExpiredPassword(t *testing.T, h *Handler, token, password string) string {
+	t.Helper()
+	b, _ := json.Marshal(ChangeExpiredPasswordRequest{PasswordToken: token, NewPassword: password})
+	rw := httptest.NewRecorder()
+	if err := h.ChangeExpiredPassword()(rw, bunrouter.NewRequest(httptest.NewRequest("POST", "/", strings.NewReader(string(b))))); err != nil {
+		t.Fatal(err)
+	}
+	var resp response.GenResponse[json.RawMessage]
+	if err := json.Unmarshal(rw.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Message
+}
+
+func TestChangeExpiredPassword(t *testing.T) {
+	h, db := newExpiredPasswordTest(t)
+	ctx := context.Background()
+	token, err := h.signLoginToken(ctx, 7, passwordTokenAudience, passwordTokenTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := changeExpiredPassword(t, h, token, "New-password-1"); got != response.MessageOK {
+		t.Fatalf("change = %s", got)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(db.user.PasswordHash), []byte("New-password-1")) != nil || h.passwordExpired(db.user) {
+		t.Error("password not changed")
+	}
+	// 使用后password_token立即失效
+	if _, ok := h.parseLoginToken(ctx, token, passwordTokenAudience); ok || len(db.revoked) != 1 {
+		t.Errorf("password token still valid, revoked = %v", db.revoked)
+	}
+}
+
+func TestChangeExpiredPasswordRejected(t *testing.T) {
+	tests := []struct {
+		name     string
+		audience string
+		password string
+		wantCode string
+	}{
+		{"mfa token", mfaTokenAudience, "New-password-1", response.MessagePasswordTokenInvalid},
+		{"weak password", passwordTokenAudience, "short", response.MessagePasswordPolicy},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, db := newExpiredPasswordTest(t)
+			ctx := context.Background()
+			token, err := h.signLoginToken(ctx, 7, tt.audience, passwordTokenTTL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := changeExpiredPassword(t, h, token, tt.password); got != tt.wantCode {
+				t.Errorf("got %s, want %s", got, tt.wantCode)
+			}
+			if !h.passwordExpired(db.user) || len(db.revoked) != 0 {
+				t.Errorf("user = %+v, revoked = %v", db.user, db.revoked)
+			}
+		})
+	}
+}
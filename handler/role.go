@@ -0,0 +1,589 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"git.blauwelle.com/go/crate/log"
+	"github.com/uptrace/bunrouter"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"git.blauwelle.com/go/crate/cmd/sso/constants"
+	"git.blauwelle.com/go/crate/cmd/sso/middleware"
+	"git.blauwelle.com/go/crate/cmd/sso/model"
+	"git.blauwelle.com/go/crate/cmd/sso/response"
+)
+
+var (
+	errPermissionNotExist = errors.New("permission not exist")
+	errRoleNotExist       = errors.New("role not exist")
+	errUserNotExist       = errors.New("user not exist")
+	errGrantDenied        = errors.New("grant denied")
+)
+
+type MyPermissionsResponse struct {
+	Groups      []string `json:"groups"`
+	Roles       []string `json:"roles"`
+	Permissions []string `json:"permissions"`
+}
+
+type CreateRoleRequest struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+type UpdateRoleRequest struct {
+	ID          uint      `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Permissions *[]string `json:"permissions"` // 为空时不修改权限
+}
+
+type DeleteRoleRequest struct {
+	ID uint `json:"id"`
+}
+
+type RoleMemberRequest struct {
+	RoleID uint `json:"role_id"`
+	UserID uint `json:"user_id"`
+}
+
+type RoleResponse struct {
+	model.Role
+	Permissions []string `json:"permissions"`
+}
+
+// GetMyPermissions 当前用户的组、角色和权限，包括通过组获得的，前端据此决定显示哪些管理功能
+func (h *Handler) GetMyPermissions() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		userID, err := currentUserID(ctx)
+		if err != nil {
+			return err
+		}
+		groupIDs, err := middleware.UserGroupIDs(ctx, h.db, userID)
+		if err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		roleIDs, err := middleware.UserRoleIDs(ctx, h.db, userID, groupIDs)
+		if err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		groups := []string{}
+		roles := []string{}
+		if len(groupIDs) > 0 {
+			if err := h.db.WithContext(ctx).Model(&model.Group{}).Where("id IN ?", groupIDs).
+				Order("name").Pluck("name", &groups).Error; err != nil {
+				log.Error(ctx, err.Error())
+				return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+			}
+		}
+		if len(roleIDs) > 0 {
+			if err := h.db.WithContext(ctx).Model(&model.Role{}).Where("id IN ?", roleIDs).
+				Order("name").Pluck("name", &roles).Error; err != nil {
+				log.Error(ctx, err.Error())
+				return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+			}
+		}
+		granted, err := middleware.UserPermissions(ctx, h.db, userID)
+		if err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		permissions := make([]string, 0, len(granted))
+		for permission := range granted {
+			permissions = append(permissions, permission)
+		}
+		sort.Strings(permissions)
+		return response.WriteOK(rw, response.MessageOK, MyPermissionsResponse{Groups: groups, Roles: roles, Permissions: permissions})
+	}
+}
+
+// SearchPermission 可以分配给角色的全部权限
+func (h *Handler) SearchPermission() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		var permissions []model.Permission
+		if err := h.db.WithContext(r.Context()).Order("name").Find(&permissions).Error; err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, permissions)
+	}
+}
+
+func (h *Handler) CreateRole() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request CreateRoleRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		request.Name = strings.TrimSpace(request.Name)
+		if request.Name == "" {
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		_, ok, err := isExistRoleByName(request.Name, h.tenant(ctx))
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if ok {
+			return response.Error(rw, response.MessageRoleExist, bunrouter.H{})
+		}
+		permissions, err := h.findPermissions(ctx, request.Permissions)
+		if err != nil {
+			return h.writeRoleError(ctx, rw, err)
+		}
+		if err := h.checkGrant(ctx, request.Permissions); err != nil {
+			return h.writeRoleError(ctx, rw, err)
+		}
+
+		role := model.Role{OrganizationID: currentOrganizationID(ctx), Name: request.Name, Description: request.Description}
+		if err := h.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&role).Error; err != nil {
+				return err
+			}
+			return setRolePermissions(tx, role.ID, permissions)
+		}); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, bunrouter.H{"id": role.ID})
+	}
+}
+
+// SearchRole 角色数量不多，不分页
+func (h *Handler) SearchRole() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		name := r.URL.Query().Get("name")
+
+		query := h.tenant(ctx).Model(&model.Role{})
+		if name != "" {
+			query = query.Where("name LIKE ?", "%"+name+"%")
+		}
+		var roles []model.Role
+		if err := query.Order("name").Find(&roles).Error; err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		roleIDs := make([]uint, 0, len(roles))
+		for _, role := range roles {
+			roleIDs = append(roleIDs, role.ID)
+		}
+		permissions, err := rolePermissions(ctx, h.db, roleIDs)
+		if err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		list := make([]RoleResponse, 0, len(roles))
+		for _, role := range roles {
+			list = append(list, RoleResponse{Role: role, Permissions: permissions[role.ID]})
+		}
+		return response.WriteOK(rw, response.MessageOK, list)
+	}
+}
+
+// UpdateRole admin角色不能改名或修改权限
+func (h *Handler) UpdateRole() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request UpdateRoleRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		request.Name = strings.TrimSpace(request.Name)
+		if request.Name == "" {
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		role, ok, err := isExistRoleByID(request.ID, h.tenant(ctx))
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if !ok {
+			return response.Error(rw, response.MessageRoleNotExist, bunrouter.H{})
+		}
+		if isBuiltinRole(role) && (request.Name != role.Name || request.Permissions != nil) {
+			return response.Error(rw, response.MessageRoleBuiltin, bunrouter.H{})
+		}
+		if request.Name != role.Name {
+			_, exist, err := isExistRoleByName(request.Name, h.tenant(ctx))
+			if err != nil {
+				return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+			}
+			if exist {
+				return response.Error(rw, response.MessageRoleExist, bunrouter.H{})
+			}
+		}
+		var permissions []model.Permission
+		if request.Permissions != nil {
+			if permissions, err = h.findPermissions(ctx, *request.Permissions); err != nil {
+				return h.writeRoleError(ctx, rw, err)
+			}
+			// 修改前后的权限都必须是当前用户拥有的，避免借此提升或削减他人的权限
+			current, err := rolePermissions(ctx, h.db, []uint{role.ID})
+			if err != nil {
+				log.Error(ctx, err.Error())
+				return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+			}
+			if err := h.checkGrant(ctx, append(current[role.ID], *request.Permissions...)); err != nil {
+				return h.writeRoleError(ctx, rw, err)
+			}
+		}
+
+		if err := h.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(&model.Role{}).Where("id = ?", role.ID).Updates(map[string]interface{}{
+				"name":        request.Name,
+				"description": request.Description,
+			}).Error; err != nil {
+				return err
+			}
+			if request.Permissions == nil {
+				return nil
+			}
+			if err := tx.Where("role_id = ?", role.ID).Delete(&model.RolePermission{}).Error; err != nil {
+				return err
+			}
+			return setRolePermissions(tx, role.ID, permissions)
+		}); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
+	}
+}
+
+// DeleteRole 同时移除角色的成员、权限和邀请中的角色，admin角色不能删除
+func (h *Handler) DeleteRole() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request DeleteRoleRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		role, ok, err := isExistRoleByID(request.ID, h.tenant(ctx))
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if !ok {
+			return response.Error(rw, response.MessageRoleNotExist, bunrouter.H{})
+		}
+		if isBuiltinRole(role) {
+			return response.Error(rw, response.MessageRoleBuiltin, bunrouter.H{})
+		}
+		permissions, err := rolePermissions(ctx, h.db, []uint{request.ID})
+		if err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if err := h.checkGrant(ctx, permissions[request.ID]); err != nil {
+			return h.writeRoleError(ctx, rw, err)
+		}
+
+		if err := h.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			for _, table := range []interface{}{&model.UserRole{}, &model.RolePermission{}, &model.InvitationRole{}, &model.AppAccessRole{}, &model.GroupRole{}} {
+				if err := tx.Where("role_id = ?", request.ID).Delete(table).Error; err != nil {
+					return err
+				}
+			}
+			// 直接删除记录，角色名可以重新使用
+			return tx.Unscoped().Delete(&model.Role{}, "id = ?", request.ID).Error
+		}); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
+	}
+}
+
+// AddRoleMember 为用户分配角色，只能分配当前用户拥有的权限
+func (h *Handler) AddRoleMember() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request RoleMemberRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		if _, err := h.checkRoleMember(ctx, request); err != nil {
+			return h.writeRoleError(ctx, rw, err)
+		}
+		if err := h.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&model.UserRole{UserID: request.UserID, RoleID: request.RoleID}).Error; err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
+	}
+}
+
+// RemoveRoleMember 取消用户的角色，用户的会话全部失效；不能移除最后一个admin
+func (h *Handler) RemoveRoleMember() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request RoleMemberRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		role, err := h.checkRoleMember(ctx, request)
+		if err != nil {
+			return h.writeRoleError(ctx, rw, err)
+		}
+		if isBuiltinRole(role) {
+			admins, err := roleHoldersAfterRemoval(ctx, h.db, role.ID, request.UserID)
+			if err != nil {
+				log.Error(ctx, err.Error())
+				return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+			}
+			if admins == 0 {
+				return response.Error(rw, response.MessageRoleLastAdmin, bunrouter.H{})
+			}
+		}
+		DB := h.db.WithContext(ctx).Delete(&model.UserRole{}, "user_id = ? AND role_id = ?", request.UserID, request.RoleID)
+		if DB.Error != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if DB.RowsAffected == 0 {
+			return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
+		}
+		if err := h.revokeUserTokens(ctx, request.UserID); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
+	}
+}
+
+// SearchRoleMember 角色的成员，分页
+func (h *Handler) SearchRoleMember() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		roleID, err := strconv.Atoi(r.URL.Query().Get("role_id"))
+		if err != nil {
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		pageSize := r.URL.Query().Get("pageSize")
+		page := r.URL.Query().Get("page")
+		// 设置默认每页记录数
+		defaultPageSize := 20
+
+		users := []model.User{}
+		var count int64
+
+		query := h.tenant(r.Context()).Model(&model.User{}).
+			Joins("JOIN user_roles ON user_roles.user_id = users.id").
+			Where("user_roles.role_id = ?", roleID)
+		if dbCount := query.Count(&count); dbCount.Error != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+
+		pageSizeInt, err := strconv.Atoi(pageSize)
+		pageInt, _ := strconv.Atoi(page)
+		if err != nil || pageSizeInt <= 0 {
+			pageSizeInt = defaultPageSize
+		}
+		if count == 0 {
+			return response.WriteOK(rw, response.MessageOK, response.NewPaginationData(pageInt, pageSizeInt, users))
+		}
+		offset, err := calculateOffset(page, pageSizeInt, count)
+		if err != nil {
+			return response.Error(rw, response.MessageCalculateOffset, bunrouter.H{})
+		}
+		if dbFind := query.Order("users.id").Offset(offset).Limit(pageSizeInt).
+			Select("users.id, users.created_at, users.updated_at, users.username, users.email, users.email_verified_at").
+			Find(&users); dbFind.Error != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, response.NewPaginationData(pageInt, pageSizeInt, users))
+	}
+}
+
+// SearchUserRole 用户拥有的角色
+func (h *Handler) SearchUserRole() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		userID, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil {
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		_, ok, err := isExistUserByID(uint(userID), h.tenant(ctx))
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if !ok {
+			return response.Error(rw, response.MessageUserNotExist, bunrouter.H{})
+		}
+		var roles []model.Role
+		if err := h.db.WithContext(ctx).
+			Joins("JOIN user_roles ON user_roles.role_id = roles.id").
+			Where("user_roles.user_id = ?", userID).Order("roles.name").Find(&roles).Error; err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, roles)
+	}
+}
+
+// 检查用户和角色在当前组织中存在，并且当前用户拥有角色的全部权限
+func (h *Handler) checkRoleMember(ctx context.Context, request RoleMemberRequest) (model.Role, error) {
+	_, ok, err := isExistUserByID(request.UserID, h.tenant(ctx))
+	if err != nil {
+		return model.Role{}, err
+	}
+	if !ok {
+		return model.Role{}, errUserNotExist
+	}
+	role, ok, err := isExistRoleByID(request.RoleID, h.tenant(ctx))
+	if err != nil {
+		return model.Role{}, err
+	}
+	if !ok {
+		return model.Role{}, errRoleNotExist
+	}
+	permissions, err := rolePermissions(ctx, h.db, []uint{request.RoleID})
+	if err != nil {
+		return model.Role{}, err
+	}
+	return role, h.checkGrant(ctx, permissions[request.RoleID])
+}
+
+// 当前用户拥有全部指定的权限时才能把这些权限授予他人，否则返回 errGrantDenied
+func (h *Handler) checkGrant(ctx context.Context, permissions []string) error {
+	userID, err := currentUserID(ctx)
+	if err != nil {
+		return err
+	}
+	granted, err := middleware.UserPermissions(ctx, h.db, userID)
+	if err != nil {
+		return err
+	}
+	for _, permission := range permissions {
+		if !middleware.HasPermission(granted, permission) {
+			return errGrantDenied
+		}
+	}
+	return nil
+}
+
+func (h *Handler) writeRoleError(ctx context.Context, rw http.ResponseWriter, err error) error {
+	switch {
+	case errors.Is(err, errPermissionNotExist):
+		return response.Error(rw, response.MessagePermissionNotExist, bunrouter.H{})
+	case errors.Is(err, errRoleNotExist):
+		return response.Error(rw, response.MessageRoleNotExist, bunrouter.H{})
+	case errors.Is(err, errUserNotExist):
+		return response.Error(rw, response.MessageUserNotExist, bunrouter.H{})
+	case errors.Is(err, errGroupNotExist):
+		return response.Error(rw, response.MessageGroupNotExist, bunrouter.H{})
+	case errors.Is(err, errGroupCycle):
+		return response.Error(rw, response.MessageGroupCycle, bunrouter.H{})
+	case errors.Is(err, errGrantDenied):
+		return response.Error(rw, response.MessageUnauthorized, bunrouter.H{})
+	}
+	log.Error(ctx, err.Error())
+	return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+}
+
+// 按名称查找权限，有不存在的权限时返回 errPermissionNotExist
+func (h *Handler) findPermissions(ctx context.Context, names []string) ([]model.Permission, error) {
+	unique := make(map[string]bool, len(names))
+	for _, name := range names {
+		unique[name] = true
+	}
+	if len(unique) == 0 {
+		return nil, nil
+	}
+	var permissions []model.Permission
+	if err := h.db.WithContext(ctx).Where("name IN ?", names).Find(&permissions).Error; err != nil {
+		return nil, err
+	}
+	if len(permissions) != len(unique) {
+		return nil, errPermissionNotExist
+	}
+	return permissions, nil
+}
+
+func setRolePermissions(tx *gorm.DB, roleID uint, permissions []model.Permission) error {
+	for _, permission := range permissions {
+		if err := tx.Create(&model.RolePermission{RoleID: roleID, PermissionID: permission.ID}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 角色ID到权限名称的映射
+func rolePermissions(ctx context.Context, db *gorm.DB, roleIDs []uint) (map[uint][]string, error) {
+	result := make(map[uint][]string, len(roleIDs))
+	if len(roleIDs) == 0 {
+		return result, nil
+	}
+	var rows []struct {
+		RoleID uint
+		Name   string
+	}
+	if err := db.WithContext(ctx).Model(&model.RolePermission{}).
+		Select("role_permissions.role_id, permissions.name").
+		Joins("JOIN permissions ON permissions.id = role_permissions.permission_id AND permissions.deleted_at IS NULL").
+		Where("role_permissions.role_id IN ?", roleIDs).
+		Order("permissions.name").Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		result[row.RoleID] = append(result[row.RoleID], row.Name)
+	}
+	return result, nil
+}
+
+// 取消用户直接拥有的角色后，仍直接或通过组拥有该角色的用户数量
+func roleHoldersAfterRemoval(ctx context.Context, db *gorm.DB, roleID, userID uint) (int64, error) {
+	var groupIDs []uint
+	if err := db.WithContext(ctx).Model(&model.GroupRole{}).
+		Where("role_id = ?", roleID).Pluck("group_id", &groupIDs).Error; err != nil {
+		return 0, err
+	}
+	groupIDs, err := middleware.GroupDescendantIDs(ctx, db, groupIDs)
+	if err != nil {
+		return 0, err
+	}
+	holders := db.Where("users.id IN (?)",
+		db.Model(&model.UserRole{}).Select("user_id").Where("role_id = ? AND user_id <> ?", roleID, userID))
+	if len(groupIDs) > 0 {
+		holders = holders.Or("users.id IN (?)",
+			db.Model(&model.GroupMember{}).Select("user_id").Where("group_id IN ?", groupIDs))
+	}
+	var count int64
+	err = db.WithContext(ctx).Model(&model.User{}).Where(holders).Count(&count).Error
+	return count, err
+}
+
+// 每个组织的admin角色，不能改名、修改权限或删除，也不能移除最后一个成员
+func isBuiltinRole(role model.Role) bool {
+	return role.Name == constants.Admin
+}
+
+func isExistRoleByID(id uint, db *gorm.DB) (model.Role, bool, error) {
+	var role model.Role
+	DB := db.Where("id = ?", id).Find(&role)
+	if DB.Error != nil || DB.RowsAffected != 1 {
+		return model.Role{}, false, DB.Error
+	}
+	return role, true, nil
+}
+
+func isExistRoleByName(name string, db *gorm.DB) (model.Role, bool, error) {
+	var role model.Role
+	DB := db.Where("name = ?", name).Find(&role)
+	if DB.Error != nil || DB.RowsAffected != 1 {
+		return model.Role{}, false, DB.Error
+	}
+	return role, true, nil
+}
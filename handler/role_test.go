@@ -0,0 +1,390 @@
+package handler
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/uptrace/bunrouter"
+
+	"git.blauwelle.com/go/crate/cmd/sso/config"
+	"git.blauwelle.com/go/crate/cmd/sso/constants"
+	"git.blauwelle.com/go/crate/cmd/sso/middleware"
+	"git.blauwelle.com/go/crate/cmd/sso/model"
+	"git.blauwelle.com/go/crate/cmd/sso/response"
+	"git.blauwelle.com/go/crate/cmd/sso/util"
+)
+
+// rbacRelation 只有两个ID列的关联表，如user_roles
+type rbacRelation struct {
+	columns [2]string
+	rows    [][2]int64
+}
+
+func (r *rbacRelation) column(name string) int {
+	if r.columns[0] == name {
+		return 0
+	}
+	if r.columns[1] == name {
+		return 1
+	}
+	return -1
+}
+
+// rbacDB 实现权限相关的表，关联表的查询、插入和删除按列名通用处理
+type rbacDB struct {
+	mu          sync.Mutex
+	users       map[int64]int64 // 用户ID到组织ID
+	permissions []string        // 权限ID为下标加一
+	roles       []model.Role
+	groups      []model.Group
+	relations   map[string]*rbacRelation
+	revoked     map[int64]bool // 会话被撤销的用户
+	locked      []string       // 使用FOR UPDATE读取过的表
+}
+
+var (
+	pluckPattern       = regexp.MustCompile("^SELECT (?:DISTINCT )?`(\\w+)` FROM `(\\w+)` WHERE (\\w+) (?:= \\?|IN \\([?,]+\\))( FOR UPDATE)?$")
+	relationDelete     = regexp.MustCompile("^DELETE FROM `(\\w+)` WHERE (\\w+) = \\?(?: AND (\\w+) = \\?)?$")
+	relationDeleteAny  = regexp.MustCompile("^DELETE FROM `(\\w+)` WHERE (\\w+) = \\? OR (\\w+) = \\?$")
+	tenantFindPattern  = regexp.MustCompile("^SELECT \\* FROM `(\\w+)` WHERE `\\w+`.`organization_id` = \\? AND (id|name) = \\?")
+	rbacInsertPattern  = regexp.MustCompile("^INSERT INTO `(\\w+)`")
+	groupDeletePattern = regexp.MustCompile("^DELETE FROM `groups` WHERE id = \\?$")
+)
+
+func newRBACDB() *rbacDB {
+	d := &rbacDB{
+		users:       map[int64]int64{7: 1, 8: 1, 9: 1, 10: 2, 11: 1},
+		permissions: []string{constants.PermissionAll, constants.PermissionUserRead, constants.PermissionUserWrite, constants.PermissionRoleWrite, constants.PermissionAuditRead},
+		roles: []model.Role{
+			{Model: model.Model{ID: 1}, OrganizationID: 1, Name: constants.Admin},
+			{Model: model.Model{ID: 2}, OrganizationID: 1, Name: "user-admin"},
+			{Model: model.Model{ID: 3}, OrganizationID: 1, Name: "auditor"},
+			{Model: model.Model{ID: 4}, OrganizationID: 2, Name: "auditor"},
+		},
+		relations: map[string]*rbacRelation{
+			"role_permissions": {columns: [2]string{"role_id", "permission_id"}, rows: [][2]int64{{1, 1}, {2, 2}, {2, 3}, {2, 4}, {3, 5}, {4, 5}}},
+			// 用户7是admin，用户8管理用户和角色，其他用户没有角色
+			"user_roles":        {columns: [2]string{"user_id", "role_id"}, rows: [][2]int64{{7, 1}, {8, 2}}},
+			"group_members":     {columns: [2]string{"group_id", "user_id"}},
+			"group_roles":       {columns: [2]string{"group_id", "role_id"}},
+			"group_subgroups":   {columns: [2]string{"parent_id", "child_id"}},
+			"group_app_roles":   {columns: [2]string{"group_id", "app_role_id"}},
+			"app_access_groups": {columns: [2]string{"app_id", "group_id"}},
+		},
+		revoked: make(map[int64]bool),
+	}
+	return d
+}
+
+func containsValue(values []driver.Value, value driver.Value) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *rbacDB) query(q string, args []driver.Value) ([]string, [][]driver.Value, int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if m := pluckPattern.FindStringSubmatch(q); m != nil && d.relations[m[2]] != nil {
+		if m[4] != "" {
+			d.locked = append(d.locked, m[2])
+		}
+		relation := d.relations[m[2]]
+		to, from := relation.column(m[1]), relation.column(m[3])
+		seen := make(map[int64]bool)
+		rows := [][]driver.Value{}
+		for _, row := range relation.rows {
+			if containsValue(args, row[from]) && !seen[row[to]] {
+				seen[row[to]] = true
+				rows = append(rows, []driver.Value{row[to]})
+			}
+		}
+		return []string{m[1]}, rows, 0
+	}
+	if m := tenantFindPattern.FindStringSubmatch(q); m != nil {
+		return d.find(m[1], m[2], args[0].(int64), args[1])
+	}
+	switch {
+	case strings.HasPrefix(q, "SELECT * FROM `users` WHERE id = ?"):
+		return d.find("users", "id", d.users[args[0].(int64)], args[0])
+	case strings.HasPrefix(q, "SELECT id, organization_id FROM `users` WHERE id = ?"):
+		columns, rows, _ := d.find("users", "id", d.users[args[0].(int64)], args[0])
+		return columns[:2], rows, 0
+	case strings.HasPrefix(q, "SELECT count(*) FROM `organizations` WHERE id = ?"):
+		if args[0] == int64(1) || args[0] == int64(2) {
+			return []string{"count"}, [][]driver.Value{{int64(1)}}, 0
+		}
+		return []string{"count"}, [][]driver.Value{{int64(0)}}, 0
+	case strings.HasPrefix(q, "SELECT DISTINCT `permissions`.`name` FROM `permissions`"):
+		// 用户拥有的角色提供的权限
+		seen := make(map[string]bool)
+		rows := [][]driver.Value{}
+		for _, row := range d.relations["role_permissions"].rows {
+			name := d.permissions[row[1]-1]
+			if containsValue(args, row[0]) && !seen[name] {
+				seen[name] = true
+				rows = append(rows, []driver.Value{name})
+			}
+		}
+		return []string{"name"}, rows, 0
+	case strings.HasPrefix(q, "SELECT role_permissions.role_id, permissions.name FROM `role_permissions`"):
+		rows := [][]driver.Value{}
+		for _, row := range d.relations["role_permissions"].rows {
+			if containsValue(args, row[0]) {
+				rows = append(rows, []driver.Value{row[0], d.permissions[row[1]-1]})
+			}
+		}
+		return []string{"role_id", "name"}, rows, 0
+	case strings.HasPrefix(q, "SELECT * FROM `permissions` WHERE name IN"):
+		rows := [][]driver.Value{}
+		for i, name := range d.permissions {
+			if containsValue(args, name) {
+				rows = append(rows, []driver.Value{int64(i + 1), name})
+			}
+		}
+		return []string{"id", "name"}, rows, 0
+	case strings.HasPrefix(q, "INSERT INTO `user_token_revocations`"):
+		d.revoked[args[0].(int64)] = true
+		return nil, nil, 1
+	case strings.HasPrefix(q, "INSERT INTO `roles`"):
+		values := insertedColumns(q, args)
+		d.roles = append(d.roles, model.Role{
+			Model:          model.Model{ID: uint(len(d.roles) + 1)},
+			OrganizationID: uint(values["organization_id"].(int64)),
+			Name:           values["name"].(string),
+		})
+		return nil, nil, 1
+	}
+	if m := rbacInsertPattern.FindStringSubmatch(q); m != nil && d.relations[m[1]] != nil {
+		relation := d.relations[m[1]]
+		values := insertedColumns(q, args)
+		row := [2]int64{values[relation.columns[0]].(int64), values[relation.columns[1]].(int64)}
+		for _, existing := range relation.rows {
+			if existing == row {
+				return nil, nil, 0
+			}
+		}
+		relation.rows = append(relation.rows, row)
+		return nil, nil, 1
+	}
+	if m := relationDelete.FindStringSubmatch(q); m != nil && d.relations[m[1]] != nil {
+		return nil, nil, d.delete(m[1], func(row [2]int64) bool {
+			relation := d.relations[m[1]]
+			if row[relation.column(m[2])] != args[0] {
+				return false
+			}
+			return m[3] == "" || row[relation.column(m[3])] == args[1]
+		})
+	}
+	if m := relationDeleteAny.FindStringSubmatch(q); m != nil && d.relations[m[1]] != nil {
+		return nil, nil, d.delete(m[1], func(row [2]int64) bool {
+			relation := d.relations[m[1]]
+			return row[relation.column(m[2])] == args[0] || row[relation.column(m[3])] == args[1]
+		})
+	}
+	if groupDeletePattern.MatchString(q) {
+		for i, group := range d.groups {
+			if args[0] == int64(group.ID) {
+				d.groups = append(d.groups[:i], d.groups[i+1:]...)
+				return nil, nil, 1
+			}
+		}
+	}
+	return nil, nil, 0
+}
+
+// find 按组织查找用户、角色或组
+func (d *rbacDB) find(table, column string, organizationID int64, value driver.Value) ([]string, [][]driver.Value, int64) {
+	columns := []string{"id", "organization_id", "name"}
+	var rows [][]driver.Value
+	switch table {
+	case "users":
+		if id, ok := value.(int64); ok && column == "id" && d.users[id] == organizationID && organizationID != 0 {
+			rows = append(rows, []driver.Value{id, organizationID, "user" + strconv.Itoa(int(id))})
+		}
+		columns[2] = "username"
+	case "roles":
+		for _, role := range d.roles {
+			if int64(role.OrganizationID) == organizationID && (value == int64(role.ID) && column == "id" || value == role.Name && column == "name") {
+				rows = append(rows, []driver.Value{int64(role.ID), organizationID, role.Name})
+			}
+		}
+	case "groups":
+		for _, group := range d.groups {
+			if int64(group.OrganizationID) == organizationID && (value == int64(group.ID) && column == "id" || value == group.Name && column == "name") {
+				rows = append(rows, []driver.Value{int64(group.ID), organizationID, group.Name})
+			}
+		}
+	}
+	return columns, rows, 0
+}
+
+func (d *rbacDB) delete(table string, match func([2]int64) bool) int64 {
+	relation := d.relations[table]
+	var kept [][2]int64
+	for _, row := range relation.rows {
+		if !match(row) {
+			kept = append(kept, row)
+		}
+	}
+	affected := int64(len(relation.rows) - len(kept))
+	relation.rows = kept
+	return affected
+}
+
+func (d *rbacDB) has(table string, row [2]int64) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, existing := range d.relations[table].rows {
+		if existing == row {
+			return true
+		}
+	}
+	return false
+}
+
+type rbacTest struct {
+	t  *testing.T
+	h  *Handler
+	db *rbacDB
+}
+
+func newRBACTest(t *testing.T) *rbacTest {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := util.NewJWT(key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := newRBACDB()
+	gdb := openFakeDB(t, db.query)
+	notifier, err := util.NewLogoutNotifier(gdb, j, testIssuer, 1, time.Second, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cfg config.Config
+	cfg.OIDC.Issuer = testIssuer
+	h := NewHandler(cfg, gdb, util.NewMemoryStore(0), j, util.NewRevocationList(gdb), notifier, nil, nil, nil)
+	return &rbacTest{t: t, h: h, db: db}
+}
+
+// asUser 以组织organizationID中的用户userID发起请求
+func asUser(r *http.Request, userID, organizationID uint) *http.Request {
+	claims := util.SessionClaims{RegisteredClaims: jwt.RegisteredClaims{Subject: strconv.Itoa(int(userID))}}
+	ctx := middleware.ContextJWTClaims{}.WithValue(context.Background(), claims)
+	ctx = middleware.ContextOrganization{}.WithValue(ctx, organizationID)
+	return r.WithContext(ctx)
+}
+
+// call 由组织1中的用户userID调用接口，返回响应的message
+func (rt *rbacTest) call(handler bunrouter.HandlerFunc, userID uint, body any) string {
+	rt.t.Helper()
+	b, err := json.Marshal(body)
+	if err != nil {
+		rt.t.Fatal(err)
+	}
+	req := asUser(httptest.NewRequest("POST", "/", strings.NewReader(string(b))), userID, 1)
+	rw := httptest.NewRecorder()
+	if err := handler(rw, bunrouter.NewRequest(req)); err != nil {
+		rt.t.Fatal(err)
+	}
+	var resp response.GenResponse[json.RawMessage]
+	if err := json.Unmarshal(rw.Body.Bytes(), &resp); err != nil {
+		rt.t.Fatal(err)
+	}
+	return resp.Message
+}
+
+func TestCheckPermission(t *testing.T) {
+	tests := []struct {
+		name       string
+		userID     uint
+		permission string
+		wantCode   string
+	}{
+		{"admin has every permission", 7, constants.PermissionOrgWrite, response.MessageOK},
+		{"granted by role", 8, constants.PermissionUserWrite, response.MessageOK},
+		{"not granted", 8, constants.PermissionAuditRead, response.MessageUnauthorized},
+		{"no role", 9, constants.PermissionUserRead, response.MessageUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := newRBACTest(t)
+			next := func(rw http.ResponseWriter, _ bunrouter.Request) error {
+				return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
+			}
+			handler := middleware.CheckPermission(rt.h.db, tt.permission)(next)
+			if got := rt.call(handler, tt.userID, struct{}{}); got != tt.wantCode {
+				t.Errorf("got %s, want %s", got, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestRoleGrant(t *testing.T) {
+	rt := newRBACTest(t)
+	// 用户8拥有auditor以外角色的权限，可以分配user-admin
+	if got := rt.call(rt.h.AddRoleMember(), 8, RoleMemberRequest{RoleID: 2, UserID: 9}); got != response.MessageOK {
+		t.Fatalf("add role member = %s", got)
+	}
+	if !rt.db.has("user_roles", [2]int64{9, 2}) {
+		t.Error("user_roles not inserted")
+	}
+	if got := rt.call(rt.h.CreateRole(), 8, CreateRoleRequest{Name: "reader", Permissions: []string{constants.PermissionUserRead}}); got != response.MessageOK {
+		t.Errorf("create role = %s", got)
+	}
+	if got := rt.call(rt.h.RemoveRoleMember(), 8, RoleMemberRequest{RoleID: 2, UserID: 9}); got != response.MessageOK {
+		t.Fatalf("remove role member = %s", got)
+	}
+	if rt.db.has("user_roles", [2]int64{9, 2}) || !rt.db.revoked[9] {
+		t.Errorf("user_roles = %v, revoked = %v", rt.db.relations["user_roles"].rows, rt.db.revoked)
+	}
+}
+
+// 不能授予自己没有的权限，也不能操作其他组织的用户和角色
+func TestRoleGrantRejected(t *testing.T) {
+	tests := []struct {
+		name     string
+		handler  func(h *Handler) bunrouter.HandlerFunc
+		body     any
+		wantCode string
+	}{
+		{"assign admin", (*Handler).AddRoleMember, RoleMemberRequest{RoleID: 1, UserID: 9}, response.MessageUnauthorized},
+		{"assign role with missing permission", (*Handler).AddRoleMember, RoleMemberRequest{RoleID: 3, UserID: 9}, response.MessageUnauthorized},
+		{"revoke admin", (*Handler).RemoveRoleMember, RoleMemberRequest{RoleID: 1, UserID: 7}, response.MessageUnauthorized},
+		{"create role with all permissions", (*Handler).CreateRole, CreateRoleRequest{Name: "root", Permissions: []string{constants.PermissionAll}}, response.MessageUnauthorized},
+		{"add missing permission to own role", (*Handler).UpdateRole, UpdateRoleRequest{ID: 2, Name: "user-admin", Permissions: &[]string{constants.PermissionAuditRead}}, response.MessageUnauthorized},
+		{"user of other organization", (*Handler).AddRoleMember, RoleMemberRequest{RoleID: 2, UserID: 10}, response.MessageUserNotExist},
+		{"role of other organization", (*Handler).AddRoleMember, RoleMemberRequest{RoleID: 4, UserID: 9}, response.MessageRoleNotExist},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := newRBACTest(t)
+			before := len(rt.db.relations["user_roles"].rows)
+			if got := rt.call(tt.handler(rt.h), 8, tt.body); got != tt.wantCode {
+				t.Errorf("got %s, want %s", got, tt.wantCode)
+			}
+			if got := len(rt.db.relations["user_roles"].rows); got != before || len(rt.db.roles) != 4 {
+				t.Errorf("user_roles = %v, roles = %v", rt.db.relations["user_roles"].rows, rt.db.roles)
+			}
+		})
+	}
+}
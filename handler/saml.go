@@ -0,0 +1,454 @@
+package handler
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"git.blauwelle.com/go/crate/log"
+	"github.com/beevik/etree"
+	"github.com/uptrace/bunrouter"
+	"gorm.io/gorm"
+
+	"git.blauwelle.com/go/crate/cmd/sso/config"
+	"git.blauwelle.com/go/crate/cmd/sso/model"
+	"git.blauwelle.com/go/crate/cmd/sso/util"
+)
+
+// SAML 2.0 IdP，支持SP发起和IdP发起的Web SSO
+// AuthnRequest支持HTTP-Redirect和HTTP-POST绑定，Response统一使用HTTP-POST绑定发送到ACS
+
+const (
+	samlProtocolNS  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	samlAssertionNS = "urn:oasis:names:tc:SAML:2.0:assertion"
+	samlMetadataNS  = "urn:oasis:names:tc:SAML:2.0:metadata"
+	samlDsigNS      = "http://www.w3.org/2000/09/xmldsig#"
+
+	samlBindingRedirect = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	samlBindingPOST     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+
+	SAMLNameIDFormatUnspecified = "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified"
+	SAMLNameIDFormatPersistent  = "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent"
+	SAMLNameIDFormatTransient   = "urn:oasis:names:tc:SAML:2.0:nameid-format:transient"
+
+	samlStatusSuccess   = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	samlStatusRequester = "urn:oasis:names:tc:SAML:2.0:status:Requester"
+	samlStatusNoPassive = "urn:oasis:names:tc:SAML:2.0:status:NoPassive"
+	samlStatusDenied    = "urn:oasis:names:tc:SAML:2.0:status:RequestDenied"
+
+	samlConfirmationBearer   = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+	samlAuthnContextPassword = "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport"
+
+	samlTimeFormat   = "2006-01-02T15:04:05Z"
+	samlAssertionTTL = 5 * time.Minute
+	// 允许SP与IdP之间的时钟偏差
+	samlClockSkew = 30 * time.Second
+)
+
+// 未配置映射时释放的属性
+var samlDefaultAttributes = map[string]string{"username": "username"}
+
+var samlNameIDFormats = []string{
+	SAMLNameIDFormatUnspecified,
+	SAMLNameIDFormatPersistent,
+	SAMLNameIDFormatTransient,
+}
+
+type samlAuthnRequest struct {
+	XMLName                     xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol AuthnRequest"`
+	ID                          string   `xml:"ID,attr"`
+	Version                     string   `xml:"Version,attr"`
+	AssertionConsumerServiceURL string   `xml:"AssertionConsumerServiceURL,attr"`
+	IsPassive                   bool     `xml:"IsPassive,attr"`
+	Issuer                      string   `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+}
+
+var samlPostTemplate = template.Must(template.New("saml").Parse(`<!DOCTYPE html>
+<html>
+<body onload="document.forms[0].submit()">
+<form method="post" action="{{.URL}}">
+<input type="hidden" name="SAMLResponse" value="{{.SAMLResponse}}">
+{{- if .RelayState}}
+<input type="hidden" name="RelayState" value="{{.RelayState}}">
+{{- end}}
+<noscript><button type="submit">Continue</button></noscript>
+</form>
+</body>
+</html>
+`))
+
+// SAMLMetadata IdP元数据
+func (h *Handler) SAMLMetadata() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		issuer := h.issuer()
+		entityID := issuer + "/saml/metadata"
+		certs := h.saml.Certificates(entityID)
+		if len(certs) == 0 {
+			log.Error(r.Context(), util.ErrSAMLUnsupportedKey.Error())
+			return writeJSON(rw, http.StatusInternalServerError, bunrouter.H{"error": util.ErrSAMLUnsupportedKey.Error()})
+		}
+
+		doc := etree.NewDocument()
+		doc.CreateProcInst("xml", `version="1.0" encoding="UTF-8"`)
+		entity := doc.CreateElement("md:EntityDescriptor")
+		entity.CreateAttr("xmlns:md", samlMetadataNS)
+		entity.CreateAttr("xmlns:ds", samlDsigNS)
+		entity.CreateAttr("entityID", entityID)
+		idp := entity.CreateElement("md:IDPSSODescriptor")
+		idp.CreateAttr("WantAuthnRequestsSigned", "false")
+		idp.CreateAttr("protocolSupportEnumeration", samlProtocolNS)
+		for _, cert := range certs {
+			keyDescriptor := idp.CreateElement("md:KeyDescriptor")
+			keyDescriptor.CreateAttr("use", "signing")
+			keyDescriptor.CreateElement("ds:KeyInfo").
+				CreateElement("ds:X509Data").
+				CreateElement("ds:X509Certificate").
+				SetText(base64.StdEncoding.EncodeToString(cert))
+		}
+		for _, format := range samlNameIDFormats {
+			idp.CreateElement("md:NameIDFormat").SetText(format)
+		}
+		for _, binding := range []string{samlBindingRedirect, samlBindingPOST} {
+			sso := idp.CreateElement("md:SingleSignOnService")
+			sso.CreateAttr("Binding", binding)
+			sso.CreateAttr("Location", issuer+"/saml/sso")
+		}
+		doc.Indent(2)
+
+		rw.Header().Set("Content-Type", "application/samlmetadata+xml")
+		rw.WriteHeader(http.StatusOK)
+		_, err := doc.WriteTo(rw)
+		return err
+	}
+}
+
+// SAMLSSO SP发起的登录，GET为HTTP-Redirect绑定，POST为HTTP-POST绑定
+func (h *Handler) SAMLSSO() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var encoded, relayState string
+		var deflated bool
+		if r.Method == http.MethodPost {
+			if err := r.ParseForm(); err != nil {
+				return writeJSON(rw, http.StatusBadRequest, bunrouter.H{"error": "invalid form"})
+			}
+			encoded = r.PostForm.Get("SAMLRequest")
+			relayState = r.PostForm.Get("RelayState")
+		} else {
+			encoded = r.URL.Query().Get("SAMLRequest")
+			relayState = r.URL.Query().Get("RelayState")
+			deflated = true
+		}
+		request, raw, err := decodeSAMLRequest(encoded, deflated)
+		if err != nil {
+			return writeJSON(rw, http.StatusBadRequest, bunrouter.H{"error": "invalid SAMLRequest"})
+		}
+
+		app, ok, err := findAppBySAMLEntityID(request.Issuer, h.db)
+		if err != nil {
+			log.Error(ctx, err.Error())
+			return writeJSON(rw, http.StatusInternalServerError, bunrouter.H{"error": "server_error"})
+		}
+		if !ok {
+			return writeJSON(rw, http.StatusBadRequest, bunrouter.H{"error": "unknown service provider"})
+		}
+		// 只向预先配置的ACS地址发送响应
+		if request.AssertionConsumerServiceURL != "" && request.AssertionConsumerServiceURL != app.SAMLACSURL {
+			return writeJSON(rw, http.StatusBadRequest, bunrouter.H{"error": "AssertionConsumerServiceURL is not registered"})
+		}
+
+		claims, ok := h.sessionClaims(r.Request)
+		if !ok {
+			if request.IsPassive {
+				return h.writeSAMLResponse(rw, r.Request, app, request.ID, relayState, nil, samlStatusNoPassive)
+			}
+			// POST绑定的请求体无法通过登录跳转保留，统一转换为Redirect绑定的地址
+			params := url.Values{}
+			params.Set("SAMLRequest", encodeSAMLRedirect(raw))
+			if relayState != "" {
+				params.Set("RelayState", relayState)
+			}
+			return h.redirectToLoginReturning(rw, r.Request, h.issuer()+"/saml/sso?"+params.Encode())
+		}
+		return h.samlLogin(rw, r.Request, app, claims, request.ID, relayState)
+	}
+}
+
+// SAMLIdPInitiated IdP发起的登录，/saml/idp/sso?sp=<entityID>&RelayState=...
+func (h *Handler) SAMLIdPInitiated() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		query := r.URL.Query()
+		app, ok, err := findAppBySAMLEntityID(query.Get("sp"), h.db)
+		if err != nil {
+			log.Error(ctx, err.Error())
+			return writeJSON(rw, http.StatusInternalServerError, bunrouter.H{"error": "server_error"})
+		}
+		if !ok {
+			return writeJSON(rw, http.StatusBadRequest, bunrouter.H{"error": "unknown service provider"})
+		}
+		claims, ok := h.sessionClaims(r.Request)
+		if !ok {
+			return h.redirectToLogin(rw, r.Request)
+		}
+		return h.samlLogin(rw, r.Request, app, claims, "", query.Get("RelayState"))
+	}
+}
+
+func (h *Handler) samlLogin(rw http.ResponseWriter, r *http.Request, app model.Application, claims util.SessionClaims, inResponseTo, relayState string) error {
+	ctx := r.Context()
+	id, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return h.redirectToLogin(rw, r)
+	}
+	user, ok, err := isExistUserByID(uint(id), h.db)
+	if err != nil {
+		return writeJSON(rw, http.StatusInternalServerError, bunrouter.H{"error": "server_error"})
+	}
+	if !ok {
+		return h.redirectToLogin(rw, r)
+	}
+	if ok, err := canAccessApp(ctx, h.db, app, user.ID); err != nil {
+		log.Error(ctx, err.Error())
+		return writeJSON(rw, http.StatusInternalServerError, bunrouter.H{"error": "server_error"})
+	} else if !ok {
+		return h.writeSAMLResponse(rw, r, app, inResponseTo, relayState, nil, samlStatusDenied)
+	}
+	// 临时NameID每次响应都不同，登出通知只能通过sid匹配
+	var subject string
+	if app.SAMLNameIDFormat != SAMLNameIDFormatTransient {
+		_, subject = samlNameID(app, user, h.r)
+	}
+	if err := h.notifier.RecordSessionApp(ctx, claims.SessionID, subject, user.ID, app.ID); err != nil {
+		log.Error(ctx, err.Error())
+	}
+	return h.writeSAMLResponse(rw, r, app, inResponseTo, relayState, &samlSubject{user: user, claims: claims}, samlStatusSuccess)
+}
+
+type samlSubject struct {
+	user   model.User
+	claims util.SessionClaims
+}
+
+// 生成Response并通过自动提交的表单POST到ACS，subject为空时只返回状态
+func (h *Handler) writeSAMLResponse(rw http.ResponseWriter, r *http.Request, app model.Application, inResponseTo, relayState string, subject *samlSubject, status string) error {
+	ctx := r.Context()
+	entityID := h.issuer() + "/saml/metadata"
+	now := time.Now().UTC()
+
+	doc := etree.NewDocument()
+	resp := doc.CreateElement("samlp:Response")
+	resp.CreateAttr("xmlns:samlp", samlProtocolNS)
+	resp.CreateAttr("xmlns:saml", samlAssertionNS)
+	resp.CreateAttr("ID", "_"+h.r.RandString(32))
+	resp.CreateAttr("Version", "2.0")
+	resp.CreateAttr("IssueInstant", now.Format(samlTimeFormat))
+	resp.CreateAttr("Destination", app.SAMLACSURL)
+	if inResponseTo != "" {
+		resp.CreateAttr("InResponseTo", inResponseTo)
+	}
+	resp.CreateElement("saml:Issuer").SetText(entityID)
+	statusCode := resp.CreateElement("samlp:Status").CreateElement("samlp:StatusCode")
+	if status == samlStatusSuccess {
+		statusCode.CreateAttr("Value", samlStatusSuccess)
+	} else {
+		statusCode.CreateAttr("Value", samlStatusRequester)
+		statusCode.CreateElement("samlp:StatusCode").CreateAttr("Value", status)
+	}
+
+	if subject != nil {
+		assertion, err := h.samlAssertion(app, entityID, inResponseTo, subject, now)
+		if err != nil {
+			log.Error(ctx, err.Error())
+			return writeJSON(rw, http.StatusInternalServerError, bunrouter.H{"error": "server_error"})
+		}
+		resp.AddChild(assertion)
+		if err := h.saml.SignEnveloped(assertion, entityID); err != nil {
+			log.Error(ctx, err.Error())
+			return writeJSON(rw, http.StatusInternalServerError, bunrouter.H{"error": "server_error"})
+		}
+	}
+
+	data, err := doc.WriteToBytes()
+	if err != nil {
+		return err
+	}
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusOK)
+	return samlPostTemplate.Execute(rw, struct {
+		URL          string
+		SAMLResponse string
+		RelayState   string
+	}{
+		URL:          app.SAMLACSURL,
+		SAMLResponse: base64.StdEncoding.EncodeToString(data),
+		RelayState:   relayState,
+	})
+}
+
+func (h *Handler) samlAssertion(app model.Application, entityID, inResponseTo string, subject *samlSubject, now time.Time) (*etree.Element, error) {
+	notBefore := now.Add(-samlClockSkew).Format(samlTimeFormat)
+	notOnOrAfter := now.Add(samlAssertionTTL).Format(samlTimeFormat)
+
+	assertion := etree.NewElement("saml:Assertion")
+	assertion.CreateAttr("xmlns:saml", samlAssertionNS)
+	assertion.CreateAttr("ID", "_"+h.r.RandString(32))
+	assertion.CreateAttr("Version", "2.0")
+	assertion.CreateAttr("IssueInstant", now.Format(samlTimeFormat))
+	assertion.CreateElement("saml:Issuer").SetText(entityID)
+
+	format, nameID := samlNameID(app, subject.user, h.r)
+	subjectEl := assertion.CreateElement("saml:Subject")
+	nameIDEl := subjectEl.CreateElement("saml:NameID")
+	nameIDEl.CreateAttr("Format", format)
+	nameIDEl.CreateAttr("SPNameQualifier", app.SAMLEntityID)
+	nameIDEl.SetText(nameID)
+	confirmation := subjectEl.CreateElement("saml:SubjectConfirmation")
+	confirmation.CreateAttr("Method", samlConfirmationBearer)
+	confirmationData := confirmation.CreateElement("saml:SubjectConfirmationData")
+	if inResponseTo != "" {
+		confirmationData.CreateAttr("InResponseTo", inResponseTo)
+	}
+	confirmationData.CreateAttr("NotOnOrAfter", notOnOrAfter)
+	confirmationData.CreateAttr("Recipient", app.SAMLACSURL)
+
+	conditions := assertion.CreateElement("saml:Conditions")
+	conditions.CreateAttr("NotBefore", notBefore)
+	conditions.CreateAttr("NotOnOrAfter", notOnOrAfter)
+	conditions.CreateElement("saml:AudienceRestriction").
+		CreateElement("saml:Audience").
+		SetText(app.SAMLEntityID)
+
+	authnInstant := now
+	if subject.claims.IssuedAt != nil {
+		authnInstant = subject.claims.IssuedAt.UTC()
+	}
+	authn := assertion.CreateElement("saml:AuthnStatement")
+	authn.CreateAttr("AuthnInstant", authnInstant.Format(samlTimeFormat))
+	if subject.claims.SessionID != "" {
+		authn.CreateAttr("SessionIndex", subject.claims.SessionID)
+	}
+	authn.CreateElement("saml:AuthnContext").
+		CreateElement("saml:AuthnContextClassRef").
+		SetText(samlAuthnContextPassword)
+
+	mapping, err := samlAttributeMapping(app)
+	if err != nil {
+		return nil, err
+	}
+	if len(mapping) > 0 {
+		statement := assertion.CreateElement("saml:AttributeStatement")
+		for _, name := range sortedStringKeys(mapping) {
+			value, ok := samlUserAttribute(subject.user, mapping[name])
+			if !ok {
+				continue
+			}
+			attribute := statement.CreateElement("saml:Attribute")
+			attribute.CreateAttr("Name", name)
+			attribute.CreateAttr("NameFormat", "urn:oasis:names:tc:SAML:2.0:attrname-format:basic")
+			attribute.CreateElement("saml:AttributeValue").SetText(value)
+		}
+	}
+	return assertion, nil
+}
+
+// 按应用配置的NameID格式生成用户标识
+func samlNameID(app model.Application, user model.User, r util.StringRand) (string, string) {
+	switch app.SAMLNameIDFormat {
+	case SAMLNameIDFormatPersistent:
+		return SAMLNameIDFormatPersistent, strconv.Itoa(int(user.ID))
+	case SAMLNameIDFormatTransient:
+		return SAMLNameIDFormatTransient, "_" + r.RandString(32)
+	default:
+		return SAMLNameIDFormatUnspecified, user.Username
+	}
+}
+
+// 映射中的值可以使用的用户字段
+func samlUserAttribute(user model.User, field string) (string, bool) {
+	switch field {
+	case "id":
+		return strconv.Itoa(int(user.ID)), true
+	case "username":
+		return user.Username, true
+	}
+	return "", false
+}
+
+func samlAttributeMapping(app model.Application) (map[string]string, error) {
+	if app.SAMLAttributes == "" {
+		return samlDefaultAttributes, nil
+	}
+	var mapping map[string]string
+	if err := json.Unmarshal([]byte(app.SAMLAttributes), &mapping); err != nil {
+		return nil, err
+	}
+	return mapping, nil
+}
+
+func decodeSAMLRequest(encoded string, deflated bool) (samlAuthnRequest, []byte, error) {
+	var request samlAuthnRequest
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return request, nil, err
+	}
+	if deflated {
+		data, err = io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(data)), 1<<20))
+		if err != nil {
+			return request, nil, err
+		}
+	}
+	if err := xml.Unmarshal(data, &request); err != nil {
+		return request, nil, err
+	}
+	return request, data, nil
+}
+
+// HTTP-Redirect绑定的编码：DEFLATE后base64
+func encodeSAMLRedirect(data []byte) string {
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	_, _ = w.Write(data)
+	_ = w.Close()
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func findAppBySAMLEntityID(entityID string, db *gorm.DB) (model.Application, bool, error) {
+	if entityID == "" {
+		return model.Application{}, false, nil
+	}
+	var app model.Application
+	DB := db.Find(&app, "saml_entity_id=?", entityID)
+	if DB.Error != nil || DB.RowsAffected != 1 || app.SAMLACSURL == "" {
+		return model.Application{}, false, DB.Error
+	}
+	return app, true, nil
+}
+
+func sortedStringKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// SAML证书保存在密钥所在的目录：密钥环目录，或单个私钥文件所在的目录
+func samlCertificateDir(keys config.KeysConfig) string {
+	if keys.Dir != "" {
+		return keys.Dir
+	}
+	return filepath.Dir(keys.PrivateKey)
+}
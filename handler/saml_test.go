@@ -0,0 +1,160 @@
+package handler
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/uptrace/bunrouter"
+
+	"git.blauwelle.com/go/crate/cmd/sso/constants"
+)
+
+const testSAMLEntityID = testIssuer + "/saml/metadata"
+
+var samlResponsePattern = regexp.MustCompile(`name="SAMLResponse" value="([^"]*)"`)
+
+func samlAuthnRequestXML(id, issuer, acsURL string, passive bool) string {
+	return fmt.Sprintf(`<samlp:AuthnRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion"`+
+		` ID="%s" Version="2.0" AssertionConsumerServiceURL="%s" IsPassive="%t"><saml:Issuer>%s</saml:Issuer></samlp:AuthnRequest>`,
+		id, acsURL, passive, issuer)
+}
+
+// samlSSO 使用HTTP-POST绑定发送AuthnRequest
+func (pt *protocolTest) samlSSO(request string, withSession bool) *httptest.ResponseRecorder {
+	pt.t.Helper()
+	form := url.Values{
+		"SAMLRequest": {base64.StdEncoding.EncodeToString([]byte(request))},
+		"RelayState":  {"relay-1"},
+	}
+	req := httptest.NewRequest("POST", "/saml/sso", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if withSession {
+		req.AddCookie(&http.Cookie{Name: constants.SessionCookieName, Value: pt.session})
+	}
+	rw := httptest.NewRecorder()
+	if err := pt.h.SAMLSSO()(rw, bunrouter.NewRequest(req)); err != nil {
+		pt.t.Fatal(err)
+	}
+	return rw
+}
+
+// 从自动提交的表单中取出Response
+func samlResponse(t *testing.T, rw *httptest.ResponseRecorder) *etree.Element {
+	t.Helper()
+	if rw.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rw.Code, rw.Body)
+	}
+	match := samlResponsePattern.FindStringSubmatch(rw.Body.String())
+	if match == nil {
+		t.Fatalf("no SAMLResponse in %s", rw.Body)
+	}
+	data, err := base64.StdEncoding.DecodeString(html.UnescapeString(match[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		t.Fatal(err)
+	}
+	return doc.Root()
+}
+
+func samlStatus(resp *etree.Element) string {
+	status := resp.FindElement("./Status/StatusCode")
+	if status == nil {
+		return ""
+	}
+	if nested := status.FindElement("./StatusCode"); nested != nil {
+		return nested.SelectAttrValue("Value", "")
+	}
+	return status.SelectAttrValue("Value", "")
+}
+
+func TestSAMLSSO(t *testing.T) {
+	pt := newProtocolTest(t)
+	resp := samlResponse(t, pt.samlSSO(samlAuthnRequestXML("_req-1", "https://sp.example.com/metadata", "https://sp.example.com/acs", false), true))
+	if got := samlStatus(resp); got != samlStatusSuccess {
+		t.Fatalf("status = %s", got)
+	}
+	if resp.SelectAttrValue("InResponseTo", "") != "_req-1" || resp.SelectAttrValue("Destination", "") != "https://sp.example.com/acs" {
+		t.Errorf("response attributes = %v", resp.Attr)
+	}
+
+	assertion := resp.FindElement("./Assertion")
+	if assertion == nil {
+		t.Fatal("no assertion")
+	}
+	// 签名使用元数据中发布的证书验证
+	certs := pt.h.saml.Certificates(testSAMLEntityID)
+	if len(certs) == 0 {
+		t.Fatal("no certificate")
+	}
+	cert, err := x509.ParseCertificate(certs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	validator := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{Roots: []*x509.Certificate{cert}})
+	verified, err := validator.Validate(assertion)
+	if err != nil {
+		t.Fatalf("signature: %v", err)
+	}
+	if got := verified.FindElement("./Issuer").Text(); got != testSAMLEntityID {
+		t.Errorf("issuer = %s", got)
+	}
+	nameID := verified.FindElement("./Subject/NameID")
+	if nameID.Text() != "7" || nameID.SelectAttrValue("Format", "") != SAMLNameIDFormatPersistent {
+		t.Errorf("name id = %s %v", nameID.Text(), nameID.Attr)
+	}
+	if got := verified.FindElement("./Conditions/AudienceRestriction/Audience").Text(); got != "https://sp.example.com/metadata" {
+		t.Errorf("audience = %s", got)
+	}
+	if got := verified.FindElement("./AuthnStatement").SelectAttrValue("SessionIndex", ""); got != "s1" {
+		t.Errorf("session index = %s", got)
+	}
+}
+
+func TestSAMLSSORejected(t *testing.T) {
+	tests := []struct {
+		name        string
+		issuer      string
+		acsURL      string
+		passive     bool
+		withSession bool
+		wantCode    int
+		wantStatus  string
+	}{
+		{"unknown service provider", "https://unknown.example.com/metadata", "", false, true, http.StatusBadRequest, ""},
+		{"unregistered acs", "https://sp.example.com/metadata", "https://evil.example.com/acs", false, true, http.StatusBadRequest, ""},
+		{"passive without session", "https://sp.example.com/metadata", "", true, false, http.StatusOK, samlStatusNoPassive},
+		{"app of other organization", "https://other.example.com/metadata", "", false, true, http.StatusOK, samlStatusDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pt := newProtocolTest(t)
+			rw := pt.samlSSO(samlAuthnRequestXML("_req-1", tt.issuer, tt.acsURL, tt.passive), tt.withSession)
+			if rw.Code != tt.wantCode {
+				t.Fatalf("status = %d, body = %s", rw.Code, rw.Body)
+			}
+			if tt.wantStatus == "" {
+				return
+			}
+			resp := samlResponse(t, rw)
+			if got := samlStatus(resp); got != tt.wantStatus {
+				t.Errorf("saml status = %s, want %s", got, tt.wantStatus)
+			}
+			if resp.FindElement("./Assertion") != nil {
+				t.Error("assertion in failed response")
+			}
+		})
+	}
+}
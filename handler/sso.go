@@ -1,20 +1,22 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"git.blauwelle.com/go/crate/log"
 	"github.com/golang-jwt/jwt/v5"
-	"github.com/redis/go-redis/v9"
 	"github.com/uptrace/bunrouter"
-	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 
+	"git.blauwelle.com/go/crate/cmd/sso/config"
 	"git.blauwelle.com/go/crate/cmd/sso/constants"
 	"git.blauwelle.com/go/crate/cmd/sso/middleware"
 	"git.blauwelle.com/go/crate/cmd/sso/model"
@@ -23,23 +25,41 @@ import (
 )
 
 type Handler struct {
-	db      *gorm.DB
-	redisDB *redis.Client
-	r       util.StringRand
-	j       *util.JWT
+	cfg           config.Config
+	db            *gorm.DB
+	store         util.Store
+	r             util.StringRand
+	j             *util.JWT
+	ticketStats   *TicketStats
+	revocations   *util.RevocationList
+	notifier      *util.LogoutNotifier
+	saml          *util.SAMLSigner
+	authenticator util.Authenticator
+	limiter       *util.LoginLimiter
+	passwords     util.PasswordPolicy
+	mailer        util.Mailer
 }
 
-func NewHandler(db *gorm.DB, redisDB *redis.Client, jwtService *util.JWT) *Handler {
+func NewHandler(cfg config.Config, db *gorm.DB, store util.Store, jwtService *util.JWT, revocations *util.RevocationList, notifier *util.LogoutNotifier, authenticator util.Authenticator, limiter *util.LoginLimiter, mailer util.Mailer) *Handler {
 	return &Handler{
-		db:      db,
-		redisDB: redisDB,
-		r:       util.NewStringRand(),
-		j:       jwtService,
+		cfg:           cfg,
+		db:            db,
+		store:         store,
+		r:             util.NewSecureStringRand(),
+		j:             jwtService,
+		ticketStats:   &TicketStats{},
+		revocations:   revocations,
+		notifier:      notifier,
+		saml:          util.NewSAMLSigner(jwtService, samlCertificateDir(cfg.Keys)),
+		authenticator: authenticator,
+		limiter:       limiter,
+		passwords:     newPasswordPolicy(cfg.Password),
+		mailer:        mailer,
 	}
 }
 
 type LoginRequest struct {
-	Username string `json:"username"`
+	Username string `json:"username"` // 用户名或已验证的邮箱
 	Password string `json:"password"`
 }
 
@@ -52,33 +72,78 @@ func (h *Handler) Login() bunrouter.HandlerFunc {
 			log.Error(ctx, err.Error())
 			return response.Error(rw, response.MessageBindError, bunrouter.H{})
 		}
-		user, ok, err := isExistUserByName(request.Username, h.db)
+		organizationID, ok, err := h.loginOrganization(r)
 		if err != nil {
 			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
 		}
 		if !ok {
-			return response.Error(rw, response.MessageUserNotExist, bunrouter.H{})
+			return response.Error(rw, response.MessageOrganizationNotExist, bunrouter.H{})
 		}
-		if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(request.Password)); err != nil {
+		username, err := h.resolveLoginName(ctx, request.Username, organizationID)
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		// 失败次数过多时在校验密码之前拒绝
+		ip := h.clientIP(r.Request)
+		wait, err := h.limiter.Check(ctx, username, ip)
+		if err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if wait > 0 {
+			return writeLoginThrottled(rw, wait)
+		}
+		user, err := h.authenticate(ctx, username, request.Password, organizationID)
+		if err != nil {
+			if !errors.Is(err, util.ErrUnknownUser) && !errors.Is(err, util.ErrBadCredentials) {
+				log.Error(ctx, err.Error())
+				return response.Error(rw, response.MessageAuthenticatorError, bunrouter.H{})
+			}
+			if err := h.limiter.Fail(ctx, username, ip); err != nil {
+				log.Error(ctx, err.Error())
+			}
+			// 用户不存在和密码错误返回相同的结果
+			return response.Error(rw, response.MessageLoginFailed, bunrouter.H{})
+		}
+		if err := h.limiter.Succeed(ctx, username); err != nil {
 			log.Error(ctx, err.Error())
-			return response.Error(rw, response.MessageIncorrectPassword, bunrouter.H{})
 		}
 
-		exp := time.Now().AddDate(1, 0, 0)
-		tokenString, err := h.j.Sign(ctx, jwt.RegisteredClaims{
-			Subject:   strconv.Itoa(int(user.ID)),
-			ExpiresAt: jwt.NewNumericDate(exp),
-		})
+		// 密码过期时先修改密码，见 ChangeExpiredPassword
+		if h.passwordExpired(user) {
+			passwordToken, err := h.signLoginToken(ctx, user.ID, passwordTokenAudience, passwordTokenTTL)
+			if err != nil {
+				return response.Error(rw, response.MessageTokenExpired, bunrouter.H{})
+			}
+			return response.Warning(rw, response.MessagePasswordExpired, PasswordExpiredResponse{PasswordToken: passwordToken})
+		}
+		return h.finishLogin(ctx, rw, user.ID)
+	}
+}
+
+// 密码校验通过后，绑定了第二因素或策略要求MFA时先返回mfa_token，验证第二因素后再签发会话
+func (h *Handler) finishLogin(ctx context.Context, rw http.ResponseWriter, userID uint) error {
+	required, methods, err := h.mfaRequired(ctx, userID)
+	if err != nil {
+		return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+	}
+	if required {
+		mfaToken, err := h.signMFAToken(ctx, userID, len(methods) == 0)
 		if err != nil {
 			return response.Error(rw, response.MessageTokenExpired, bunrouter.H{})
 		}
-		http.SetCookie(rw, &http.Cookie{
-			Name:    constants.SessionCookieName,
-			Value:   tokenString,
-			Expires: exp,
+		return response.Warning(rw, response.MessageMFARequired, LoginMFARequiredResponse{
+			MFAToken:           mfaToken,
+			Methods:            methods,
+			EnrollmentRequired: len(methods) == 0,
 		})
-		return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
 	}
+
+	session, err := h.issueSession(ctx, rw, userID, "")
+	if err != nil {
+		return response.Error(rw, response.MessageTokenExpired, bunrouter.H{})
+	}
+	return response.WriteOK(rw, response.MessageOK, session)
 }
 
 type SSOLoginRequest struct {
@@ -120,7 +185,8 @@ func (h *Handler) SSOLogin() bunrouter.HandlerFunc {
 				return response.Error(rw, response.MessageAppExist, bunrouter.H{})
 			}
 		}
-		id, err := strconv.Atoi(middleware.ContextJWTClaims{}.Value(ctx).Subject)
+		claims := middleware.ContextJWTClaims{}.Value(ctx)
+		id, err := strconv.Atoi(claims.Subject)
 		if err != nil {
 			return err
 		}
@@ -131,10 +197,21 @@ func (h *Handler) SSOLogin() bunrouter.HandlerFunc {
 		if !ok {
 			return response.Error(rw, response.MessageUnauthorized, bunrouter.H{})
 		}
+		if ok, err := canAccessApp(ctx, h.db, app, user.ID); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		} else if !ok {
+			return response.Error(rw, response.MessageAppAccessDenied, bunrouter.H{})
+		}
 		ticket := h.r.RandString(20)
-		if err := util.SetTicketToRedis(ctx, ticket, h.redisDB, util.UserInfo{
-			ID:       user.ID,
-			Username: user.Username,
+		if err := h.store.SetTicket(ctx, ticket, util.TicketInfo{
+			UserInfo: util.UserInfo{
+				ID:       user.ID,
+				Username: user.Username,
+			},
+			AppID:     app.ID,
+			Service:   request.Redirect,
+			SessionID: claims.SessionID,
 		}); err != nil {
 			return response.Error(rw, response.MessageBadTicket, bunrouter.H{})
 		}
@@ -155,8 +232,18 @@ func (h *Handler) SSOLogin() bunrouter.HandlerFunc {
 	}
 }
 
+// AppTokenClaims SSOVerify 签发给应用的token，sid用于匹配后端通道登出通知
+type AppTokenClaims struct {
+	jwt.RegisteredClaims
+	SessionID     string   `json:"sid,omitempty"`
+	Email         string   `json:"email,omitempty"`
+	EmailVerified *bool    `json:"email_verified,omitempty"` // 用户设置了邮箱时才有
+	Roles         []string `json:"roles,omitempty"`          // 用户在该应用中的角色
+}
+
 type SSOVerifyRequest struct {
-	Ticket string `json:"ticket"`
+	Ticket  string `json:"ticket"`
+	Service string `json:"service"`
 }
 
 func (h *Handler) SSOVerify() bunrouter.HandlerFunc {
@@ -180,21 +267,89 @@ func (h *Handler) SSOVerify() bunrouter.HandlerFunc {
 		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
 			return response.Error(rw, response.MessageBindError, bunrouter.H{})
 		}
+		if request.Ticket == "" || request.Service == "" {
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
 
-		info, err := util.GetTicketFromRedis(ctx, request.Ticket, h.redisDB)
+		// ticket无论校验是否通过都会被消耗
+		info, err := h.store.ConsumeTicket(ctx, request.Ticket)
 		if err != nil {
+			if errors.Is(err, util.ErrTicketUsed) {
+				h.ticketStats.Replayed.Add(1)
+				log.Error(ctx, fmt.Sprintf("ticket replay: app=%d ticket=%s", app.ID, request.Ticket))
+				return response.Error(rw, response.MessageTicketUsed, bunrouter.H{})
+			}
 			if errors.Is(err, util.ErrTicketNotExists) {
 				return response.Error(rw, response.MessageBadTicket, bunrouter.H{})
 			}
 			return err
 		}
+		// OIDC的授权码只能在 /token 使用client_secret或PKCE兑换
+		if info.OIDC != nil || info.AppID != app.ID {
+			h.ticketStats.AppMismatch.Add(1)
+			log.Error(ctx, fmt.Sprintf("ticket app mismatch: issued=%d redeemed=%d user=%d", info.AppID, app.ID, info.ID))
+			return response.Error(rw, response.MessageTicketAppMismatch, bunrouter.H{})
+		}
+		if info.Service != request.Service {
+			h.ticketStats.ServiceMismatch.Add(1)
+			log.Error(ctx, fmt.Sprintf("ticket service mismatch: app=%d user=%d", app.ID, info.ID))
+			return response.Error(rw, response.MessageTicketServiceMismatch, bunrouter.H{})
+		}
+		// 签发ticket之后访问权限可能已被收回
+		if ok, err := canAccessApp(ctx, h.db, app, info.ID); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		} else if !ok {
+			return response.Error(rw, response.MessageAppAccessDenied, bunrouter.H{})
+		}
 
-		tokenString, err := h.j.Sign(ctx, jwt.RegisteredClaims{
-			Subject: info.Username,
-		})
+		if err := h.notifier.RecordSessionApp(ctx, info.SessionID, info.Username, info.ID, app.ID); err != nil {
+			log.Error(ctx, err.Error())
+		}
+
+		claims := AppTokenClaims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				Subject:  info.Username,
+				Audience: jwt.ClaimStrings{app.AppKey},
+				IssuedAt: jwt.NewNumericDate(time.Now()),
+			},
+			SessionID: info.SessionID,
+		}
+		user, ok, err := isExistUserByID(info.ID, h.db)
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if ok && user.Email != nil {
+			verified := user.EmailVerifiedAt != nil
+			claims.Email = *user.Email
+			claims.EmailVerified = &verified
+		}
+		if claims.Roles, err = appRoleNames(ctx, h.db, app.ID, info.ID); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		tokenString, err := h.j.SignClaims(ctx, claims)
 		if err != nil {
 			return err
 		}
 		return response.WriteOK(rw, response.MessageOK, bunrouter.H{"token": tokenString})
 	}
 }
+
+// ticket校验失败的计数，供管理员查看
+type TicketStats struct {
+	Replayed        atomic.Int64
+	AppMismatch     atomic.Int64
+	ServiceMismatch atomic.Int64
+}
+
+// GetTicketStats ticket校验失败的计数，全部组织共用
+func (h *Handler) GetTicketStats() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		return response.WriteOK(rw, response.MessageOK, bunrouter.H{
+			"replayed":         h.ticketStats.Replayed.Load(),
+			"app_mismatch":     h.ticketStats.AppMismatch.Load(),
+			"service_mismatch": h.ticketStats.ServiceMismatch.Load(),
+		})
+	}
+}
@@ -0,0 +1,234 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"git.blauwelle.com/go/crate/log"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/uptrace/bunrouter"
+	"gorm.io/gorm"
+
+	"git.blauwelle.com/go/crate/cmd/sso/constants"
+	"git.blauwelle.com/go/crate/cmd/sso/middleware"
+	"git.blauwelle.com/go/crate/cmd/sso/model"
+	"git.blauwelle.com/go/crate/cmd/sso/response"
+	"git.blauwelle.com/go/crate/cmd/sso/util"
+)
+
+const (
+	defaultSessionAccessTokenTTL  = 15 * time.Minute
+	defaultSessionRefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+var (
+	errRefreshTokenInvalid = errors.New("refresh token invalid")
+	errRefreshTokenReused  = errors.New("refresh token reused")
+)
+
+type SessionResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// RefreshToken 使用refresh token换取新的access token，旧的refresh token随即失效
+// 已使用过的refresh token再次出现时视为泄露，整个family全部作废
+func (h *Handler) RefreshToken() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request RefreshTokenRequest
+		if cookie, err := r.Cookie(constants.RefreshCookieName); err == nil {
+			request.RefreshToken = cookie.Value
+		} else if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		if request.RefreshToken == "" {
+			return response.Error(rw, response.MessageRefreshTokenInvalid, bunrouter.H{})
+		}
+
+		token, err := h.rotateRefreshToken(ctx, request.RefreshToken)
+		if err != nil {
+			clearSessionCookies(rw)
+			if errors.Is(err, errRefreshTokenReused) {
+				return response.Error(rw, response.MessageRefreshTokenReused, bunrouter.H{})
+			}
+			if errors.Is(err, errRefreshTokenInvalid) {
+				return response.Error(rw, response.MessageRefreshTokenInvalid, bunrouter.H{})
+			}
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+
+		// 用户已删除或已被整体撤销时不再续期
+		if _, ok, err := isExistUserByID(token.UserID, h.db); err != nil || !ok {
+			clearSessionCookies(rw)
+			return response.Error(rw, response.MessageRefreshTokenInvalid, bunrouter.H{})
+		}
+
+		session, err := h.issueSession(ctx, rw, token.UserID, token.FamilyID)
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, session)
+	}
+}
+
+// 签发会话access token和refresh token，并写入cookie
+// familyID为空时表示一次新的登录
+func (h *Handler) issueSession(ctx context.Context, rw http.ResponseWriter, userID uint, familyID string) (SessionResponse, error) {
+	now := time.Now()
+	accessTTL := ttlSeconds(h.cfg.Session.AccessTokenTTL, defaultSessionAccessTokenTTL)
+	refreshTTL := ttlSeconds(h.cfg.Session.RefreshTokenTTL, defaultSessionRefreshTokenTTL)
+
+	if familyID == "" {
+		familyID = h.r.RandString(32)
+	}
+	accessToken, err := h.j.SignClaims(ctx, util.SessionClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        h.r.RandString(24),
+			Subject:   strconv.Itoa(int(userID)),
+			ExpiresAt: jwt.NewNumericDate(now.Add(accessTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+		SessionID: familyID,
+	})
+	if err != nil {
+		return SessionResponse{}, err
+	}
+
+	refreshToken := h.r.RandString(48)
+	if err := h.db.WithContext(ctx).Create(&model.RefreshToken{
+		TokenHash: hashRefreshToken(refreshToken),
+		FamilyID:  familyID,
+		UserID:    userID,
+		ExpiresAt: now.Add(refreshTTL),
+	}).Error; err != nil {
+		log.Error(ctx, err.Error())
+		return SessionResponse{}, err
+	}
+
+	http.SetCookie(rw, &http.Cookie{
+		Name:     constants.SessionCookieName,
+		Value:    accessToken,
+		Path:     "/",
+		Expires:  now.Add(refreshTTL),
+		HttpOnly: true,
+	})
+	http.SetCookie(rw, &http.Cookie{
+		Name:     constants.RefreshCookieName,
+		Value:    refreshToken,
+		Path:     constants.RefreshCookiePath,
+		Expires:  now.Add(refreshTTL),
+		HttpOnly: true,
+	})
+	return SessionResponse{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(accessTTL / time.Second),
+	}, nil
+}
+
+// 将refresh token标记为已使用，返回其记录
+func (h *Handler) rotateRefreshToken(ctx context.Context, refreshToken string) (model.RefreshToken, error) {
+	now := time.Now()
+	var token model.RefreshToken
+	err := h.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		db := tx.Where("token_hash = ?", hashRefreshToken(refreshToken)).Find(&token)
+		if db.Error != nil {
+			return db.Error
+		}
+		if db.RowsAffected != 1 || token.RevokedAt != nil || !now.Before(token.ExpiresAt) {
+			return errRefreshTokenInvalid
+		}
+		// 条件更新保证并发时只有一个请求能轮换成功
+		db = tx.Model(&model.RefreshToken{}).
+			Where("id = ? AND used_at IS NULL", token.ID).
+			Update("used_at", now)
+		if db.Error != nil {
+			return db.Error
+		}
+		if db.RowsAffected != 1 {
+			return errRefreshTokenReused
+		}
+		return nil
+	})
+	if errors.Is(err, errRefreshTokenReused) {
+		log.Error(ctx, "refresh token reused: user="+strconv.Itoa(int(token.UserID))+" family="+token.FamilyID)
+		if err := h.revokeRefreshFamily(ctx, token.FamilyID); err != nil {
+			log.Error(ctx, err.Error())
+		}
+	}
+	return token, err
+}
+
+func (h *Handler) revokeRefreshFamily(ctx context.Context, familyID string) error {
+	return h.db.WithContext(ctx).Model(&model.RefreshToken{}).
+		Where("family_id = ? AND revoked_at IS NULL", familyID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// Logout 撤销当前access token及其所属的refresh token family
+func (h *Handler) Logout() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		if err := h.endSession(ctx, rw, middleware.ContextJWTClaims{}.Value(ctx)); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
+	}
+}
+
+// 结束会话：撤销access token和refresh token family，通知使用过该会话的应用，并清除cookie
+func (h *Handler) endSession(ctx context.Context, rw http.ResponseWriter, claims util.SessionClaims) error {
+	if claims.ID != "" {
+		if err := h.revocations.RevokeToken(ctx, claims); err != nil {
+			return err
+		}
+	}
+	if claims.SessionID != "" {
+		if err := h.revokeRefreshFamily(ctx, claims.SessionID); err != nil {
+			return err
+		}
+		if err := h.notifier.NotifySession(ctx, claims.SessionID); err != nil {
+			log.Error(ctx, err.Error())
+		}
+	}
+	clearSessionCookies(rw)
+	return nil
+}
+
+// 撤销用户全部已签发的access token和refresh token
+func (h *Handler) revokeUserTokens(ctx context.Context, userID uint) error {
+	if err := h.revocations.RevokeUser(ctx, userID); err != nil {
+		return err
+	}
+	if err := h.db.WithContext(ctx).Model(&model.RefreshToken{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now()).Error; err != nil {
+		return err
+	}
+	return h.notifier.NotifyUser(ctx, userID)
+}
+
+func clearSessionCookies(rw http.ResponseWriter) {
+	http.SetCookie(rw, &http.Cookie{Name: constants.SessionCookieName, Path: "/", MaxAge: -1, HttpOnly: true})
+	http.SetCookie(rw, &http.Cookie{Name: constants.RefreshCookieName, Path: constants.RefreshCookiePath, MaxAge: -1, HttpOnly: true})
+}
+
+func hashRefreshToken(refreshToken string) string {
+	sum := sha256.Sum256([]byte(refreshToken))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,235 @@
+package handler
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uptrace/bunrouter"
+
+	"git.blauwelle.com/go/crate/cmd/sso/config"
+	"git.blauwelle.com/go/crate/cmd/sso/model"
+	"git.blauwelle.com/go/crate/cmd/sso/response"
+	"git.blauwelle.com/go/crate/cmd/sso/util"
+)
+
+// refreshDB 只实现refresh_tokens表，users表中只有ID为7的用户
+type refreshDB struct {
+	mu     sync.Mutex
+	tokens []model.RefreshToken
+}
+
+func (d *refreshDB) query(q string, args []driver.Value) ([]string, [][]driver.Value, int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch {
+	case strings.HasPrefix(q, "SELECT * FROM `users`"):
+		if args[0] == int64(7) {
+			return []string{"id", "username", "source"}, [][]driver.Value{{int64(7), "alice", model.UserSourceLocal}}, 0
+		}
+		return []string{"id"}, nil, 0
+	case strings.HasPrefix(q, "SELECT * FROM `refresh_tokens` WHERE token_hash = ?"):
+		for _, token := range d.tokens {
+			if args[0] == token.TokenHash {
+				return refreshTokenColumns, [][]driver.Value{refreshTokenRow(token)}, 0
+			}
+		}
+		return refreshTokenColumns, nil, 0
+	case strings.HasPrefix(q, "UPDATE `refresh_tokens` SET `used_at`=? WHERE id = ?"):
+		for i, token := range d.tokens {
+			if args[1] == int64(token.ID) && (token.UsedAt == nil || !strings.Contains(q, "used_at IS NULL")) {
+				usedAt := args[0].(time.Time)
+				d.tokens[i].UsedAt = &usedAt
+				return nil, nil, 1
+			}
+		}
+		return nil, nil, 0
+	case strings.HasPrefix(q, "UPDATE `refresh_tokens` SET `revoked_at`=? WHERE family_id = ?"):
+		var n int64
+		for i, token := range d.tokens {
+			if args[1] == token.FamilyID && token.RevokedAt == nil {
+				revokedAt := args[0].(time.Time)
+				d.tokens[i].RevokedAt = &revokedAt
+				n++
+			}
+		}
+		return nil, nil, n
+	case strings.HasPrefix(q, "INSERT INTO `refresh_tokens`"):
+		token := model.RefreshToken{ID: uint(len(d.tokens) + 1)}
+		for i, column := range strings.Split(insertColumnsPattern.FindStringSubmatch(q)[1], ",") {
+			switch column {
+			case "`token_hash`":
+				token.TokenHash = args[i].(string)
+			case "`family_id`":
+				token.FamilyID = args[i].(string)
+			case "`user_id`":
+				token.UserID = uint(args[i].(int64))
+			case "`expires_at`":
+				token.ExpiresAt = args[i].(time.Time)
+			case "`created_at`":
+				token.CreatedAt = args[i].(time.Time)
+			}
+		}
+		d.tokens = append(d.tokens, token)
+		return nil, nil, 1
+	}
+	return nil, nil, 0
+}
+
+func (d *refreshDB) family(familyID string) []model.RefreshToken {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var tokens []model.RefreshToken
+	for _, token := range d.tokens {
+		if token.FamilyID == familyID {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+var refreshTokenColumns = []string{"id", "token_hash", "family_id", "user_id", "expires_at", "used_at", "revoked_at", "created_at"}
+
+func refreshTokenRow(token model.RefreshToken) []driver.Value {
+	var usedAt, revokedAt driver.Value
+	if token.UsedAt != nil {
+		usedAt = *token.UsedAt
+	}
+	if token.RevokedAt != nil {
+		revokedAt = *token.RevokedAt
+	}
+	return []driver.Value{int64(token.ID), token.TokenHash, token.FamilyID, int64(token.UserID), token.ExpiresAt, usedAt, revokedAt, token.CreatedAt}
+}
+
+func newRefreshTest(t *testing.T) (*Handler, *refreshDB) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := util.NewJWT(key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &refreshDB{}
+	gdb := openFakeDB(t, db.query)
+	h := NewHandler(config.Config{}, gdb, util.NewMemoryStore(0), j, util.NewRevocationList(gdb), nil, nil, nil, nil)
+	return h, db
+}
+
+// 签发一个新会话，返回refresh token
+func seedRefreshToken(t *testing.T, h *Handler, familyID string) string {
+	t.Helper()
+	session, err := h.issueSession(context.Background(), httptest.NewRecorder(), 7, familyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session.RefreshToken
+}
+
+func refresh(t *testing.T, h *Handler, refreshToken string) (string, SessionResponse) {
+	t.Helper()
+	b, _ := json.Marshal(RefreshTokenRequest{RefreshToken: refreshToken})
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/", strings.NewReader(string(b)))
+	if err := h.RefreshToken()(rw, bunrouter.NewRequest(req)); err != nil {
+		t.Fatal(err)
+	}
+	var resp response.GenResponse[SessionResponse]
+	if err := json.Unmarshal(rw.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Message, resp.Data
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	h, db := newRefreshTest(t)
+	first := seedRefreshToken(t, h, "family-1")
+
+	msg, session := refresh(t, h, first)
+	if msg != response.MessageOK {
+		t.Fatalf("refresh = %s", msg)
+	}
+	if session.RefreshToken == "" || session.RefreshToken == first {
+		t.Fatalf("refresh token not rotated: %q", session.RefreshToken)
+	}
+	msg, third := refresh(t, h, session.RefreshToken)
+	if msg != response.MessageOK {
+		t.Fatalf("second refresh = %s", msg)
+	}
+	// 轮换后仍属于同一个family
+	tokens := db.family("family-1")
+	if len(tokens) != 3 {
+		t.Fatalf("family has %d tokens, want 3", len(tokens))
+	}
+	for _, token := range tokens[:2] {
+		if token.UsedAt == nil || token.RevokedAt != nil {
+			t.Errorf("token %d used=%v revoked=%v", token.ID, token.UsedAt, token.RevokedAt)
+		}
+	}
+	if tokens[2].TokenHash != hashRefreshToken(third.RefreshToken) || tokens[2].UsedAt != nil {
+		t.Errorf("latest token = %+v", tokens[2])
+	}
+}
+
+// 已使用的refresh token再次出现时整个family作废，最新的token也不能再使用
+func TestRefreshTokenReuse(t *testing.T) {
+	h, db := newRefreshTest(t)
+	first := seedRefreshToken(t, h, "family-1")
+	other := seedRefreshToken(t, h, "family-2")
+
+	msg, session := refresh(t, h, first)
+	if msg != response.MessageOK {
+		t.Fatalf("refresh = %s", msg)
+	}
+	if msg, _ := refresh(t, h, first); msg != response.MessageRefreshTokenReused {
+		t.Fatalf("reuse = %s", msg)
+	}
+	for _, token := range db.family("family-1") {
+		if token.RevokedAt == nil {
+			t.Errorf("token %d not revoked", token.ID)
+		}
+	}
+	if msg, _ := refresh(t, h, session.RefreshToken); msg != response.MessageRefreshTokenInvalid {
+		t.Fatalf("rotated token after reuse = %s", msg)
+	}
+	// 其他会话不受影响
+	if msg, _ := refresh(t, h, other); msg != response.MessageOK {
+		t.Fatalf("other family = %s", msg)
+	}
+}
+
+func TestRefreshTokenInvalid(t *testing.T) {
+	h, db := newRefreshTest(t)
+	expired := seedRefreshToken(t, h, "family-1")
+	db.mu.Lock()
+	db.tokens[0].ExpiresAt = time.Now().Add(-time.Second)
+	db.mu.Unlock()
+	revoked := seedRefreshToken(t, h, "family-2")
+	if err := h.revokeRefreshFamily(context.Background(), "family-2"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name         string
+		refreshToken string
+	}{
+		{"empty", ""},
+		{"unknown", "unknown"},
+		{"expired", expired},
+		{"revoked", revoked},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if msg, _ := refresh(t, h, tt.refreshToken); msg != response.MessageRefreshTokenInvalid {
+				t.Errorf("refresh = %s", msg)
+			}
+		})
+	}
+}
@@ -2,10 +2,14 @@ package handler
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"git.blauwelle.com/go/crate/log"
+	"github.com/go-sql-driver/mysql"
 	"github.com/uptrace/bunrouter"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
@@ -15,7 +19,15 @@ import (
 	"git.blauwelle.com/go/crate/cmd/sso/response"
 )
 
-type CreateUserRequest LoginRequest
+// ER_DUP_ENTRY
+const mysqlErrDuplicateEntry = 1062
+
+type CreateUserRequest struct {
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	Email         string `json:"email"`          // 可选，用于找回密码和登录
+	EmailVerified bool   `json:"email_verified"` // 管理员确认邮箱属于该用户时直接标记为已验证，否则需用户自行验证
+}
 
 func (h *Handler) CreateUser() bunrouter.HandlerFunc {
 	return func(rw http.ResponseWriter, r bunrouter.Request) error {
@@ -26,17 +38,62 @@ func (h *Handler) CreateUser() bunrouter.HandlerFunc {
 			log.Error(ctx, err.Error())
 			return response.Error(rw, response.MessageBindError, bunrouter.H{})
 		}
+		if !validUsername(request.Username) {
+			return response.Error(rw, response.MessageUsernameInvalid, bunrouter.H{})
+		}
 		var user model.User
 		result := h.db.Where("username = ?", request.Username).First(&user)
 		if result.RowsAffected > 0 {
-			return response.Error(rw, response.MessageUserIsExist, bunrouter.H{})
+			return response.Error(rw, response.MessageUsernameUnavailable, bunrouter.H{})
 		}
 
-		passwordHash, _ := bcrypt.GenerateFromPassword([]byte(request.Password), 12)
-		h.db.Create(&model.User{
-			Username:     request.Username,
-			PasswordHash: string(passwordHash),
-		})
+		if err := h.passwords.Check(request.Username, request.Password); err != nil {
+			return h.writePasswordError(ctx, rw, err)
+		}
+		var email *string
+		var emailVerifiedAt *time.Time
+		if request.Email != "" {
+			normalized, ok := normalizeEmail(request.Email)
+			if !ok {
+				return response.Error(rw, response.MessageEmailInvalid, bunrouter.H{})
+			}
+			_, exist, err := isExistUserByEmail(normalized, h.db)
+			if err != nil {
+				return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+			}
+			if exist {
+				return response.Error(rw, response.MessageEmailExist, bunrouter.H{})
+			}
+			email = &normalized
+			if request.EmailVerified {
+				now := time.Now()
+				emailVerifiedAt = &now
+			}
+		}
+
+		passwordHash, err := bcrypt.GenerateFromPassword([]byte(request.Password), 12)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		if err := h.db.WithContext(ctx).Create(&model.User{
+			OrganizationID:    currentOrganizationID(ctx),
+			Username:          request.Username,
+			PasswordHash:      string(passwordHash),
+			Email:             email,
+			EmailVerifiedAt:   emailVerifiedAt,
+			PasswordChangedAt: &now,
+		}).Error; err != nil {
+			// 并发创建时通过了上面的检查仍可能违反唯一索引
+			if key, ok := duplicateKey(err); ok {
+				if strings.HasSuffix(key, "email") {
+					return response.Error(rw, response.MessageEmailExist, bunrouter.H{})
+				}
+				return response.Error(rw, response.MessageUsernameUnavailable, bunrouter.H{})
+			}
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
 		return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
 	}
 }
@@ -52,8 +109,8 @@ func (h *Handler) SearchUser() bunrouter.HandlerFunc {
 		var users []model.User
 		var count int64
 
-		// 构建查询条件
-		query := h.db.Model(&model.User{})
+		// 构建查询条件，只查询当前组织的用户
+		query := h.tenant(r.Context()).Model(&model.User{})
 
 		// 添加模糊查询条件
 		if userName != "" {
@@ -80,7 +137,7 @@ func (h *Handler) SearchUser() bunrouter.HandlerFunc {
 		}
 
 		// 分页查询应用程序
-		if dbFind := query.Offset(offset).Limit(pageSizeInt).Select("id, created_at, updated_at, username").Find(&users); dbFind.Error != nil {
+		if dbFind := query.Offset(offset).Limit(pageSizeInt).Select("id, created_at, updated_at, username, email, email_verified_at").Find(&users); dbFind.Error != nil {
 			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
 		}
 		return response.WriteOK(rw, response.MessageOK, response.NewPaginationData(pageInt, pageSizeInt, users))
@@ -99,21 +156,29 @@ func (h *Handler) UpdateUsername() bunrouter.HandlerFunc {
 			log.Error(ctx, err.Error())
 			return response.Error(rw, response.MessageBindError, bunrouter.H{})
 		}
+		if !validUsername(request.Username) {
+			return response.Error(rw, response.MessageUsernameInvalid, bunrouter.H{})
+		}
 		_, ok, err := isExistUserByName(request.Username, h.db)
 		if err != nil {
 			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
 		}
 		if ok {
-			return response.Error(rw, response.MessageUserIsExist, bunrouter.H{})
+			return response.Error(rw, response.MessageUsernameUnavailable, bunrouter.H{})
 		}
 		id, err := strconv.Atoi(middleware.ContextJWTClaims{}.Value(r.Context()).Subject)
 		if err != nil {
 			return err
 		}
-		if result := h.db.Model(&model.User{}).Where("id = ?", id).
-			Update("username", request.Username); result.Error != nil {
+		// 外部目录的用户按用户名与目录条目对应，不允许修改
+		result := h.db.Model(&model.User{}).Where("id = ? AND source = ?", id, model.UserSourceLocal).
+			Update("username", request.Username)
+		if result.Error != nil {
 			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
 		}
+		if result.RowsAffected != 1 {
+			return response.Error(rw, response.MessageExternalUser, bunrouter.H{})
+		}
 		return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
 	}
 }
@@ -142,19 +207,27 @@ func (h *Handler) UpdatePassword() bunrouter.HandlerFunc {
 		if !ok {
 			return response.Error(rw, response.MessageUserNotExist, bunrouter.H{})
 		}
+		// 外部目录的用户密码由目录管理
+		if user.Source != model.UserSourceLocal {
+			return response.Error(rw, response.MessageExternalUser, bunrouter.H{})
+		}
 		if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(request.Password)); err != nil {
 			log.Error(ctx, err.Error())
 			return response.Error(rw, response.MessageIncorrectPassword, bunrouter.H{})
 		}
-		passwordHash, err := bcrypt.GenerateFromPassword([]byte(request.NewPassword), 12)
-		if err != nil {
-			return err
+		if err := h.setPassword(ctx, user, request.NewPassword); err != nil {
+			return h.writePasswordError(ctx, rw, err)
 		}
-		if result := h.db.Model(&model.User{}).Where("id = ?", id).
-			Update("password_hash", passwordHash); result.Error != nil {
+		// 修改密码后其他会话全部失效，当前会话重新签发
+		if err := h.revokeUserTokens(ctx, user.ID); err != nil {
+			log.Error(ctx, err.Error())
 			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
 		}
-		return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
+		session, err := h.issueSession(ctx, rw, user.ID, "")
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, session)
 	}
 }
 
@@ -166,6 +239,22 @@ func isExistUserByID(UserID uint, db *gorm.DB) (model.User, bool, error) {
 	}
 	return user, true, nil
 }
+
+// 违反唯一索引时返回索引名，MySQL的错误信息为 Duplicate entry '...' for key '...'
+func duplicateKey(err error) (string, bool) {
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) || mysqlErr.Number != mysqlErrDuplicateEntry {
+		return "", false
+	}
+	_, key, _ := strings.Cut(mysqlErr.Message, " for key ")
+	return strings.Trim(key, "'"), true
+}
+
+// 用户名不能包含@，避免与登录时使用的邮箱混淆
+func validUsername(username string) bool {
+	return username != "" && !strings.Contains(username, "@")
+}
+
 func isExistUserByName(Username string, db *gorm.DB) (model.User, bool, error) {
 	var user model.User
 	DB := db.Where("username = ?", Username).Find(&user)
@@ -189,7 +278,15 @@ func (h *Handler) DeleteUser() bunrouter.HandlerFunc {
 			return response.Error(rw, response.MessageBindError, bunrouter.H{})
 		}
 
-		if db := h.db.Delete(&model.User{}, "id=?", request.ID); db.Error != nil {
+		db := h.tenant(ctx).Delete(&model.User{}, "id=?", request.ID)
+		if db.Error != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if db.RowsAffected != 1 {
+			return response.Error(rw, response.MessageUserNotExist, bunrouter.H{})
+		}
+		if err := h.revokeUserTokens(ctx, request.ID); err != nil {
+			log.Error(ctx, err.Error())
 			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
 		}
 		return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
@@ -0,0 +1,92 @@
+package handler
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/uptrace/bunrouter"
+
+	"git.blauwelle.com/go/crate/cmd/sso/config"
+	"git.blauwelle.com/go/crate/cmd/sso/response"
+	"git.blauwelle.com/go/crate/cmd/sso/util"
+)
+
+// userDB 已有用户taken，邮箱为taken@example.com
+type userDB struct {
+	inserted map[string]driver.Value
+}
+
+func (d *userDB) query(q string, args []driver.Value) ([]string, [][]driver.Value, int64) {
+	switch {
+	case strings.HasPrefix(q, "SELECT * FROM `users` WHERE username = ?") && args[0] == "taken",
+		strings.HasPrefix(q, "SELECT * FROM `users` WHERE email = ?") && args[0] == "taken@example.com":
+		return []string{"id", "username"}, [][]driver.Value{{int64(1), "taken"}}, 0
+	case strings.HasPrefix(q, "INSERT INTO `users`"):
+		d.inserted = insertedColumns(q, args)
+		return nil, nil, 1
+	}
+	return []string{"id"}, nil, 0
+}
+
+func TestCreateUser(t *testing.T) {
+	tests := []struct {
+		name     string
+		request  CreateUserRequest
+		insert   error // 插入用户时数据库返回的错误
+		wantCode string
+	}{
+		{"created", CreateUserRequest{Username: "alice", Password: "correct horse", Email: "Alice@Example.com"}, nil, response.MessageOK},
+		{"username taken", CreateUserRequest{Username: "taken", Password: "correct horse"}, nil, response.MessageUsernameUnavailable},
+		{"email taken", CreateUserRequest{Username: "alice", Password: "correct horse", Email: "taken@example.com"}, nil, response.MessageEmailExist},
+		// 并发创建时检查通过，插入时违反唯一索引
+		{
+			"username created concurrently", CreateUserRequest{Username: "alice", Password: "correct horse"},
+			&mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'alice' for key 'users.username'"}, response.MessageUsernameUnavailable,
+		},
+		{
+			"email created concurrently", CreateUserRequest{Username: "alice", Password: "correct horse", Email: "alice@example.com"},
+			&mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'alice@example.com' for key 'users.email'"}, response.MessageEmailExist,
+		},
+		{"insert failed", CreateUserRequest{Username: "alice", Password: "correct horse"}, errors.New("connection lost"), response.MessageDatabaseConnectionError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &userDB{}
+			gdb := openFailingFakeDB(t, db.query, func(q string, _ []driver.Value) error {
+				if strings.HasPrefix(q, "INSERT INTO `users`") {
+					return tt.insert
+				}
+				return nil
+			})
+			var cfg config.Config
+			cfg.Password.MinLength = 8
+			cfg.Password.MaxLength = 72
+			h := NewHandler(cfg, gdb, util.NewMemoryStore(0), nil, util.NewRevocationList(gdb), nil, nil, nil, nil)
+
+			b, _ := json.Marshal(tt.request)
+			req := asUser(httptest.NewRequest("POST", "/", strings.NewReader(string(b))), 7, 2)
+			rw := httptest.NewRecorder()
+			if err := h.CreateUser()(rw, bunrouter.NewRequest(req)); err != nil {
+				t.Fatal(err)
+			}
+			var resp response.GenResponse[json.RawMessage]
+			if err := json.Unmarshal(rw.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Message != tt.wantCode {
+				t.Fatalf("got %s, want %s", resp.Message, tt.wantCode)
+			}
+			if tt.wantCode != response.MessageOK {
+				return
+			}
+			if db.inserted["username"] != "alice" || db.inserted["email"] != "alice@example.com" || db.inserted["organization_id"] != int64(2) {
+				t.Errorf("inserted = %v", db.inserted)
+			}
+		})
+	}
+}
@@ -0,0 +1,593 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.blauwelle.com/go/crate/log"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/uptrace/bunrouter"
+
+	"git.blauwelle.com/go/crate/cmd/sso/model"
+	"git.blauwelle.com/go/crate/cmd/sso/response"
+)
+
+// WebAuthn凭证的注册和认证，同一个凭证既可以用于无密码登录，也可以在密码登录后作为第二因素
+
+const webAuthnChallengeTTL = 5 * time.Minute
+
+var (
+	errWebAuthnChallenge = errors.New("webauthn challenge invalid")
+	errWebAuthnCloned    = errors.New("webauthn authenticator may be cloned")
+)
+
+type WebAuthnBeginResponse struct {
+	ChallengeID string `json:"challenge_id"`
+	Options     any    `json:"options"` // 直接传给 navigator.credentials.create/get
+}
+
+type WebAuthnRegisterBeginRequest struct {
+	Name string `json:"name"`
+}
+
+type WebAuthnFinishRequest struct {
+	ChallengeID string          `json:"challenge_id"`
+	MFAToken    string          `json:"mfa_token"`
+	Credential  json.RawMessage `json:"credential"` // navigator.credentials.create/get 的返回值
+}
+
+type WebAuthnMFABeginRequest struct {
+	MFAToken string `json:"mfa_token"`
+}
+
+type UpdateWebAuthnCredentialRequest struct {
+	ID   uint   `json:"id"`
+	Name string `json:"name"`
+}
+
+type DeleteWebAuthnCredentialRequest struct {
+	ID uint `json:"id"`
+}
+
+// 实现 webauthn.User，user handle使用用户ID，不包含用户名等信息
+type webAuthnUser struct {
+	user        model.User
+	credentials []model.WebAuthnCredential
+}
+
+func (u webAuthnUser) WebAuthnID() []byte {
+	return webAuthnUserHandle(u.user.ID)
+}
+
+func (u webAuthnUser) WebAuthnName() string {
+	return u.user.Username
+}
+
+func (u webAuthnUser) WebAuthnDisplayName() string {
+	return u.user.Username
+}
+
+func (u webAuthnUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (u webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, 0, len(u.credentials))
+	for _, c := range u.credentials {
+		id, err := base64.RawURLEncoding.DecodeString(c.CredentialID)
+		if err != nil {
+			continue
+		}
+		aaguid, _ := hex.DecodeString(c.AAGUID)
+		var transports []protocol.AuthenticatorTransport
+		if c.Transports != "" {
+			for _, t := range strings.Split(c.Transports, ",") {
+				transports = append(transports, protocol.AuthenticatorTransport(t))
+			}
+		}
+		credentials = append(credentials, webauthn.Credential{
+			ID:              id,
+			PublicKey:       c.PublicKey,
+			AttestationType: c.AttestationType,
+			Transport:       transports,
+			Flags: webauthn.CredentialFlags{
+				BackupEligible: c.BackupEligible,
+				BackupState:    c.BackupState,
+			},
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    aaguid,
+				SignCount: c.SignCount,
+			},
+		})
+	}
+	return credentials
+}
+
+func (u webAuthnUser) descriptors() []protocol.CredentialDescriptor {
+	credentials := u.WebAuthnCredentials()
+	descriptors := make([]protocol.CredentialDescriptor, 0, len(credentials))
+	for _, c := range credentials {
+		descriptors = append(descriptors, c.Descriptor())
+	}
+	return descriptors
+}
+
+// ListWebAuthnCredentials 当前用户的全部凭证
+func (h *Handler) ListWebAuthnCredentials() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		userID, err := currentUserID(ctx)
+		if err != nil {
+			return err
+		}
+		var credentials []model.WebAuthnCredential
+		if err := h.db.WithContext(ctx).Where("user_id = ?", userID).Order("id").Find(&credentials).Error; err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, credentials)
+	}
+}
+
+// BeginWebAuthnRegistration 开始注册新的凭证
+func (h *Handler) BeginWebAuthnRegistration() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request WebAuthnRegisterBeginRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		userID, err := currentUserID(ctx)
+		if err != nil {
+			return err
+		}
+		user, err := h.loadWebAuthnUser(ctx, userID)
+		if err != nil {
+			return h.writeWebAuthnError(rw, err)
+		}
+		w, err := h.webAuthn()
+		if err != nil {
+			return h.writeWebAuthnError(rw, err)
+		}
+		// 优先创建可发现凭证（通行密钥），以支持无用户名登录
+		creation, session, err := w.BeginRegistration(user,
+			webauthn.WithExclusions(user.descriptors()),
+			webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementPreferred),
+		)
+		if err != nil {
+			return h.writeWebAuthnError(rw, err)
+		}
+		name := strings.TrimSpace(request.Name)
+		if name == "" {
+			name = "Passkey " + time.Now().Format("2006-01-02")
+		}
+		challengeID, err := h.saveWebAuthnChallenge(ctx, model.WebAuthnPurposeRegister, userID, name, session)
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, WebAuthnBeginResponse{ChallengeID: challengeID, Options: creation})
+	}
+}
+
+// FinishWebAuthnRegistration 校验认证器的返回并保存凭证
+func (h *Handler) FinishWebAuthnRegistration() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request WebAuthnFinishRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		userID, err := currentUserID(ctx)
+		if err != nil {
+			return err
+		}
+		challenge, data, err := h.consumeWebAuthnChallenge(ctx, request.ChallengeID, model.WebAuthnPurposeRegister, userID)
+		if err != nil {
+			return h.writeWebAuthnError(rw, err)
+		}
+		user, err := h.loadWebAuthnUser(ctx, userID)
+		if err != nil {
+			return h.writeWebAuthnError(rw, err)
+		}
+		parsed, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(request.Credential))
+		if err != nil {
+			return h.writeWebAuthnError(rw, err)
+		}
+		w, err := h.webAuthn()
+		if err != nil {
+			return h.writeWebAuthnError(rw, err)
+		}
+		credential, err := w.CreateCredential(user, data, parsed)
+		if err != nil {
+			return h.writeWebAuthnError(rw, err)
+		}
+
+		transports := make([]string, 0, len(credential.Transport))
+		for _, t := range credential.Transport {
+			transports = append(transports, string(t))
+		}
+		row := model.WebAuthnCredential{
+			UserID:          userID,
+			Name:            challenge.Name,
+			CredentialID:    base64.RawURLEncoding.EncodeToString(credential.ID),
+			PublicKey:       credential.PublicKey,
+			AttestationType: credential.AttestationType,
+			AAGUID:          hex.EncodeToString(credential.Authenticator.AAGUID),
+			SignCount:       credential.Authenticator.SignCount,
+			Transports:      strings.Join(transports, ","),
+			BackupEligible:  credential.Flags.BackupEligible,
+			BackupState:     credential.Flags.BackupState,
+		}
+		if err := h.db.WithContext(ctx).Create(&row).Error; err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, row)
+	}
+}
+
+// UpdateWebAuthnCredential 修改凭证名称
+func (h *Handler) UpdateWebAuthnCredential() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request UpdateWebAuthnCredentialRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || strings.TrimSpace(request.Name) == "" {
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		userID, err := currentUserID(ctx)
+		if err != nil {
+			return err
+		}
+		db := h.db.WithContext(ctx).Model(&model.WebAuthnCredential{}).
+			Where("id = ? AND user_id = ?", request.ID, userID).
+			Update("name", strings.TrimSpace(request.Name))
+		if db.Error != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if db.RowsAffected != 1 {
+			return response.Error(rw, response.MessageWebAuthnNotExist, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
+	}
+}
+
+// DeleteWebAuthnCredential 删除凭证；策略要求MFA时不能删除最后一个第二因素
+func (h *Handler) DeleteWebAuthnCredential() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request DeleteWebAuthnCredentialRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		userID, err := currentUserID(ctx)
+		if err != nil {
+			return err
+		}
+		factors, err := h.secondFactors(ctx, userID)
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if required, err := h.mfaRequiredByPolicy(ctx, userID); err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		} else if required && factors.totp == 0 && factors.webAuthn <= 1 {
+			return response.Error(rw, response.MessageMFARequired, bunrouter.H{})
+		}
+		db := h.db.WithContext(ctx).Where("id = ? AND user_id = ?", request.ID, userID).Delete(&model.WebAuthnCredential{})
+		if db.Error != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if db.RowsAffected != 1 {
+			return response.Error(rw, response.MessageWebAuthnNotExist, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, bunrouter.H{})
+	}
+}
+
+// BeginWebAuthnLogin 开始无密码登录，由认证器选择可发现凭证
+func (h *Handler) BeginWebAuthnLogin() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		if _, ok, err := h.loginOrganization(r); err != nil || !ok {
+			if err != nil {
+				return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+			}
+			return response.Error(rw, response.MessageOrganizationNotExist, bunrouter.H{})
+		}
+		w, err := h.webAuthn()
+		if err != nil {
+			return h.writeWebAuthnError(rw, err)
+		}
+		// 无密码登录要求认证器验证用户(PIN、生物识别)
+		assertion, session, err := w.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+		if err != nil {
+			return h.writeWebAuthnError(rw, err)
+		}
+		challengeID, err := h.saveWebAuthnChallenge(ctx, model.WebAuthnPurposeLogin, 0, "", session)
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, WebAuthnBeginResponse{ChallengeID: challengeID, Options: assertion})
+	}
+}
+
+// FinishWebAuthnLogin 校验断言并签发会话，凭证的用户必须属于登录的组织
+func (h *Handler) FinishWebAuthnLogin() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request WebAuthnFinishRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		organizationID, ok, err := h.loginOrganization(r)
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		if !ok {
+			return response.Error(rw, response.MessageOrganizationNotExist, bunrouter.H{})
+		}
+		_, data, err := h.consumeWebAuthnChallenge(ctx, request.ChallengeID, model.WebAuthnPurposeLogin, 0)
+		if err != nil {
+			return h.writeWebAuthnError(rw, err)
+		}
+		parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(request.Credential))
+		if err != nil {
+			return h.writeWebAuthnError(rw, err)
+		}
+		w, err := h.webAuthn()
+		if err != nil {
+			return h.writeWebAuthnError(rw, err)
+		}
+		var found webAuthnUser
+		credential, err := w.ValidateDiscoverableLogin(func(_, userHandle []byte) (webauthn.User, error) {
+			if len(userHandle) != 8 {
+				return nil, errWebAuthnChallenge
+			}
+			user, err := h.loadWebAuthnUser(ctx, uint(binary.BigEndian.Uint64(userHandle)))
+			if err == nil && user.user.OrganizationID != organizationID {
+				return nil, errWebAuthnChallenge
+			}
+			found = user
+			return user, err
+		}, data, parsed)
+		if err != nil {
+			return h.writeWebAuthnError(rw, err)
+		}
+		if err := h.recordWebAuthnUse(ctx, found.user.ID, credential); err != nil {
+			return h.writeWebAuthnError(rw, err)
+		}
+
+		session, err := h.issueSession(ctx, rw, found.user.ID, "")
+		if err != nil {
+			return response.Error(rw, response.MessageTokenExpired, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, session)
+	}
+}
+
+// BeginWebAuthnMFA 密码登录后使用已注册的凭证作为第二因素
+func (h *Handler) BeginWebAuthnMFA() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request WebAuthnMFABeginRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		token, ok := h.verifyMFAToken(ctx, request.MFAToken)
+		if !ok {
+			return response.Error(rw, response.MessageMFATokenInvalid, bunrouter.H{})
+		}
+		userID := token.userID
+		user, err := h.loadWebAuthnUser(ctx, userID)
+		if err != nil {
+			return h.writeWebAuthnError(rw, err)
+		}
+		if len(user.credentials) == 0 {
+			return response.Error(rw, response.MessageMFANotEnabled, bunrouter.H{})
+		}
+		w, err := h.webAuthn()
+		if err != nil {
+			return h.writeWebAuthnError(rw, err)
+		}
+		assertion, session, err := w.BeginLogin(user)
+		if err != nil {
+			return h.writeWebAuthnError(rw, err)
+		}
+		challengeID, err := h.saveWebAuthnChallenge(ctx, model.WebAuthnPurposeMFA, userID, "", session)
+		if err != nil {
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, WebAuthnBeginResponse{ChallengeID: challengeID, Options: assertion})
+	}
+}
+
+// FinishWebAuthnMFA 校验第二因素并签发会话
+func (h *Handler) FinishWebAuthnMFA() bunrouter.HandlerFunc {
+	return func(rw http.ResponseWriter, r bunrouter.Request) error {
+		ctx := r.Context()
+		var request WebAuthnFinishRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageBindError, bunrouter.H{})
+		}
+		token, ok := h.verifyMFAToken(ctx, request.MFAToken)
+		if !ok {
+			return response.Error(rw, response.MessageMFATokenInvalid, bunrouter.H{})
+		}
+		userID := token.userID
+		_, data, err := h.consumeWebAuthnChallenge(ctx, request.ChallengeID, model.WebAuthnPurposeMFA, userID)
+		if err != nil {
+			return h.writeWebAuthnError(rw, err)
+		}
+		user, err := h.loadWebAuthnUser(ctx, userID)
+		if err != nil {
+			return h.writeWebAuthnError(rw, err)
+		}
+		parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(request.Credential))
+		if err != nil {
+			return h.writeWebAuthnError(rw, err)
+		}
+		w, err := h.webAuthn()
+		if err != nil {
+			return h.writeWebAuthnError(rw, err)
+		}
+		credential, err := w.ValidateLogin(user, data, parsed)
+		if err != nil {
+			return h.writeWebAuthnError(rw, err)
+		}
+		if err := h.recordWebAuthnUse(ctx, userID, credential); err != nil {
+			return h.writeWebAuthnError(rw, err)
+		}
+		if err := h.succeedSecondFactor(ctx, token); err != nil {
+			log.Error(ctx, err.Error())
+			return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+		}
+
+		session, err := h.issueSession(ctx, rw, userID, "")
+		if err != nil {
+			return response.Error(rw, response.MessageTokenExpired, bunrouter.H{})
+		}
+		return response.WriteOK(rw, response.MessageOK, session)
+	}
+}
+
+// 根据配置创建WebAuthn，未配置时按oidc的地址推断
+func (h *Handler) webAuthn() (*webauthn.WebAuthn, error) {
+	cfg := h.cfg.WebAuthn
+	issuer, err := url.Parse(h.issuer())
+	if err != nil {
+		return nil, err
+	}
+	rpID := cfg.RPID
+	if rpID == "" {
+		rpID = issuer.Hostname()
+	}
+	displayName := cfg.RPDisplayName
+	if displayName == "" {
+		displayName = h.cfg.MFA.Issuer
+	}
+	origins := cfg.RPOrigins
+	if len(origins) == 0 {
+		origins = []string{issuer.Scheme + "://" + issuer.Host}
+		if loginURL, err := url.Parse(h.cfg.OIDC.LoginURL); err == nil && loginURL.Host != "" {
+			origins = append(origins, loginURL.Scheme+"://"+loginURL.Host)
+		}
+	}
+	return webauthn.New(&webauthn.Config{
+		RPID:          rpID,
+		RPDisplayName: displayName,
+		RPOrigins:     origins,
+	})
+}
+
+func (h *Handler) loadWebAuthnUser(ctx context.Context, userID uint) (webAuthnUser, error) {
+	user, ok, err := isExistUserByID(userID, h.db)
+	if err != nil {
+		return webAuthnUser{}, err
+	}
+	if !ok {
+		return webAuthnUser{}, errWebAuthnChallenge
+	}
+	var credentials []model.WebAuthnCredential
+	if err := h.db.WithContext(ctx).Where("user_id = ?", userID).Find(&credentials).Error; err != nil {
+		return webAuthnUser{}, err
+	}
+	return webAuthnUser{user: user, credentials: credentials}, nil
+}
+
+func (h *Handler) saveWebAuthnChallenge(ctx context.Context, purpose string, userID uint, name string, session *webauthn.SessionData) (string, error) {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	challenge := model.WebAuthnChallenge{
+		ID:        h.r.RandString(32),
+		UserID:    userID,
+		Purpose:   purpose,
+		Name:      name,
+		Session:   string(data),
+		ExpiresAt: now.Add(webAuthnChallengeTTL),
+	}
+	if err := h.db.WithContext(ctx).Create(&challenge).Error; err != nil {
+		log.Error(ctx, err.Error())
+		return "", err
+	}
+	// 顺带清理过期的挑战
+	h.db.WithContext(ctx).Where("expires_at < ?", now).Delete(&model.WebAuthnChallenge{})
+	return challenge.ID, nil
+}
+
+// 取出并删除挑战，并发请求中只有一个能成功
+func (h *Handler) consumeWebAuthnChallenge(ctx context.Context, id, purpose string, userID uint) (model.WebAuthnChallenge, webauthn.SessionData, error) {
+	var challenge model.WebAuthnChallenge
+	var session webauthn.SessionData
+	DB := h.db.WithContext(ctx).Where("id = ?", id).Find(&challenge)
+	if DB.Error != nil {
+		return challenge, session, DB.Error
+	}
+	if DB.RowsAffected != 1 {
+		return challenge, session, errWebAuthnChallenge
+	}
+	DB = h.db.WithContext(ctx).Where("id = ?", id).Delete(&model.WebAuthnChallenge{})
+	if DB.Error != nil {
+		return challenge, session, DB.Error
+	}
+	if DB.RowsAffected != 1 || challenge.Purpose != purpose || challenge.UserID != userID || !time.Now().Before(challenge.ExpiresAt) {
+		return challenge, session, errWebAuthnChallenge
+	}
+	if err := json.Unmarshal([]byte(challenge.Session), &session); err != nil {
+		return challenge, session, err
+	}
+	return challenge, session, nil
+}
+
+// 更新签名计数和最近使用时间，计数回退说明认证器可能被复制
+func (h *Handler) recordWebAuthnUse(ctx context.Context, userID uint, credential *webauthn.Credential) error {
+	credentialID := base64.RawURLEncoding.EncodeToString(credential.ID)
+	if credential.Authenticator.CloneWarning {
+		log.Error(ctx, "webauthn clone warning: user="+strconv.Itoa(int(userID))+" credential="+credentialID)
+		return errWebAuthnCloned
+	}
+	return h.db.WithContext(ctx).Model(&model.WebAuthnCredential{}).
+		Where("user_id = ? AND credential_id = ?", userID, credentialID).
+		Updates(map[string]interface{}{
+			"sign_count":   credential.Authenticator.SignCount,
+			"backup_state": credential.Flags.BackupState,
+			"last_used_at": time.Now(),
+		}).Error
+}
+
+func (h *Handler) writeWebAuthnError(rw http.ResponseWriter, err error) error {
+	var protocolErr *protocol.Error
+	switch {
+	case errors.Is(err, errWebAuthnChallenge):
+		return response.Error(rw, response.MessageWebAuthnChallenge, bunrouter.H{})
+	case errors.As(err, &protocolErr):
+		return response.Error(rw, response.MessageWebAuthnError, bunrouter.H{"type": protocolErr.Type})
+	case errors.Is(err, errWebAuthnCloned):
+		return response.Error(rw, response.MessageWebAuthnError, bunrouter.H{})
+	default:
+		return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+	}
+}
+
+func webAuthnUserHandle(userID uint) []byte {
+	handle := make([]byte, 8)
+	binary.BigEndian.PutUint64(handle, uint64(userID))
+	return handle
+}
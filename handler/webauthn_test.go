@@ -0,0 +1,364 @@
+package handler
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/uptrace/bunrouter"
+
+	"git.blauwelle.com/go/crate/cmd/sso/config"
+	"git.blauwelle.com/go/crate/cmd/sso/middleware"
+	"git.blauwelle.com/go/crate/cmd/sso/model"
+	"git.blauwelle.com/go/crate/cmd/sso/response"
+	"git.blauwelle.com/go/crate/cmd/sso/util"
+)
+
+// webAuthnDB 实现users、web_authn_challenges和web_authn_credentials表
+// 用户7属于组织1，用户8属于组织2
+type webAuthnDB struct {
+	mu          sync.Mutex
+	challenges  []model.WebAuthnChallenge
+	credentials []model.WebAuthnCredential
+}
+
+func (d *webAuthnDB) query(q string, args []driver.Value) ([]string, [][]driver.Value, int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch {
+	case strings.HasPrefix(q, "SELECT * FROM `users`"):
+		if strings.Contains(q, "id = ?") && (args[0] == int64(7) || args[0] == int64(8)) {
+			id := args[0].(int64)
+			return []string{"id", "organization_id", "username"}, [][]driver.Value{{id, id - 6, "user" + strconv.Itoa(int(id))}}, 0
+		}
+		return []string{"id"}, nil, 0
+	case strings.HasPrefix(q, "INSERT INTO `web_authn_challenges`"):
+		values := insertedColumns(q, args)
+		d.challenges = append(d.challenges, model.WebAuthnChallenge{
+			ID:        values["id"].(string),
+			UserID:    uint(values["user_id"].(int64)),
+			Purpose:   values["purpose"].(string),
+			Name:      values["name"].(string),
+			Session:   values["session"].(string),
+			ExpiresAt: values["expires_at"].(time.Time),
+		})
+		return nil, nil, 1
+	case strings.HasPrefix(q, "SELECT * FROM `web_authn_challenges` WHERE id = ?"):
+		for _, c := range d.challenges {
+			if args[0] == c.ID {
+				return []string{"id", "user_id", "purpose", "name", "session", "expires_at"},
+					[][]driver.Value{{c.ID, int64(c.UserID), c.Purpose, c.Name, c.Session, c.ExpiresAt}}, 0
+			}
+		}
+		return []string{"id"}, nil, 0
+	case strings.HasPrefix(q, "DELETE FROM `web_authn_challenges` WHERE id = ?"):
+		for i, c := range d.challenges {
+			if args[0] == c.ID {
+				d.challenges = append(d.challenges[:i], d.challenges[i+1:]...)
+				return nil, nil, 1
+			}
+		}
+		return nil, nil, 0
+	case strings.HasPrefix(q, "SELECT * FROM `web_authn_credentials` WHERE user_id = ?"):
+		rows := [][]driver.Value{}
+		for _, c := range d.credentials {
+			if args[0] == int64(c.UserID) {
+				rows = append(rows, []driver.Value{int64(c.ID), int64(c.UserID), c.CredentialID, c.PublicKey, c.AttestationType, c.AAGUID, int64(c.SignCount)})
+			}
+		}
+		return []string{"id", "user_id", "credential_id", "public_key", "attestation_type", "aa_guid", "sign_count"}, rows, 0
+	case strings.HasPrefix(q, "INSERT INTO `web_authn_credentials`"):
+		values := insertedColumns(q, args)
+		d.credentials = append(d.credentials, model.WebAuthnCredential{
+			ID:              uint(len(d.credentials) + 1),
+			UserID:          uint(values["user_id"].(int64)),
+			Name:            values["name"].(string),
+			CredentialID:    values["credential_id"].(string),
+			PublicKey:       values["public_key"].([]byte),
+			AttestationType: values["attestation_type"].(string),
+			AAGUID:          values["aa_guid"].(string),
+			SignCount:       uint32(values["sign_count"].(int64)),
+		})
+		return nil, nil, 1
+	case strings.HasPrefix(q, "UPDATE `web_authn_credentials`") && strings.Contains(q, "user_id = ? AND credential_id = ?"):
+		columns := strings.Split(setColumnsPattern.FindStringSubmatch(q)[1], ",")
+		for i, c := range d.credentials {
+			if args[len(columns)] == int64(c.UserID) && args[len(columns)+1] == c.CredentialID {
+				for j, column := range columns {
+					if strings.HasPrefix(column, "`sign_count`") {
+						d.credentials[i].SignCount = uint32(args[j].(int64))
+					}
+				}
+				return nil, nil, 1
+			}
+		}
+		return nil, nil, 0
+	}
+	return nil, nil, 0
+}
+
+// softAuthenticator 软件实现的认证器，使用ES256和none格式的证明
+type softAuthenticator struct {
+	key   *ecdsa.PrivateKey
+	id    []byte
+	count uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		t.Fatal(err)
+	}
+	return &softAuthenticator{key: key, id: id}
+}
+
+// flags: UP=0x01 UV=0x04 AT=0x40
+func (a *softAuthenticator) authData(t *testing.T, attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte("sso.example.com"))
+	data := append([]byte{}, rpIDHash[:]...)
+	if !attested {
+		data = append(data, 0x05)
+		return binary.BigEndian.AppendUint32(data, a.count)
+	}
+	data = append(data, 0x45)
+	data = binary.BigEndian.AppendUint32(data, a.count)
+	data = append(data, make([]byte, 16)...) // AAGUID
+	data = binary.BigEndian.AppendUint16(data, uint16(len(a.id)))
+	data = append(data, a.id...)
+	publicKey, err := cbor.Marshal(map[int]any{
+		1:  2,  // kty: EC2
+		3:  -7, // alg: ES256
+		-1: 1,  // crv: P-256
+		-2: a.key.X.FillBytes(make([]byte, 32)),
+		-3: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(data, publicKey...)
+}
+
+func clientDataJSON(t *testing.T, typ, challenge, origin string) []byte {
+	data, err := json.Marshal(map[string]string{"type": typ, "challenge": challenge, "origin": origin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// create navigator.credentials.create 的返回值
+func (a *softAuthenticator) create(t *testing.T, challenge, origin string) json.RawMessage {
+	attestation, err := cbor.Marshal(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": a.authData(t, true),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	data, _ := json.Marshal(map[string]any{
+		"id":    b64(a.id),
+		"rawId": b64(a.id),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64(clientDataJSON(t, "webauthn.create", challenge, origin)),
+			"attestationObject": b64(attestation),
+		},
+	})
+	return data
+}
+
+// get navigator.credentials.get 的返回值，每次签名计数加一
+func (a *softAuthenticator) get(t *testing.T, challenge, origin string, userHandle []byte) json.RawMessage {
+	a.count++
+	authData := a.authData(t, false)
+	clientData := clientDataJSON(t, "webauthn.get", challenge, origin)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	data, _ := json.Marshal(map[string]any{
+		"id":    b64(a.id),
+		"rawId": b64(a.id),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64(clientData),
+			"authenticatorData": b64(authData),
+			"signature":         b64(signature),
+			"userHandle":        b64(userHandle),
+		},
+	})
+	return data
+}
+
+type webAuthnTest struct {
+	t  *testing.T
+	h  *Handler
+	db *webAuthnDB
+}
+
+func newWebAuthnTest(t *testing.T) *webAuthnTest {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := util.NewJWT(key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &webAuthnDB{}
+	gdb := openFakeDB(t, db.query)
+	var cfg config.Config
+	cfg.OIDC.Issuer = testIssuer
+	cfg.MFA.Issuer = "SSO"
+	h := NewHandler(cfg, gdb, util.NewMemoryStore(0), j, util.NewRevocationList(gdb), nil, nil, nil, nil)
+	return &webAuthnTest{t: t, h: h, db: db}
+}
+
+// call 调用接口，userID不为0时以该用户登录
+func (wt *webAuthnTest) call(handler bunrouter.HandlerFunc, userID uint, body any) response.GenResponse[json.RawMessage] {
+	wt.t.Helper()
+	b, err := json.Marshal(body)
+	if err != nil {
+		wt.t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", "/", strings.NewReader(string(b)))
+	if userID != 0 {
+		claims := util.SessionClaims{RegisteredClaims: jwt.RegisteredClaims{Subject: strconv.Itoa(int(userID))}}
+		req = req.WithContext(middleware.ContextJWTClaims{}.WithValue(context.Background(), claims))
+	}
+	rw := httptest.NewRecorder()
+	if err := handler(rw, bunrouter.NewRequest(req)); err != nil {
+		wt.t.Fatal(err)
+	}
+	var resp response.GenResponse[json.RawMessage]
+	if err := json.Unmarshal(rw.Body.Bytes(), &resp); err != nil {
+		wt.t.Fatal(err)
+	}
+	return resp
+}
+
+// begin 调用Begin接口，返回challenge_id和challenge
+func (wt *webAuthnTest) begin(handler bunrouter.HandlerFunc, userID uint, body any) (string, string) {
+	wt.t.Helper()
+	resp := wt.call(handler, userID, body)
+	if resp.Message != response.MessageOK {
+		wt.t.Fatalf("begin = %s", resp.Message)
+	}
+	var data struct {
+		ChallengeID string `json:"challenge_id"`
+		Options     struct {
+			PublicKey struct {
+				Challenge string `json:"challenge"`
+			} `json:"publicKey"`
+		} `json:"options"`
+	}
+	if err := json.Unmarshal(resp.Data, &data); err != nil {
+		wt.t.Fatal(err)
+	}
+	return data.ChallengeID, data.Options.PublicKey.Challenge
+}
+
+func (wt *webAuthnTest) register(userID uint, a *softAuthenticator) {
+	wt.t.Helper()
+	challengeID, challenge := wt.begin(wt.h.BeginWebAuthnRegistration(), userID, WebAuthnRegisterBeginRequest{Name: "key"})
+	resp := wt.call(wt.h.FinishWebAuthnRegistration(), userID, WebAuthnFinishRequest{
+		ChallengeID: challengeID,
+		Credential:  a.create(wt.t, challenge, testIssuer),
+	})
+	if resp.Message != response.MessageOK {
+		wt.t.Fatalf("register = %s %s", resp.Message, resp.Data)
+	}
+}
+
+func TestWebAuthnRegisterAndLogin(t *testing.T) {
+	wt := newWebAuthnTest(t)
+	a := newSoftAuthenticator(t)
+	wt.register(7, a)
+	if len(wt.db.credentials) != 1 || wt.db.credentials[0].UserID != 7 || wt.db.credentials[0].Name != "key" {
+		t.Fatalf("credentials = %+v", wt.db.credentials)
+	}
+
+	challengeID, challenge := wt.begin(wt.h.BeginWebAuthnLogin(), 0, struct{}{})
+	resp := wt.call(wt.h.FinishWebAuthnLogin(), 0, WebAuthnFinishRequest{
+		ChallengeID: challengeID,
+		Credential:  a.get(t, challenge, testIssuer, webAuthnUserHandle(7)),
+	})
+	if resp.Message != response.MessageOK {
+		t.Fatalf("login = %s %s", resp.Message, resp.Data)
+	}
+	var session SessionResponse
+	if err := json.Unmarshal(resp.Data, &session); err != nil {
+		t.Fatal(err)
+	}
+	var claims util.SessionClaims
+	if err := wt.h.j.VerifyClaims(context.Background(), session.AccessToken, &claims); err != nil || claims.Subject != "7" {
+		t.Errorf("session claims = %+v, err = %v", claims, err)
+	}
+	if got := wt.db.credentials[0].SignCount; got != 1 {
+		t.Errorf("sign count = %d, want 1", got)
+	}
+	if len(wt.db.challenges) != 0 {
+		t.Errorf("challenges left = %+v", wt.db.challenges)
+	}
+}
+
+func TestWebAuthnLoginRejected(t *testing.T) {
+	tests := []struct {
+		name     string
+		userID   uint   // 注册凭证的用户
+		origin   string // 断言中的origin
+		replay   bool   // 重复使用同一个挑战
+		wantCode string
+	}{
+		{"wrong origin", 7, "https://evil.example.com", false, response.MessageWebAuthnError},
+		{"challenge reused", 7, testIssuer, true, response.MessageWebAuthnChallenge},
+		{"user of other organization", 8, testIssuer, false, response.MessageWebAuthnError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wt := newWebAuthnTest(t)
+			a := newSoftAuthenticator(t)
+			wt.register(tt.userID, a)
+			challengeID, challenge := wt.begin(wt.h.BeginWebAuthnLogin(), 0, struct{}{})
+			finish := func() string {
+				return wt.call(wt.h.FinishWebAuthnLogin(), 0, WebAuthnFinishRequest{
+					ChallengeID: challengeID,
+					Credential:  a.get(t, challenge, tt.origin, webAuthnUserHandle(tt.userID)),
+				}).Message
+			}
+			msg := finish()
+			if tt.replay {
+				if msg != response.MessageOK {
+					t.Fatalf("first login = %s", msg)
+				}
+				msg = finish()
+			}
+			if msg != tt.wantCode {
+				t.Errorf("login = %s, want %s", msg, tt.wantCode)
+			}
+		})
+	}
+}
@@ -1,9 +1,11 @@
 package middleware
 
 import (
+	"context"
 	"net/http"
 	"strconv"
 
+	"git.blauwelle.com/go/crate/log"
 	"github.com/uptrace/bunrouter"
 	"gorm.io/gorm"
 
@@ -12,33 +14,123 @@ import (
 	"git.blauwelle.com/go/crate/cmd/sso/response"
 )
 
-func CheckPermission(db *gorm.DB) bunrouter.MiddlewareFunc {
+// CheckPermission 要求当前用户拥有全部指定的权限，权限在router.go中按路由声明，角色包括通过组获得的
+func CheckPermission(db *gorm.DB, permissions ...string) bunrouter.MiddlewareFunc {
 	return func(next bunrouter.HandlerFunc) bunrouter.HandlerFunc {
 		return func(rw http.ResponseWriter, r bunrouter.Request) error {
-			id, err := strconv.Atoi(ContextJWTClaims{}.Value(r.Context()).Subject)
+			ctx := r.Context()
+			id, err := strconv.Atoi(ContextJWTClaims{}.Value(ctx).Subject)
 			if err != nil {
 				return err
 			}
-			var roles []model.Role
-			db.Joins("JOIN user_roles ON user_roles.role_id = roles.id").
-				Joins("JOIN users ON users.id = user_roles.user_id").
-				Where("users.id = ?", id).
-				Find(&roles)
-			if len(roles) == 0 {
-				return response.Error(rw, response.MessageUnauthorized, bunrouter.H{})
+			granted, err := UserPermissions(ctx, db, uint(id))
+			if err != nil {
+				log.Error(ctx, err.Error())
+				return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
 			}
-			var isAdmin bool
-			// 可以遍历 roles 切片获取每个角色的名称
-			for _, role := range roles {
-				if role.Name == constants.Admin {
-					isAdmin = true
-					break
+			for _, permission := range permissions {
+				if !HasPermission(granted, permission) {
+					return response.Error(rw, response.MessageUnauthorized, bunrouter.H{"permission": permission})
 				}
 			}
-			if isAdmin {
-				return next(rw, r)
+			return next(rw, r)
+		}
+	}
+}
+
+// UserPermissions 用户直接拥有的角色和所在组的角色提供的全部权限
+func UserPermissions(ctx context.Context, db *gorm.DB, userID uint) (map[string]bool, error) {
+	groupIDs, err := UserGroupIDs(ctx, db, userID)
+	if err != nil {
+		return nil, err
+	}
+	roleIDs, err := UserRoleIDs(ctx, db, userID, groupIDs)
+	if err != nil {
+		return nil, err
+	}
+	granted := make(map[string]bool)
+	if len(roleIDs) == 0 {
+		return granted, nil
+	}
+	var names []string
+	if err := db.WithContext(ctx).Model(&model.Permission{}).
+		Joins("JOIN role_permissions ON role_permissions.permission_id = permissions.id").
+		Joins("JOIN roles ON roles.id = role_permissions.role_id AND roles.deleted_at IS NULL").
+		Where("roles.id IN ?", roleIDs).
+		Distinct().Pluck("permissions.name", &names).Error; err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		granted[name] = true
+	}
+	return granted, nil
+}
+
+// UserGroupIDs 用户直接所在的组及其全部上级组
+func UserGroupIDs(ctx context.Context, db *gorm.DB, userID uint) ([]uint, error) {
+	var direct []uint
+	if err := db.WithContext(ctx).Model(&model.GroupMember{}).
+		Where("user_id = ?", userID).Pluck("group_id", &direct).Error; err != nil {
+		return nil, err
+	}
+	return GroupAncestorIDs(ctx, db, direct)
+}
+
+// UserRoleIDs 用户直接拥有的角色和groupIDs中各组的角色
+func UserRoleIDs(ctx context.Context, db *gorm.DB, userID uint, groupIDs []uint) ([]uint, error) {
+	var roleIDs []uint
+	if err := db.WithContext(ctx).Model(&model.UserRole{}).
+		Where("user_id = ?", userID).Pluck("role_id", &roleIDs).Error; err != nil {
+		return nil, err
+	}
+	if len(groupIDs) > 0 {
+		var groupRoleIDs []uint
+		if err := db.WithContext(ctx).Model(&model.GroupRole{}).
+			Where("group_id IN ?", groupIDs).Distinct().Pluck("role_id", &groupRoleIDs).Error; err != nil {
+			return nil, err
+		}
+		roleIDs = append(roleIDs, groupRoleIDs...)
+	}
+	return roleIDs, nil
+}
+
+// GroupAncestorIDs 指定的组及其全部上级组
+func GroupAncestorIDs(ctx context.Context, db *gorm.DB, groupIDs []uint) ([]uint, error) {
+	return expandGroups(ctx, db, groupIDs, "child_id", "parent_id")
+}
+
+// GroupDescendantIDs 指定的组及其全部子组
+func GroupDescendantIDs(ctx context.Context, db *gorm.DB, groupIDs []uint) ([]uint, error) {
+	return expandGroups(ctx, db, groupIDs, "parent_id", "child_id")
+}
+
+// 沿嵌套关系逐层查找，已访问的组不再展开，数据中出现环时也能结束
+func expandGroups(ctx context.Context, db *gorm.DB, groupIDs []uint, from, to string) ([]uint, error) {
+	seen := make(map[uint]bool)
+	var result []uint
+	frontier := groupIDs
+	for len(frontier) > 0 {
+		var next []uint
+		for _, id := range frontier {
+			if !seen[id] {
+				seen[id] = true
+				result = append(result, id)
+				next = append(next, id)
 			}
-			return response.Error(rw, response.MessageUnauthorized, bunrouter.H{})
+		}
+		if len(next) == 0 {
+			break
+		}
+		frontier = nil
+		if err := db.WithContext(ctx).Model(&model.GroupSubgroup{}).
+			Where(from+" IN ?", next).Pluck(to, &frontier).Error; err != nil {
+			return nil, err
 		}
 	}
+	return result, nil
+}
+
+// HasPermission 拥有 constants.PermissionAll 时视为拥有任何权限
+func HasPermission(granted map[string]bool, permission string) bool {
+	return granted[constants.PermissionAll] || granted[permission]
 }
@@ -5,7 +5,6 @@ import (
 	"net/http"
 
 	"git.blauwelle.com/go/crate/log"
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/uptrace/bunrouter"
 
 	"git.blauwelle.com/go/crate/cmd/sso/constants"
@@ -25,10 +24,10 @@ func (key ContextKey[K, T]) Value(ctx context.Context) T {
 }
 
 type ContextJWTClaims struct {
-	ContextKey[ContextJWTClaims, jwt.RegisteredClaims]
+	ContextKey[ContextJWTClaims, util.SessionClaims]
 }
 
-func HTTPMiddlewareJWT(jwtService *util.JWT) bunrouter.MiddlewareFunc {
+func HTTPMiddlewareJWT(jwtService *util.JWT, revocations *util.RevocationList) bunrouter.MiddlewareFunc {
 	return func(next bunrouter.HandlerFunc) bunrouter.HandlerFunc {
 		return func(rw http.ResponseWriter, r bunrouter.Request) error {
 			ctx := r.Context()
@@ -40,11 +39,25 @@ func HTTPMiddlewareJWT(jwtService *util.JWT) bunrouter.MiddlewareFunc {
 			}
 
 			// 验证 JWT 并获取声明信息
-			claims, err := jwtService.Verify(ctx, cookie.Value)
-			if err != nil {
+			var claims util.SessionClaims
+			if err := jwtService.VerifyClaims(ctx, cookie.Value, &claims); err != nil {
 				log.Error(ctx, err.Error())
 				return response.Error(rw, response.MessageCheckJWTError, bunrouter.H{})
 			}
+			// 签发给应用的token带有aud，不能作为会话使用
+			if len(claims.Audience) > 0 {
+				return response.Error(rw, response.MessageCheckJWTError, bunrouter.H{})
+			}
+
+			// 检查token是否已被撤销（登出、修改密码、删除用户等）
+			revoked, err := revocations.IsRevoked(ctx, claims)
+			if err != nil {
+				log.Error(ctx, err.Error())
+				return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+			}
+			if revoked {
+				return response.Error(rw, response.MessageTokenRevoked, bunrouter.H{})
+			}
 
 			// 将声明信息存储到请求的上下文中
 			ctx = ContextJWTClaims{}.WithValue(ctx, claims)
@@ -0,0 +1,70 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+
+	"git.blauwelle.com/go/crate/log"
+	"github.com/uptrace/bunrouter"
+	"gorm.io/gorm"
+
+	"git.blauwelle.com/go/crate/cmd/sso/constants"
+	"git.blauwelle.com/go/crate/cmd/sso/model"
+	"git.blauwelle.com/go/crate/cmd/sso/response"
+)
+
+// ContextOrganization 管理接口操作的组织ID
+type ContextOrganization struct {
+	ContextKey[ContextOrganization, uint]
+}
+
+// Tenant 确定管理接口操作的组织，默认是当前用户所属的组织
+// 拥有 constants.PermissionOrgWrite 的用户可以通过 constants.HTTPHeaderOrganization 指定其他组织
+func Tenant(db *gorm.DB) bunrouter.MiddlewareFunc {
+	return func(next bunrouter.HandlerFunc) bunrouter.HandlerFunc {
+		return func(rw http.ResponseWriter, r bunrouter.Request) error {
+			ctx := r.Context()
+			id, err := strconv.Atoi(ContextJWTClaims{}.Value(ctx).Subject)
+			if err != nil {
+				return err
+			}
+			var user model.User
+			DB := db.WithContext(ctx).Select("id, organization_id").Where("id = ?", id).Find(&user)
+			if DB.Error != nil {
+				log.Error(ctx, DB.Error.Error())
+				return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+			}
+			if DB.RowsAffected != 1 {
+				return response.Error(rw, response.MessageUnauthorized, bunrouter.H{})
+			}
+			organizationID := user.OrganizationID
+			if header := r.Header.Get(constants.HTTPHeaderOrganization); header != "" {
+				requested, err := strconv.Atoi(header)
+				if err != nil {
+					return response.Error(rw, response.MessageBindError, bunrouter.H{})
+				}
+				if uint(requested) != organizationID {
+					granted, err := UserPermissions(ctx, db, user.ID)
+					if err != nil {
+						log.Error(ctx, err.Error())
+						return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+					}
+					if !HasPermission(granted, constants.PermissionOrgWrite) {
+						return response.Error(rw, response.MessageUnauthorized, bunrouter.H{"permission": constants.PermissionOrgWrite})
+					}
+					var count int64
+					if err := db.WithContext(ctx).Model(&model.Organization{}).Where("id = ?", requested).Count(&count).Error; err != nil {
+						return response.Error(rw, response.MessageDatabaseConnectionError, bunrouter.H{})
+					}
+					if count == 0 {
+						return response.Error(rw, response.MessageOrganizationNotExist, bunrouter.H{})
+					}
+					organizationID = uint(requested)
+				}
+			}
+			ctx = ContextOrganization{}.WithValue(ctx, organizationID)
+			r.Request = r.Request.WithContext(ctx)
+			return next(rw, r)
+		}
+	}
+}
@@ -14,27 +14,303 @@ type Model struct {
 	DeletedAt gorm.DeletedAt `gorm:"index;" json:"deleted_at"`
 }
 
+// Organization 租户，用户、应用、角色和组都属于一个组织，组织之间互不可见
+// 登录时按路径中的Slug或请求的域名选择组织
+type Organization struct {
+	Model
+	Name        string `gorm:"size:64;not null;unique;" json:"name"`
+	Slug        string `gorm:"size:64;not null;unique;" json:"slug"`
+	Domain      string `gorm:"size:255;not null;default:'';index;" json:"domain"` // 为空时只能通过路径选择
+	Description string `gorm:"not null;default:'';" json:"description"`
+}
+
+// Application 同时作为OIDC的client，AppKey即client_id
 type Application struct {
 	Model
-	AppKey   string `gorm:"not null;" json:"app_key"`
-	Name     string `gorm:"not null;" json:"name"`
-	Site     string `gorm:"not null;unique;" json:"site"`
-	Redirect string `gorm:"not null;unique;" json:"redirect"`
+	OrganizationID   uint   `gorm:"not null;default:1;index;" json:"organization_id"`
+	AppKey           string `gorm:"not null;" json:"app_key"`
+	Name             string `gorm:"not null;" json:"name"`
+	Site             string `gorm:"not null;unique;" json:"site"`
+	Redirect         string `gorm:"not null;unique;" json:"redirect"`
+	ClientSecretHash string `gorm:"not null;" json:"-"`
+	RedirectURIs     string `gorm:"type:text;" json:"redirect_uris"`        // 以空格分隔的OIDC回调地址
+	LogoutURL        string `gorm:"not null;default:'';" json:"logout_url"` // 后端通道登出地址
+	// SAML SP配置，SAMLEntityID为空表示未启用SAML
+	SAMLEntityID     string `gorm:"column:saml_entity_id;size:255;not null;default:'';index;" json:"saml_entity_id"`
+	SAMLACSURL       string `gorm:"column:saml_acs_url;size:2048;not null;default:'';" json:"saml_acs_url"`
+	SAMLNameIDFormat string `gorm:"column:saml_name_id_format;not null;default:'';" json:"saml_name_id_format"`
+	SAMLAttributes   string `gorm:"column:saml_attributes;type:text;" json:"saml_attributes"` // 属性名到用户字段的映射，json格式
+	// 为true时只有拥有 AppAccessRole 中角色或属于 AppAccessGroup 中组的用户可以登录应用
+	RestrictAccess bool `gorm:"not null;default:false;" json:"restrict_access"`
+}
+
+// AppAccessRole 允许访问应用的角色
+type AppAccessRole struct {
+	AppID  uint `gorm:"not null;index:idx_app_access_role,unique;" json:"app_id"`
+	RoleID uint `gorm:"not null;index:idx_app_access_role,unique;" json:"role_id"`
+}
+
+// AppRole 应用自己定义的角色，只出现在签发给该应用的token中，与SSO的管理权限无关
+type AppRole struct {
+	Model
+	AppID       uint   `gorm:"not null;index:idx_app_role_name,unique;" json:"app_id"`
+	Name        string `gorm:"size:64;not null;index:idx_app_role_name,unique;" json:"name"`
+	Description string `gorm:"not null;" json:"description"`
+}
+
+type UserAppRole struct {
+	UserID    uint `gorm:"not null;index:idx_user_app_role,unique;" json:"user_id"`
+	AppRoleID uint `gorm:"not null;index:idx_user_app_role,unique;" json:"app_role_id"`
+}
+
+// Group 用户组，组的成员同时拥有组及其全部上级组的角色
+type Group struct {
+	Model
+	OrganizationID uint   `gorm:"not null;default:1;index:idx_group_org_name,unique;" json:"organization_id"`
+	Name           string `gorm:"column:name;size:64;not null;index:idx_group_org_name,unique;" json:"name"`
+	Description    string `gorm:"column:description;not null;" json:"description"`
+}
+
+type GroupMember struct {
+	GroupID uint `gorm:"not null;index:idx_group_member,unique;" json:"group_id"`
+	UserID  uint `gorm:"not null;index:idx_group_member,unique;index;" json:"user_id"`
+}
+
+// GroupSubgroup 组的嵌套关系，子组的成员也是上级组的成员，不允许形成环
+type GroupSubgroup struct {
+	ParentID uint `gorm:"not null;index:idx_group_subgroup,unique;" json:"parent_id"`
+	ChildID  uint `gorm:"not null;index:idx_group_subgroup,unique;index;" json:"child_id"`
 }
 
+type GroupRole struct {
+	GroupID uint `gorm:"not null;index:idx_group_role,unique;" json:"group_id"`
+	RoleID  uint `gorm:"not null;index:idx_group_role,unique;" json:"role_id"`
+}
+
+type GroupAppRole struct {
+	GroupID   uint `gorm:"not null;index:idx_group_app_role,unique;" json:"group_id"`
+	AppRoleID uint `gorm:"not null;index:idx_group_app_role,unique;" json:"app_role_id"`
+}
+
+// AppAccessGroup 允许访问应用的组，包括其子组的成员
+type AppAccessGroup struct {
+	AppID   uint `gorm:"not null;index:idx_app_access_group,unique;" json:"app_id"`
+	GroupID uint `gorm:"not null;index:idx_app_access_group,unique;" json:"group_id"`
+}
+
+// Role 角色名在组织内唯一
 type Role struct {
 	Model
-	Name        string `gorm:"column:name;not null;unique;" json:"name"`
+	OrganizationID uint   `gorm:"not null;default:1;index:idx_role_org_name,unique;" json:"organization_id"`
+	Name           string `gorm:"column:name;size:64;not null;index:idx_role_org_name,unique;" json:"name"`
+	Description    string `gorm:"column:description;not null;" json:"description"`
+}
+
+// Permission 权限，名称为 资源:操作，如 user:read
+type Permission struct {
+	Model
+	Name        string `gorm:"column:name;size:64;not null;unique;" json:"name"`
 	Description string `gorm:"column:description;not null;" json:"description"`
 }
 
+type RolePermission struct {
+	RoleID       uint `gorm:"not null;index:idx_role_permission,unique;" json:"role_id"`
+	PermissionID uint `gorm:"not null;index:idx_role_permission,unique;" json:"permission_id"`
+}
+
+// 用户来源，外部目录的用户不在本地保存密码
+const (
+	UserSourceLocal = "local"
+	UserSourceLDAP  = "ldap"
+)
+
+// User 用户名在所有组织中唯一，登录时只能进入所属的组织
 type User struct {
 	Model
-	Username     string `gorm:"not null;unique;" json:"username"`
-	PasswordHash string `gorm:"not null;" json:"password_hash"`
+	OrganizationID    uint       `gorm:"not null;default:1;index;" json:"organization_id"`
+	Username          string     `gorm:"not null;unique;" json:"username"`
+	PasswordHash      string     `gorm:"not null;" json:"password_hash"`
+	Source            string     `gorm:"size:32;not null;default:'local';" json:"source"`
+	Email             *string    `gorm:"size:255;unique;" json:"email"` // 统一保存为小写，未设置时为NULL
+	EmailVerifiedAt   *time.Time `json:"email_verified_at"`
+	PasswordChangedAt *time.Time `json:"password_changed_at"` // 为空时按创建时间计算密码有效期
+}
+
+// PasswordResetToken 通过邮件重置密码的token，只保存哈希，使用一次后失效
+type PasswordResetToken struct {
+	ID        uint       `gorm:"primaryKey;" json:"id"`
+	TokenHash string     `gorm:"not null;size:64;unique;" json:"-"`
+	UserID    uint       `gorm:"not null;index;" json:"user_id"`
+	ExpiresAt time.Time  `gorm:"not null;" json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `gorm:"not null;" json:"created_at"`
+}
+
+// EmailVerification 验证邮箱的token，Email为发送时的邮箱，邮箱修改后token失效
+type EmailVerification struct {
+	ID        uint       `gorm:"primaryKey;" json:"id"`
+	TokenHash string     `gorm:"not null;size:64;unique;" json:"-"`
+	UserID    uint       `gorm:"not null;index;" json:"user_id"`
+	Email     string     `gorm:"not null;size:255;" json:"email"`
+	ExpiresAt time.Time  `gorm:"not null;" json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `gorm:"not null;" json:"created_at"`
+}
+
+// Invitation 注册邀请，只保存邀请码的哈希，最多可注册MaxUses个用户
+type Invitation struct {
+	Model
+	OrganizationID uint       `gorm:"not null;default:1;index;" json:"organization_id"` // 注册的用户属于该组织
+	CodeHash       string     `gorm:"not null;size:64;unique;" json:"-"`
+	Note           string     `gorm:"not null;default:'';" json:"note"`
+	Email          string     `gorm:"size:255;not null;default:'';" json:"email"` // 不为空时只能使用该邮箱注册
+	MaxUses        int        `gorm:"not null;default:1;" json:"max_uses"`
+	Uses           int        `gorm:"not null;default:0;" json:"uses"`
+	ExpiresAt      time.Time  `gorm:"not null;" json:"expires_at"`
+	RevokedAt      *time.Time `json:"revoked_at"`
+	CreatedBy      uint       `gorm:"not null;" json:"created_by"`
+}
+
+// InvitationRole 通过邀请注册的用户自动获得的角色
+type InvitationRole struct {
+	InvitationID uint `gorm:"not null;index:idx_invitation_role,unique;" json:"invitation_id"`
+	RoleID       uint `gorm:"not null;index:idx_invitation_role,unique;" json:"role_id"`
+}
+
+// PasswordHistory 用户用过的旧密码，用于禁止重复使用
+type PasswordHistory struct {
+	ID           uint      `gorm:"primarykey" json:"id"`
+	UserID       uint      `gorm:"not null;index;" json:"user_id"`
+	PasswordHash string    `gorm:"not null;" json:"-"`
+	CreatedAt    time.Time `json:"created_at"`
 }
 
 type UserRole struct {
 	UserID uint `gorm:"not null;index:idx_user_role,unique;" json:"user_id"`
 	RoleID uint `gorm:"not null;index:idx_user_role,unique;" json:"role_id"`
 }
+
+// Ticket 使用sql存储时的ticket表
+type Ticket struct {
+	Ticket    string     `gorm:"primaryKey;size:64;" json:"ticket"`
+	UserID    uint       `gorm:"not null;" json:"user_id"`
+	Username  string     `gorm:"not null;" json:"username"`
+	AppID     uint       `gorm:"not null;" json:"app_id"`
+	Service   string     `gorm:"not null;size:2048;" json:"service"`
+	SessionID string     `gorm:"not null;size:32;" json:"session_id"`
+	OIDC      string     `gorm:"type:text;" json:"oidc"` // OIDC授权码附带的参数，json格式
+	UsedAt    *time.Time `json:"used_at"`
+	ExpiresAt time.Time  `gorm:"not null;index;" json:"expires_at"`
+	CreatedAt time.Time  `gorm:"not null;" json:"created_at"`
+}
+
+// RefreshToken 只保存token的哈希，同一次登录轮换出的token属于同一个family
+type RefreshToken struct {
+	ID        uint       `gorm:"primaryKey;" json:"id"`
+	TokenHash string     `gorm:"not null;size:64;unique;" json:"-"`
+	FamilyID  string     `gorm:"not null;size:32;index;" json:"family_id"`
+	UserID    uint       `gorm:"not null;index;" json:"user_id"`
+	ExpiresAt time.Time  `gorm:"not null;" json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+	RevokedAt *time.Time `json:"revoked_at"`
+	CreatedAt time.Time  `gorm:"not null;" json:"created_at"`
+}
+
+// RevokedToken 被撤销的会话token
+type RevokedToken struct {
+	JTI       string    `gorm:"primaryKey;size:64;" json:"jti"`
+	UserID    uint      `gorm:"not null;index;" json:"user_id"`
+	ExpiresAt time.Time `gorm:"not null;index;" json:"expires_at"`
+	CreatedAt time.Time `gorm:"not null;" json:"created_at"`
+}
+
+// UserTokenRevocation 用户在RevokedBefore之前签发的token全部无效
+type UserTokenRevocation struct {
+	UserID        uint      `gorm:"primaryKey;autoIncrement:false;" json:"user_id"`
+	RevokedBefore time.Time `gorm:"not null;" json:"revoked_before"`
+	UpdatedAt     time.Time `gorm:"not null;" json:"updated_at"`
+}
+
+// SessionApplication 记录会话（refresh token family）在哪些应用中使用过，用于单点登出
+type SessionApplication struct {
+	SessionID string    `gorm:"primaryKey;size:32;" json:"session_id"`
+	AppID     uint      `gorm:"primaryKey;autoIncrement:false;" json:"app_id"`
+	UserID    uint      `gorm:"not null;index;" json:"user_id"`
+	Subject   string    `gorm:"size:255;not null;default:'';" json:"subject"` // 应用收到的用户标识，登出通知中作为sub
+	CreatedAt time.Time `gorm:"not null;" json:"created_at"`
+}
+
+const (
+	LogoutDeliveryPending   = "pending"
+	LogoutDeliveryDelivered = "delivered"
+	LogoutDeliveryFailed    = "failed"
+)
+
+// LogoutDelivery 发送给应用的后端通道登出通知
+type LogoutDelivery struct {
+	ID            uint       `gorm:"primaryKey;" json:"id"`
+	SessionID     string     `gorm:"not null;size:32;index;" json:"session_id"`
+	UserID        uint       `gorm:"not null;index;" json:"user_id"`
+	AppID         uint       `gorm:"not null;index;" json:"app_id"`
+	Subject       string     `gorm:"size:255;not null;default:'';" json:"subject"`
+	Status        string     `gorm:"not null;size:16;index;" json:"status"`
+	Attempts      int        `gorm:"not null;" json:"attempts"`
+	LastError     string     `gorm:"type:text;" json:"last_error"`
+	NextAttemptAt time.Time  `gorm:"not null;index;" json:"next_attempt_at"`
+	DeliveredAt   *time.Time `json:"delivered_at"`
+	CreatedAt     time.Time  `gorm:"not null;" json:"created_at"`
+	UpdatedAt     time.Time  `gorm:"not null;" json:"updated_at"`
+}
+
+// UserTOTP 用户的TOTP密钥，Secret为加密后的密文，ConfirmedAt为空表示尚未完成绑定
+type UserTOTP struct {
+	UserID       uint       `gorm:"primaryKey;autoIncrement:false;" json:"user_id"`
+	Secret       string     `gorm:"not null;size:255;" json:"-"`
+	LastUsedStep int64      `gorm:"not null;default:0;" json:"-"` // 最近一次使用的时间窗口，防止验证码重放
+	ConfirmedAt  *time.Time `json:"confirmed_at"`
+	CreatedAt    time.Time  `gorm:"not null;" json:"created_at"`
+	UpdatedAt    time.Time  `gorm:"not null;" json:"updated_at"`
+}
+
+// RecoveryCode 一次性恢复码，只保存哈希
+type RecoveryCode struct {
+	ID        uint       `gorm:"primaryKey;" json:"id"`
+	UserID    uint       `gorm:"not null;index;" json:"user_id"`
+	CodeHash  string     `gorm:"not null;size:64;index;" json:"-"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `gorm:"not null;" json:"created_at"`
+}
+
+// WebAuthnCredential 用户注册的WebAuthn凭证（安全密钥、通行密钥），一个用户可以注册多个
+type WebAuthnCredential struct {
+	ID              uint       `gorm:"primaryKey;" json:"id"`
+	UserID          uint       `gorm:"not null;index;" json:"user_id"`
+	Name            string     `gorm:"not null;" json:"name"`
+	CredentialID    string     `gorm:"not null;size:255;unique;" json:"credential_id"` // base64url编码
+	PublicKey       []byte     `gorm:"not null;" json:"-"`                             // COSE格式的公钥
+	AttestationType string     `gorm:"not null;size:32;" json:"attestation_type"`
+	AAGUID          string     `gorm:"not null;size:32;" json:"aaguid"` // 认证器型号，hex编码
+	SignCount       uint32     `gorm:"not null;" json:"sign_count"`
+	Transports      string     `gorm:"not null;default:'';" json:"transports"` // 以逗号分隔
+	BackupEligible  bool       `gorm:"not null;" json:"backup_eligible"`
+	BackupState     bool       `gorm:"not null;" json:"backup_state"`
+	LastUsedAt      *time.Time `json:"last_used_at"`
+	CreatedAt       time.Time  `gorm:"not null;" json:"created_at"`
+}
+
+const (
+	WebAuthnPurposeRegister = "register"
+	WebAuthnPurposeLogin    = "login"
+	WebAuthnPurposeMFA      = "mfa"
+)
+
+// WebAuthnChallenge 注册或认证过程中的挑战，完成时删除，只能使用一次
+type WebAuthnChallenge struct {
+	ID        string    `gorm:"primaryKey;size:64;" json:"id"`
+	UserID    uint      `gorm:"not null;" json:"user_id"` // 无用户名登录时为0
+	Purpose   string    `gorm:"not null;size:16;" json:"purpose"`
+	Name      string    `gorm:"not null;default:'';" json:"name"` // 注册时的凭证名称
+	Session   string    `gorm:"type:text;" json:"session"`        // webauthn.SessionData，json格式
+	ExpiresAt time.Time `gorm:"not null;index;" json:"expires_at"`
+	CreatedAt time.Time `gorm:"not null;" json:"created_at"`
+}
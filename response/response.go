@@ -28,6 +28,57 @@ const (
 	MessageCheckJWTError           = "check.jwt.error"
 	MessageUserIsExist             = "user.is.exist"
 	MessageUserNotExist            = "user.not.exist"
+	MessageUsernameInvalid         = "username.invalid"
+	MessageUsernameUnavailable     = "username.unavailable" // 用户名在所有组织中唯一，不区分重复的用户属于哪个组织
+	MessageTicketUsed              = "ticket.used"
+	MessageTicketAppMismatch       = "ticket.app.mismatch"
+	MessageTicketServiceMismatch   = "ticket.service.mismatch"
+	MessageAppNotExist             = "app.not.exist"
+	MessageRefreshTokenInvalid     = "refresh.token.invalid"
+	MessageRefreshTokenReused      = "refresh.token.reused"
+	MessageTokenRevoked            = "token.revoked"
+	MessageSAMLEntityExist         = "saml.entity.exist"
+	MessageSAMLConfigInvalid       = "saml.config.invalid"
+	MessageAuthenticatorError      = "authenticator.error"
+	MessageExternalUser            = "external.user"
+	MessageMFARequired             = "mfa.required"
+	MessageMFATokenInvalid         = "mfa.token.invalid"
+	MessageMFAInvalidCode          = "mfa.invalid.code"
+	MessageMFAAlreadyEnabled       = "mfa.already.enabled"
+	MessageMFANotEnabled           = "mfa.not.enabled"
+	MessageMFANotConfigured        = "mfa.not.configured"
+	MessageWebAuthnError           = "webauthn.error"
+	MessageWebAuthnChallenge       = "webauthn.challenge.invalid"
+	MessageWebAuthnNotExist        = "webauthn.not.exist"
+	MessageLoginFailed             = "login.failed"
+	MessageLoginThrottled          = "login.throttled"
+	MessagePasswordPolicy          = "password.policy"
+	MessagePasswordExpired         = "password.expired"
+	MessagePasswordTokenInvalid    = "password.token.invalid"
+	MessageResetTokenInvalid       = "reset.token.invalid"
+	MessageEmailInvalid            = "email.invalid"
+	MessageEmailExist              = "email.exist"
+	MessageEmailNotSet             = "email.not.set"
+	MessageEmailAlreadyVerified    = "email.already.verified"
+	MessageEmailTokenInvalid       = "email.token.invalid"
+	MessageMailError               = "mail.error"
+	MessageMailTooFrequent         = "mail.too.frequent"
+	MessageInvitationInvalid       = "invitation.invalid"
+	MessageInvitationNotExist      = "invitation.not.exist"
+	MessageRoleNotExist            = "role.not.exist"
+	MessageRoleExist               = "role.exist"
+	MessageRoleBuiltin             = "role.builtin"
+	MessageRoleLastAdmin           = "role.last.admin"
+	MessagePermissionNotExist      = "permission.not.exist"
+	MessageAppAccessDenied         = "app.access.denied"
+	MessageAppRoleExist            = "app.role.exist"
+	MessageAppRoleNotExist         = "app.role.not.exist"
+	MessageGroupExist              = "group.exist"
+	MessageGroupNotExist           = "group.not.exist"
+	MessageGroupCycle              = "group.cycle"
+	MessageOrganizationExist       = "organization.exist"
+	MessageOrganizationNotExist    = "organization.not.exist"
+	MessageOrganizationNotEmpty    = "organization.not.empty"
 )
 
 type GenResponse[D any] struct {
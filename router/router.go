@@ -4,49 +4,153 @@ import (
 	"context"
 
 	"git.blauwelle.com/go/crate/log"
-	"github.com/redis/go-redis/v9"
 	"github.com/uptrace/bunrouter"
 	"github.com/uptrace/bunrouter/extra/reqlog"
 	"gorm.io/gorm"
 
+	"git.blauwelle.com/go/crate/cmd/sso/config"
+	"git.blauwelle.com/go/crate/cmd/sso/constants"
 	"git.blauwelle.com/go/crate/cmd/sso/handler"
 	"git.blauwelle.com/go/crate/cmd/sso/middleware"
 	"git.blauwelle.com/go/crate/cmd/sso/util"
 )
 
-func NewRouter(db *gorm.DB, redisDB *redis.Client, jwt *util.JWT) *bunrouter.Router {
+func NewRouter(cfg config.Config, db *gorm.DB, store util.Store, jwt *util.JWT, notifier *util.LogoutNotifier, authenticator util.Authenticator, limiter *util.LoginLimiter, mailer util.Mailer) *bunrouter.Router {
 	log.Info(context.TODO(), "Loading routes...")
 	router := bunrouter.New(bunrouter.Use(
 		reqlog.NewMiddleware(),
 	))
 
-	handlers := handler.NewHandler(db, redisDB, jwt)
-	registerRoutes(router, handlers, jwt, db)
+	revocations := util.NewRevocationList(db)
+	handlers := handler.NewHandler(cfg, db, store, jwt, revocations, notifier, authenticator, limiter, mailer)
+	registerRoutes(router, handlers, jwt, revocations, db)
 
 	return router
 }
 
-func registerRoutes(router *bunrouter.Router, handlers *handler.Handler, jwt *util.JWT, db *gorm.DB) {
+func registerRoutes(router *bunrouter.Router, handlers *handler.Handler, jwt *util.JWT, revocations *util.RevocationList, db *gorm.DB) {
 	router.POST("/api/v1/login", handlers.Login())
+	router.POST("/api/v1/login/password", handlers.ChangeExpiredPassword())
+	router.POST("/api/v1/login/mfa", handlers.LoginMFA())
+	router.POST("/api/v1/login/mfa/totp", handlers.LoginMFAEnroll())
+	router.POST("/api/v1/login/mfa/webauthn/begin", handlers.BeginWebAuthnMFA())
+	router.POST("/api/v1/login/mfa/webauthn/finish", handlers.FinishWebAuthnMFA())
+	router.POST("/api/v1/login/webauthn/begin", handlers.BeginWebAuthnLogin())
+	router.POST("/api/v1/login/webauthn/finish", handlers.FinishWebAuthnLogin())
+	// 按路径选择组织登录，未指定时按请求的域名选择
+	router.POST("/api/v1/org/:org/login", handlers.Login())
+	router.POST("/api/v1/org/:org/login/webauthn/begin", handlers.BeginWebAuthnLogin())
+	router.POST("/api/v1/org/:org/login/webauthn/finish", handlers.FinishWebAuthnLogin())
+	router.POST("/api/v1/password/forgot", handlers.ForgotPassword())
+	router.POST("/api/v1/password/reset", handlers.ResetPassword())
+	router.POST("/api/v1/email/verify", handlers.VerifyEmail())
+	router.POST("/api/v1/register", handlers.Register())
 	router.POST("/api/v1/verify", handlers.SSOVerify())
+	router.POST("/api/v1/token/refresh", handlers.RefreshToken())
 
-	routerJWTGroup := router.Use(middleware.HTTPMiddlewareJWT(jwt))
+	// OIDC
+	router.GET("/.well-known/openid-configuration", handlers.OIDCDiscovery())
+	router.GET("/.well-known/jwks.json", handlers.JWKS())
+	router.GET("/authorize", handlers.OIDCAuthorize())
+	router.POST("/token", handlers.OIDCToken())
+	router.GET("/userinfo", handlers.OIDCUserInfo())
+	router.POST("/userinfo", handlers.OIDCUserInfo())
+
+	// CAS
+	router.GET("/cas/login", handlers.CASLogin())
+	router.GET("/cas/logout", handlers.CASLogout())
+	router.GET("/cas/serviceValidate", handlers.CASServiceValidate())
+	router.GET("/cas/p3/serviceValidate", handlers.CASP3ServiceValidate())
+
+	// SAML
+	router.GET("/saml/metadata", handlers.SAMLMetadata())
+	router.GET("/saml/sso", handlers.SAMLSSO())
+	router.POST("/saml/sso", handlers.SAMLSSO())
+	router.GET("/saml/idp/sso", handlers.SAMLIdPInitiated())
+
+	routerJWTGroup := router.Use(middleware.HTTPMiddlewareJWT(jwt, revocations))
 	routerJWTGroup.WithGroup("/api/v1", func(g *bunrouter.Group) {
 		g.POST("/auth", handlers.SSOLogin())
+		g.POST("/logout", handlers.Logout())
 		g.PUT("/me/username", handlers.UpdateUsername())
 		g.PUT("/me/password", handlers.UpdatePassword())
+		g.PUT("/me/email", handlers.UpdateEmail())
+		g.POST("/me/email/verify", handlers.SendEmailVerification())
+		g.GET("/me/mfa/totp", handlers.GetTOTP())
+		g.POST("/me/mfa/totp", handlers.EnrollTOTP())
+		g.DELETE("/me/mfa/totp", handlers.DisableTOTP())
+		g.POST("/me/mfa/totp/confirm", handlers.ConfirmTOTP())
+		g.POST("/me/mfa/totp/recovery-codes", handlers.RegenerateRecoveryCodes())
+		g.GET("/me/webauthn", handlers.ListWebAuthnCredentials())
+		g.PUT("/me/webauthn", handlers.UpdateWebAuthnCredential())
+		g.DELETE("/me/webauthn", handlers.DeleteWebAuthnCredential())
+		g.POST("/me/webauthn/register/begin", handlers.BeginWebAuthnRegistration())
+		g.POST("/me/webauthn/register/finish", handlers.FinishWebAuthnRegistration())
+		g.GET("/me/permissions", handlers.GetMyPermissions())
 	})
 
-	routerPermissionGroup := routerJWTGroup.Use(middleware.CheckPermission(db))
-	routerPermissionGroup.WithGroup("/api/v1", func(g *bunrouter.Group) {
-		g.POST("/user/", handlers.CreateUser())
-		g.GET("/user/", handlers.SearchUser())
-		g.DELETE("/user/", handlers.DeleteUser())
-		g.POST("/user/admin", handlers.CreateAdmin())
-		g.DELETE("/user/admin", handlers.ConcelAdmin())
-		g.POST("/app/", handlers.CreateApp())
-		g.GET("/app/", handlers.SearchApp())
-		g.DELETE("/app/", handlers.DeleteApp())
-		g.PUT("/app/", handlers.UpdateApp())
+	// 管理接口按路由声明所需的权限，只能操作当前组织的数据
+	routerJWTGroup.Use(middleware.Tenant(db)).WithGroup("/api/v1", func(g *bunrouter.Group) {
+		require := func(permissions ...string) *bunrouter.Group {
+			return g.Use(middleware.CheckPermission(db, permissions...))
+		}
+		require(constants.PermissionOrgWrite).POST("/organization/", handlers.CreateOrganization())
+		require(constants.PermissionOrgRead).GET("/organization/", handlers.SearchOrganization())
+		require(constants.PermissionOrgWrite).PUT("/organization/", handlers.UpdateOrganization())
+		require(constants.PermissionOrgWrite).DELETE("/organization/", handlers.DeleteOrganization())
+		require(constants.PermissionUserWrite).POST("/user/", handlers.CreateUser())
+		require(constants.PermissionUserRead).GET("/user/", handlers.SearchUser())
+		require(constants.PermissionUserWrite).DELETE("/user/", handlers.DeleteUser())
+		require(constants.PermissionRoleRead).GET("/user/role", handlers.SearchUserRole())
+		require(constants.PermissionUserRead).GET("/user/lock", handlers.GetLoginLock())
+		require(constants.PermissionUserWrite).DELETE("/user/lock", handlers.UnlockLogin())
+		require(constants.PermissionRoleRead).GET("/permission/", handlers.SearchPermission())
+		require(constants.PermissionRoleWrite).POST("/role/", handlers.CreateRole())
+		require(constants.PermissionRoleRead).GET("/role/", handlers.SearchRole())
+		require(constants.PermissionRoleWrite).PUT("/role/", handlers.UpdateRole())
+		require(constants.PermissionRoleWrite).DELETE("/role/", handlers.DeleteRole())
+		require(constants.PermissionRoleWrite).POST("/role/member", handlers.AddRoleMember())
+		require(constants.PermissionRoleRead).GET("/role/member", handlers.SearchRoleMember())
+		require(constants.PermissionRoleWrite).DELETE("/role/member", handlers.RemoveRoleMember())
+		require(constants.PermissionUserRead).GET("/user/group", handlers.SearchUserGroup())
+		require(constants.PermissionUserWrite).POST("/group/", handlers.CreateGroup())
+		require(constants.PermissionUserRead).GET("/group/", handlers.SearchGroup())
+		require(constants.PermissionUserWrite).PUT("/group/", handlers.UpdateGroup())
+		require(constants.PermissionUserWrite).DELETE("/group/", handlers.DeleteGroup())
+		require(constants.PermissionUserWrite).POST("/group/member", handlers.AddGroupMember())
+		require(constants.PermissionUserRead).GET("/group/member", handlers.SearchGroupMember())
+		require(constants.PermissionUserWrite).DELETE("/group/member", handlers.RemoveGroupMember())
+		require(constants.PermissionUserWrite).POST("/group/subgroup", handlers.AddSubgroup())
+		require(constants.PermissionUserRead).GET("/group/subgroup", handlers.SearchSubgroup())
+		require(constants.PermissionUserWrite).DELETE("/group/subgroup", handlers.RemoveSubgroup())
+		require(constants.PermissionRoleWrite).POST("/group/role", handlers.AddGroupRole())
+		require(constants.PermissionRoleRead).GET("/group/role", handlers.SearchGroupRole())
+		require(constants.PermissionRoleWrite).DELETE("/group/role", handlers.RemoveGroupRole())
+		require(constants.PermissionAppWrite).POST("/group/app-role", handlers.AddGroupAppRole())
+		require(constants.PermissionAppRead).GET("/group/app-role", handlers.SearchGroupAppRole())
+		require(constants.PermissionAppWrite).DELETE("/group/app-role", handlers.RemoveGroupAppRole())
+		require(constants.PermissionUserWrite).POST("/invitation/", handlers.CreateInvitation())
+		require(constants.PermissionUserRead).GET("/invitation/", handlers.SearchInvitation())
+		require(constants.PermissionUserWrite).DELETE("/invitation/", handlers.RevokeInvitation())
+		require(constants.PermissionAppWrite).POST("/app/", handlers.CreateApp())
+		require(constants.PermissionAppRead).GET("/app/", handlers.SearchApp())
+		require(constants.PermissionAppWrite).DELETE("/app/", handlers.DeleteApp())
+		require(constants.PermissionAppWrite).PUT("/app/", handlers.UpdateApp())
+		require(constants.PermissionAppWrite).POST("/app/secret", handlers.ResetAppSecret())
+		require(constants.PermissionAppWrite).PUT("/app/saml", handlers.UpdateAppSAML())
+		require(constants.PermissionAppRead).GET("/app/access", handlers.GetAppAccess())
+		require(constants.PermissionAppWrite).PUT("/app/access", handlers.UpdateAppAccess())
+		require(constants.PermissionAppRead).GET("/app/member", handlers.SearchAppMember())
+		require(constants.PermissionAppWrite).POST("/app/role", handlers.CreateAppRole())
+		require(constants.PermissionAppRead).GET("/app/role", handlers.SearchAppRole())
+		require(constants.PermissionAppWrite).PUT("/app/role", handlers.UpdateAppRole())
+		require(constants.PermissionAppWrite).DELETE("/app/role", handlers.DeleteAppRole())
+		require(constants.PermissionAppWrite).POST("/app/role/member", handlers.AddAppRoleMember())
+		require(constants.PermissionAppRead).GET("/app/role/member", handlers.SearchAppRoleMember())
+		require(constants.PermissionAppWrite).DELETE("/app/role/member", handlers.RemoveAppRoleMember())
+		require(constants.PermissionAppRead).GET("/user/app-role", handlers.SearchUserAppRole())
+		// 计数是全部组织共用的，只开放给能管理所有组织的用户
+		require(constants.PermissionOrgWrite).GET("/ticket/stats", handlers.GetTicketStats())
+		require(constants.PermissionAuditRead).GET("/logout/deliveries", handlers.SearchLogoutDeliveries())
 	})
 }
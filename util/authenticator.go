@@ -0,0 +1,73 @@
+package util
+
+import (
+	"context"
+	"errors"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+
+	"git.blauwelle.com/go/crate/cmd/sso/model"
+)
+
+// 认证器返回的错误
+// ErrUnknownUser 表示该认证器不认识此用户，由链中的下一个认证器继续尝试
+var (
+	ErrUnknownUser    = errors.New("unknown user")
+	ErrBadCredentials = errors.New("bad credentials")
+)
+
+// Identity 认证成功后的用户身份
+type Identity struct {
+	Username string
+	Source   string   // 用户来源，对应 model.User 的Source
+	Groups   []string // 外部目录中的组，用于映射到角色
+}
+
+// Authenticator 校验用户名和密码，具体实现见 LocalAuthenticator、LDAPAuthenticator
+type Authenticator interface {
+	Authenticate(ctx context.Context, username, password string) (Identity, error)
+}
+
+// AuthenticatorChain 依次尝试每个认证器，直到某个认证器认识该用户
+type AuthenticatorChain []Authenticator
+
+func (c AuthenticatorChain) Authenticate(ctx context.Context, username, password string) (Identity, error) {
+	for _, authenticator := range c {
+		identity, err := authenticator.Authenticate(ctx, username, password)
+		if errors.Is(err, ErrUnknownUser) {
+			continue
+		}
+		return identity, err
+	}
+	return Identity{}, ErrUnknownUser
+}
+
+// LocalAuthenticator 校验users表中的bcrypt密码，只处理本地创建的用户
+type LocalAuthenticator struct {
+	db        *gorm.DB
+	dummyHash []byte
+}
+
+func NewLocalAuthenticator(db *gorm.DB) *LocalAuthenticator {
+	// 与创建用户时的cost一致
+	dummyHash, _ := bcrypt.GenerateFromPassword([]byte("dummy password"), 12)
+	return &LocalAuthenticator{db: db, dummyHash: dummyHash}
+}
+
+func (a *LocalAuthenticator) Authenticate(ctx context.Context, username, password string) (Identity, error) {
+	var user model.User
+	DB := a.db.WithContext(ctx).Find(&user, "username=?", username)
+	if DB.Error != nil {
+		return Identity{}, DB.Error
+	}
+	if DB.RowsAffected != 1 || user.Source != model.UserSourceLocal {
+		// 用户不存在时同样计算一次bcrypt，避免通过响应时间判断用户是否存在
+		_ = bcrypt.CompareHashAndPassword(a.dummyHash, []byte(password))
+		return Identity{}, ErrUnknownUser
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		return Identity{}, ErrBadCredentials
+	}
+	return Identity{Username: user.Username, Source: model.UserSourceLocal}, nil
+}
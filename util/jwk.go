@@ -0,0 +1,233 @@
+package util
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// 支持的签名算法，RS256对应RSA密钥，ES256对应P-256密钥，EdDSA对应Ed25519密钥
+const (
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+	AlgEdDSA = "EdDSA"
+)
+
+var SupportedAlgs = []string{AlgRS256, AlgES256, AlgEdDSA}
+
+var ErrUnsupportedKey = errors.New("unsupported key type")
+
+// KeyAlg 根据公钥类型确定签名算法
+func KeyAlg(publicKey crypto.PublicKey) (string, error) {
+	switch k := publicKey.(type) {
+	case *rsa.PublicKey:
+		return AlgRS256, nil
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return "", fmt.Errorf("%w: ecdsa curve %s", ErrUnsupportedKey, k.Curve.Params().Name)
+		}
+		return AlgES256, nil
+	case ed25519.PublicKey:
+		return AlgEdDSA, nil
+	default:
+		return "", ErrUnsupportedKey
+	}
+}
+
+// 生成指定算法的私钥
+func GenerateKey(alg string) (crypto.Signer, error) {
+	switch alg {
+	case AlgRS256, "":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case AlgES256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgEdDSA:
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		return privateKey, err
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedKey, alg)
+	}
+}
+
+// 解析PEM格式的私钥，支持PKCS#1(RSA)、SEC1(EC)和PKCS#8
+func ParsePrivateKey(keyBytes []byte) (crypto.Signer, error) {
+	// 解码给定的 PEM 数据，将其转换为一个 *pem.Block 结构
+	block, _ := pem.Decode(keyBytes)
+	if block == nil {
+		return nil, errors.New("failed to decode PEM block")
+	}
+
+	var signer crypto.Signer
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer = key
+	case "EC PRIVATE KEY":
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer = key
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if signer, ok = key.(crypto.Signer); !ok {
+			return nil, ErrUnsupportedKey
+		}
+	default:
+		return nil, fmt.Errorf("%w: PEM type %s", ErrUnsupportedKey, block.Type)
+	}
+	if _, err := KeyAlg(signer.Public()); err != nil {
+		return nil, err
+	}
+	return signer, nil
+}
+
+// 编码为PEM格式的私钥，RSA使用PKCS#1以兼容原有的private.rsa
+func MarshalPrivateKey(key crypto.Signer) ([]byte, error) {
+	var block *pem.Block
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}
+	case *ecdsa.PrivateKey:
+		b, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, err
+		}
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}
+	case ed25519.PrivateKey:
+		b, err := x509.MarshalPKCS8PrivateKey(k)
+		if err != nil {
+			return nil, err
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: b}
+	default:
+		return nil, ErrUnsupportedKey
+	}
+	return pem.EncodeToMemory(block), nil
+}
+
+// 编码为PEM格式的公钥(PKIX)
+func MarshalPublicKey(publicKey crypto.PublicKey) ([]byte, error) {
+	b, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: b}), nil
+}
+
+// JWK 公钥的JSON Web Key表示
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+func PublicJWK(key Key) (JWK, error) {
+	jwk, err := publicJWK(key.PublicKey)
+	if err != nil {
+		return JWK{}, err
+	}
+	jwk.Kid = key.ID
+	jwk.Use = "sig"
+	return jwk, nil
+}
+
+func publicJWK(publicKey crypto.PublicKey) (JWK, error) {
+	alg, err := KeyAlg(publicKey)
+	if err != nil {
+		return JWK{}, err
+	}
+	enc := base64.RawURLEncoding.EncodeToString
+	switch k := publicKey.(type) {
+	case *rsa.PublicKey:
+		return JWK{
+			Kty: "RSA",
+			Alg: alg,
+			N:   enc(k.N.Bytes()),
+			E:   enc(big.NewInt(int64(k.E)).Bytes()),
+		}, nil
+	case *ecdsa.PublicKey:
+		// 坐标需补齐到曲线长度
+		size := (k.Curve.Params().BitSize + 7) / 8
+		return JWK{
+			Kty: "EC",
+			Alg: alg,
+			Crv: k.Curve.Params().Name,
+			X:   enc(k.X.FillBytes(make([]byte, size))),
+			Y:   enc(k.Y.FillBytes(make([]byte, size))),
+		}, nil
+	case ed25519.PublicKey:
+		return JWK{
+			Kty: "OKP",
+			Alg: alg,
+			Crv: "Ed25519",
+			X:   enc(k),
+		}, nil
+	}
+	return JWK{}, ErrUnsupportedKey
+}
+
+// KeyID 使用RFC 7638的JWK指纹作为kid
+func KeyID(publicKey crypto.PublicKey) (string, error) {
+	jwk, err := publicJWK(publicKey)
+	if err != nil {
+		return "", err
+	}
+	// 指纹只包含必需成员，并按字典序排列
+	var members any
+	switch jwk.Kty {
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{jwk.E, jwk.Kty, jwk.N}
+	case "EC":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{jwk.Crv, jwk.Kty, jwk.X, jwk.Y}
+	case "OKP":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwk.Crv, jwk.Kty, jwk.X}
+	}
+	b, err := json.Marshal(members)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
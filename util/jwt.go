@@ -2,35 +2,175 @@ package util
 
 import (
 	"context"
-	"crypto/rsa"
-	"crypto/x509"
-	"encoding/pem"
+	"crypto"
 	"errors"
+	"fmt"
+	"sort"
+	"sync"
 
 	"git.blauwelle.com/go/crate/log"
 	"github.com/golang-jwt/jwt/v5"
 )
 
+// 密钥状态
+// next：已发布到jwks但尚未用于签名；active：用于签名；previous：轮换下来的旧密钥，仍可用于校验；retired：不再接受
+type KeyStatus string
+
+const (
+	KeyStatusNext     KeyStatus = "next"
+	KeyStatusActive   KeyStatus = "active"
+	KeyStatusPrevious KeyStatus = "previous"
+	KeyStatusRetired  KeyStatus = "retired"
+)
+
+var (
+	ErrNoActiveKey = errors.New("no active signing key")
+	ErrUnknownKey  = errors.New("unknown or retired signing key")
+	ErrKeyAlg      = errors.New("signing method does not match key")
+)
+
+// Key 签名密钥，算法由密钥类型决定，见 KeyAlg
+type Key struct {
+	ID         string
+	Status     KeyStatus
+	PrivateKey crypto.Signer
+	PublicKey  crypto.PublicKey
+}
+
+func (k Key) Alg() string {
+	alg, _ := KeyAlg(k.PublicKey)
+	return alg
+}
+
 type JWT struct {
-	privateKey *rsa.PrivateKey
-	publicKey  *rsa.PublicKey
+	mu     sync.RWMutex
+	keys   map[string]Key
+	active Key
 }
 
 // 初始化JWT
-func NewJWT(privateKey *rsa.PrivateKey, publicKey *rsa.PublicKey) *JWT {
+func NewJWT(privateKey crypto.Signer, publicKey crypto.PublicKey) (*JWT, error) {
 	if publicKey == nil {
-		publicKey = &privateKey.PublicKey
+		publicKey = privateKey.Public()
 	}
-	return &JWT{
-		privateKey: privateKey,
-		publicKey:  publicKey,
+	kid, err := KeyID(publicKey)
+	if err != nil {
+		return nil, err
 	}
+	return NewJWTFromKeys([]Key{{
+		ID:         kid,
+		Status:     KeyStatusActive,
+		PrivateKey: privateKey,
+		PublicKey:  publicKey,
+	}})
+}
+
+// 使用密钥环初始化JWT，keys中必须有且只有一个active密钥
+func NewJWTFromKeys(keys []Key) (*JWT, error) {
+	j := &JWT{}
+	if err := j.SetKeys(keys); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// 替换全部密钥，用于密钥轮换后重新加载
+func (j *JWT) SetKeys(keys []Key) error {
+	m := make(map[string]Key, len(keys))
+	var active *Key
+	for i := range keys {
+		key := keys[i]
+		if key.PublicKey == nil && key.PrivateKey != nil {
+			key.PublicKey = key.PrivateKey.Public()
+		}
+		if _, err := KeyAlg(key.PublicKey); err != nil {
+			return fmt.Errorf("key %s: %w", key.ID, err)
+		}
+		if key.Status == KeyStatusActive {
+			if active != nil {
+				return errors.New("more than one active signing key")
+			}
+			if key.PrivateKey == nil {
+				return errors.New("active signing key has no private key")
+			}
+			active = &key
+		}
+		m[key.ID] = key
+	}
+	if active == nil {
+		return ErrNoActiveKey
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.keys = m
+	j.active = *active
+	return nil
+}
+
+// 可公开的密钥，即除retired外的全部密钥
+func (j *JWT) PublicKeys() []Key {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	keys := make([]Key, 0, len(j.keys))
+	for _, key := range j.keys {
+		if key.Status == KeyStatusRetired {
+			continue
+		}
+		keys = append(keys, Key{ID: key.ID, Status: key.Status, PublicKey: key.PublicKey})
+	}
+	sort.Slice(keys, func(a, b int) bool { return keys[a].ID < keys[b].ID })
+	return keys
+}
+
+// 当前用于签名的密钥
+func (j *JWT) ActiveKey() Key {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return j.active
+}
+
+// 带私钥的全部密钥
+func (j *JWT) signingKeys() []Key {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	keys := make([]Key, 0, len(j.keys))
+	for _, key := range j.keys {
+		if key.PrivateKey != nil && key.Status != KeyStatusRetired {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(a, b int) bool { return keys[a].ID < keys[b].ID })
+	return keys
+}
+
+// 当前可校验的签名算法
+func (j *JWT) Algorithms() []string {
+	var algs []string
+	seen := make(map[string]bool)
+	for _, key := range j.PublicKeys() {
+		alg := key.Alg()
+		if !seen[alg] {
+			seen[alg] = true
+			algs = append(algs, alg)
+		}
+	}
+	return algs
 }
 
 // 加密过程
 func (j *JWT) Sign(ctx context.Context, claims jwt.RegisteredClaims) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	tokenString, err := token.SignedString(j.privateKey)
+	return j.SignClaims(ctx, claims)
+}
+
+// 使用自定义claims加密
+func (j *JWT) SignClaims(ctx context.Context, claims jwt.Claims) (string, error) {
+	j.mu.RLock()
+	active := j.active
+	j.mu.RUnlock()
+
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(active.Alg()), claims)
+	token.Header["kid"] = active.ID
+	tokenString, err := token.SignedString(active.PrivateKey)
 	if err != nil {
 		log.Error(ctx, err.Error())
 	}
@@ -40,52 +180,69 @@ func (j *JWT) Sign(ctx context.Context, claims jwt.RegisteredClaims) (string, er
 // 解密过程
 func (j *JWT) Verify(ctx context.Context, tokenString string) (jwt.RegisteredClaims, error) {
 	var claims jwt.RegisteredClaims
+	if err := j.VerifyClaims(ctx, tokenString, &claims); err != nil {
+		return jwt.RegisteredClaims{}, err
+	}
+	return claims, nil
+}
+
+// 解密到自定义claims，claims需为指针
+func (j *JWT) VerifyClaims(ctx context.Context, tokenString string, claims jwt.Claims) error {
 	_, err := jwt.ParseWithClaims(
 		tokenString,
-		&claims,
-		func(token *jwt.Token) (interface{}, error) {
-			return j.publicKey, nil
-		},
-		jwt.WithValidMethods([]string{"RS256"}),
+		claims,
+		j.keyFunc,
+		jwt.WithValidMethods(SupportedAlgs),
 	)
 	if err != nil {
 		log.Error(ctx, err.Error())
-		return jwt.RegisteredClaims{}, err
+		return err
 	}
-	return claims, nil
+	return nil
 }
 
-func NewJWTFromKeyBytes(keyBytes []byte) (*JWT, error) {
-	// 解码给定的 PEM 数据，将其转换为一个 *pem.Block 结构
-	block, _ := pem.Decode(keyBytes)
-	if block == nil {
-		return nil, errors.New("failed to decode PEM block")
+// 按header中的kid查找校验密钥，没有kid的旧token使用active密钥
+// 每个密钥只接受与其类型对应的算法
+func (j *JWT) keyFunc(token *jwt.Token) (interface{}, error) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	key := j.active
+	if kid, _ := token.Header["kid"].(string); kid != "" {
+		var ok bool
+		key, ok = j.keys[kid]
+		if !ok || key.Status == KeyStatusRetired {
+			return nil, ErrUnknownKey
+		}
+	}
+	if token.Method.Alg() != key.Alg() {
+		return nil, ErrKeyAlg
+	}
+	return key.PublicKey, nil
+}
+
+func (j *JWT) JWKS() JWKS {
+	keys := j.PublicKeys()
+	jwks := JWKS{Keys: make([]JWK, 0, len(keys))}
+	for _, key := range keys {
+		jwk, err := PublicJWK(key)
+		if err != nil {
+			continue
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
 	}
+	return jwks
+}
 
-	// 将传入的字节块解析为 PKCS1 格式的 RSA 私钥
-	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+func NewJWTFromKeyBytes(keyBytes []byte) (*JWT, error) {
+	key, err := ParsePrivateKey(keyBytes)
 	if err != nil {
 		return nil, err
 	}
+	return NewJWT(key, nil)
+}
 
-	return NewJWT(key, nil), nil
-}
-
-//func init() {
-//	bit := 2048
-//	key, err := rsa.GenerateKey(rand.Reader, bit)
-//	if err != nil {
-//		panic(err)
-//	}
-//	b := x509.MarshalPKCS1PrivateKey(key)
-//	f, _ := os.Create("private.rsa")
-//	defer f.Close()
-//	pem.Encode(f, &pem.Block{
-//		Type:  "RSA PRIVATE KEY",
-//		Bytes: b,
-//	})
-//	pem.Encode(os.Stdout, &pem.Block{
-//		Type:  "RSA PUBLIC KEY",
-//		Bytes: x509.MarshalPKCS1PublicKey(&key.PublicKey),
-//	})
-//}
+// SessionClaims 会话cookie中的access token，SessionID对应refresh token的family
+type SessionClaims struct {
+	jwt.RegisteredClaims
+	SessionID string `json:"sid,omitempty"`
+}
@@ -0,0 +1,225 @@
+package util
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const keyRingFile = "keyring.yaml"
+
+// KeyRing 保存在目录中的密钥环，keyring.yaml记录每个密钥的状态，私钥保存在 <kid>.pem
+type KeyRing struct {
+	Dir  string         `yaml:"-"`
+	Keys []KeyRingEntry `yaml:"keys"`
+}
+
+type KeyRingEntry struct {
+	ID          string     `yaml:"kid"`
+	Alg         string     `yaml:"alg"`
+	Status      KeyStatus  `yaml:"status"`
+	CreatedAt   time.Time  `yaml:"createdAt"`
+	ActivatedAt *time.Time `yaml:"activatedAt,omitempty"`
+	RotatedAt   *time.Time `yaml:"rotatedAt,omitempty"`
+	RetiredAt   *time.Time `yaml:"retiredAt,omitempty"`
+}
+
+// 读取密钥环，目录或文件不存在时返回空密钥环
+func LoadKeyRing(dir string) (*KeyRing, error) {
+	kr := &KeyRing{Dir: dir}
+	b, err := os.ReadFile(filepath.Join(dir, keyRingFile))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return kr, nil
+		}
+		return nil, err
+	}
+	if err := yaml.Unmarshal(b, kr); err != nil {
+		return nil, err
+	}
+	return kr, nil
+}
+
+func (kr *KeyRing) Save() error {
+	if err := os.MkdirAll(kr.Dir, 0o700); err != nil {
+		return err
+	}
+	b, err := yaml.Marshal(kr)
+	if err != nil {
+		return err
+	}
+	// 先写临时文件再改名，避免服务端读到写了一半的文件
+	tmp := filepath.Join(kr.Dir, keyRingFile+".tmp")
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(kr.Dir, keyRingFile))
+}
+
+// 读取除retired以外密钥的私钥
+func (kr *KeyRing) LoadKeys() ([]Key, error) {
+	keys := make([]Key, 0, len(kr.Keys))
+	for _, entry := range kr.Keys {
+		if entry.Status == KeyStatusRetired {
+			continue
+		}
+		b, err := os.ReadFile(kr.keyPath(entry.ID))
+		if err != nil {
+			return nil, err
+		}
+		privateKey, err := ParsePrivateKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", entry.ID, err)
+		}
+		keys = append(keys, Key{
+			ID:         entry.ID,
+			Status:     entry.Status,
+			PrivateKey: privateKey,
+			PublicKey:  privateKey.Public(),
+		})
+	}
+	return keys, nil
+}
+
+func (kr *KeyRing) Active() (KeyRingEntry, bool) {
+	for _, entry := range kr.Keys {
+		if entry.Status == KeyStatusActive {
+			return entry, true
+		}
+	}
+	return KeyRingEntry{}, false
+}
+
+// 生成指定算法的新密钥并加入密钥环
+func (kr *KeyRing) Generate(alg string, status KeyStatus, now time.Time) (KeyRingEntry, error) {
+	privateKey, err := GenerateKey(alg)
+	if err != nil {
+		return KeyRingEntry{}, err
+	}
+	return kr.Import(privateKey, status, now)
+}
+
+// 导入已有私钥，如 private.rsa
+func (kr *KeyRing) Import(privateKey crypto.Signer, status KeyStatus, now time.Time) (KeyRingEntry, error) {
+	kid, err := KeyID(privateKey.Public())
+	if err != nil {
+		return KeyRingEntry{}, err
+	}
+	alg, _ := KeyAlg(privateKey.Public())
+	keyBytes, err := MarshalPrivateKey(privateKey)
+	if err != nil {
+		return KeyRingEntry{}, err
+	}
+	entry := KeyRingEntry{
+		ID:        kid,
+		Alg:       alg,
+		Status:    status,
+		CreatedAt: now,
+	}
+	for _, e := range kr.Keys {
+		if e.ID == entry.ID {
+			return KeyRingEntry{}, fmt.Errorf("key %s already exists", entry.ID)
+		}
+	}
+	if status == KeyStatusActive {
+		entry.ActivatedAt = &now
+	}
+	if err := os.MkdirAll(kr.Dir, 0o700); err != nil {
+		return KeyRingEntry{}, err
+	}
+	if err := os.WriteFile(kr.keyPath(entry.ID), keyBytes, 0o600); err != nil {
+		return KeyRingEntry{}, err
+	}
+	kr.Keys = append(kr.Keys, entry)
+	return entry, nil
+}
+
+// Rotate 轮换密钥：
+// 超过retireAfter的previous变为retired，active变为previous，next变为active，并生成alg算法的新next
+func (kr *KeyRing) Rotate(alg string, now time.Time, retireAfter time.Duration) error {
+	hasNext := false
+	for _, entry := range kr.Keys {
+		if entry.Status == KeyStatusNext {
+			hasNext = true
+			break
+		}
+	}
+	// 没有next时先生成一个，此次轮换后应用需尽快刷新jwks
+	if !hasNext {
+		if _, err := kr.Generate(alg, KeyStatusNext, now); err != nil {
+			return err
+		}
+	}
+
+	for i := range kr.Keys {
+		entry := &kr.Keys[i]
+		switch entry.Status {
+		case KeyStatusPrevious:
+			if entry.RotatedAt == nil || now.Sub(*entry.RotatedAt) >= retireAfter {
+				entry.Status = KeyStatusRetired
+				entry.RetiredAt = &now
+			}
+		case KeyStatusActive:
+			entry.Status = KeyStatusPrevious
+			entry.RotatedAt = &now
+		}
+	}
+	for i := range kr.Keys {
+		entry := &kr.Keys[i]
+		if entry.Status == KeyStatusNext {
+			entry.Status = KeyStatusActive
+			entry.ActivatedAt = &now
+			break
+		}
+	}
+
+	_, err := kr.Generate(alg, KeyStatusNext, now)
+	return err
+}
+
+func (kr *KeyRing) keyPath(kid string) string {
+	return filepath.Join(kr.Dir, kid+".pem")
+}
+
+// LoadJWT 优先使用密钥环，密钥环为空时使用单个私钥文件
+func LoadJWT(keyRingDir, privateKeyFile string) (*JWT, error) {
+	if keyRingDir != "" {
+		kr, err := LoadKeyRing(keyRingDir)
+		if err != nil {
+			return nil, err
+		}
+		if len(kr.Keys) > 0 {
+			keys, err := kr.LoadKeys()
+			if err != nil {
+				return nil, err
+			}
+			return NewJWTFromKeys(keys)
+		}
+	}
+	keyBytes, err := os.ReadFile(privateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return NewJWTFromKeyBytes(keyBytes)
+}
+
+// 重新读取密钥环，供轮换后服务端无需重启即可生效
+func (j *JWT) ReloadKeyRing(dir string) error {
+	kr, err := LoadKeyRing(dir)
+	if err != nil {
+		return err
+	}
+	if len(kr.Keys) == 0 {
+		return nil
+	}
+	keys, err := kr.LoadKeys()
+	if err != nil {
+		return err
+	}
+	return j.SetKeys(keys)
+}
@@ -0,0 +1,135 @@
+package util
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+
+	"git.blauwelle.com/go/crate/cmd/sso/model"
+)
+
+var ErrLDAPAmbiguousUser = errors.New("ldap: more than one entry matches user filter")
+
+// LDAPAuthenticator 使用服务账号搜索用户条目，再以用户DN和密码绑定完成认证
+type LDAPAuthenticator struct {
+	URL               string
+	StartTLS          bool
+	TLSConfig         *tls.Config
+	BindDN            string // 用于搜索的服务账号，为空时匿名搜索
+	BindPassword      string
+	BaseDN            string
+	UserFilter        string // %s替换为转义后的用户名，如 (uid=%s)
+	UsernameAttribute string // 本地用户名使用的属性
+	GroupBaseDN       string
+	GroupFilter       string // %s替换为转义后的用户DN，如 (member=%s)；为空时读取用户条目的memberOf
+	GroupAttribute    string // 组名使用的属性，如 cn
+	Timeout           time.Duration
+	// Dial 建立连接，默认连接URL；测试时可替换为进程内的LDAP实现
+	Dial func(ctx context.Context) (ldap.Client, error)
+}
+
+func (a *LDAPAuthenticator) Authenticate(ctx context.Context, username, password string) (Identity, error) {
+	if username == "" {
+		return Identity{}, ErrUnknownUser
+	}
+	conn, err := a.dial(ctx)
+	if err != nil {
+		return Identity{}, err
+	}
+	defer conn.Close()
+
+	if err := a.bindService(conn); err != nil {
+		return Identity{}, err
+	}
+	attributes := []string{a.UsernameAttribute}
+	if a.GroupFilter == "" {
+		attributes = append(attributes, "memberOf")
+	}
+	result, err := conn.Search(ldap.NewSearchRequest(
+		a.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(a.Timeout.Seconds()), false,
+		fmt.Sprintf(a.UserFilter, ldap.EscapeFilter(username)),
+		attributes, nil,
+	))
+	if err != nil {
+		return Identity{}, err
+	}
+	if len(result.Entries) == 0 {
+		return Identity{}, ErrUnknownUser
+	}
+	if len(result.Entries) > 1 {
+		return Identity{}, ErrLDAPAmbiguousUser
+	}
+	entry := result.Entries[0]
+
+	// 空密码的绑定会被服务器当作匿名绑定而成功，必须拒绝
+	if password == "" {
+		return Identity{}, ErrBadCredentials
+	}
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return Identity{}, ErrBadCredentials
+		}
+		return Identity{}, err
+	}
+
+	identity := Identity{
+		Username: entry.GetAttributeValue(a.UsernameAttribute),
+		Source:   model.UserSourceLDAP,
+	}
+	if identity.Username == "" {
+		identity.Username = username
+	}
+	if a.GroupFilter == "" {
+		identity.Groups = entry.GetAttributeValues("memberOf")
+		return identity, nil
+	}
+	// 用户绑定后可能没有搜索组的权限，切换回服务账号
+	if err := a.bindService(conn); err != nil {
+		return Identity{}, err
+	}
+	groups, err := conn.Search(ldap.NewSearchRequest(
+		a.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, int(a.Timeout.Seconds()), false,
+		fmt.Sprintf(a.GroupFilter, ldap.EscapeFilter(entry.DN)),
+		[]string{a.GroupAttribute}, nil,
+	))
+	if err != nil {
+		return Identity{}, err
+	}
+	for _, group := range groups.Entries {
+		if name := group.GetAttributeValue(a.GroupAttribute); name != "" {
+			identity.Groups = append(identity.Groups, name)
+		}
+	}
+	return identity, nil
+}
+
+func (a *LDAPAuthenticator) dial(ctx context.Context) (ldap.Client, error) {
+	if a.Dial != nil {
+		return a.Dial(ctx)
+	}
+	conn, err := ldap.DialURL(a.URL, ldap.DialWithTLSConfig(a.TLSConfig))
+	if err != nil {
+		return nil, err
+	}
+	if a.Timeout > 0 {
+		conn.SetTimeout(a.Timeout)
+	}
+	if a.StartTLS {
+		if err := conn.StartTLS(a.TLSConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (a *LDAPAuthenticator) bindService(conn ldap.Client) error {
+	if a.BindDN == "" {
+		return conn.UnauthenticatedBind("")
+	}
+	return conn.Bind(a.BindDN, a.BindPassword)
+}
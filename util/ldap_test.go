@@ -0,0 +1,239 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+
+	"git.blauwelle.com/go/crate/cmd/sso/model"
+)
+
+const (
+	testServiceDN = "cn=sso,dc=example,dc=com"
+	testAliceDN   = "uid=alice,ou=people,dc=example,dc=com"
+)
+
+// fakeLDAP 进程内的LDAP实现，按过滤器字符串返回预置的条目并记录绑定和搜索
+type fakeLDAP struct {
+	ldap.Client
+	passwords map[string]string
+	entries   map[string][]*ldap.Entry
+	binds     []string
+	filters   []string
+	closed    bool
+}
+
+func (f *fakeLDAP) Bind(username, password string) error {
+	f.binds = append(f.binds, username)
+	if want, ok := f.passwords[username]; !ok || want != password {
+		return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+	}
+	return nil
+}
+
+func (f *fakeLDAP) UnauthenticatedBind(username string) error {
+	f.binds = append(f.binds, username)
+	return nil
+}
+
+func (f *fakeLDAP) Search(request *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	f.filters = append(f.filters, request.Filter)
+	return &ldap.SearchResult{Entries: f.entries[request.Filter]}, nil
+}
+
+func (f *fakeLDAP) Close() {
+	f.closed = true
+}
+
+func newFakeLDAP() *fakeLDAP {
+	return &fakeLDAP{
+		passwords: map[string]string{
+			testServiceDN: "service-secret",
+			testAliceDN:   "alice-secret",
+		},
+		entries: map[string][]*ldap.Entry{
+			"(uid=alice)": {ldap.NewEntry(testAliceDN, map[string][]string{
+				"uid":      {"alice"},
+				"memberOf": {"cn=admins,ou=groups,dc=example,dc=com", "cn=staff,ou=groups,dc=example,dc=com"},
+			})},
+			"(uid=twin)": {
+				ldap.NewEntry("uid=twin,ou=a,dc=example,dc=com", nil),
+				ldap.NewEntry("uid=twin,ou=b,dc=example,dc=com", nil),
+			},
+			"(member=uid=alice,ou=people,dc=example,dc=com)": {
+				ldap.NewEntry("cn=admins,ou=groups,dc=example,dc=com", map[string][]string{"cn": {"admins"}}),
+				ldap.NewEntry("cn=staff,ou=groups,dc=example,dc=com", map[string][]string{"cn": {"staff"}}),
+			},
+		},
+	}
+}
+
+func newTestLDAPAuthenticator(conn *fakeLDAP) *LDAPAuthenticator {
+	return &LDAPAuthenticator{
+		BindDN:            testServiceDN,
+		BindPassword:      "service-secret",
+		BaseDN:            "ou=people,dc=example,dc=com",
+		UserFilter:        "(uid=%s)",
+		UsernameAttribute: "uid",
+		GroupBaseDN:       "ou=groups,dc=example,dc=com",
+		GroupAttribute:    "cn",
+		Dial: func(context.Context) (ldap.Client, error) {
+			return conn, nil
+		},
+	}
+}
+
+func TestLDAPAuthenticatorBind(t *testing.T) {
+	tests := []struct {
+		name         string
+		bindPassword string
+		username     string
+		password     string
+		wantErr      error
+		wantBinds    []string
+	}{
+		{"ok", "service-secret", "alice", "alice-secret", nil, []string{testServiceDN, testAliceDN}},
+		{"wrong password", "service-secret", "alice", "guess", ErrBadCredentials, []string{testServiceDN, testAliceDN}},
+		{"empty password", "service-secret", "alice", "", ErrBadCredentials, []string{testServiceDN}},
+		{"unknown user", "service-secret", "bob", "alice-secret", ErrUnknownUser, []string{testServiceDN}},
+		{"ambiguous user", "service-secret", "twin", "alice-secret", ErrLDAPAmbiguousUser, []string{testServiceDN}},
+		{"empty username", "service-secret", "", "alice-secret", ErrUnknownUser, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := newFakeLDAP()
+			a := newTestLDAPAuthenticator(conn)
+			a.BindPassword = tt.bindPassword
+			identity, err := a.Authenticate(context.Background(), tt.username, tt.password)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(conn.binds, tt.wantBinds) {
+				t.Errorf("binds = %q, want %q", conn.binds, tt.wantBinds)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if identity.Username != "alice" || identity.Source != model.UserSourceLDAP {
+				t.Errorf("identity = %+v", identity)
+			}
+			if !conn.closed {
+				t.Error("connection not closed")
+			}
+		})
+	}
+}
+
+// 服务账号密码错误时不是用户的凭据错误，不能返回 ErrBadCredentials
+func TestLDAPAuthenticatorServiceBindFails(t *testing.T) {
+	conn := newFakeLDAP()
+	a := newTestLDAPAuthenticator(conn)
+	a.BindPassword = "wrong"
+	_, err := a.Authenticate(context.Background(), "alice", "alice-secret")
+	if err == nil || errors.Is(err, ErrBadCredentials) || errors.Is(err, ErrUnknownUser) {
+		t.Fatalf("err = %v, want ldap error", err)
+	}
+	if len(conn.filters) != 0 {
+		t.Errorf("searched %q after failed service bind", conn.filters)
+	}
+}
+
+func TestLDAPAuthenticatorAnonymousBind(t *testing.T) {
+	conn := newFakeLDAP()
+	a := newTestLDAPAuthenticator(conn)
+	a.BindDN = ""
+	if _, err := a.Authenticate(context.Background(), "alice", "alice-secret"); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"", testAliceDN}; !reflect.DeepEqual(conn.binds, want) {
+		t.Errorf("binds = %q, want %q", conn.binds, want)
+	}
+}
+
+func TestLDAPAuthenticatorEscapesFilter(t *testing.T) {
+	tests := []struct {
+		username string
+		want     string
+	}{
+		{"alice", "(uid=alice)"},
+		{"*", `(uid=\2a)`},
+		{"a*)(uid=*", `(uid=a\2a\29\28uid=\2a)`},
+		{`x\00`, `(uid=x\5c00)`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.username, func(t *testing.T) {
+			conn := newFakeLDAP()
+			a := newTestLDAPAuthenticator(conn)
+			_, _ = a.Authenticate(context.Background(), tt.username, "alice-secret")
+			if len(conn.filters) == 0 || conn.filters[0] != tt.want {
+				t.Errorf("filters = %q, want first %q", conn.filters, tt.want)
+			}
+		})
+	}
+}
+
+func TestLDAPAuthenticatorGroups(t *testing.T) {
+	tests := []struct {
+		name        string
+		groupFilter string
+		wantGroups  []string
+		wantBinds   []string
+		wantFilters []string
+	}{
+		{
+			name:        "memberOf",
+			wantGroups:  []string{"cn=admins,ou=groups,dc=example,dc=com", "cn=staff,ou=groups,dc=example,dc=com"},
+			wantBinds:   []string{testServiceDN, testAliceDN},
+			wantFilters: []string{"(uid=alice)"},
+		},
+		{
+			// 组搜索前切换回服务账号，用户DN经过转义
+			name:        "group filter",
+			groupFilter: "(member=%s)",
+			wantGroups:  []string{"admins", "staff"},
+			wantBinds:   []string{testServiceDN, testAliceDN, testServiceDN},
+			wantFilters: []string{"(uid=alice)", "(member=" + testAliceDN + ")"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := newFakeLDAP()
+			a := newTestLDAPAuthenticator(conn)
+			a.GroupFilter = tt.groupFilter
+			identity, err := a.Authenticate(context.Background(), "alice", "alice-secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(identity.Groups, tt.wantGroups) {
+				t.Errorf("groups = %q, want %q", identity.Groups, tt.wantGroups)
+			}
+			if !reflect.DeepEqual(conn.binds, tt.wantBinds) {
+				t.Errorf("binds = %q, want %q", conn.binds, tt.wantBinds)
+			}
+			if !reflect.DeepEqual(conn.filters, tt.wantFilters) {
+				t.Errorf("filters = %q, want %q", conn.filters, tt.wantFilters)
+			}
+		})
+	}
+}
+
+// 用户DN中的过滤器特殊字符在组搜索时同样转义
+func TestLDAPAuthenticatorGroupFilterEscapesDN(t *testing.T) {
+	const dn = `uid=a(b)*,ou=people,dc=example,dc=com`
+	conn := newFakeLDAP()
+	conn.passwords[dn] = "secret"
+	conn.entries["(uid=a(b)*)"] = nil
+	conn.entries[`(uid=a\28b\29\2a)`] = []*ldap.Entry{ldap.NewEntry(dn, map[string][]string{"uid": {"a(b)*"}})}
+	a := newTestLDAPAuthenticator(conn)
+	a.GroupFilter = "(member=%s)"
+	if _, err := a.Authenticate(context.Background(), "a(b)*", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	want := `(member=uid=a\28b\29\2a,ou=people,dc=example,dc=com)`
+	if len(conn.filters) != 2 || conn.filters[1] != want {
+		t.Errorf("filters = %q, want group filter %q", conn.filters, want)
+	}
+}
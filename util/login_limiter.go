@@ -0,0 +1,169 @@
+package util
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LoginFailures 某个用户名或IP的连续登录失败记录
+type LoginFailures struct {
+	Count int       `json:"count"`
+	Last  time.Time `json:"last"`
+}
+
+// LoginFailureStore 保存登录失败计数，具体实现见 login_limiter_redis.go、login_limiter_memory.go
+// 计数在最后一次失败ttl之后自动清除
+type LoginFailureStore interface {
+	GetFailures(ctx context.Context, key string) (LoginFailures, error)
+	AddFailure(ctx context.Context, key string, at time.Time, ttl time.Duration) error
+	ResetFailures(ctx context.Context, keys ...string) error
+}
+
+// LoginLimitPolicy 连续失败FreeAttempts次之后，每次失败都要等待BaseDelay*2^n才能再次尝试，
+// 最长为MaxDelay；达到LockoutAttempts次时锁定LockoutDuration
+type LoginLimitPolicy struct {
+	FreeAttempts    int
+	BaseDelay       time.Duration
+	MaxDelay        time.Duration
+	LockoutAttempts int
+	LockoutDuration time.Duration
+}
+
+// Wait 按失败记录计算距离下次允许尝试还需等待的时长
+func (p LoginLimitPolicy) Wait(f LoginFailures, now time.Time) time.Duration {
+	var delay time.Duration
+	switch {
+	case p.LockoutAttempts > 0 && f.Count >= p.LockoutAttempts:
+		delay = p.LockoutDuration
+	case f.Count > p.FreeAttempts:
+		delay = p.BaseDelay
+		for i := p.FreeAttempts + 1; i < f.Count && delay < p.MaxDelay; i++ {
+			delay *= 2
+		}
+		if delay > p.MaxDelay {
+			delay = p.MaxDelay
+		}
+	default:
+		return 0
+	}
+	if wait := f.Last.Add(delay).Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// LoginLimiter 按用户名和客户端IP分别统计登录失败次数
+// 不存在的用户名同样计数，避免通过是否被限制来判断用户是否存在
+type LoginLimiter struct {
+	store  LoginFailureStore
+	user   LoginLimitPolicy
+	ip     LoginLimitPolicy
+	window time.Duration
+	now    func() time.Time
+}
+
+func NewLoginLimiter(store LoginFailureStore, user, ip LoginLimitPolicy, window time.Duration) *LoginLimiter {
+	return &LoginLimiter{store: store, user: user, ip: ip, window: window, now: time.Now}
+}
+
+// Check 返回还需等待的时长，为0时允许尝试
+func (l *LoginLimiter) Check(ctx context.Context, username, ip string) (time.Duration, error) {
+	now := l.now()
+	userWait, err := l.wait(ctx, loginUserKey(username), l.user, now)
+	if err != nil {
+		return 0, err
+	}
+	ipWait, err := l.wait(ctx, loginIPKey(ip), l.ip, now)
+	if err != nil {
+		return 0, err
+	}
+	if ipWait > userWait {
+		return ipWait, nil
+	}
+	return userWait, nil
+}
+
+// Fail 记录一次失败
+func (l *LoginLimiter) Fail(ctx context.Context, username, ip string) error {
+	now := l.now()
+	if err := l.store.AddFailure(ctx, loginUserKey(username), now, l.ttl(l.user)); err != nil {
+		return err
+	}
+	return l.store.AddFailure(ctx, loginIPKey(ip), now, l.ttl(l.ip))
+}
+
+// Succeed 登录成功后清除用户名的计数，IP的计数保留，避免用自己的账号重置对其他账号的猜测
+func (l *LoginLimiter) Succeed(ctx context.Context, username string) error {
+	return l.store.ResetFailures(ctx, loginUserKey(username))
+}
+
+// UserStatus 用户名的失败记录和剩余等待时长
+func (l *LoginLimiter) UserStatus(ctx context.Context, username string) (LoginFailures, time.Duration, error) {
+	return l.status(ctx, loginUserKey(username), l.user)
+}
+
+// IPStatus IP的失败记录和剩余等待时长
+func (l *LoginLimiter) IPStatus(ctx context.Context, ip string) (LoginFailures, time.Duration, error) {
+	return l.status(ctx, loginIPKey(ip), l.ip)
+}
+
+func (l *LoginLimiter) UnlockUser(ctx context.Context, username string) error {
+	return l.store.ResetFailures(ctx, loginUserKey(username))
+}
+
+func (l *LoginLimiter) UnlockIP(ctx context.Context, ip string) error {
+	return l.store.ResetFailures(ctx, loginIPKey(ip))
+}
+
+// CheckSecondFactor 第二因素(TOTP、恢复码)验证前的等待时长，按用户计数并使用用户名的策略
+// 与密码的计数分开，重新通过密码校验不会清除
+func (l *LoginLimiter) CheckSecondFactor(ctx context.Context, userID uint) (time.Duration, error) {
+	return l.wait(ctx, loginSecondFactorKey(userID), l.user, l.now())
+}
+
+func (l *LoginLimiter) FailSecondFactor(ctx context.Context, userID uint) error {
+	return l.store.AddFailure(ctx, loginSecondFactorKey(userID), l.now(), l.ttl(l.user))
+}
+
+func (l *LoginLimiter) SucceedSecondFactor(ctx context.Context, userID uint) error {
+	return l.store.ResetFailures(ctx, loginSecondFactorKey(userID))
+}
+
+func (l *LoginLimiter) status(ctx context.Context, key string, policy LoginLimitPolicy) (LoginFailures, time.Duration, error) {
+	failures, err := l.store.GetFailures(ctx, key)
+	if err != nil {
+		return LoginFailures{}, 0, err
+	}
+	return failures, policy.Wait(failures, l.now()), nil
+}
+
+func (l *LoginLimiter) wait(ctx context.Context, key string, policy LoginLimitPolicy, now time.Time) (time.Duration, error) {
+	failures, err := l.store.GetFailures(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	return policy.Wait(failures, now), nil
+}
+
+// 计数至少保留到锁定结束
+func (l *LoginLimiter) ttl(policy LoginLimitPolicy) time.Duration {
+	if policy.LockoutDuration > l.window {
+		return policy.LockoutDuration
+	}
+	return l.window
+}
+
+// 用户名不区分大小写，与MySQL默认的排序规则一致
+func loginUserKey(username string) string {
+	return "login:fail:user:" + strings.ToLower(strings.TrimSpace(username))
+}
+
+func loginSecondFactorKey(userID uint) string {
+	return "login:fail:mfa:" + strconv.FormatUint(uint64(userID), 10)
+}
+
+func loginIPKey(ip string) string {
+	return "login:fail:ip:" + ip
+}
@@ -0,0 +1,67 @@
+package util
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryLoginFailureStore 进程内计数，适用于单节点部署和测试
+type MemoryLoginFailureStore struct {
+	mu       sync.Mutex
+	failures map[string]memoryLoginFailures
+	now      func() time.Time
+}
+
+type memoryLoginFailures struct {
+	LoginFailures
+	expireAt time.Time
+}
+
+func NewMemoryLoginFailureStore() *MemoryLoginFailureStore {
+	return &MemoryLoginFailureStore{
+		failures: make(map[string]memoryLoginFailures),
+		now:      time.Now,
+	}
+}
+
+func (s *MemoryLoginFailureStore) GetFailures(ctx context.Context, key string) (LoginFailures, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.failures[key]
+	if !ok || !s.now().Before(f.expireAt) {
+		return LoginFailures{}, nil
+	}
+	return f.LoginFailures, nil
+}
+
+func (s *MemoryLoginFailureStore) AddFailure(ctx context.Context, key string, at time.Time, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	s.gc(now)
+	f := s.failures[key]
+	f.Count++
+	f.Last = at
+	f.expireAt = now.Add(ttl)
+	s.failures[key] = f
+	return nil
+}
+
+func (s *MemoryLoginFailureStore) ResetFailures(ctx context.Context, keys ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		delete(s.failures, key)
+	}
+	return nil
+}
+
+// 清理已过期的计数，调用方需持有锁
+func (s *MemoryLoginFailureStore) gc(now time.Time) {
+	for k, f := range s.failures {
+		if !now.Before(f.expireAt) {
+			delete(s.failures, k)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// 原子地增加失败次数并刷新过期时间，多个节点共享同一计数
+var redisAddFailureScript = redis.NewScript(`
+redis.call('HINCRBY', KEYS[1], 'count', 1)
+redis.call('HSET', KEYS[1], 'last', ARGV[1])
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+return 1
+`)
+
+type RedisLoginFailureStore struct {
+	r *redis.Client
+}
+
+func NewRedisLoginFailureStore(r *redis.Client) *RedisLoginFailureStore {
+	return &RedisLoginFailureStore{r: r}
+}
+
+func (s *RedisLoginFailureStore) GetFailures(ctx context.Context, key string) (LoginFailures, error) {
+	values, err := s.r.HMGet(ctx, key, "count", "last").Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return LoginFailures{}, nil
+		}
+		return LoginFailures{}, err
+	}
+	var failures LoginFailures
+	if v, ok := values[0].(string); ok {
+		failures.Count, _ = strconv.Atoi(v)
+	}
+	if v, ok := values[1].(string); ok {
+		if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+			failures.Last = time.UnixMilli(ms)
+		}
+	}
+	return failures, nil
+}
+
+func (s *RedisLoginFailureStore) AddFailure(ctx context.Context, key string, at time.Time, ttl time.Duration) error {
+	return redisAddFailureScript.Run(ctx, s.r, []string{key}, at.UnixMilli(), ttl.Milliseconds()).Err()
+}
+
+func (s *RedisLoginFailureStore) ResetFailures(ctx context.Context, keys ...string) error {
+	return s.r.Del(ctx, keys...).Err()
+}
@@ -0,0 +1,135 @@
+package util
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLoginLimitPolicyWait(t *testing.T) {
+	policy := LoginLimitPolicy{
+		FreeAttempts:    3,
+		BaseDelay:       time.Second,
+		MaxDelay:        10 * time.Second,
+		LockoutAttempts: 10,
+		LockoutDuration: 15 * time.Minute,
+	}
+	last := time.Unix(1700000000, 0)
+	tests := []struct {
+		name    string
+		policy  LoginLimitPolicy
+		count   int
+		elapsed time.Duration
+		want    time.Duration
+	}{
+		{"no failures", policy, 0, 0, 0},
+		{"free attempts", policy, 3, 0, 0},
+		{"first delay", policy, 4, 0, time.Second},
+		{"doubled", policy, 5, 0, 2 * time.Second},
+		{"doubled twice", policy, 6, 0, 4 * time.Second},
+		{"doubled three times", policy, 7, 0, 8 * time.Second},
+		{"capped", policy, 8, 0, 10 * time.Second},
+		{"still capped", policy, 9, 0, 10 * time.Second},
+		{"lockout", policy, 10, 0, 15 * time.Minute},
+		{"past lockout", policy, 11, 0, 15 * time.Minute},
+		{"partly waited", policy, 5, 500 * time.Millisecond, 1500 * time.Millisecond},
+		{"fully waited", policy, 5, 2 * time.Second, 0},
+		{"lockout waited", policy, 10, 15 * time.Minute, 0},
+		{"no lockout configured", LoginLimitPolicy{FreeAttempts: 3, BaseDelay: time.Second, MaxDelay: 10 * time.Second}, 100, 0, 10 * time.Second},
+		{"zero policy", LoginLimitPolicy{}, 100, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.policy.Wait(LoginFailures{Count: tt.count, Last: last}, last.Add(tt.elapsed))
+			if got != tt.want {
+				t.Errorf("Wait(count=%d, elapsed=%v) = %v, want %v", tt.count, tt.elapsed, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoginLimiter(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+	store := NewMemoryLoginFailureStore()
+	store.now = func() time.Time { return now }
+	user := LoginLimitPolicy{FreeAttempts: 1, BaseDelay: time.Second, MaxDelay: time.Minute}
+	ip := LoginLimitPolicy{FreeAttempts: 2, BaseDelay: time.Minute, MaxDelay: time.Hour}
+	l := NewLoginLimiter(store, user, ip, time.Hour)
+	l.now = func() time.Time { return now }
+
+	wait := func(username, addr string) time.Duration {
+		t.Helper()
+		d, err := l.Check(ctx, username, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	for i := 0; i < 2; i++ {
+		if err := l.Fail(ctx, "Alice", "192.0.2.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 用户名不区分大小写
+	if got := wait(" alice ", "198.51.100.1"); got != time.Second {
+		t.Errorf("user wait = %v, want 1s", got)
+	}
+	if got := wait("bob", "192.0.2.1"); got != 0 {
+		t.Errorf("ip wait after 2 failures = %v, want 0", got)
+	}
+	if err := l.Fail(ctx, "bob", "192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	// 取用户名和IP中较长的等待
+	if got := wait("alice", "192.0.2.1"); got != time.Minute {
+		t.Errorf("combined wait = %v, want 1m", got)
+	}
+	// 登录成功只清除用户名的计数
+	if err := l.Succeed(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if got := wait("alice", "198.51.100.1"); got != 0 {
+		t.Errorf("user wait after success = %v, want 0", got)
+	}
+	if got := wait("alice", "192.0.2.1"); got != time.Minute {
+		t.Errorf("ip wait after success = %v, want 1m", got)
+	}
+	if err := l.UnlockIP(ctx, "192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := wait("alice", "192.0.2.1"); got != 0 {
+		t.Errorf("ip wait after unlock = %v, want 0", got)
+	}
+}
+
+// 第二因素的计数与密码分开，密码登录成功不会清除
+func TestLoginLimiterSecondFactor(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+	store := NewMemoryLoginFailureStore()
+	store.now = func() time.Time { return now }
+	l := NewLoginLimiter(store, LoginLimitPolicy{LockoutAttempts: 3, LockoutDuration: time.Hour}, LoginLimitPolicy{}, time.Hour)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if err := l.FailSecondFactor(ctx, 7); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Succeed(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := l.CheckSecondFactor(ctx, 7); got != time.Hour {
+		t.Errorf("wait = %v, want 1h", got)
+	}
+	if got, _ := l.CheckSecondFactor(ctx, 8); got != 0 {
+		t.Errorf("other user wait = %v, want 0", got)
+	}
+	if err := l.SucceedSecondFactor(ctx, 7); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := l.CheckSecondFactor(ctx, 7); got != 0 {
+		t.Errorf("wait after success = %v, want 0", got)
+	}
+}
@@ -0,0 +1,252 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"git.blauwelle.com/go/crate/log"
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+
+	"git.blauwelle.com/go/crate/cmd/sso/model"
+)
+
+const backChannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+var ErrLogoutIssuerRequired = errors.New("logout notifier: issuer is required")
+
+// LogoutTokenClaims OIDC Back-Channel Logout 规范中的logout_token
+// sid为登录时的会话ID，应用应按sid结束本地会话；sub与应用登录时收到的用户标识相同，可能为空
+type LogoutTokenClaims struct {
+	jwt.RegisteredClaims
+	SessionID string                    `json:"sid,omitempty"`
+	Events    map[string]map[string]any `json:"events"`
+}
+
+// LogoutNotifier 把登出通知写入数据库，并在后台发送给配置了logout_url的应用
+type LogoutNotifier struct {
+	db            *gorm.DB
+	j             *JWT
+	client        *http.Client
+	issuer        string
+	maxAttempts   int
+	retryInterval time.Duration
+	r             StringRand
+}
+
+// issuer为logout_token的iss，与id_token相同，不能为空
+func NewLogoutNotifier(db *gorm.DB, j *JWT, issuer string, maxAttempts int, retryInterval, timeout time.Duration) (*LogoutNotifier, error) {
+	issuer = strings.TrimSuffix(issuer, "/")
+	if issuer == "" {
+		return nil, ErrLogoutIssuerRequired
+	}
+	if maxAttempts <= 0 {
+		maxAttempts = 5
+	}
+	if retryInterval <= 0 {
+		retryInterval = 30 * time.Second
+	}
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	return &LogoutNotifier{
+		db:            db,
+		j:             j,
+		client:        &http.Client{Timeout: timeout},
+		issuer:        issuer,
+		maxAttempts:   maxAttempts,
+		retryInterval: retryInterval,
+		r:             NewSecureStringRand(),
+	}, nil
+}
+
+// 记录会话在应用中使用过，subject为应用收到的用户标识，各协议不同：
+// SSOVerify和CAS为用户名，OIDC为用户ID，SAML为NameID；为空时登出通知只包含sid
+func (n *LogoutNotifier) RecordSessionApp(ctx context.Context, sessionID, subject string, userID, appID uint) error {
+	if sessionID == "" {
+		return nil
+	}
+	var count int64
+	db := n.db.WithContext(ctx)
+	if err := db.Model(&model.SessionApplication{}).
+		Where("session_id = ? AND app_id = ?", sessionID, appID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	return db.Create(&model.SessionApplication{SessionID: sessionID, AppID: appID, UserID: userID, Subject: subject}).Error
+}
+
+// 会话登出时通知使用过该会话的应用
+func (n *LogoutNotifier) NotifySession(ctx context.Context, sessionID string) error {
+	if sessionID == "" {
+		return nil
+	}
+	var sessionApps []model.SessionApplication
+	if err := n.db.WithContext(ctx).Where("session_id = ?", sessionID).Find(&sessionApps).Error; err != nil {
+		return err
+	}
+	return n.enqueue(ctx, sessionApps)
+}
+
+// 用户的全部会话失效时通知所有相关应用
+func (n *LogoutNotifier) NotifyUser(ctx context.Context, userID uint) error {
+	var sessionApps []model.SessionApplication
+	if err := n.db.WithContext(ctx).Where("user_id = ?", userID).Find(&sessionApps).Error; err != nil {
+		return err
+	}
+	return n.enqueue(ctx, sessionApps)
+}
+
+func (n *LogoutNotifier) enqueue(ctx context.Context, sessionApps []model.SessionApplication) error {
+	if len(sessionApps) == 0 {
+		return nil
+	}
+	now := time.Now()
+	deliveries := make([]model.LogoutDelivery, 0, len(sessionApps))
+	for _, sa := range sessionApps {
+		deliveries = append(deliveries, model.LogoutDelivery{
+			SessionID:     sa.SessionID,
+			UserID:        sa.UserID,
+			AppID:         sa.AppID,
+			Subject:       sa.Subject,
+			Status:        model.LogoutDeliveryPending,
+			NextAttemptAt: now,
+		})
+	}
+	return n.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&deliveries).Error; err != nil {
+			return err
+		}
+		// 已登出的会话不再需要记录
+		for _, sa := range sessionApps {
+			if err := tx.Delete(&model.SessionApplication{}, "session_id = ? AND app_id = ?", sa.SessionID, sa.AppID).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Run 定时发送待处理的登出通知，直到ctx结束
+func (n *LogoutNotifier) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := n.deliverPending(ctx); err != nil {
+				log.Error(ctx, "deliver logout notifications: "+err.Error())
+			}
+		}
+	}
+}
+
+func (n *LogoutNotifier) deliverPending(ctx context.Context) error {
+	now := time.Now()
+	var deliveries []model.LogoutDelivery
+	if err := n.db.WithContext(ctx).
+		Where("status = ? AND next_attempt_at <= ?", model.LogoutDeliveryPending, now).
+		Order("next_attempt_at").Limit(50).Find(&deliveries).Error; err != nil {
+		return err
+	}
+	for _, delivery := range deliveries {
+		// 多个实例同时运行时，通过条件更新占用该条记录
+		lease := now.Add(n.client.Timeout * 2)
+		db := n.db.WithContext(ctx).Model(&model.LogoutDelivery{}).
+			Where("id = ? AND next_attempt_at = ?", delivery.ID, delivery.NextAttemptAt).
+			Update("next_attempt_at", lease)
+		if db.Error != nil {
+			return db.Error
+		}
+		if db.RowsAffected != 1 {
+			continue
+		}
+		n.deliver(ctx, delivery)
+	}
+	return nil
+}
+
+func (n *LogoutNotifier) deliver(ctx context.Context, delivery model.LogoutDelivery) {
+	now := time.Now()
+	err := n.send(ctx, delivery)
+	updates := map[string]interface{}{
+		"attempts": delivery.Attempts + 1,
+	}
+	switch {
+	case err == nil:
+		updates["status"] = model.LogoutDeliveryDelivered
+		updates["delivered_at"] = now
+		updates["last_error"] = ""
+	case delivery.Attempts+1 >= n.maxAttempts:
+		updates["status"] = model.LogoutDeliveryFailed
+		updates["last_error"] = err.Error()
+	default:
+		updates["last_error"] = err.Error()
+		updates["next_attempt_at"] = now.Add(n.retryInterval << delivery.Attempts)
+	}
+	if err != nil {
+		log.Error(ctx, fmt.Sprintf("logout notification %d to app %d: %s", delivery.ID, delivery.AppID, err.Error()))
+	}
+	if err := n.db.WithContext(ctx).Model(&model.LogoutDelivery{}).Where("id = ?", delivery.ID).Updates(updates).Error; err != nil {
+		log.Error(ctx, err.Error())
+	}
+}
+
+func (n *LogoutNotifier) send(ctx context.Context, delivery model.LogoutDelivery) error {
+	var app model.Application
+	db := n.db.WithContext(ctx).Find(&app, "id = ?", delivery.AppID)
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected != 1 {
+		return errors.New("application not exists")
+	}
+	// 未配置登出地址的应用视为无需通知
+	if app.LogoutURL == "" {
+		return nil
+	}
+
+	now := time.Now()
+	logoutToken, err := n.j.SignClaims(ctx, LogoutTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    n.issuer,
+			Subject:   delivery.Subject,
+			Audience:  jwt.ClaimStrings{app.AppKey},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(2 * time.Minute)),
+			ID:        n.r.RandString(24),
+		},
+		SessionID: delivery.SessionID,
+		Events:    map[string]map[string]any{backChannelLogoutEvent: {}},
+	})
+	if err != nil {
+		return err
+	}
+
+	form := url.Values{"logout_token": {logoutToken}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, app.LogoutURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package util
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNewLogoutNotifierIssuer(t *testing.T) {
+	tests := []struct {
+		issuer  string
+		want    string
+		wantErr error
+	}{
+		{"https://sso.example.com", "https://sso.example.com", nil},
+		{"https://sso.example.com/", "https://sso.example.com", nil},
+		{"", "", ErrLogoutIssuerRequired},
+		{"/", "", ErrLogoutIssuerRequired},
+	}
+	for _, tt := range tests {
+		n, err := NewLogoutNotifier(nil, nil, tt.issuer, 0, 0, 0)
+		if !errors.Is(err, tt.wantErr) {
+			t.Fatalf("NewLogoutNotifier(%q) err = %v, want %v", tt.issuer, err, tt.wantErr)
+		}
+		if err == nil && n.issuer != tt.want {
+			t.Errorf("NewLogoutNotifier(%q) issuer = %q, want %q", tt.issuer, n.issuer, tt.want)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// Mail 纯文本邮件
+type Mail struct {
+	To      []string
+	Subject string
+	Body    string
+}
+
+// Mailer 发送邮件，具体实现见 mailer_smtp.go、mailer_file.go
+type Mailer interface {
+	Send(ctx context.Context, m Mail) error
+}
+
+const (
+	MailerTypeSMTP = "smtp"
+	MailerTypeFile = "file"
+	MailerTypeLog  = "log"
+)
+
+// 按RFC 5322组装邮件，正文使用quoted-printable编码
+func buildMail(from string, m Mail, now time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	domain := "localhost"
+	if addr, err := mail.ParseAddress(from); err == nil {
+		if _, d, ok := strings.Cut(addr.Address, "@"); ok {
+			domain = d
+		}
+	}
+	header := [][2]string{
+		{"From", from},
+		{"To", strings.Join(m.To, ", ")},
+		{"Subject", mime.QEncoding.Encode("utf-8", m.Subject)},
+		{"Date", now.Format(time.RFC1123Z)},
+		{"Message-ID", "<" + hex.EncodeToString(id) + "@" + domain + ">"},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "text/plain; charset=utf-8"},
+		{"Content-Transfer-Encoding", "quoted-printable"},
+	}
+	for _, h := range header {
+		buf.WriteString(h[0] + ": " + h[1] + "\r\n")
+	}
+	buf.WriteString("\r\n")
+	w := quotedprintable.NewWriter(&buf)
+	if _, err := w.Write([]byte(strings.ReplaceAll(m.Body, "\n", "\r\n"))); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
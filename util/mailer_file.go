@@ -0,0 +1,45 @@
+package util
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"git.blauwelle.com/go/crate/log"
+)
+
+// FileMailer 把邮件保存为目录中的.eml文件，用于开发和测试
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+func (f *FileMailer) Send(ctx context.Context, m Mail) error {
+	now := time.Now()
+	msg, err := buildMail(f.From, m, now)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(f.Dir, 0o700); err != nil {
+		return err
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	name := now.Format("20060102T150405.000000000") + "-" + hex.EncodeToString(suffix) + ".eml"
+	// 邮件中包含重置密码等凭证，只允许当前用户读取
+	return os.WriteFile(filepath.Join(f.Dir, name), msg, 0o600)
+}
+
+// LogMailer 只把邮件内容写入日志，用于开发环境
+type LogMailer struct{}
+
+func (LogMailer) Send(ctx context.Context, m Mail) error {
+	log.Info(ctx, "mail to "+strings.Join(m.To, ", ")+": "+m.Subject+"\n"+m.Body)
+	return nil
+}
@@ -0,0 +1,159 @@
+package util
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// 密码策略的规则名称，校验失败时返回给调用方
+const (
+	PasswordRuleMinLength = "min_length"
+	PasswordRuleMaxLength = "max_length"
+	PasswordRuleUpper     = "uppercase"
+	PasswordRuleLower     = "lowercase"
+	PasswordRuleDigit     = "digit"
+	PasswordRuleSymbol    = "symbol"
+	PasswordRuleUsername  = "username"
+	PasswordRuleBreached  = "breached"
+	PasswordRuleHistory   = "history"
+)
+
+// PasswordViolation 未通过的规则，Limit为规则的参数，如最小长度
+type PasswordViolation struct {
+	Rule  string `json:"rule"`
+	Limit int    `json:"limit,omitempty"`
+}
+
+// PasswordPolicyError 密码不符合策略，包含全部未通过的规则
+type PasswordPolicyError struct {
+	Violations []PasswordViolation
+}
+
+func (e *PasswordPolicyError) Error() string {
+	rules := make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		rules = append(rules, v.Rule)
+	}
+	return "password policy violated: " + strings.Join(rules, ",")
+}
+
+// PasswordPolicy 密码复杂度和有效期，History需要数据库中的旧密码，由调用方校验
+type PasswordPolicy struct {
+	MinLength        int // 按字符计算
+	MaxLength        int // 按字节计算，bcrypt只使用前72字节
+	RequireUpper     bool
+	RequireLower     bool
+	RequireDigit     bool
+	RequireSymbol    bool
+	DisallowUsername bool
+	History          int
+	MaxAge           time.Duration
+	Breached         *BreachedPasswords
+}
+
+// Check 校验密码，不符合策略时返回 *PasswordPolicyError
+func (p PasswordPolicy) Check(username, password string) error {
+	var violations []PasswordViolation
+	if utf8.RuneCountInString(password) < p.MinLength {
+		violations = append(violations, PasswordViolation{Rule: PasswordRuleMinLength, Limit: p.MinLength})
+	}
+	if p.MaxLength > 0 && len(password) > p.MaxLength {
+		violations = append(violations, PasswordViolation{Rule: PasswordRuleMaxLength, Limit: p.MaxLength})
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsDigit(c):
+			digit = true
+		case unicode.IsPunct(c) || unicode.IsSymbol(c) || unicode.IsSpace(c):
+			symbol = true
+		}
+	}
+	if p.RequireUpper && !upper {
+		violations = append(violations, PasswordViolation{Rule: PasswordRuleUpper})
+	}
+	if p.RequireLower && !lower {
+		violations = append(violations, PasswordViolation{Rule: PasswordRuleLower})
+	}
+	if p.RequireDigit && !digit {
+		violations = append(violations, PasswordViolation{Rule: PasswordRuleDigit})
+	}
+	if p.RequireSymbol && !symbol {
+		violations = append(violations, PasswordViolation{Rule: PasswordRuleSymbol})
+	}
+	if p.DisallowUsername && len(username) >= 3 &&
+		strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		violations = append(violations, PasswordViolation{Rule: PasswordRuleUsername})
+	}
+
+	if p.Breached != nil && password != "" {
+		breached, err := p.Breached.Contains(password)
+		if err != nil {
+			return err
+		}
+		if breached {
+			violations = append(violations, PasswordViolation{Rule: PasswordRuleBreached})
+		}
+	}
+
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+	return nil
+}
+
+// Expired 密码是否超过有效期
+func (p PasswordPolicy) Expired(changedAt, now time.Time) bool {
+	return p.MaxAge > 0 && now.Sub(changedAt) > p.MaxAge
+}
+
+// BreachedPasswords 本地的泄露密码库，按SHA-1的前5位十六进制分文件保存，
+// 文件中每行为剩余35位和出现次数，如 "0018A45C4D1DEF81644B54AB7F969B88D65:10"，与HIBP range接口的格式相同。
+// 查询时只读取前缀对应的文件，不需要把整个库载入内存
+type BreachedPasswords struct {
+	dir string
+}
+
+func NewBreachedPasswords(dir string) *BreachedPasswords {
+	return &BreachedPasswords{dir: dir}
+}
+
+func (b *BreachedPasswords) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	f, err := os.Open(filepath.Join(b.dir, prefix))
+	if errors.Is(err, os.ErrNotExist) {
+		f, err = os.Open(filepath.Join(b.dir, prefix+".txt"))
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if strings.EqualFold(line, suffix) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
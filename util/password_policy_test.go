@@ -0,0 +1,119 @@
+package util
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	strict := PasswordPolicy{
+		MinLength:        8,
+		MaxLength:        72,
+		RequireUpper:     true,
+		RequireLower:     true,
+		RequireDigit:     true,
+		RequireSymbol:    true,
+		DisallowUsername: true,
+	}
+	tests := []struct {
+		name     string
+		policy   PasswordPolicy
+		username string
+		password string
+		want     []PasswordViolation
+	}{
+		{"valid", strict, "alice", "Corr3ct-horse", nil},
+		{"empty policy", PasswordPolicy{}, "alice", "", nil},
+		{"too short", strict, "alice", "Ab1-", []PasswordViolation{{Rule: PasswordRuleMinLength, Limit: 8}}},
+		// 长度按字符计算
+		{"multibyte length", PasswordPolicy{MinLength: 4}, "alice", "密码密码", nil},
+		{"too long", strict, "alice", "Aa1-" + strings.Repeat("x", 69), []PasswordViolation{{Rule: PasswordRuleMaxLength, Limit: 72}}},
+		// 最大长度按字节计算
+		{"multibyte too long", PasswordPolicy{MaxLength: 72}, "alice", strings.Repeat("密", 25), []PasswordViolation{{Rule: PasswordRuleMaxLength, Limit: 72}}},
+		{"no upper", strict, "alice", "corr3ct-horse", []PasswordViolation{{Rule: PasswordRuleUpper}}},
+		{"no lower", strict, "alice", "CORR3CT-HORSE", []PasswordViolation{{Rule: PasswordRuleLower}}},
+		{"no digit", strict, "alice", "Correct-horse", []PasswordViolation{{Rule: PasswordRuleDigit}}},
+		{"no symbol", strict, "alice", "Corr3cthorse", []PasswordViolation{{Rule: PasswordRuleSymbol}}},
+		{"space is symbol", strict, "alice", "Corr3ct horse", nil},
+		{"contains username", strict, "alice", "xALICE-1x", []PasswordViolation{{Rule: PasswordRuleUsername}}},
+		// 过短的用户名不检查
+		{"short username", strict, "al", "Xal-1xxxx", nil},
+		{"username allowed", PasswordPolicy{}, "alice", "alice", nil},
+		{
+			"all violations", strict, "alice", "",
+			[]PasswordViolation{
+				{Rule: PasswordRuleMinLength, Limit: 8},
+				{Rule: PasswordRuleUpper},
+				{Rule: PasswordRuleLower},
+				{Rule: PasswordRuleDigit},
+				{Rule: PasswordRuleSymbol},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.Check(tt.username, tt.password)
+			var got []PasswordViolation
+			var policyErr *PasswordPolicyError
+			if errors.As(err, &policyErr) {
+				got = policyErr.Violations
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("violations = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPasswordPolicyBreached(t *testing.T) {
+	dir := t.TempDir()
+	sum := sha1.Sum([]byte("P@ssw0rd"))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	if err := os.WriteFile(filepath.Join(dir, hash[:5]), []byte("0000000000000000000000000000000000A:1\r\n"+strings.ToLower(hash[5:])+":42\r\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	policy := PasswordPolicy{Breached: NewBreachedPasswords(dir)}
+	tests := []struct {
+		password string
+		breached bool
+	}{
+		{"P@ssw0rd", true},
+		{"p@ssw0rd", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		err := policy.Check("alice", tt.password)
+		var policyErr *PasswordPolicyError
+		got := errors.As(err, &policyErr) && policyErr.Violations[0].Rule == PasswordRuleBreached
+		if got != tt.breached {
+			t.Errorf("Check(%q) = %v, want breached=%v", tt.password, err, tt.breached)
+		}
+	}
+}
+
+func TestPasswordPolicyExpired(t *testing.T) {
+	changed := time.Unix(1700000000, 0)
+	tests := []struct {
+		maxAge  time.Duration
+		elapsed time.Duration
+		want    bool
+	}{
+		{0, 1000 * 24 * time.Hour, false},
+		{90 * 24 * time.Hour, 90 * 24 * time.Hour, false},
+		{90 * 24 * time.Hour, 90*24*time.Hour + time.Second, true},
+	}
+	for _, tt := range tests {
+		if got := (PasswordPolicy{MaxAge: tt.maxAge}).Expired(changed, changed.Add(tt.elapsed)); got != tt.want {
+			t.Errorf("Expired(maxAge=%v, elapsed=%v) = %v, want %v", tt.maxAge, tt.elapsed, got, tt.want)
+		}
+	}
+}
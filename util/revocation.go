@@ -0,0 +1,93 @@
+package util
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"git.blauwelle.com/go/crate/cmd/sso/model"
+)
+
+// RevocationList 记录被撤销的会话token：按jti单个撤销，或按用户撤销某一时间之前签发的全部token
+type RevocationList struct {
+	db *gorm.DB
+}
+
+func NewRevocationList(db *gorm.DB) *RevocationList {
+	return &RevocationList{db: db}
+}
+
+// 撤销单个token，记录保留到token过期
+func (l *RevocationList) RevokeToken(ctx context.Context, claims SessionClaims) error {
+	now := time.Now()
+	expiresAt := now
+	if claims.ExpiresAt != nil {
+		expiresAt = claims.ExpiresAt.Time
+	}
+	var userID uint
+	if claims.Subject != "" {
+		if id, err := parseUint(claims.Subject); err == nil {
+			userID = id
+		}
+	}
+	db := l.db.WithContext(ctx)
+	// 顺便清理已过期的记录
+	if err := db.Where("expires_at <= ?", now).Delete(&model.RevokedToken{}).Error; err != nil {
+		return err
+	}
+	return db.Clauses(clause.OnConflict{DoNothing: true}).Create(&model.RevokedToken{
+		JTI:       claims.ID,
+		UserID:    userID,
+		ExpiresAt: expiresAt,
+	}).Error
+}
+
+// 撤销用户在当前时间之前签发的全部token
+// 精度为秒，与jwt中iat一致，同一秒内重新签发的token仍然有效
+func (l *RevocationList) RevokeUser(ctx context.Context, userID uint) error {
+	return l.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"revoked_before", "updated_at"}),
+	}).Create(&model.UserTokenRevocation{
+		UserID:        userID,
+		RevokedBefore: time.Now().Truncate(time.Second),
+	}).Error
+}
+
+func (l *RevocationList) IsRevoked(ctx context.Context, claims SessionClaims) (bool, error) {
+	db := l.db.WithContext(ctx)
+	if claims.ID != "" {
+		var count int64
+		if err := db.Model(&model.RevokedToken{}).Where("jti = ?", claims.ID).Count(&count).Error; err != nil {
+			return false, err
+		}
+		if count > 0 {
+			return true, nil
+		}
+	}
+	userID, err := parseUint(claims.Subject)
+	if err != nil {
+		return true, nil
+	}
+	var revocation model.UserTokenRevocation
+	result := db.Where("user_id = ?", userID).Find(&revocation)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
+	}
+	// 没有iat的旧token一律视为已撤销
+	if claims.IssuedAt == nil {
+		return true, nil
+	}
+	return claims.IssuedAt.Time.Before(revocation.RevokedBefore), nil
+}
+
+func parseUint(s string) (uint, error) {
+	id, err := strconv.ParseUint(s, 10, 64)
+	return uint(id), err
+}
@@ -0,0 +1,179 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"git.blauwelle.com/go/crate/log"
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// XML签名只支持RSA和ECDSA密钥，EdDSA密钥无法用于SAML
+var ErrSAMLUnsupportedKey = errors.New("saml signing requires an RSA or ECDSA key")
+
+// SAMLSigner 使用JWT的签名密钥对SAML断言签名
+// SAML要求在元数据中发布X.509证书，这里为每个密钥生成自签名证书
+// ECDSA签名带有随机数，重新生成的证书与之前的不同，SP按证书配置信任时需要保存第一次生成的证书：
+// dir不为空时证书保存在 <dir>/<kid>.saml-<entityID哈希>.crt，重启后继续使用
+type SAMLSigner struct {
+	j     *JWT
+	dir   string
+	mu    sync.Mutex
+	certs map[string][]byte
+}
+
+func NewSAMLSigner(j *JWT, dir string) *SAMLSigner {
+	return &SAMLSigner{j: j, dir: dir, certs: make(map[string][]byte)}
+}
+
+// Certificates 元数据中发布的证书，包含active和next密钥，便于SP提前信任轮换后的密钥
+func (s *SAMLSigner) Certificates(commonName string) [][]byte {
+	var certs [][]byte
+	active := s.j.ActiveKey()
+	if cert, err := s.certificate(active, commonName); err == nil {
+		certs = append(certs, cert)
+	}
+	for _, key := range s.j.signingKeys() {
+		if key.Status != KeyStatusNext {
+			continue
+		}
+		if cert, err := s.certificate(key, commonName); err == nil {
+			certs = append(certs, cert)
+		}
+	}
+	return certs
+}
+
+// SignEnveloped 对el签名，签名元素插入到第一个子元素(Issuer)之后
+func (s *SAMLSigner) SignEnveloped(el *etree.Element, commonName string) error {
+	key := s.j.ActiveKey()
+	cert, err := s.certificate(key, commonName)
+	if err != nil {
+		return err
+	}
+	ctx, err := dsig.NewSigningContext(key.PrivateKey, [][]byte{cert})
+	if err != nil {
+		return err
+	}
+	ctx.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+	sig, err := ctx.ConstructSignature(el, true)
+	if err != nil {
+		return err
+	}
+	children := make([]etree.Token, 0, len(el.Child)+1)
+	inserted := false
+	for _, child := range el.Child {
+		children = append(children, child)
+		if e, ok := child.(*etree.Element); ok && !inserted && e.Tag == "Issuer" {
+			children = append(children, sig)
+			inserted = true
+		}
+	}
+	if !inserted {
+		children = append([]etree.Token{sig}, el.Child...)
+	}
+	el.Child = children
+	return nil
+}
+
+func (s *SAMLSigner) certificate(key Key, commonName string) ([]byte, error) {
+	switch key.PublicKey.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+	default:
+		return nil, ErrSAMLUnsupportedKey
+	}
+	if key.PrivateKey == nil {
+		return nil, ErrSAMLUnsupportedKey
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cacheKey := key.ID + "\x00" + commonName
+	if cert, ok := s.certs[cacheKey]; ok {
+		return cert, nil
+	}
+	if cert, ok := s.loadCertificate(key, commonName); ok {
+		s.certs[cacheKey] = cert
+		return cert, nil
+	}
+	sum := sha256.Sum256([]byte(key.ID))
+	template := &x509.Certificate{
+		SerialNumber:          new(big.Int).SetBytes(sum[:16]),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:              time.Date(2099, 12, 31, 23, 59, 59, 0, time.UTC),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, key.PublicKey, key.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	s.certs[cacheKey] = cert
+	// 保存失败时本次运行仍可使用，重启后会重新生成
+	if err := s.saveCertificate(key, commonName, cert); err != nil {
+		log.Error(context.Background(), "save saml certificate: "+err.Error())
+	}
+	return cert, nil
+}
+
+// 读取已保存的证书，证书的公钥或名称与当前密钥不符时视为不存在
+func (s *SAMLSigner) loadCertificate(key Key, commonName string) ([]byte, bool) {
+	if s.dir == "" {
+		return nil, false
+	}
+	b, err := os.ReadFile(s.certificatePath(key, commonName))
+	if err != nil {
+		return nil, false
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, false
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil || cert.Subject.CommonName != commonName {
+		return nil, false
+	}
+	want, err := x509.MarshalPKIXPublicKey(key.PublicKey)
+	if err != nil {
+		return nil, false
+	}
+	got, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	if err != nil || !bytes.Equal(got, want) {
+		return nil, false
+	}
+	return block.Bytes, true
+}
+
+func (s *SAMLSigner) saveCertificate(key Key, commonName string, cert []byte) error {
+	if s.dir == "" {
+		return nil
+	}
+	path := s.certificatePath(key, commonName)
+	// 先写临时文件再改名，与密钥环相同
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// 同一密钥可能以不同的entityID(域名)发布，文件名中包含entityID的哈希
+func (s *SAMLSigner) certificatePath(key Key, commonName string) string {
+	sum := sha256.Sum256([]byte(commonName))
+	return filepath.Join(s.dir, key.ID+".saml-"+hex.EncodeToString(sum[:8])+".crt")
+}
@@ -0,0 +1,115 @@
+package util
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestSAMLJWT(t *testing.T, ec bool) *JWT {
+	t.Helper()
+	var j *JWT
+	var err error
+	if ec {
+		key, kerr := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if kerr != nil {
+			t.Fatal(kerr)
+		}
+		j, err = NewJWT(key, nil)
+	} else {
+		key, kerr := rsa.GenerateKey(rand.Reader, 2048)
+		if kerr != nil {
+			t.Fatal(kerr)
+		}
+		j, err = NewJWT(key, nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+// 重启后(新的SAMLSigner)发布的证书与之前相同
+func TestSAMLSignerCertificatePersisted(t *testing.T) {
+	const entityID = "https://sso.example.com/saml/metadata"
+	for _, tt := range []struct {
+		name string
+		ec   bool
+	}{{"ecdsa", true}, {"rsa", false}} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			j := newTestSAMLJWT(t, tt.ec)
+			first := NewSAMLSigner(j, dir).Certificates(entityID)
+			if len(first) != 1 {
+				t.Fatalf("got %d certificates", len(first))
+			}
+			second := NewSAMLSigner(j, dir).Certificates(entityID)
+			if len(second) != 1 || !bytes.Equal(first[0], second[0]) {
+				t.Fatal("certificate changed after restart")
+			}
+			cert, err := x509.ParseCertificate(first[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cert.Subject.CommonName != entityID {
+				t.Errorf("CN = %q", cert.Subject.CommonName)
+			}
+			// 不同的entityID使用各自的证书
+			other := NewSAMLSigner(j, dir).Certificates("https://login.example.org/saml/metadata")
+			if len(other) != 1 || bytes.Equal(other[0], first[0]) {
+				t.Error("certificate shared between entity IDs")
+			}
+		})
+	}
+}
+
+// 保存的证书属于其他密钥时重新生成
+func TestSAMLSignerCertificateKeyMismatch(t *testing.T) {
+	const entityID = "https://sso.example.com/saml/metadata"
+	dir := t.TempDir()
+	j := newTestSAMLJWT(t, true)
+	other := newTestSAMLJWT(t, true)
+	otherCert := NewSAMLSigner(other, dir).Certificates(entityID)[0]
+	matches, err := filepath.Glob(filepath.Join(dir, "*.crt"))
+	if err != nil || len(matches) != 1 {
+		t.Fatalf("saved files = %v, %v", matches, err)
+	}
+	b, err := os.ReadFile(matches[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := j.ActiveKey()
+	if err := os.WriteFile(NewSAMLSigner(j, dir).certificatePath(key, entityID), b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cert := NewSAMLSigner(j, dir).Certificates(entityID)[0]
+	if bytes.Equal(cert, otherCert) {
+		t.Fatal("published certificate of another key")
+	}
+	parsed, err := x509.ParseCertificate(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.PublicKey.(*ecdsa.PublicKey).Equal(key.PublicKey) {
+		t.Error("certificate public key mismatch")
+	}
+}
+
+func TestSAMLSignerWithoutDir(t *testing.T) {
+	j := newTestSAMLJWT(t, true)
+	s := NewSAMLSigner(j, "")
+	first := s.Certificates("https://sso.example.com/saml/metadata")
+	if len(first) != 1 {
+		t.Fatalf("got %d certificates", len(first))
+	}
+	// 同一进程内缓存
+	if again := s.Certificates("https://sso.example.com/saml/metadata"); !bytes.Equal(first[0], again[0]) {
+		t.Error("certificate not cached")
+	}
+}
@@ -0,0 +1,97 @@
+package util
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+var testSecretBoxKey = base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+
+func TestNewSecretBoxKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		wantErr error
+	}{
+		{"32 bytes", testSecretBoxKey, nil},
+		{"16 bytes", base64.StdEncoding.EncodeToString(make([]byte, 16)), ErrSecretBoxKey},
+		{"33 bytes", base64.StdEncoding.EncodeToString(make([]byte, 33)), ErrSecretBoxKey},
+		{"not base64", "not base64!", ErrSecretBoxKey},
+		{"empty", "", ErrSecretBoxKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewSecretBox(tt.key); !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSecretBox(t *testing.T) {
+	box, err := NewSecretBox(testSecretBoxKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, plaintext := range []string{"", "JBSWY3DPEHPK3PXP", strings.Repeat("密钥", 100)} {
+		sealed, err := box.Seal(plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if plaintext != "" && strings.Contains(sealed, plaintext) {
+			t.Errorf("plaintext visible in %q", sealed)
+		}
+		// 每次加密使用新的nonce
+		again, _ := box.Seal(plaintext)
+		if again == sealed {
+			t.Error("nonce reused")
+		}
+		got, err := box.Open(sealed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != plaintext {
+			t.Errorf("Open = %q, want %q", got, plaintext)
+		}
+	}
+}
+
+func TestSecretBoxOpenInvalid(t *testing.T) {
+	box, err := NewSecretBox(testSecretBoxKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherBox, err := NewSecretBox(base64.StdEncoding.EncodeToString([]byte("fedcba9876543210fedcba9876543210")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := box.Seal("JBSWY3DPEHPK3PXP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := base64.StdEncoding.DecodeString(sealed)
+	tampered := append([]byte(nil), raw...)
+	tampered[len(tampered)-1] ^= 1
+	otherSealed, _ := otherBox.Seal("JBSWY3DPEHPK3PXP")
+
+	tests := []struct {
+		name       string
+		ciphertext string
+	}{
+		{"tampered", base64.StdEncoding.EncodeToString(tampered)},
+		{"truncated", base64.StdEncoding.EncodeToString(raw[:len(raw)-1])},
+		{"shorter than nonce", base64.StdEncoding.EncodeToString(raw[:4])},
+		{"not base64", "not base64!"},
+		{"empty", ""},
+		{"other key", otherSealed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := box.Open(tt.ciphertext); !errors.Is(err, ErrSecretBoxCiphertext) {
+				t.Errorf("err = %v, want %v", err, ErrSecretBoxCiphertext)
+			}
+		})
+	}
+}
@@ -2,19 +2,15 @@ package util
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
-	"fmt"
-	"os"
 	"time"
-
-	"github.com/redis/go-redis/v9"
-	"gopkg.in/yaml.v3"
 )
 
 // Ticket的获取和储存操作
 var (
 	ErrTicketNotExists = errors.New("ticket not exists")
+	ErrTicketUsed      = errors.New("ticket already used")
+	ErrTicketExists    = errors.New("ticket already exists")
 )
 
 type UserInfo struct {
@@ -22,56 +18,51 @@ type UserInfo struct {
 	Username string `json:"username"`
 }
 
-//type Store interface {
-//	GetTicket(ctx context.Context, ticket string) (UserInfo, error)
-//	SetTicket(ctx context.Context, ticket string, info UserInfo) error
-//}
-
-func SetTicketToRedis(ctx context.Context, ticket string, r *redis.Client, info UserInfo) error {
-	jsoninfo, _ := json.Marshal(info)
-	data := string(jsoninfo)
-	ttl := getTTL()
-	result := r.Set(ctx, ticket, data, time.Duration(ttl)*time.Second)
-	if result.Err() != nil {
-		fmt.Println("redis set fault")
-		return nil
-	}
-	fmt.Println("redis set success")
-	return nil
+// TicketInfo ticket签发时绑定的信息
+// OIDC的授权码也作为ticket保存，此时Service为redirect_uri
+type TicketInfo struct {
+	UserInfo
+	AppID     uint      `json:"app_id"`
+	Service   string    `json:"service"`
+	SessionID string    `json:"session_id"`
+	OIDC      *OIDCCode `json:"oidc,omitempty"`
 }
-func GetTicketFromRedis(ctx context.Context, ticket string, r *redis.Client) (UserInfo, error) {
-
-	existe, _ := r.Exists(ctx, ticket).Result()
-	var info UserInfo
-	if existe == 1 {
-		jsoninfo, err := r.Get(ctx, ticket).Result()
-		if err != nil {
-			return UserInfo{}, ErrTicketNotExists
-		}
-		err = json.Unmarshal([]byte(jsoninfo), &info)
-		if err != nil {
-			return UserInfo{}, ErrTicketNotExists
-		}
-		return info, nil
-	}
 
-	return UserInfo{}, ErrTicketNotExists
+// OIDCCode 授权码请求中需要在换取token时使用的参数
+type OIDCCode struct {
+	Scope               string `json:"scope"`
+	Nonce               string `json:"nonce"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+	AuthTime            int64  `json:"auth_time"`
 }
 
-type TTL struct {
-	Redis struct {
-		TTL int `yaml:"ttl"`
-	} `yaml:"redis"`
+// Store 保存ticket到用户信息的映射，具体实现见 store_redis.go、store_memory.go、store_sql.go
+// ticket只能被ConsumeTicket成功取出一次，之后在有效期内再次取出会返回ErrTicketUsed
+// 有效期内的ticket不能被SetTicket覆盖，重复时返回ErrTicketExists
+type Store interface {
+	SetTicket(ctx context.Context, ticket string, info TicketInfo) error
+	ConsumeTicket(ctx context.Context, ticket string) (TicketInfo, error)
 }
 
-func getTTL() int {
-	b, err := os.ReadFile("config/config.yaml")
-	if err != nil {
-		panic(err)
+const (
+	StoreTypeRedis  = "redis"
+	StoreTypeMemory = "memory"
+	StoreTypeSQL    = "sql"
+)
+
+// ticket只用于一次跳转，有效期不宜过长
+const (
+	DefaultTicketTTL = 10 * time.Second
+	MaxTicketTTL     = 5 * time.Minute
+)
+
+func ticketTTL(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		return DefaultTicketTTL
 	}
-	var cfg TTL
-	if err := yaml.Unmarshal(b, &cfg); err != nil {
-		panic(err)
+	if ttl > MaxTicketTTL {
+		return MaxTicketTTL
 	}
-	return cfg.Redis.TTL
+	return ttl
 }
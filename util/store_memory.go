@@ -0,0 +1,69 @@
+package util
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryStore 进程内存储，适用于单节点部署和测试
+type MemoryStore struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	tickets map[string]memoryTicket
+	now     func() time.Time
+}
+
+type memoryTicket struct {
+	info     TicketInfo
+	used     bool
+	expireAt time.Time
+}
+
+func NewMemoryStore(ttl time.Duration) *MemoryStore {
+	return &MemoryStore{
+		ttl:     ticketTTL(ttl),
+		tickets: make(map[string]memoryTicket),
+		now:     time.Now,
+	}
+}
+
+func (s *MemoryStore) SetTicket(ctx context.Context, ticket string, info TicketInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	s.gc(now)
+	if _, ok := s.tickets[ticket]; ok {
+		return ErrTicketExists
+	}
+	s.tickets[ticket] = memoryTicket{info: info, expireAt: now.Add(s.ttl)}
+	return nil
+}
+
+func (s *MemoryStore) ConsumeTicket(ctx context.Context, ticket string) (TicketInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tickets[ticket]
+	if !ok {
+		return TicketInfo{}, ErrTicketNotExists
+	}
+	if !s.now().Before(t.expireAt) {
+		delete(s.tickets, ticket)
+		return TicketInfo{}, ErrTicketNotExists
+	}
+	if t.used {
+		return TicketInfo{}, ErrTicketUsed
+	}
+	t.used = true
+	s.tickets[ticket] = t
+	return t.info, nil
+}
+
+// 清理已过期的ticket，调用方需持有锁
+func (s *MemoryStore) gc(now time.Time) {
+	for k, t := range s.tickets {
+		if !now.Before(t.expireAt) {
+			delete(s.tickets, k)
+		}
+	}
+}
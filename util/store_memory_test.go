@@ -0,0 +1,113 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreConsumeTicket(t *testing.T) {
+	info := TicketInfo{UserInfo: UserInfo{ID: 7, Username: "alice"}, AppID: 3, Service: "https://app.example.com/cb", SessionID: "s1"}
+	tests := []struct {
+		name    string
+		set     bool
+		elapsed time.Duration
+		consume int // 消费的次数，只检查最后一次的结果
+		wantErr error
+	}{
+		{"first use", true, 0, 1, nil},
+		{"second use", true, 0, 2, ErrTicketUsed},
+		{"third use", true, 0, 3, ErrTicketUsed},
+		{"unknown", false, 0, 1, ErrTicketNotExists},
+		{"before expiry", true, 9 * time.Second, 1, nil},
+		{"expired", true, 10 * time.Second, 1, ErrTicketNotExists},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Unix(1700000000, 0)
+			s := NewMemoryStore(10 * time.Second)
+			s.now = func() time.Time { return now }
+			ctx := context.Background()
+			if tt.set {
+				if err := s.SetTicket(ctx, "ST-1", info); err != nil {
+					t.Fatal(err)
+				}
+			}
+			now = now.Add(tt.elapsed)
+			var got TicketInfo
+			var err error
+			for i := 0; i < tt.consume; i++ {
+				got, err = s.ConsumeTicket(ctx, "ST-1")
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && got != info {
+				t.Errorf("info = %+v, want %+v", got, info)
+			}
+		})
+	}
+}
+
+// 过期的ticket即使已使用也返回不存在，重新签发同名ticket后可以再次使用
+func TestMemoryStoreExpiredUsedTicket(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	s := NewMemoryStore(time.Second)
+	s.now = func() time.Time { return now }
+	ctx := context.Background()
+	if err := s.SetTicket(ctx, "ST-1", TicketInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ConsumeTicket(ctx, "ST-1"); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Second)
+	if _, err := s.ConsumeTicket(ctx, "ST-1"); !errors.Is(err, ErrTicketNotExists) {
+		t.Fatalf("err = %v, want %v", err, ErrTicketNotExists)
+	}
+	if err := s.SetTicket(ctx, "ST-1", TicketInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ConsumeTicket(ctx, "ST-1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryStoreSetTicketExists(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	s := NewMemoryStore(time.Second)
+	s.now = func() time.Time { return now }
+	ctx := context.Background()
+	if err := s.SetTicket(ctx, "ST-1", TicketInfo{AppID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetTicket(ctx, "ST-1", TicketInfo{AppID: 2}); !errors.Is(err, ErrTicketExists) {
+		t.Fatalf("err = %v, want %v", err, ErrTicketExists)
+	}
+	info, err := s.ConsumeTicket(ctx, "ST-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.AppID != 1 {
+		t.Errorf("ticket overwritten: %+v", info)
+	}
+}
+
+func TestTicketTTL(t *testing.T) {
+	tests := []struct {
+		ttl  time.Duration
+		want time.Duration
+	}{
+		{0, DefaultTicketTTL},
+		{-time.Second, DefaultTicketTTL},
+		{time.Minute, time.Minute},
+		{MaxTicketTTL, MaxTicketTTL},
+		{time.Hour, MaxTicketTTL},
+	}
+	for _, tt := range tests {
+		if got := ticketTTL(tt.ttl); got != tt.want {
+			t.Errorf("ticketTTL(%v) = %v, want %v", tt.ttl, got, tt.want)
+		}
+	}
+}
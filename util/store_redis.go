@@ -0,0 +1,70 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"git.blauwelle.com/go/crate/log"
+	"github.com/redis/go-redis/v9"
+)
+
+// 已使用的ticket保留该标记直到过期，用于识别重放
+const redisTicketUsedMarker = "\x00used"
+
+// 原子地取出ticket并替换为已使用标记
+var redisConsumeTicketScript = redis.NewScript(`
+local v = redis.call('GET', KEYS[1])
+if not v then
+	return false
+end
+if v ~= ARGV[1] then
+	redis.call('SET', KEYS[1], ARGV[1], 'KEEPTTL')
+end
+return v
+`)
+
+type RedisStore struct {
+	r   *redis.Client
+	ttl time.Duration
+}
+
+func NewRedisStore(r *redis.Client, ttl time.Duration) *RedisStore {
+	return &RedisStore{r: r, ttl: ticketTTL(ttl)}
+}
+
+func (s *RedisStore) SetTicket(ctx context.Context, ticket string, info TicketInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	ok, err := s.r.SetNX(ctx, ticket, data, s.ttl).Result()
+	if err != nil {
+		log.Error(ctx, "redis set ticket: "+err.Error())
+		return err
+	}
+	// 同名的ticket仍在有效期内，未写入
+	if !ok {
+		return ErrTicketExists
+	}
+	return nil
+}
+
+func (s *RedisStore) ConsumeTicket(ctx context.Context, ticket string) (TicketInfo, error) {
+	data, err := redisConsumeTicketScript.Run(ctx, s.r, []string{ticket}, redisTicketUsedMarker).Text()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return TicketInfo{}, ErrTicketNotExists
+		}
+		return TicketInfo{}, err
+	}
+	if data == redisTicketUsedMarker {
+		return TicketInfo{}, ErrTicketUsed
+	}
+	var info TicketInfo
+	if err := json.Unmarshal([]byte(data), &info); err != nil {
+		return TicketInfo{}, ErrTicketNotExists
+	}
+	return info, nil
+}
@@ -0,0 +1,91 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"gorm.io/gorm"
+
+	"git.blauwelle.com/go/crate/cmd/sso/model"
+)
+
+// SQLStore 把ticket保存在数据库表中，MySQL和SQLite均可使用
+type SQLStore struct {
+	db  *gorm.DB
+	ttl time.Duration
+}
+
+func NewSQLStore(db *gorm.DB, ttl time.Duration) *SQLStore {
+	return &SQLStore{db: db, ttl: ticketTTL(ttl)}
+}
+
+func (s *SQLStore) SetTicket(ctx context.Context, ticket string, info TicketInfo) error {
+	now := time.Now()
+	var oidc string
+	if info.OIDC != nil {
+		b, err := json.Marshal(info.OIDC)
+		if err != nil {
+			return err
+		}
+		oidc = string(b)
+	}
+	db := s.db.WithContext(ctx)
+	// 顺便清理已过期的ticket
+	if err := db.Where("expires_at <= ?", now).Delete(&model.Ticket{}).Error; err != nil {
+		return err
+	}
+	return db.Create(&model.Ticket{
+		Ticket:    ticket,
+		UserID:    info.ID,
+		Username:  info.Username,
+		AppID:     info.AppID,
+		Service:   info.Service,
+		SessionID: info.SessionID,
+		OIDC:      oidc,
+		ExpiresAt: now.Add(s.ttl),
+	}).Error
+}
+
+func (s *SQLStore) ConsumeTicket(ctx context.Context, ticket string) (TicketInfo, error) {
+	now := time.Now()
+	var t model.Ticket
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// 通过条件更新抢占ticket，并发时只有一个请求能更新成功
+		db := tx.Model(&model.Ticket{}).
+			Where("ticket = ? AND used_at IS NULL AND expires_at > ?", ticket, now).
+			Update("used_at", now)
+		if db.Error != nil {
+			return db.Error
+		}
+		consumed := db.RowsAffected == 1
+
+		db = tx.Where("ticket = ? AND expires_at > ?", ticket, now).Find(&t)
+		if db.Error != nil {
+			return db.Error
+		}
+		if db.RowsAffected != 1 {
+			return ErrTicketNotExists
+		}
+		if !consumed {
+			return ErrTicketUsed
+		}
+		return nil
+	})
+	if err != nil {
+		return TicketInfo{}, err
+	}
+	info := TicketInfo{
+		UserInfo:  UserInfo{ID: t.UserID, Username: t.Username},
+		AppID:     t.AppID,
+		Service:   t.Service,
+		SessionID: t.SessionID,
+	}
+	if t.OIDC != "" {
+		info.OIDC = &OIDCCode{}
+		if err := json.Unmarshal([]byte(t.OIDC), info.OIDC); err != nil {
+			return TicketInfo{}, err
+		}
+	}
+	return info, nil
+}
@@ -1,6 +1,8 @@
 package util
 
 import (
+	cryptorand "crypto/rand"
+	"math/big"
 	"math/rand"
 	"time"
 )
@@ -23,16 +25,39 @@ func (sr *stringRand) RandString(lens int) string {
 	return string(b)
 }
 
+const (
+	randNumbers      = "0123456789"
+	randLettersUpper = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	randLettersLower = "abcdefghijklmnopqrstuvwxyz"
+)
+
 func NewStringRand() StringRand {
-	var (
-		Numbers      = "0123456789"
-		LettersUpper = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
-		LettersLower = "abcdefghijklmnopqrstuvwxyz"
-	)
-	base := Numbers + LettersUpper + LettersLower
+	base := randNumbers + randLettersUpper + randLettersLower
 	sr := &stringRand{
 		r:    rand.New(rand.NewSource(time.Now().UnixNano())),
 		base: base,
 	}
 	return sr
 }
+
+// 使用crypto/rand，用于ticket、授权码、密钥等不可被猜测的场景
+type secureStringRand struct {
+	base string
+}
+
+func (sr *secureStringRand) RandString(lens int) string {
+	b := make([]byte, lens)
+	max := big.NewInt(int64(len(sr.base)))
+	for i := 0; i < len(b); i++ {
+		n, err := cryptorand.Int(cryptorand.Reader, max)
+		if err != nil {
+			panic(err)
+		}
+		b[i] = sr.base[n.Int64()]
+	}
+	return string(b)
+}
+
+func NewSecureStringRand() StringRand {
+	return &secureStringRand{base: randNumbers + randLettersUpper + randLettersLower}
+}